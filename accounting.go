@@ -0,0 +1,276 @@
+package main
+
+import (
+        "encoding/csv"
+        "fmt"
+        "io"
+        "log/slog"
+        "os"
+        "path/filepath"
+        "sort"
+        "strconv"
+        "strings"
+
+        "golang.org/x/text/encoding"
+        "golang.org/x/text/encoding/japanese"
+)
+
+// accountingFormats are the journal import layouts -accounting-export writes
+var accountingFormats = []string{"freee", "moneyforward", "yayoi"}
+
+// defaultDebitAccounts books the default categories; -account-map adds or overrides.
+// Medical is personal spending for a sole proprietor, so it goes to 事業主貸.
+var defaultDebitAccounts = map[string]string{
+        "medical":   "事業主貸",
+        "grocery":   "消耗品費",
+        "tax":       "租税公課",
+        "utilities": "水道光熱費",
+        "septic":    "修繕費",
+        "other":     "雑費",
+}
+
+// defaultCreditAccounts says how each payment method was paid for. Card and QR payments
+// are settled later, so they are booked as 未払金 until the statement is reconciled.
+var defaultCreditAccounts = map[string]string{
+        "cash":        "現金",
+        "credit_card": "未払金",
+        "debit_card":  "普通預金",
+        "ic_card":     "現金",
+        "qr":          "未払金",
+        "other":       "現金",
+        "":            "現金",
+}
+
+// accountingTaxCategories is each service's name for purchases at 10%, at the reduced 8%
+// rate, and outside consumption tax, keyed by rate
+var accountingTaxCategories = map[string]map[int]string{
+        "freee":        {10: "課対仕入10%", 8: "課対仕入8%（軽）", 0: "対象外"},
+        "moneyforward": {10: "課税仕入 10%", 8: "課税仕入 (軽)8%", 0: "対象外"},
+        "yayoi":        {10: "課対仕入込10%", 8: "課対仕入込軽減8%", 0: "対象外"},
+}
+
+// AccountMap books receipts: the debit account for each category (lower case) and the
+// credit account for each payment method. -account-map lines are "Category=Account", or
+// "payment:credit_card=Account" for payment methods, with "payment:default" for the rest.
+type AccountMap struct {
+        Debit         map[string]string
+        Credit        map[string]string
+        DefaultDebit  string
+        DefaultCredit string
+}
+
+// loadAccountMap starts from the built-in accounts and applies -account-map if given
+func loadAccountMap(path string) (AccountMap, error) {
+        accounts := AccountMap{Debit: map[string]string{}, Credit: map[string]string{}, DefaultDebit: "雑費"}
+        for category, account := range defaultDebitAccounts {
+                accounts.Debit[category] = account
+        }
+        for method, account := range defaultCreditAccounts {
+                accounts.Credit[method] = account
+        }
+        if path == "" {
+                return accounts, nil
+        }
+
+        raw, err := readMappingFile(path, "account map")
+        if err != nil {
+                return accounts, err
+        }
+        for key, account := range raw {
+                if method, ok := strings.CutPrefix(key, "payment:"); ok {
+                        if method = strings.ToLower(method); method == "default" {
+                                method = ""
+                        }
+                        accounts.Credit[method] = account
+                } else {
+                        accounts.Debit[strings.ToLower(key)] = account
+                }
+        }
+        return accounts, nil
+}
+
+func (m AccountMap) debit(category string) string {
+        if account, ok := m.Debit[strings.ToLower(category)]; ok {
+                return account
+        }
+        return m.DefaultDebit
+}
+
+func (m AccountMap) credit(paymentMethod string) string {
+        if account, ok := m.Credit[paymentMethod]; ok {
+                return account
+        }
+        return m.Credit[""]
+}
+
+// journalLine is one debit line of a receipt's journal entry: the amount including tax
+// at one rate
+type journalLine struct {
+        Rate   int
+        Amount int64
+        Tax    int64
+}
+
+// journalLines splits a receipt by tax rate when -invoice-details extracted a breakdown
+// that adds up to the total, whether the receipt printed the taxable amounts with or
+// without tax. Otherwise the whole total is one line at 10%.
+func journalLines(data ReceiptData, total int64) []journalLine {
+        var inclusive, exclusive int64
+        for _, tax := range data.TaxBreakdown {
+                inclusive += int64(tax.TaxableAmount)
+                exclusive += int64(tax.TaxableAmount + tax.TaxAmount)
+        }
+
+        var lines []journalLine
+        for _, tax := range data.TaxBreakdown {
+                line := journalLine{Rate: tax.Rate, Amount: int64(tax.TaxableAmount), Tax: int64(tax.TaxAmount)}
+                if inclusive != total {
+                        line.Amount += int64(tax.TaxAmount)
+                }
+                lines = append(lines, line)
+        }
+        if len(lines) == 0 || (inclusive != total && exclusive != total) {
+                return []journalLine{{Rate: 10, Amount: total, Tax: total * 10 / 110}}
+        }
+        return lines
+}
+
+// taxCategory names a rate in the export format, treating unknown rates as 10%
+func taxCategory(format string, rate int) string {
+        if name, ok := accountingTaxCategories[format][rate]; ok {
+                return name
+        }
+        return accountingTaxCategories[format][10]
+}
+
+// writeAccountingExport writes filed receipts in the import layout of format. Only yen
+// receipts are exported, since these services book in yen.
+func writeAccountingExport(out io.Writer, format string, receipts []FiledReceipt, accounts AccountMap) (int, error) {
+        w := csv.NewWriter(out)
+        w.UseCRLF = true
+
+        switch format {
+        case "freee":
+                w.Write([]string{"収支区分", "管理番号", "発生日", "決済期日", "取引先", "勘定科目", "税区分", "金額", "税計算区分", "税額", "備考", "品目", "部門", "メモタグ（複数指定可、カンマ区切り）", "決済日", "決済口座", "決済金額"})
+        case "moneyforward":
+                w.Write([]string{"取引No", "取引日", "借方勘定科目", "借方補助科目", "借方部門", "借方取引先", "借方税区分", "借方インボイス", "借方金額(円)", "借方税額", "貸方勘定科目", "貸方補助科目", "貸方部門", "貸方取引先", "貸方税区分", "貸方インボイス", "貸方金額(円)", "貸方税額", "摘要", "仕訳メモ", "タグ", "MF仕訳タイプ", "決算整理仕訳", "作成日時", "作成者", "最終更新日時", "最終更新者"})
+        }
+
+        count := 0
+        for _, receipt := range receipts {
+                if receipt.Currency != "JPY" {
+                        slog.Warn("Skipping receipt: amount is not in yen", "event", "export", "path", receipt.Path, "currency", receipt.Currency)
+                        continue
+                }
+                total, err := strconv.ParseInt(receipt.Amount.Round(0).String(), 10, 64)
+                if err != nil {
+                        return count, fmt.Errorf("invalid amount in %s: %w", receipt.Path, err)
+                }
+                count++
+
+                date := strings.ReplaceAll(receipt.Date, "-", "/")
+                debit := accounts.debit(receipt.Category)
+                credit := accounts.credit(receipt.PaymentMethod)
+                summary := strings.TrimSpace(receipt.Vendor + " " + receipt.RegistrationNumber)
+                lines := journalLines(receipt.ReceiptData, total)
+                number := strconv.Itoa(count)
+
+                for i, line := range lines {
+                        // Personal spending drawn from the business carries no purchase tax credit
+                        if debit == "事業主貸" {
+                                line.Rate, line.Tax = 0, 0
+                        }
+                        amount, tax := strconv.FormatInt(line.Amount, 10), strconv.FormatInt(line.Tax, 10)
+                        switch format {
+                        case "freee":
+                                // Continuation lines of the same 取引 leave its header columns empty, and
+                                // only the first carries the payment. 未払金 is left unsettled for freee to track.
+                                kind, id, day, partner, settleDate, wallet, settled := "支出", number, date, receipt.Vendor, "", "", ""
+                                if i > 0 {
+                                        kind, id, day, partner = "", "", "", ""
+                                } else if credit != "未払金" {
+                                        settleDate, wallet, settled = date, credit, strconv.FormatInt(total, 10)
+                                }
+                                w.Write([]string{kind, id, day, "", partner, debit, taxCategory(format, line.Rate), amount, "内税", tax, receipt.RegistrationNumber, "", "", receipt.Category, settleDate, wallet, settled})
+                        case "moneyforward":
+                                w.Write([]string{number, date, debit, "", "", receipt.Vendor, taxCategory(format, line.Rate), "", amount, tax, credit, "", "", receipt.Vendor, "対象外", "", amount, "", summary, "", receipt.Category, "", "", "", "", "", ""})
+                        case "yayoi":
+                                // 2000 is a single-line entry; longer ones run 2110, 2100..., 2101
+                                flag := "2000"
+                                if len(lines) > 1 {
+                                        switch i {
+                                        case 0:
+                                                flag = "2110"
+                                        case len(lines) - 1:
+                                                flag = "2101"
+                                        default:
+                                                flag = "2100"
+                                        }
+                                }
+                                w.Write([]string{flag, "", "", date, debit, "", "", taxCategory(format, line.Rate), amount, tax, credit, "", "", "対象外", amount, "", summary, "", "", "0", "", "", "0", "0", "no"})
+                        }
+                }
+        }
+
+        w.Flush()
+        return count, w.Error()
+}
+
+// exportAccounting writes -accounting-export for the receipts filed under destDir between
+// -report-from and -report-to. Yayoi imports Shift_JIS; freee and MoneyForward get UTF-8
+// with a byte order mark, which their importers and Excel detect.
+func exportAccounting(format, outPath, accountMapPath string, report ExpenseReport) error {
+        accounts, err := loadAccountMap(accountMapPath)
+        if err != nil {
+                return err
+        }
+        receipts, err := collectFiledReceipts(destDir)
+        if err != nil {
+                return fmt.Errorf("failed to scan %s: %w", destDir, err)
+        }
+
+        var matched []FiledReceipt
+        for _, receipt := range receipts {
+                if report.matches(receipt) {
+                        matched = append(matched, receipt)
+                }
+        }
+        sort.Slice(matched, func(i, j int) bool {
+                if matched[i].Date != matched[j].Date {
+                        return matched[i].Date < matched[j].Date
+                }
+                return matched[i].Path < matched[j].Path
+        })
+
+        if outPath == "" {
+                outPath = filepath.Join(destDir, "reports", format+".csv")
+        }
+        if dryRun {
+                slog.Info("[dry-run] Would write accounting export", "event", "export", "dry_run", true, "path", outPath, "format", format, "receipts", len(matched))
+                return nil
+        }
+        if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+                return fmt.Errorf("failed to create directory %s: %w", filepath.Dir(outPath), err)
+        }
+        f, err := os.Create(outPath)
+        if err != nil {
+                return fmt.Errorf("failed to create export: %w", err)
+        }
+        defer f.Close()
+
+        var out io.Writer = f
+        if format == "yayoi" {
+                // Characters Shift_JIS lacks, such as emoji in a vendor name, are replaced rather
+                // than failing the export
+                out = encoding.ReplaceUnsupported(japanese.ShiftJIS.NewEncoder()).Writer(f)
+        } else if _, err := f.WriteString("\ufeff"); err != nil {
+                return fmt.Errorf("failed to write export: %w", err)
+        }
+
+        count, err := writeAccountingExport(out, format, matched, accounts)
+        if err != nil {
+                return fmt.Errorf("failed to write export: %w", err)
+        }
+        slog.Info("Wrote accounting export", "event", "export", "path", outPath, "format", format, "receipts", count)
+        return nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+        "bytes"
+        "context"
+        "encoding/base64"
+        "encoding/json"
+        "fmt"
+        "io"
+        "log/slog"
+        "net/http"
+        "os"
+        "strings"
+        "time"
+
+        "github.com/google/generative-ai-go/genai"
+        "google.golang.org/api/option"
+)
+
+// ReceiptAnalyzer extracts receipt data from a scanned file. Each provider implements it,
+// and -provider picks which one is used.
+type ReceiptAnalyzer interface {
+        Analyze(ctx context.Context, path string) ([]ReceiptData, error)
+        Close() error
+}
+
+// providerDefaultModels replaces the Gemini default for -model when another provider is chosen
+var providerDefaultModels = map[string]string{
+        "gemini":    ModelName,
+        "openai":    "gpt-4o",
+        "anthropic": "claude-sonnet-4-5",
+        "ollama":    "llava",
+}
+
+// newAnalyzer builds the analyzer for -provider followed by any -fallback backends,
+// checked by the -verify backend if one is set
+func newAnalyzer(ctx context.Context) (ReceiptAnalyzer, error) {
+        primary, err := newProviderAnalyzer(ctx, provider, "", apiBaseURL)
+        if err != nil {
+                return nil, err
+        }
+        chain := &analyzerChain{}
+        chain.add(provider, "", primary, &apiQuota)
+
+        for _, entry := range fallbacks {
+                // "provider" or "provider:model"; only the first colon splits, as in ollama:llava:13b
+                name, model, _ := strings.Cut(entry, ":")
+                if model == "" {
+                        model = providerDefaultModels[name]
+                }
+                analyzer, err := newProviderAnalyzer(ctx, name, model, "")
+                if err != nil {
+                        chain.Close()
+                        return nil, fmt.Errorf("invalid -fallback %s: %w", entry, err)
+                }
+                chain.add(name, model, analyzer, &quotaGate{})
+        }
+
+        if verifyWith == "" {
+                return chain, nil
+        }
+        name, model, _ := strings.Cut(verifyWith, ":")
+        if model == "" {
+                model = providerDefaultModels[name]
+        }
+        verifier, err := newProviderAnalyzer(ctx, name, model, "")
+        if err != nil {
+                chain.Close()
+                return nil, fmt.Errorf("invalid -verify %s: %w", verifyWith, err)
+        }
+        return &verifyingAnalyzer{primary: chain, verifier: verifier, backend: analysisBackend{Provider: name, Model: model}}, nil
+}
+
+// newProviderAnalyzer builds one provider's analyzer, reading its API key from the environment.
+// An empty model picks -model or -large-model per file; an empty baseURL uses the provider's default.
+func newProviderAnalyzer(ctx context.Context, name, model, baseURL string) (ReceiptAnalyzer, error) {
+        switch name {
+        case "gemini":
+                apiKey := os.Getenv("GEMINI_API_KEY")
+                if apiKey == "" {
+                        return nil, fmt.Errorf("GEMINI_API_KEY environment variable not set")
+                }
+                client, err := genai.NewClient(ctx, option.WithAPIKey(apiKey))
+                if err != nil {
+                        return nil, err
+                }
+                return &geminiAnalyzer{client: client, model: model}, nil
+        case "openai":
+                apiKey := os.Getenv("OPENAI_API_KEY")
+                if apiKey == "" {
+                        return nil, fmt.Errorf("OPENAI_API_KEY environment variable not set")
+                }
+                return &openAIAnalyzer{apiKey: apiKey, model: model, baseURL: baseURLOr(baseURL, "https://api.openai.com")}, nil
+        case "anthropic":
+                apiKey := os.Getenv("ANTHROPIC_API_KEY")
+                if apiKey == "" {
+                        return nil, fmt.Errorf("ANTHROPIC_API_KEY environment variable not set")
+                }
+                return &anthropicAnalyzer{apiKey: apiKey, model: model, baseURL: baseURLOr(baseURL, "https://api.anthropic.com")}, nil
+        case "ollama":
+                return &ollamaAnalyzer{model: model, baseURL: ollamaBaseURL(baseURL)}, nil
+        default:
+                return nil, fmt.Errorf("unknown provider %q (expected gemini, openai, anthropic, or ollama)", name)
+        }
+}
+
+// geminiAnalyzer uploads files through the Gemini File API
+type geminiAnalyzer struct {
+        client *genai.Client
+        model  string
+}
+
+func (a *geminiAnalyzer) Analyze(ctx context.Context, path string) ([]ReceiptData, error) {
+        return analyzeReceipt(ctx, a.client, path, pickModel(a.model, path))
+}
+
+func (a *geminiAnalyzer) Close() error {
+        return a.client.Close()
+}
+
+func baseURLOr(baseURL, fallback string) string {
+        if baseURL != "" {
+                return strings.TrimRight(baseURL, "/")
+        }
+        return fallback
+}
+
+// pdfPageCount returns the number of pages to mention in the prompt (1 for images) and
+// rejects PDFs over -max-pdf-pages before they are sent anywhere
+func pdfPageCount(path string) (int, error) {
+        pages := 1
+        if mediaType(path) != "application/pdf" {
+                return pages, nil
+        }
+
+        if n, err := countPDFPages(path); err != nil {
+                slog.Warn("Failed to count PDF pages", "path", path, "error", err)
+        } else if n > 0 {
+                pages = n
+        }
+        if maxPDFPages > 0 && pages > maxPDFPages {
+                return 0, fmt.Errorf("PDF has %d pages, more than -max-pdf-pages %d", pages, maxPDFPages)
+        }
+        return pages, nil
+}
+
+// receiptPrompt is the extraction prompt for the file at path plus, for multi-page PDFs,
+// the request for an array, and with -prompt-corrections the corrections made before.
+// The source file's hash, for its own correction, comes from ctx (see withSourceHash).
+func receiptPrompt(ctx context.Context, path string, pages int) (string, error) {
+        prompt, err := extractionPrompt(pages)
+        if err != nil {
+                return "", err
+        }
+
+        if multiPage && pages > 1 {
+                prompt += fmt.Sprintf(`
+This PDF has %d pages and may contain several separate receipts.
+Return a JSON array with one object per receipt, using the same keys.`, pages)
+        }
+        if promptCorrections > 0 && receiptDB != nil {
+                examples, err := correctionExamples(sourceHashFrom(ctx))
+                if err != nil {
+                        slog.Warn("Failed to add corrections to the prompt", "path", path, "error", err)
+                }
+                prompt += examples
+        }
+        return prompt, nil
+}
+
+// readBase64 returns the file content base64-encoded for inline upload
+func readBase64(path string) (string, error) {
+        content, err := os.ReadFile(path)
+        if err != nil {
+                return "", fmt.Errorf("error opening file: %w", err)
+        }
+        return base64.StdEncoding.EncodeToString(content), nil
+}
+
+// httpStatusError is a non-2xx answer from a provider's HTTP API. Rate limits and
+// server errors are recognised by withRetry through Code and the Retry-After header.
+type httpStatusError struct {
+        Code   int
+        Header http.Header
+        Body   string
+}
+
+func (e *httpStatusError) Error() string {
+        return fmt.Sprintf("HTTP %d: %s", e.Code, e.Body)
+}
+
+// apiClient is shared by the HTTP-based providers; uploads of large PDFs can be slow
+var apiClient = &http.Client{Timeout: 5 * time.Minute}
+
+// postJSON sends body as JSON and decodes a 2xx response into out
+func postJSON(ctx context.Context, url string, headers map[string]string, body, out any) error {
+        return postJSONWith(ctx, apiClient, url, headers, body, out)
+}
+
+func postJSONWith(ctx context.Context, client *http.Client, url string, headers map[string]string, body, out any) error {
+        payload, err := json.Marshal(body)
+        if err != nil {
+                return err
+        }
+
+        req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+        if err != nil {
+                return err
+        }
+        req.Header.Set("Content-Type", "application/json")
+        return doJSON(client, req, headers, out)
+}
+
+// getJSON decodes a 2xx response to a GET into out
+func getJSON(ctx context.Context, url string, headers map[string]string, out any) error {
+        req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+        if err != nil {
+                return err
+        }
+        return doJSON(apiClient, req, headers, out)
+}
+
+// doJSON sends req with headers and decodes a 2xx response into out
+func doJSON(client *http.Client, req *http.Request, headers map[string]string, out any) error {
+        for key, value := range headers {
+                req.Header.Set(key, value)
+        }
+
+        resp, err := client.Do(req)
+        if err != nil {
+                return err
+        }
+        defer resp.Body.Close()
+
+        if resp.StatusCode < 200 || resp.StatusCode > 299 {
+                text, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+                return &httpStatusError{Code: resp.StatusCode, Header: resp.Header, Body: strings.TrimSpace(string(text))}
+        }
+        if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+                return fmt.Errorf("failed to decode response: %w", err)
+        }
+        return nil
+}
+
@@ -0,0 +1,162 @@
+package main
+
+import (
+        "fmt"
+        "log/slog"
+        "os"
+        "path/filepath"
+        "sort"
+        "strings"
+        "time"
+
+        "github.com/jung-kurt/gofpdf"
+)
+
+// fiscalYearRange returns the first day of the fiscal year and the first day of the next one.
+// startMonth 1 is a plain calendar year; 4 means April through March of the following year.
+func fiscalYearRange(year int, startMonth time.Month) (time.Time, time.Time) {
+        start := time.Date(year, startMonth, 1, 0, 0, 0, 0, time.UTC)
+        return start, start.AddDate(1, 0, 0)
+}
+
+// exportAnnualPDF writes dest/reports/annual-<year>.pdf with totals per category per month.
+// The table is in -default-currency; receipts in other currencies are totalled separately
+// below it, since they cannot be added together.
+func exportAnnualPDF(year int, startMonth time.Month) error {
+        receipts, err := collectFiledReceipts(destDir)
+        if err != nil {
+                return fmt.Errorf("failed to scan %s: %w", destDir, err)
+        }
+
+        start, end := fiscalYearRange(year, startMonth)
+
+        // totals[category][monthIndex], where monthIndex 0 is the first month of the fiscal year
+        totals := map[string]*[12]Decimal{}
+        var monthTotals [12]Decimal
+        var grandTotal Decimal
+        otherTotals := map[string]Decimal{}
+        count := 0
+
+        for _, receipt := range receipts {
+                date, err := time.Parse("2006-01-02", receipt.Date)
+                if err != nil || date.Before(start) || !date.Before(end) {
+                        continue
+                }
+                count++
+                if receipt.Currency != defaultCurrency {
+                        otherTotals[receipt.Currency] = otherTotals[receipt.Currency].Add(receipt.Amount)
+                        continue
+                }
+
+                idx := (int(date.Month()) - int(startMonth) + 12) % 12
+                if totals[receipt.Category] == nil {
+                        totals[receipt.Category] = &[12]Decimal{}
+                }
+                totals[receipt.Category][idx] = totals[receipt.Category][idx].Add(receipt.Amount)
+                monthTotals[idx] = monthTotals[idx].Add(receipt.Amount)
+                grandTotal = grandTotal.Add(receipt.Amount)
+        }
+
+        if count == 0 {
+                return fmt.Errorf("no receipts found for fiscal year %d", year)
+        }
+
+        var categories []string
+        for category := range totals {
+                categories = append(categories, category)
+        }
+        sort.Strings(categories)
+
+        outPath := filepath.Join(destDir, "reports", fmt.Sprintf("annual-%d.pdf", year))
+        if dryRun {
+                slog.Info("[dry-run] Would write annual summary", "event", "report", "dry_run", true, "path", outPath, "receipts", count, "total", grandTotal, "currency", defaultCurrency)
+                return nil
+        }
+
+        pdf := gofpdf.New("L", "mm", "A4", "")
+        tr := pdf.UnicodeTranslatorFromDescriptor("")
+        pdf.SetTitle(fmt.Sprintf("Receipt Summary %d", year), true)
+        pdf.AddPage()
+
+        pdf.SetFont("Helvetica", "B", 16)
+        pdf.CellFormat(0, 10, fmt.Sprintf("Receipt Summary - Fiscal Year %d", year), "", 1, "L", false, 0, "")
+        pdf.SetFont("Helvetica", "", 10)
+        pdf.CellFormat(0, 6, fmt.Sprintf("Period: %s to %s", start.Format("2006-01-02"), end.AddDate(0, 0, -1).Format("2006-01-02")), "", 1, "L", false, 0, "")
+        pdf.CellFormat(0, 6, fmt.Sprintf("Receipts: %d    Generated: %s", count, time.Now().Format("2006-01-02")), "", 1, "L", false, 0, "")
+        pdf.Ln(4)
+
+        const categoryWidth, monthWidth, totalWidth, rowHeight = 41.0, 17.0, 32.0, 7.0
+
+        // Header row
+        pdf.SetFont("Helvetica", "B", 8)
+        pdf.SetFillColor(230, 230, 230)
+        pdf.CellFormat(categoryWidth, rowHeight, "Category", "1", 0, "L", true, 0, "")
+        for i := 0; i < 12; i++ {
+                month := time.Month((int(startMonth)-1+i)%12 + 1)
+                pdf.CellFormat(monthWidth, rowHeight, month.String()[:3], "1", 0, "C", true, 0, "")
+        }
+        pdf.CellFormat(totalWidth, rowHeight, "Total", "1", 1, "R", true, 0, "")
+
+        // One row per category
+        pdf.SetFont("Helvetica", "", 8)
+        for _, category := range categories {
+                var rowTotal Decimal
+                pdf.CellFormat(categoryWidth, rowHeight, tr(category), "1", 0, "L", false, 0, "")
+                for _, amount := range totals[category] {
+                        pdf.CellFormat(monthWidth, rowHeight, formatAmount(amount), "1", 0, "R", false, 0, "")
+                        rowTotal = rowTotal.Add(amount)
+                }
+                pdf.CellFormat(totalWidth, rowHeight, formatAmount(rowTotal), "1", 1, "R", false, 0, "")
+        }
+
+        // Monthly totals and grand total
+        pdf.SetFont("Helvetica", "B", 8)
+        pdf.CellFormat(categoryWidth, rowHeight, "Total", "1", 0, "L", true, 0, "")
+        for _, amount := range monthTotals {
+                pdf.CellFormat(monthWidth, rowHeight, formatAmount(amount), "1", 0, "R", true, 0, "")
+        }
+        pdf.CellFormat(totalWidth, rowHeight, formatAmount(grandTotal), "1", 1, "R", true, 0, "")
+
+        pdf.Ln(6)
+        pdf.SetFont("Helvetica", "B", 12)
+        pdf.CellFormat(0, 8, "Grand Total: "+formatAmount(grandTotal)+" "+defaultCurrency, "", 1, "L", false, 0, "")
+        if len(otherTotals) > 0 {
+                pdf.SetFont("Helvetica", "", 10)
+                var others []string
+                for _, currency := range sortedKeys(otherTotals) {
+                        others = append(others, formatAmount(otherTotals[currency])+" "+currency)
+                }
+                pdf.CellFormat(0, 6, "Other currencies (not included above): "+strings.Join(others, ", "), "", 1, "L", false, 0, "")
+        }
+
+        if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+                return fmt.Errorf("failed to create directory %s: %w", filepath.Dir(outPath), err)
+        }
+        if err := pdf.OutputFileAndClose(outPath); err != nil {
+                return fmt.Errorf("failed to write %s: %w", outPath, err)
+        }
+
+        slog.Info("Wrote annual summary", "event", "report", "path", outPath, "receipts", count, "total", grandTotal, "currency", defaultCurrency)
+        return nil
+}
+
+// formatAmount renders an amount with thousands separators, or a dash for zero
+func formatAmount(amount Decimal) string {
+        if amount.IsZero() {
+                return "-"
+        }
+
+        digits, frac, _ := strings.Cut(amount.String(), ".")
+        sign := ""
+        if amount.Sign() < 0 {
+                sign, digits = "-", digits[1:]
+        }
+
+        for i := len(digits) - 3; i > 0; i -= 3 {
+                digits = digits[:i] + "," + digits[i:]
+        }
+        if frac != "" {
+                digits += "." + frac
+        }
+        return sign + digits
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+        "context"
+        "fmt"
+        "strings"
+)
+
+// anthropicAPIVersion is sent as the anthropic-version header
+const anthropicAPIVersion = "2023-06-01"
+
+// anthropicAnalyzer sends scans inline to the Anthropic Messages API
+type anthropicAnalyzer struct {
+        apiKey  string
+        model   string
+        baseURL string
+}
+
+type anthropicRequest struct {
+        Model       string             `json:"model"`
+        MaxTokens   int                `json:"max_tokens"`
+        Temperature *float64           `json:"temperature,omitempty"`
+        Messages    []anthropicMessage `json:"messages"`
+}
+
+type anthropicMessage struct {
+        Role    string             `json:"role"`
+        Content []anthropicContent `json:"content"`
+}
+
+type anthropicContent struct {
+        Type   string           `json:"type"`
+        Text   string           `json:"text,omitempty"`
+        Source *anthropicSource `json:"source,omitempty"`
+}
+
+type anthropicSource struct {
+        Type      string `json:"type"`
+        MediaType string `json:"media_type"`
+        Data      string `json:"data"`
+}
+
+type anthropicResponse struct {
+        Content []struct {
+                Type string `json:"type"`
+                Text string `json:"text"`
+        } `json:"content"`
+        StopReason string `json:"stop_reason"`
+        Usage      struct {
+                InputTokens  int64 `json:"input_tokens"`
+                OutputTokens int64 `json:"output_tokens"`
+        } `json:"usage"`
+}
+
+func (a *anthropicAnalyzer) Analyze(ctx context.Context, path string) ([]ReceiptData, error) {
+        pages, err := pdfPageCount(path)
+        if err != nil {
+                return nil, err
+        }
+        prompt, err := receiptPrompt(ctx, path, pages)
+        if err != nil {
+                return nil, err
+        }
+        encoded, err := readBase64(path)
+        if err != nil {
+                return nil, err
+        }
+
+        // PDFs go in a document block, images in an image block
+        blockType := "image"
+        if mediaType(path) == "application/pdf" {
+                blockType = "document"
+        }
+
+        maxTokens := maxOutputTokens
+        if maxTokens <= 0 {
+                maxTokens = defaultOutputTokens
+        }
+
+        req := anthropicRequest{
+                Model:     pickModel(a.model, path),
+                MaxTokens: maxTokens,
+                Messages: []anthropicMessage{{
+                        Role: "user",
+                        Content: []anthropicContent{
+                                {Type: blockType, Source: &anthropicSource{Type: "base64", MediaType: mediaType(path), Data: encoded}},
+                                {Type: "text", Text: prompt},
+                        },
+                }},
+        }
+        if temperature >= 0 {
+                req.Temperature = &temperature
+        }
+
+        headers := map[string]string{"x-api-key": a.apiKey, "anthropic-version": anthropicAPIVersion}
+
+        send := func() (string, error) {
+                var resp anthropicResponse
+                err := withRetry(ctx, "generate", func() error {
+                        return postJSON(ctx, a.baseURL+"/v1/messages", headers, req, &resp)
+                })
+                if err != nil {
+                        return "", fmt.Errorf("anthropic request failed: %w", err)
+                }
+                recordUsage(ctx, "anthropic", req.Model, resp.Usage.InputTokens, resp.Usage.OutputTokens)
+
+                var text strings.Builder
+                for _, block := range resp.Content {
+                        if block.Type == "text" {
+                                text.WriteString(block.Text)
+                        }
+                }
+
+                switch {
+                case resp.StopReason == "refusal":
+                        return "", fmt.Errorf("blocked: refusal")
+                case resp.StopReason == "max_tokens":
+                        return "", errTruncated
+                case strings.TrimSpace(text.String()) == "":
+                        return "", fmt.Errorf("empty response from model: stop reason %s", resp.StopReason)
+                }
+                return text.String(), nil
+        }
+
+        text, err := send()
+        if err != nil {
+                return nil, err
+        }
+        return parseWithCorrection(path, text, func(invalid, correction string) (string, error) {
+                req.Messages = append(req.Messages,
+                        anthropicMessage{Role: "assistant", Content: []anthropicContent{{Type: "text", Text: invalid}}},
+                        anthropicMessage{Role: "user", Content: []anthropicContent{{Type: "text", Text: correction}}},
+                )
+                return send()
+        })
+}
+
+func (a *anthropicAnalyzer) Close() error {
+        return nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+        "context"
+        "crypto/subtle"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "log/slog"
+        "net/http"
+        "strconv"
+        "strings"
+        "time"
+)
+
+const (
+        // apiDefaultLimit and apiMaxLimit bound the receipts GET /receipts returns at once;
+        // ?offset= pages through the rest
+        apiDefaultLimit = 100
+        apiMaxLimit     = 1000
+
+        // apiMaxBody is the largest correction accepted by PATCH /receipts/{id}
+        apiMaxBody = 1 << 20
+)
+
+// errInvalidCorrection marks corrections refused before anything was re-filed
+var errInvalidCorrection = errors.New("invalid correction")
+
+// apiReceipt is a receipt as the API returns it: the database row, with every field the
+// sidecar has and the values earlier corrections and reprocessing replaced
+type apiReceipt struct {
+        StoredReceipt
+        History []SidecarRevision `json:"history,omitempty"`
+}
+
+// receiptPatch is the body of PATCH /receipts/{id}; fields left out keep their value
+type receiptPatch struct {
+        Date     *string  `json:"date"`
+        Vendor   *string  `json:"vendor"`
+        Category *string  `json:"category"`
+        Amount   *Decimal `json:"total_amount"`
+        Currency *string  `json:"currency"`
+}
+
+// startAPIServer serves the receipts API on addr in the background. Requests must carry
+// "Authorization: Bearer <API_TOKEN>".
+func startAPIServer(addr, token string) *http.Server {
+        mux := http.NewServeMux()
+        mux.HandleFunc("GET /receipts", handleAPIList)
+        mux.HandleFunc("GET /receipts/{id}", handleAPIReceipt)
+        mux.HandleFunc("PATCH /receipts/{id}", handleAPIEdit)
+        mux.HandleFunc("GET /stats", handleAPIStats)
+
+        srv := &http.Server{Addr: addr, Handler: apiAuth(token, mux), ReadHeaderTimeout: 10 * time.Second}
+        go func() {
+                if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+                        slog.Error("API server error", "error", err)
+                }
+        }()
+
+        slog.Info("Serving API", "addr", addr)
+        return srv
+}
+
+// stopAPIServer gives requests in progress a few seconds to finish
+func stopAPIServer(srv *http.Server) {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        if err := srv.Shutdown(ctx); err != nil {
+                slog.Warn("API server shutdown error", "error", err)
+        }
+}
+
+// apiAuth checks the bearer token of every request
+func apiAuth(token string, next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                given, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+                if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+                        slog.Warn("Rejected API request", "event", "api", "remote", r.RemoteAddr, "error", "invalid token")
+                        w.Header().Set("WWW-Authenticate", "Bearer")
+                        writeAPIError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+                        return
+                }
+                next.ServeHTTP(w, r)
+        })
+}
+
+// handleAPIList lists receipts, newest first, selected by ?q=, ?category=, ?from=, and
+// ?to= and paged by ?limit= and ?offset=
+func handleAPIList(w http.ResponseWriter, r *http.Request) {
+        query, err := apiReceiptQuery(r)
+        if err != nil {
+                writeAPIError(w, http.StatusBadRequest, err)
+                return
+        }
+        receipts, err := receiptDB.ListReceipts(query)
+        if err != nil {
+                slog.Error("Failed to list receipts", "event", "api", "error", err)
+                writeAPIError(w, http.StatusInternalServerError, err)
+                return
+        }
+        if receipts == nil {
+                receipts = []StoredReceipt{}
+        }
+        writeAPIJSON(w, http.StatusOK, map[string]any{"receipts": receipts, "limit": query.Limit, "offset": query.Offset})
+}
+
+func handleAPIReceipt(w http.ResponseWriter, r *http.Request) {
+        receipt, ok := apiLookup(w, r)
+        if !ok {
+                return
+        }
+        writeAPIJSON(w, http.StatusOK, newAPIReceipt(receipt))
+}
+
+// handleAPIEdit applies a correction the way the dashboard does: the processed copy is
+// re-filed under the name the new values give it, and the database, journal, and
+// ledger are updated
+func handleAPIEdit(w http.ResponseWriter, r *http.Request) {
+        receipt, ok := apiLookup(w, r)
+        if !ok {
+                return
+        }
+
+        var patch receiptPatch
+        decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, apiMaxBody))
+        decoder.DisallowUnknownFields()
+        if err := decoder.Decode(&patch); err != nil {
+                writeAPIError(w, http.StatusBadRequest, fmt.Errorf("%w: %w", errInvalidCorrection, err))
+                return
+        }
+
+        receipt, err := applyPatch(receipt, patch)
+        switch {
+        case errors.Is(err, errInvalidCorrection):
+                writeAPIError(w, http.StatusBadRequest, err)
+        case err != nil:
+                writeAPIError(w, http.StatusConflict, err)
+        default:
+                writeAPIJSON(w, http.StatusOK, newAPIReceipt(receipt))
+        }
+}
+
+// applyPatch re-files a receipt under the values the patch sets and returns it as it is
+// stored now
+func applyPatch(receipt *StoredReceipt, patch receiptPatch) (*StoredReceipt, error) {
+        data := newAPIReceipt(receipt).ReceiptData
+        for _, field := range []struct {
+                value *string
+                into  *string
+        }{{patch.Date, &data.Date}, {patch.Vendor, &data.Vendor}, {patch.Category, &data.Category}, {patch.Currency, &data.Currency}} {
+                if field.value != nil {
+                        *field.into = strings.TrimSpace(*field.value)
+                }
+        }
+        data.Currency = strings.ToUpper(data.Currency)
+        if patch.Amount != nil {
+                data.Amount = *patch.Amount
+        }
+        if err := checkCorrection(data); err != nil {
+                return nil, fmt.Errorf("%w: %w", errInvalidCorrection, err)
+        }
+
+        if _, err := editReceipt(receipt, data); err != nil {
+                slog.Warn("Failed to edit receipt", "event", "edit", "path", receipt.ProcessedPath, "error", err)
+                return nil, err
+        }
+        // The row keeps its id when the copy is re-filed
+        edited, err := receiptDB.Receipt(receipt.ID)
+        if err == nil && edited == nil {
+                err = fmt.Errorf("receipt %d disappeared while it was re-filed", receipt.ID)
+        }
+        return edited, err
+}
+
+// handleAPIStats totals the receipts selected like GET /receipts, per category and month
+func handleAPIStats(w http.ResponseWriter, r *http.Request) {
+        query, err := apiReceiptQuery(r)
+        if err != nil {
+                writeAPIError(w, http.StatusBadRequest, err)
+                return
+        }
+        stats, err := receiptDB.Stats(query)
+        if err != nil {
+                slog.Error("Failed to total receipts", "event", "api", "error", err)
+                writeAPIError(w, http.StatusInternalServerError, err)
+                return
+        }
+        writeAPIJSON(w, http.StatusOK, stats)
+}
+
+// apiReceiptQuery reads the receipt selection from the query string
+func apiReceiptQuery(r *http.Request) (ReceiptQuery, error) {
+        values := r.URL.Query()
+        query := ReceiptQuery{
+                Search:   strings.TrimSpace(values.Get("q")),
+                Category: strings.TrimSpace(values.Get("category")),
+                From:     values.Get("from"),
+                To:       values.Get("to"),
+        }
+        for _, param := range []struct {
+                name string
+                into *int
+        }{{"limit", &query.Limit}, {"offset", &query.Offset}} {
+                if values.Has(param.name) {
+                        n, err := strconv.Atoi(values.Get(param.name))
+                        if err != nil {
+                                return query, fmt.Errorf("invalid %s %q", param.name, values.Get(param.name))
+                        }
+                        *param.into = n
+                }
+        }
+        return checkReceiptQuery(query)
+}
+
+// checkReceiptQuery rejects malformed dates and negative paging, and bounds the limit,
+// using the default when it is 0
+func checkReceiptQuery(query ReceiptQuery) (ReceiptQuery, error) {
+        for _, date := range []string{query.From, query.To} {
+                if _, err := time.Parse("2006-01-02", date); date != "" && err != nil {
+                        return query, fmt.Errorf("invalid date %q (expected YYYY-MM-DD)", date)
+                }
+        }
+        if query.Limit < 0 || query.Offset < 0 {
+                return query, errors.New("limit and offset cannot be negative")
+        }
+        if query.Limit == 0 {
+                query.Limit = apiDefaultLimit
+        }
+        query.Limit = min(query.Limit, apiMaxLimit)
+        return query, nil
+}
+
+// apiLookup looks up the receipt named by the request's {id}, answering 404 when there
+// is none
+func apiLookup(w http.ResponseWriter, r *http.Request) (*StoredReceipt, bool) {
+        id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+        if err != nil {
+                writeAPIError(w, http.StatusNotFound, fmt.Errorf("no receipt %q", r.PathValue("id")))
+                return nil, false
+        }
+        receipt, err := receiptDB.Receipt(id)
+        if err != nil {
+                slog.Error("Failed to look up receipt", "event", "api", "id", id, "error", err)
+                writeAPIError(w, http.StatusInternalServerError, err)
+                return nil, false
+        }
+        if receipt == nil {
+                writeAPIError(w, http.StatusNotFound, fmt.Errorf("no receipt %d", id))
+                return nil, false
+        }
+        return receipt, true
+}
+
+// newAPIReceipt fills in the receipt from its sidecar, when there is one
+func newAPIReceipt(receipt *StoredReceipt) apiReceipt {
+        full := apiReceipt{StoredReceipt: *receipt}
+        if sidecar, ok := readSidecar(receipt.ProcessedPath); ok {
+                full.ReceiptData, full.History = sidecar.ReceiptData, sidecar.History
+        }
+        return full
+}
+
+func writeAPIJSON(w http.ResponseWriter, status int, body any) {
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(status)
+        json.NewEncoder(w).Encode(body)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+        writeAPIJSON(w, status, map[string]string{"error": err.Error()})
+}
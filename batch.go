@@ -0,0 +1,103 @@
+package main
+
+import (
+        "context"
+        "errors"
+        "io/fs"
+        "log/slog"
+        "path/filepath"
+        "sync"
+)
+
+// batchResult counts what a one-shot run over a directory did
+type batchResult struct {
+        mu          sync.Mutex
+        Done        int
+        Skipped     int
+        Deferred    []string
+        NeedsReview []string
+        Failed      []string
+}
+
+func (r *batchResult) record(path string, err error) {
+        r.mu.Lock()
+        defer r.mu.Unlock()
+        switch {
+        case err == nil:
+                r.Done++
+        case errors.Is(err, errUnsupportedFile):
+                r.Skipped++
+        case errors.Is(err, errRetryLater):
+                r.Deferred = append(r.Deferred, path)
+        case errors.Is(err, errNeedsReview):
+                r.NeedsReview = append(r.NeedsReview, path)
+        default:
+                r.Failed = append(r.Failed, path)
+        }
+}
+
+// listBatchFiles returns the files in dir, and with -recursive in its subdirectories,
+// skipping ignored files and destination roots the way the watcher does
+func listBatchFiles(dir string) ([]string, error) {
+        var files []string
+        err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+                if err != nil {
+                        if path == dir {
+                                return err
+                        }
+                        slog.Warn("Skipping unreadable path", "path", path, "error", err)
+                        return nil
+                }
+                if !d.IsDir() {
+                        if !isIgnoredFile(path) && isReceiptCandidate(path) {
+                                files = append(files, path)
+                        }
+                        return nil
+                }
+                if path != dir && (!recursive || isIgnoredFile(path) || isDestRoot(path)) {
+                        return filepath.SkipDir
+                }
+                return nil
+        })
+        return files, err
+}
+
+// processBatch runs every receipt currently in dir through the pipeline, -workers at a
+// time, then logs a summary. Files that arrive meanwhile are left for the next run.
+func processBatch(ctx context.Context, analyzer ReceiptAnalyzer, dir string) (*batchResult, error) {
+        files, err := listBatchFiles(dir)
+        if err != nil {
+                return nil, err
+        }
+        slog.Info("Processing directory", "path", dir, "files", len(files), "recursive", recursive)
+
+        result := &batchResult{}
+        pool := startWorkers(workers, func(path string) {
+                // Files not started before a signal are counted as failed, so the run exits non-zero
+                if ctx.Err() != nil {
+                        result.record(path, ctx.Err())
+                        return
+                }
+                err := processFile(ctx, analyzer, path)
+                if err != nil && !errors.Is(err, errUnsupportedFile) && !errors.Is(err, errRetryLater) && !errors.Is(err, errNeedsReview) {
+                        slog.Error("Failed to process file", "path", path, "error", err)
+                }
+                result.record(path, err)
+        })
+        for _, path := range files {
+                pool.Submit(path)
+        }
+        pool.Close()
+
+        slog.Info("Batch complete", "event", "batch", "path", dir, "files", len(files), "processed", result.Done, "skipped", result.Skipped, "deferred", len(result.Deferred), "needs_review", len(result.NeedsReview), "failed", len(result.Failed))
+        for _, path := range result.Deferred {
+                slog.Info("Left for a later retry", "event", "batch", "path", path)
+        }
+        for _, path := range result.NeedsReview {
+                slog.Info("Held for review", "event", "batch", "path", path)
+        }
+        for _, path := range result.Failed {
+                slog.Warn("Not processed", "event", "batch", "path", path)
+        }
+        return result, nil
+}
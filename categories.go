@@ -0,0 +1,97 @@
+package main
+
+import (
+        "bufio"
+        "bytes"
+        "encoding/json"
+        "fmt"
+        "log/slog"
+        "os"
+        "strings"
+)
+
+// categoryMap maps lower-cased model categories (and canonical names) to canonical folder names.
+// Empty means categories are only checked against -categories.
+var categoryMap map[string]string
+
+// loadCategoryMap reads either a JSON object or key=value lines ("#" starts a comment).
+// Each canonical value also maps to itself, so the model returning it directly is fine.
+func loadCategoryMap(path string) (map[string]string, error) {
+        raw, err := readMappingFile(path, "category map")
+        if err != nil {
+                return nil, err
+        }
+
+        mapping := map[string]string{}
+        for _, value := range raw {
+                mapping[strings.ToLower(value)] = value
+        }
+        for key, value := range raw {
+                mapping[strings.ToLower(key)] = value
+        }
+        return mapping, nil
+}
+
+// readMappingFile reads a JSON object or key=value lines ("#" starts a comment) into
+// a map. what names the file in errors.
+func readMappingFile(path, what string) (map[string]string, error) {
+        content, err := os.ReadFile(path)
+        if err != nil {
+                return nil, fmt.Errorf("error reading %s: %w", what, err)
+        }
+
+        raw := map[string]string{}
+        if trimmed := bytes.TrimSpace(content); len(trimmed) > 0 && trimmed[0] == '{' {
+                if err := json.Unmarshal(trimmed, &raw); err != nil {
+                        return nil, fmt.Errorf("error parsing %s %s: %w", what, path, err)
+                }
+        } else {
+                scanner := bufio.NewScanner(bytes.NewReader(content))
+                for lineNo := 1; scanner.Scan(); lineNo++ {
+                        line := strings.TrimSpace(scanner.Text())
+                        if line == "" || strings.HasPrefix(line, "#") {
+                                continue
+                        }
+                        key, value, ok := strings.Cut(line, "=")
+                        if !ok {
+                                return nil, fmt.Errorf("%s:%d: expected key=value", path, lineNo)
+                        }
+                        raw[strings.TrimSpace(key)] = strings.TrimSpace(value)
+                }
+        }
+
+        for key, value := range raw {
+                if value == "" {
+                        return nil, fmt.Errorf("%s %s: empty value for %q", what, path, key)
+                }
+        }
+        return raw, nil
+}
+
+// normalizeCategory maps the model's category to a canonical folder name: through
+// -category-map when one is set, otherwise by matching it against -categories.
+// Anything that matches neither goes to -default-category.
+func normalizeCategory(category string) string {
+        category = strings.TrimSpace(category)
+        if category == "" {
+                return defaultCategory
+        }
+
+        if canonical, ok := categoryMap[strings.ToLower(category)]; ok {
+                return canonical
+        }
+
+        // The model sometimes changes the case; file under the configured spelling
+        allowed := categoryList()
+        for _, name := range allowed {
+                if strings.EqualFold(name, category) {
+                        return name
+                }
+        }
+        if len(categoryMap) == 0 && len(allowed) == 0 {
+                return category
+        }
+
+        slog.Warn("Category not in the configured list, using the default", "category", category, "default", defaultCategory)
+        return defaultCategory
+}
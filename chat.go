@@ -0,0 +1,228 @@
+package main
+
+import (
+        "bytes"
+        "encoding/json"
+        "fmt"
+        "image"
+        "image/jpeg"
+        "log/slog"
+        "mime/multipart"
+        "net/url"
+        "os"
+        "path/filepath"
+        "strings"
+        "time"
+)
+
+// thumbnailSize is the longest side of the preview attached to Discord messages
+const thumbnailSize = 320
+
+// Embed colours for Discord messages
+const (
+        discordColorFiled  = 0x2eb67d
+        discordColorFailed = 0xe01e5a
+)
+
+// chatField is one labelled value in a Slack or Discord message
+type chatField struct {
+        Name, Value string
+}
+
+// chatMessage is what both notifiers render: a title, the link to the file if
+// -notify-link-base is set, labelled fields, and the image shown as a thumbnail
+type chatMessage struct {
+        Title   string
+        Link    string
+        Fields  []chatField
+        Image   string
+        Failure bool
+}
+
+// notifyChatReceipt posts a filed receipt to the Slack and Discord channels configured
+func notifyChatReceipt(data ReceiptData, srcPath, processedPath string) {
+        if slackWebhookURL == "" && discordWebhookURL == "" {
+                return
+        }
+        fields := []chatField{
+                {"Vendor", data.Vendor},
+                {"Amount", amountLabel(data.Amount, data.Currency)},
+                {"Category", data.Category},
+                {"Date", data.Date},
+        }
+        if linkBaseURL == "" {
+                fields = append(fields, chatField{"File", processedPath})
+        }
+        sendChat(chatMessage{
+                Title:  "Receipt filed: " + filepath.Base(processedPath),
+                Link:   fileLink(srcPath, processedPath),
+                Fields: fields,
+                Image:  processedPath,
+        }, processedPath)
+}
+
+// notifyChatError posts a file that was quarantined, with the reason
+func notifyChatError(srcPath, failedPath string, reason error) {
+        if slackWebhookURL == "" && discordWebhookURL == "" {
+                return
+        }
+        fields := []chatField{{"Error", truncateBytes(reason.Error(), 1000)}}
+        if linkBaseURL == "" {
+                fields = append(fields, chatField{"File", failedPath})
+        }
+        sendChat(chatMessage{
+                Title:   "Receipt failed: " + filepath.Base(srcPath),
+                Link:    fileLink(srcPath, failedPath),
+                Fields:  fields,
+                Failure: true,
+        }, failedPath)
+}
+
+func sendChat(msg chatMessage, path string) {
+        if slackWebhookURL != "" {
+                postWebhook(slackWebhookURL, slackPayload(msg), path)
+        }
+        if discordWebhookURL != "" {
+                body, contentType, err := discordBody(msg)
+                if err != nil {
+                        slog.Error("Failed to build Discord message", "path", path, "error", err)
+                        return
+                }
+                deliverWebhook(discordWebhookURL, contentType, body, path)
+        }
+}
+
+// fileLink turns a path under the destination into a URL under -notify-link-base, such
+// as a Nextcloud or file server share of the destination folder
+func fileLink(srcPath, path string) string {
+        // Paperless documents and Drive files already have their own link
+        if strings.HasPrefix(path, "https://") || strings.HasPrefix(path, "http://") {
+                return path
+        }
+        if linkBaseURL == "" {
+                return ""
+        }
+        rel, err := filepath.Rel(destFor(srcPath), path)
+        if err != nil || strings.HasPrefix(rel, "..") {
+                return ""
+        }
+        segments := strings.Split(filepath.ToSlash(rel), "/")
+        for i, segment := range segments {
+                segments[i] = url.PathEscape(segment)
+        }
+        return strings.TrimRight(linkBaseURL, "/") + "/" + strings.Join(segments, "/")
+}
+
+// slackPayload renders a Block Kit message. Slack fetches images itself, so the
+// thumbnail is only shown when the file has a link and is an image.
+func slackPayload(msg chatMessage) map[string]any {
+        title := "*" + msg.Title + "*"
+        if msg.Link != "" {
+                title = "*<" + msg.Link + "|" + msg.Title + ">*"
+        }
+        if msg.Failure {
+                title = ":warning: " + title
+        }
+
+        var fields []map[string]string
+        for _, field := range msg.Fields {
+                fields = append(fields, map[string]string{"type": "mrkdwn", "text": "*" + field.Name + "*\n" + field.Value})
+        }
+        section := map[string]any{
+                "type":   "section",
+                "text":   map[string]string{"type": "mrkdwn", "text": title},
+                "fields": fields,
+        }
+        if msg.Link != "" && msg.Image != "" && mediaType(msg.Image) != "application/pdf" {
+                section["accessory"] = map[string]string{"type": "image", "image_url": msg.Link, "alt_text": msg.Title}
+        }
+        return map[string]any{
+                "text":   msg.Title,
+                "blocks": []any{section},
+        }
+}
+
+// discordBody renders an embed, attaching a small JPEG of an image receipt as its
+// thumbnail so the channel shows it without access to the files
+func discordBody(msg chatMessage) ([]byte, string, error) {
+        embed := map[string]any{
+                "title":     msg.Title,
+                "color":     discordColorFiled,
+                "timestamp": time.Now().Format(time.RFC3339),
+        }
+        if msg.Failure {
+                embed["color"] = discordColorFailed
+        }
+        if msg.Link != "" {
+                embed["url"] = msg.Link
+        }
+        var fields []map[string]any
+        for _, field := range msg.Fields {
+                fields = append(fields, map[string]any{"name": field.Name, "value": field.Value, "inline": field.Name != "Error" && field.Name != "File"})
+        }
+        embed["fields"] = fields
+
+        payload := map[string]any{"embeds": []any{embed}}
+        var thumbnail []byte
+        if msg.Image != "" {
+                var err error
+                if thumbnail, err = makeThumbnail(msg.Image); err != nil {
+                        slog.Debug("No thumbnail for notification", "path", msg.Image, "error", err)
+                }
+        }
+        if thumbnail != nil {
+                embed["thumbnail"] = map[string]string{"url": "attachment://thumbnail.jpg"}
+                payload["attachments"] = []any{map[string]any{"id": 0, "filename": "thumbnail.jpg"}}
+        }
+
+        payloadJSON, err := json.Marshal(payload)
+        if err != nil {
+                return nil, "", err
+        }
+        if thumbnail == nil {
+                return payloadJSON, "application/json", nil
+        }
+
+        var body bytes.Buffer
+        w := multipart.NewWriter(&body)
+        if err := w.WriteField("payload_json", string(payloadJSON)); err != nil {
+                return nil, "", err
+        }
+        part, err := w.CreateFormFile("files[0]", "thumbnail.jpg")
+        if err != nil {
+                return nil, "", err
+        }
+        if _, err := part.Write(thumbnail); err != nil {
+                return nil, "", err
+        }
+        if err := w.Close(); err != nil {
+                return nil, "", err
+        }
+        return body.Bytes(), w.FormDataContentType(), nil
+}
+
+// makeThumbnail shrinks a JPEG or PNG receipt to at most thumbnailSize pixels a side
+func makeThumbnail(path string) ([]byte, error) {
+        if format := mediaType(path); format != "image/jpeg" && format != "image/png" {
+                return nil, nil
+        }
+        f, err := os.Open(path)
+        if err != nil {
+                return nil, err
+        }
+        defer f.Close()
+        img, _, err := image.Decode(f)
+        if err != nil {
+                return nil, fmt.Errorf("failed to decode image: %w", err)
+        }
+
+        b := img.Bounds()
+        if longest := max(b.Dx(), b.Dy()); longest > thumbnailSize {
+                img = shrinkRGBA(img, max(b.Dx()*thumbnailSize/longest, 1), max(b.Dy()*thumbnailSize/longest, 1))
+        }
+        var out bytes.Buffer
+        if err := jpeg.Encode(&out, img, &jpeg.Options{Quality: 80}); err != nil {
+                return nil, err
+        }
+        return out.Bytes(), nil
+}
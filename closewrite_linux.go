@@ -0,0 +1,131 @@
+//go:build linux
+
+package main
+
+import (
+        "bytes"
+        "context"
+        "errors"
+        "fmt"
+        "log/slog"
+        "os"
+        "path/filepath"
+        "sync"
+        "time"
+        "unsafe"
+
+        "golang.org/x/sys/unix"
+)
+
+// closeWriteWatcher listens for IN_CLOSE_WRITE and IN_MOVED_TO, which fsnotify doesn't
+// expose. Either one means the writer is done with the file, so the size polling in
+// waitForStableFile can be skipped.
+type closeWriteWatcher struct {
+        file *os.File
+
+        mu     sync.Mutex
+        dirs   map[int]string
+        closed map[string]time.Time
+}
+
+// closedRetention bounds how long a close is remembered for a file nobody asked about
+const closedRetention = time.Hour
+
+// newCloseWriteWatcher starts listening; the inotify descriptor is closed, and the reader
+// stops, once ctx is done
+func newCloseWriteWatcher(ctx context.Context) (*closeWriteWatcher, error) {
+        // Non-blocking, so reads go through the runtime poller and closing the file ends them
+        fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+        if err != nil {
+                return nil, fmt.Errorf("inotify unavailable: %w", err)
+        }
+
+        w := &closeWriteWatcher{file: os.NewFile(uintptr(fd), "inotify"), dirs: map[int]string{}, closed: map[string]time.Time{}}
+        go w.run()
+        go func() {
+                <-ctx.Done()
+                w.file.Close()
+        }()
+        return w, nil
+}
+
+// Add starts listening for completed writes in dir. It is a no-op on a nil watcher.
+func (w *closeWriteWatcher) Add(dir string) error {
+        if w == nil {
+                return nil
+        }
+
+        // Through the file, so a watcher that has been closed fails instead of a reused fd
+        conn, err := w.file.SyscallConn()
+        if err != nil {
+                return fmt.Errorf("failed to add inotify watch on %s: %w", dir, err)
+        }
+        var wd int
+        if ctrlErr := conn.Control(func(fd uintptr) {
+                wd, err = unix.InotifyAddWatch(int(fd), dir, unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO)
+        }); ctrlErr != nil {
+                err = ctrlErr
+        }
+        if err != nil {
+                return fmt.Errorf("failed to add inotify watch on %s: %w", dir, err)
+        }
+
+        w.mu.Lock()
+        w.dirs[wd] = dir
+        w.mu.Unlock()
+        return nil
+}
+
+// ClosedSince reports whether path was closed after writing (or moved into place)
+// no earlier than t, usually the file's modification time
+func (w *closeWriteWatcher) ClosedSince(path string, t time.Time) bool {
+        if w == nil {
+                return false
+        }
+
+        w.mu.Lock()
+        defer w.mu.Unlock()
+
+        closedAt, ok := w.closed[path]
+        return ok && !closedAt.Before(t)
+}
+
+func (w *closeWriteWatcher) run() {
+        var buf [unix.SizeofInotifyEvent * 4096]byte
+        for {
+                n, err := w.file.Read(buf[:])
+                if errors.Is(err, os.ErrClosed) || errors.Is(err, unix.EBADF) || errors.Is(err, unix.EINTR) {
+                        return
+                }
+                if err != nil {
+                        slog.Error("Close-write watcher stopped", "error", err)
+                        return
+                }
+
+                now := time.Now()
+                w.mu.Lock()
+                for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+                        event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+                        nameStart := offset + unix.SizeofInotifyEvent
+                        offset = nameStart + int(event.Len)
+
+                        if event.Mask&unix.IN_IGNORED != 0 {
+                                delete(w.dirs, int(event.Wd))
+                                continue
+                        }
+                        dir, ok := w.dirs[int(event.Wd)]
+                        if !ok || event.Len == 0 || offset > n {
+                                continue
+                        }
+                        name := string(bytes.TrimRight(buf[nameStart:offset], "\x00"))
+                        w.closed[filepath.Join(dir, name)] = now
+                }
+
+                for path, closedAt := range w.closed {
+                        if now.Sub(closedAt) > closedRetention {
+                                delete(w.closed, path)
+                        }
+                }
+                w.mu.Unlock()
+        }
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+
+package main
+
+import (
+        "context"
+        "errors"
+        "time"
+)
+
+// closeWriteWatcher is Linux-only; elsewhere waitForStableFile always polls the size
+type closeWriteWatcher struct{}
+
+func newCloseWriteWatcher(ctx context.Context) (*closeWriteWatcher, error) {
+        return nil, errors.New("close-write events are only available on Linux")
+}
+
+func (w *closeWriteWatcher) Add(dir string) error {
+        return nil
+}
+
+func (w *closeWriteWatcher) ClosedSince(path string, t time.Time) bool {
+        return false
+}
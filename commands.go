@@ -0,0 +1,320 @@
+package main
+
+import (
+        "flag"
+        "fmt"
+        "log"
+        "os"
+        "runtime"
+        "runtime/debug"
+        "slices"
+        "strconv"
+        "strings"
+        "time"
+)
+
+// version is set at build time with -ldflags "-X main.version=v1.2.3"
+var version = "dev"
+
+// commandUsage lists the subcommands for -help. Each command accepts only the flags it
+// uses; the flags that select a mode (-file, -expense-report, -retry-failed, ...) keep
+// working without a command, where every flag is accepted, so existing scripts and
+// service files are unaffected.
+const commandUsage = `Usage: scanner-bot [command] [flags] [arguments]
+
+Commands:
+  watch                      Watch -watch directories and file new receipts (the default)
+  process <file|dir>         Process one file, or every file now in a directory, and exit
+  report expense <name>      Build an expense report under dest/reports
+  report medical [-year N]   Write the medical expense deduction summary (last year by default)
+  report spending <period>   Print totals per category and vendor (YYYY-MM, YYYY, month, or year)
+  report annual <year>       Write the annual PDF summary
+  report summary             Print spend per category per month from -db
+  report cost                Print model usage and cost from -db
+  report digest              Send the -digest email now
+  export <format>            Export journal entries for freee, moneyforward, or yayoi
+  reprocess <path|id>        Analyze a filed receipt again and re-file it under its new values
+  retry-failed               Move quarantined files back to their watch directory
+  doctor                     Check the configuration and environment, then exit
+  version                    Print the version and exit
+
+Run "scanner-bot <command> -help" for the flags a command accepts.
+
+Flags without a command:
+`
+
+// commands are the names parseCommandLine accepts as the first argument
+var commands = []string{"watch", "process", "report", "export", "reprocess", "retry-failed", "doctor", "version", "help"}
+
+// commandForms are the usage lines of the commands, with reports under "report <kind>"
+var commandForms = map[string]string{
+        "watch":           "watch [flags]",
+        "process":         "process [flags] <file or directory>",
+        "export":          "export [flags] <freee|moneyforward|yayoi>",
+        "reprocess":       "reprocess [flags] <original, processed copy, or journal id>",
+        "retry-failed":    "retry-failed [flags]",
+        "doctor":          "doctor [flags]",
+        "version":         "version",
+        "help":            "help",
+        "report":          "report <expense|medical|spending|annual|summary|cost|digest> [flags] [argument]",
+        "report expense":  "report expense [flags] <name>",
+        "report medical":  "report medical [-year N] [flags]",
+        "report spending": "report spending [flags] <YYYY-MM|YYYY|month|year>",
+        "report annual":   "report annual [flags] <year>",
+        "report summary":  "report summary [flags]",
+        "report cost":     "report cost [flags]",
+        "report digest":   "report digest [flags]",
+}
+
+var (
+        // sharedFlags are accepted by every command but help and version
+        sharedFlags = []string{"config", "dest", "db", "provider", "dry-run", "timezone", "default-currency", "log-format", "log-level"}
+
+        // modeFlags select what to do when no command is given; each has a command instead
+        modeFlags = []string{"file", "reprocess", "retry-failed", "expense-report", "accounting-export", "medical-report",
+                "spending-report", "export-annual-pdf", "db-summary", "cost-report", "send-digest"}
+
+        // watchFlags only matter to a running watcher
+        watchFlags = []string{"watch", "poll-watch", "poll-watch-interval", "scan-existing", "debounce", "max-failures",
+                "retry-delay", "tui", "imap-url", "gmail", "mail-from", "mail-subject", "mail-attachment", "mail-interval",
+                "mail-max-age", "upload-addr", "upload-max-size", "dashboard-addr", "api-addr", "grpc-addr", "digest-time"}
+
+        // digestFlags are read by the watcher's scheduled digest and by report digest
+        digestFlags = []string{"digest", "digest-to", "digest-from", "smtp-host", "smtp-port", "smtp-user"}
+
+        // reportFlags are read only by the report and export commands
+        reportFlags = []string{"report-from", "report-to", "report-tags", "accounting-out", "account-map",
+                "medical-patient", "medical-category", "spending-format", "spending-out", "fiscal-year-start"}
+)
+
+// commandFlags returns the flags of a command besides sharedFlags. Analysis and filing
+// flags are every top-level flag not in one of the groups above, so a new flag reaches
+// watch, process, reprocess, and doctor without being listed here.
+func commandFlags(key string) []string {
+        var analysis, all []string
+        grouped := slices.Concat(sharedFlags, modeFlags, watchFlags, digestFlags, reportFlags)
+        flag.VisitAll(func(f *flag.Flag) {
+                if !slices.Contains(sharedFlags, f.Name) && !slices.Contains(modeFlags, f.Name) {
+                        all = append(all, f.Name)
+                }
+                if !slices.Contains(grouped, f.Name) {
+                        analysis = append(analysis, f.Name)
+                }
+        })
+
+        switch key {
+        case "watch":
+                return slices.Concat(analysis, watchFlags, digestFlags)
+        case "process", "reprocess":
+                return analysis
+        case "doctor":
+                // doctor checks the settings of every mode
+                return all
+        case "retry-failed":
+                return []string{"watch", "poll-watch"}
+        case "export":
+                return []string{"report-from", "report-to", "report-tags", "accounting-out", "account-map"}
+        case "report expense":
+                return []string{"report-from", "report-to", "report-tags"}
+        case "report medical":
+                return []string{"medical-patient", "medical-category"}
+        case "report spending":
+                return []string{"spending-format", "spending-out"}
+        case "report annual":
+                return []string{"fiscal-year-start"}
+        case "report digest":
+                return digestFlags
+        }
+        return nil
+}
+
+// newCommandFlagSet builds the flag set of a command from the top-level flags of the same
+// names, sharing their values so main and -config see what the command line set
+func newCommandFlagSet(key string) *flag.FlagSet {
+        set := flag.NewFlagSet("scanner-bot "+key, flag.ExitOnError)
+        set.SetOutput(flag.CommandLine.Output())
+        addFlags := func(names []string) {
+                for _, name := range names {
+                        f := flag.Lookup(name)
+                        set.Var(f.Value, f.Name, f.Usage)
+                        set.Lookup(name).DefValue = f.DefValue
+                }
+        }
+        if key != "version" && key != "help" {
+                addFlags(sharedFlags)
+        }
+        addFlags(commandFlags(key))
+        // -year belongs to report medical alone; -medical-report is its top-level form
+        if key == "report medical" {
+                set.IntVar(&medicalReportYear, "year", time.Now().Year()-1, "Calendar year to total")
+        }
+
+        set.Usage = func() {
+                fmt.Fprintf(set.Output(), "Usage: scanner-bot %s\n", commandForms[key])
+                if key != "version" && key != "help" {
+                        fmt.Fprint(set.Output(), "\nFlags:\n")
+                        set.PrintDefaults()
+                }
+        }
+        return set
+}
+
+// positionalArgs returns the arguments that are neither flags nor flag values, telling
+// the two apart by the top-level flags, so the command can be found before its flag set
+// is chosen. It stops at a flag no mode defines, leaving that error to the flag set.
+func positionalArgs(args []string) []string {
+        var positional []string
+        for i := 0; i < len(args); i++ {
+                arg := args[i]
+                if !strings.HasPrefix(arg, "-") || arg == "-" {
+                        positional = append(positional, arg)
+                        continue
+                }
+                name := strings.TrimLeft(arg, "-")
+                if strings.Contains(name, "=") {
+                        continue
+                }
+                f := flag.Lookup(name)
+                if f == nil {
+                        break
+                }
+                if b, ok := f.Value.(interface{ IsBoolFlag() bool }); !ok || !b.IsBoolFlag() {
+                        i++
+                }
+        }
+        return positional
+}
+
+// parseCommandLine finds the subcommand, if any, parses the flags with its flag set
+// wherever they appear, and returns the command, its arguments, and the flag set, so
+// "report spending 2024-05 -db receipts.db" works as well as flags first. A flag the
+// command does not use is an error, as is an unknown command.
+func parseCommandLine(args []string) (string, []string, *flag.FlagSet) {
+        set := flag.CommandLine
+        if words := positionalArgs(args); len(words) > 0 {
+                key := words[0]
+                if !slices.Contains(commands, key) {
+                        fmt.Fprintf(flag.CommandLine.Output(), "Unknown command %q\n\n", key)
+                        flag.Usage()
+                        os.Exit(2)
+                }
+                if key == "report" && len(words) > 1 {
+                        key += " " + words[1]
+                        if _, ok := commandForms[key]; !ok {
+                                fmt.Fprintf(flag.CommandLine.Output(), "Unknown report %q (expected expense, medical, spending, annual, summary, cost, or digest)\n\n", words[1])
+                                fmt.Fprintf(flag.CommandLine.Output(), "Usage: scanner-bot %s\n", commandForms["report"])
+                                os.Exit(2)
+                        }
+                }
+                set = newCommandFlagSet(key)
+                flag.Usage = set.Usage
+        }
+
+        var positional []string
+        for {
+                // Parse exits on a bad flag under flag.ExitOnError
+                set.Parse(args)
+                args = set.Args()
+                if len(args) == 0 {
+                        break
+                }
+                positional = append(positional, args[0])
+                args = args[1:]
+        }
+        if len(positional) == 0 {
+                return "", nil, set
+        }
+        return positional[0], positional[1:], set
+}
+
+// usage prints the commands followed by the flags
+func usage() {
+        fmt.Fprint(flag.CommandLine.Output(), commandUsage)
+        flag.PrintDefaults()
+}
+
+// applyCommand turns a subcommand and its arguments into the mode flags main acts on
+func applyCommand(command string, args []string) {
+        key := command
+        if command == "report" && len(args) > 0 {
+                key += " " + args[0]
+                args = args[1:]
+        }
+        want := func(n int) {
+                if len(args) != n {
+                        flag.Usage()
+                        log.Fatalf("Usage: scanner-bot %s", commandForms[key])
+                }
+        }
+
+        switch key {
+        case "", "watch":
+                want(0)
+        case "process":
+                want(1)
+                singleFile = args[0]
+        case "export":
+                want(1)
+                accountingExport = args[0]
+        case "reprocess":
+                want(1)
+                reprocess = args[0]
+        case "retry-failed":
+                want(0)
+                retryFailedRun = true
+        case "report":
+                flag.Usage()
+                log.Fatalf("Usage: scanner-bot %s", commandForms[key])
+        case "report expense":
+                want(1)
+                expenseReport = args[0]
+        case "report medical":
+                // The year may also follow the command, as in earlier releases
+                if len(args) > 0 {
+                        want(1)
+                        medicalReportYear = commandYear(args[0])
+                } else if medicalReportYear < 1000 || medicalReportYear > 9999 {
+                        log.Fatalf("Invalid -year %d", medicalReportYear)
+                }
+        case "report spending":
+                want(1)
+                spendingReport = args[0]
+        case "report annual":
+                want(1)
+                exportAnnualYear = commandYear(args[0])
+        case "report summary":
+                want(0)
+                dbSummary = true
+        case "report cost":
+                want(0)
+                costReport = true
+        case "report digest":
+                want(0)
+                sendDigestNow = true
+        }
+}
+
+func commandYear(value string) int {
+        year, err := strconv.Atoi(value)
+        if err != nil || year < 1000 || year > 9999 {
+                log.Fatalf("Invalid year %q", value)
+        }
+        return year
+}
+
+// versionString describes the build: -ldflags version, or the module version and VCS
+// revision Go embeds
+func versionString() string {
+        v := version
+        if info, ok := debug.ReadBuildInfo(); ok && v == "dev" {
+                if info.Main.Version != "" && info.Main.Version != "(devel)" {
+                        v = info.Main.Version
+                }
+                for _, setting := range info.Settings {
+                        if setting.Key == "vcs.revision" && len(setting.Value) >= 12 {
+                                v += " (" + setting.Value[:12] + ")"
+                        }
+                }
+        }
+        return fmt.Sprintf("scanner-bot %s %s %s/%s", v, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+        "encoding/json"
+        "fmt"
+        "sort"
+        "strconv"
+        "strings"
+)
+
+// confidenceFields are the fields the model is asked to score with -min-confidence
+var confidenceFields = []string{"date", "vendor", "category", "total_amount"}
+
+// Confidence maps a field name to the model's own 0-1 estimate that it read it correctly
+type Confidence map[string]float64
+
+// UnmarshalJSON accepts numbers, numeric strings, and percentages (95 or "95%"),
+// since models are not consistent about the scale
+func (c *Confidence) UnmarshalJSON(b []byte) error {
+        var raw map[string]any
+        if err := json.Unmarshal(b, &raw); err != nil {
+                return err
+        }
+        scores := Confidence{}
+        for field, value := range raw {
+                var score float64
+                switch v := value.(type) {
+                case float64:
+                        score = v
+                case string:
+                        s := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(v), "%"))
+                        parsed, err := strconv.ParseFloat(s, 64)
+                        if err != nil {
+                                return fmt.Errorf("invalid confidence %q for %s", v, field)
+                        }
+                        score = parsed
+                case nil:
+                        continue
+                default:
+                        return fmt.Errorf("invalid confidence for %s", field)
+                }
+                if score > 1 && score <= 100 {
+                        score /= 100
+                }
+                scores[field] = score
+        }
+        *c = scores
+        return nil
+}
+
+// lowConfidence lists the scored fields below -min-confidence, in a stable order
+func lowConfidence(c Confidence) []string {
+        var problems []string
+        fields := make([]string, 0, len(c))
+        for field := range c {
+                fields = append(fields, field)
+        }
+        sort.Strings(fields)
+        for _, field := range fields {
+                if score := c[field]; score < minConfidence {
+                        problems = append(problems, fmt.Sprintf("%s confidence %.2f is below -min-confidence %.2f", field, score, minConfidence))
+                }
+        }
+        return problems
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+        "flag"
+        "fmt"
+        "os"
+        "path/filepath"
+        "sort"
+        "strings"
+
+        "github.com/BurntSushi/toml"
+        "gopkg.in/yaml.v3"
+)
+
+// applyConfigFile loads a YAML or TOML file whose keys are flag names (without the dash)
+// and applies each value unless that flag was given explicitly in commandLine, the flag
+// set the command line was parsed with. A file may hold settings for any command.
+// Lists are joined with commas, so `categories: [Medical, Grocery]` works like -categories.
+func applyConfigFile(path string, commandLine *flag.FlagSet) error {
+        content, err := os.ReadFile(path)
+        if err != nil {
+                return fmt.Errorf("error reading config: %w", err)
+        }
+
+        values := map[string]any{}
+        switch strings.ToLower(filepath.Ext(path)) {
+        case ".toml":
+                err = toml.Unmarshal(content, &values)
+        case ".yaml", ".yml":
+                err = yaml.Unmarshal(content, &values)
+        default:
+                return fmt.Errorf("config %s: unknown format (use .yaml, .yml, or .toml)", path)
+        }
+        if err != nil {
+                return fmt.Errorf("error parsing config %s: %w", path, err)
+        }
+
+        explicit := map[string]bool{}
+        commandLine.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+        // Sorted so errors are reported deterministically
+        keys := make([]string, 0, len(values))
+        for key := range values {
+                keys = append(keys, key)
+        }
+        sort.Strings(keys)
+
+        for _, key := range keys {
+                if key == "config" || flag.Lookup(key) == nil {
+                        return fmt.Errorf("config %s: unknown setting %q", path, key)
+                }
+                if explicit[key] {
+                        continue
+                }
+                if err := flag.Set(key, configValueString(values[key])); err != nil {
+                        return fmt.Errorf("config %s: invalid value for %q: %w", path, key, err)
+                }
+        }
+        return nil
+}
+
+func configValueString(value any) string {
+        switch v := value.(type) {
+        case []any:
+                parts := make([]string, len(v))
+                for i, item := range v {
+                        parts[i] = fmt.Sprint(item)
+                }
+                return strings.Join(parts, ",")
+        default:
+                return fmt.Sprint(v)
+        }
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+        "bytes"
+        "context"
+        "fmt"
+        "log/slog"
+        "os"
+        "os/exec"
+        "path/filepath"
+        "sort"
+        "strings"
+)
+
+// convertTargets are the formats converted before analysis, and what they become:
+// single images to JPEG, and TIFF, which flatbed scanners write with several pages, to PDF
+var convertTargets = map[string]string{
+        "image/heic": ".jpg",
+        "image/heif": ".jpg",
+        "image/webp": ".jpg",
+        "image/tiff": ".pdf",
+}
+
+// heifBrands are the ISO-BMFF major brands used by HEIC and HEIF still images
+var heifBrands = []string{"heic", "heix", "heim", "heis", "hevc", "hevx", "mif1", "msf1"}
+
+// sniffConvertible recognises the formats http.DetectContentType does not
+func sniffConvertible(head []byte) string {
+        switch {
+        case bytes.HasPrefix(head, []byte("II*\x00")), bytes.HasPrefix(head, []byte("MM\x00*")):
+                return "image/tiff"
+        case len(head) >= 12 && string(head[4:8]) == "ftyp":
+                brand := string(head[8:12])
+                for _, heif := range heifBrands {
+                        if brand == heif {
+                                if brand == "mif1" || brand == "msf1" {
+                                        return "image/heif"
+                                }
+                                return "image/heic"
+                        }
+                }
+        }
+        return ""
+}
+
+// convertForAnalysis converts a HEIC, WebP, or TIFF file with -convert-command
+// (ImageMagick) into a temp directory, keeping the file's base name so processed
+// copies are named as usual. The caller removes the directory when done.
+func convertForAnalysis(ctx context.Context, path, detected string) (string, string, error) {
+        ext := convertTargets[detected]
+        dir, err := os.MkdirTemp("", "scanner-bot-convert-*")
+        if err != nil {
+                return "", "", err
+        }
+        out := filepath.Join(dir, strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))+ext)
+
+        // Images keep only their primary frame; every TIFF page becomes a PDF page
+        args := []string{path + "[0]", "-auto-orient", "-quality", "90", out}
+        if ext == ".pdf" {
+                args = []string{path, out}
+        }
+
+        if err := runConvertCommand(ctx, args); err != nil {
+                os.RemoveAll(dir)
+                return "", "", fmt.Errorf("failed to convert %s with %s: %w", detected, convertCommand, err)
+        }
+
+        slog.Info("Converted file for analysis", "path", path, "from", detected, "to", ext)
+        return out, dir, nil
+}
+
+// preprocessArgs are the ImageMagick operations applied by -preprocess: rotate by the
+// EXIF orientation, straighten a tilted photo, trim the border around the paper, stretch
+// faded thermal print to full contrast, and cap the size of the upload
+var preprocessArgs = []string{
+        "-auto-orient",
+        "-deskew", "40%",
+        "-fuzz", "10%", "-trim", "+repage",
+        "-normalize",
+        "-resize", "2400x2400>",
+}
+
+// preprocessImage cleans up a JPEG or PNG photo with -convert-command into a temp
+// directory, keeping its name and format. The caller removes the directory when done.
+func preprocessImage(ctx context.Context, path string) (string, string, error) {
+        dir, err := os.MkdirTemp("", "scanner-bot-preprocess-*")
+        if err != nil {
+                return "", "", err
+        }
+        out := filepath.Join(dir, filepath.Base(path))
+
+        args := append([]string{path + "[0]"}, preprocessArgs...)
+        if mediaType(path) == "image/jpeg" {
+                args = append(args, "-quality", "85")
+        }
+        // The explicit format prefix keeps an extension-less name in the original format
+        args = append(args, strings.TrimPrefix(receiptExt(path), ".")+":"+out)
+
+        if err := runConvertCommand(ctx, args); err != nil {
+                os.RemoveAll(dir)
+                return "", "", fmt.Errorf("failed to preprocess image with %s: %w", convertCommand, err)
+        }
+        return out, dir, nil
+}
+
+// rasterizePDF renders each page of a PDF to a JPEG with -convert-command (ImageMagick,
+// through Ghostscript) for providers that only take images. It returns the pages in
+// order with the temp directory holding them, which the caller removes.
+func rasterizePDF(ctx context.Context, path string) ([]string, string, error) {
+        dir, err := os.MkdirTemp("", "scanner-bot-rasterize-*")
+        if err != nil {
+                return nil, "", err
+        }
+
+        // 200 dpi keeps receipt print legible; transparent pages are flattened onto white
+        args := []string{"-density", "200", "pdf:" + path, "-background", "white", "-alpha", "remove", "-quality", "90", filepath.Join(dir, "page-%03d.jpg")}
+        if err := runConvertCommand(ctx, args); err != nil {
+                os.RemoveAll(dir)
+                return nil, "", fmt.Errorf("failed to render PDF pages with %s: %w", convertCommand, err)
+        }
+
+        pages, err := filepath.Glob(filepath.Join(dir, "page-*.jpg"))
+        if err != nil || len(pages) == 0 {
+                os.RemoveAll(dir)
+                return nil, "", fmt.Errorf("%s rendered no pages", convertCommand)
+        }
+        sort.Strings(pages)
+        return pages, dir, nil
+}
+
+// runConvertCommand runs -convert-command, adding its error output to a failure
+func runConvertCommand(ctx context.Context, args []string) error {
+        var stderr bytes.Buffer
+        cmd := exec.CommandContext(ctx, convertCommand, args...)
+        cmd.Stderr = &stderr
+        if err := cmd.Run(); err != nil {
+                if msg := strings.TrimSpace(stderr.String()); msg != "" {
+                        err = fmt.Errorf("%w: %s", err, msg)
+                }
+                return err
+        }
+        return nil
+}
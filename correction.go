@@ -0,0 +1,39 @@
+package main
+
+import (
+        "fmt"
+        "log/slog"
+)
+
+// maxQuotedOutput caps how much of an invalid answer is quoted back to the model
+const maxQuotedOutput = 4000
+
+// correctionPrompt is the follow-up turn sent after an answer that could not be parsed
+func correctionPrompt(invalid string) string {
+        if len(invalid) > maxQuotedOutput {
+                invalid = invalid[:maxQuotedOutput] + "…"
+        }
+        return fmt.Sprintf(`Your previous answer could not be parsed as JSON:
+
+%s
+
+Reply again with only the corrected JSON, using the same keys as requested. Do not add code fences, comments, or any other text.`, invalid)
+}
+
+// parseWithCorrection parses the model's answer and, while it is not valid receipt JSON,
+// asks the model to correct it, up to -json-retries times. ask continues the same
+// conversation with the invalid answer and the correction prompt and returns the reply.
+func parseWithCorrection(path, text string, ask func(invalid, correction string) (string, error)) ([]ReceiptData, error) {
+        dataList, err := parseReceiptResponse(text)
+        for attempt := 1; err != nil && attempt <= jsonRetries; attempt++ {
+                slog.Warn("Model returned invalid JSON, asking it to correct it", "path", path, "attempt", attempt, "max_attempts", jsonRetries, "error", err)
+
+                reply, askErr := ask(text, correctionPrompt(text))
+                if askErr != nil {
+                        return nil, fmt.Errorf("correction request failed: %w", askErr)
+                }
+                text = reply
+                dataList, err = parseReceiptResponse(text)
+        }
+        return dataList, err
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+        "fmt"
+        "image"
+        "image/jpeg"
+        "image/png"
+        "log/slog"
+        "os"
+        "path/filepath"
+)
+
+// cropMargin pads each crop, as a fraction of the image, so edges the model placed
+// tightly are not cut off
+const cropMargin = 0.01
+
+// BoundingBox is where one receipt lies in a photo of several, as fractions of the
+// image width and height from the top left corner
+type BoundingBox struct {
+        Left   float64 `json:"left"`
+        Top    float64 `json:"top"`
+        Right  float64 `json:"right"`
+        Bottom float64 `json:"bottom"`
+}
+
+// rect converts the box to pixels within bounds, padded by cropMargin. Some models answer
+// on a 0-1000 scale instead of fractions, which is accepted too. It reports false for a
+// box that is missing, inverted, or too small to hold a receipt.
+func (b BoundingBox) rect(bounds image.Rectangle) (image.Rectangle, bool) {
+        scale := 1.0
+        if max(b.Left, b.Top, b.Right, b.Bottom) > 1 {
+                scale = 1000
+        }
+        left, top, right, bottom := b.Left/scale-cropMargin, b.Top/scale-cropMargin, b.Right/scale+cropMargin, b.Bottom/scale+cropMargin
+        if right-left < 0.05 || bottom-top < 0.05 {
+                return image.Rectangle{}, false
+        }
+
+        width, height := float64(bounds.Dx()), float64(bounds.Dy())
+        r := image.Rect(
+                bounds.Min.X+int(left*width), bounds.Min.Y+int(top*height),
+                bounds.Min.X+int(right*width), bounds.Min.Y+int(bottom*height),
+        ).Intersect(bounds)
+        return r, !r.Empty()
+}
+
+// cropReceiptImages writes each receipt's region of a photo of several receipts to its
+// own file in a temp directory, which the caller removes. The returned paths line up
+// with dataList; a receipt without a usable box gets "" and is filed as the whole image.
+func cropReceiptImages(path string, dataList []ReceiptData) ([]string, string, error) {
+        format := mediaType(path)
+        if format != "image/jpeg" && format != "image/png" {
+                return nil, "", nil
+        }
+
+        f, err := os.Open(path)
+        if err != nil {
+                return nil, "", err
+        }
+        defer f.Close()
+        img, _, err := image.Decode(f)
+        if err != nil {
+                return nil, "", fmt.Errorf("failed to decode image: %w", err)
+        }
+        sub, ok := img.(interface {
+                SubImage(image.Rectangle) image.Image
+        })
+        if !ok {
+                return nil, "", fmt.Errorf("cannot crop %T images", img)
+        }
+
+        dir, err := os.MkdirTemp("", "scanner-bot-crop-*")
+        if err != nil {
+                return nil, "", err
+        }
+        crops := make([]string, len(dataList))
+        for i, data := range dataList {
+                if data.BoundingBox == nil {
+                        slog.Warn("No bounding box for receipt, filing the whole image", "path", path, "receipt", i+1)
+                        continue
+                }
+                r, ok := data.BoundingBox.rect(img.Bounds())
+                if !ok {
+                        slog.Warn("Unusable bounding box for receipt, filing the whole image", "path", path, "receipt", i+1, "box", *data.BoundingBox)
+                        continue
+                }
+
+                cropPath := filepath.Join(dir, fmt.Sprintf("receipt-%d%s", i+1, receiptExt(path)))
+                if err := writeCrop(cropPath, format, sub.SubImage(r)); err != nil {
+                        os.RemoveAll(dir)
+                        return nil, "", err
+                }
+                crops[i] = cropPath
+        }
+        return crops, dir, nil
+}
+
+// writeCrop encodes a cropped region in the format of the photo it came from
+func writeCrop(path, format string, img image.Image) error {
+        out, err := os.Create(path)
+        if err != nil {
+                return err
+        }
+        if format == "image/png" {
+                err = png.Encode(out, img)
+        } else {
+                err = jpeg.Encode(out, img, &jpeg.Options{Quality: 92})
+        }
+        if closeErr := out.Close(); err == nil {
+                err = closeErr
+        }
+        if err != nil {
+                return fmt.Errorf("failed to write crop: %w", err)
+        }
+        return nil
+}
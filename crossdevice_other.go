@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import (
+        "errors"
+        "syscall"
+)
+
+// isCrossDevice reports whether a rename failed because src and dst are on different
+// filesystems, which robustMove handles by copying instead
+func isCrossDevice(err error) bool {
+        return errors.Is(err, syscall.EXDEV)
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+
+package main
+
+import "syscall"
+
+// crossDeviceErrno is what a rename across filesystems fails with here
+const crossDeviceErrno = syscall.EXDEV
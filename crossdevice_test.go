@@ -0,0 +1,84 @@
+package main
+
+import (
+        "errors"
+        "os"
+        "path/filepath"
+        "syscall"
+        "testing"
+)
+
+// crossDeviceRename fails the way os.Rename does when dst is on another filesystem
+func crossDeviceRename(t *testing.T) {
+        t.Helper()
+        renameFile = func(src, dst string) error {
+                return &os.LinkError{Op: "rename", Old: src, New: dst, Err: crossDeviceErrno}
+        }
+        t.Cleanup(func() { renameFile = os.Rename })
+}
+
+func TestIsCrossDevice(t *testing.T) {
+        tests := []struct {
+                name string
+                err  error
+                want bool
+        }{
+                {"link error", &os.LinkError{Op: "rename", Old: "a", New: "b", Err: crossDeviceErrno}, true},
+                {"bare errno", crossDeviceErrno, true},
+                {"missing file", &os.LinkError{Op: "rename", Old: "a", New: "b", Err: syscall.ENOENT}, false},
+                {"other error", errors.New("invalid cross-device link"), false},
+                {"nil", nil, false},
+        }
+        for _, tt := range tests {
+                if got := isCrossDevice(tt.err); got != tt.want {
+                        t.Errorf("%s: isCrossDevice(%v) = %v, want %v", tt.name, tt.err, got, tt.want)
+                }
+        }
+}
+
+func TestRobustMoveCopiesAcrossDevices(t *testing.T) {
+        crossDeviceRename(t)
+        dir := t.TempDir()
+        src, dst := filepath.Join(dir, "scan.jpg"), filepath.Join(dir, "filed.jpg")
+        if err := os.WriteFile(src, []byte("receipt"), 0644); err != nil {
+                t.Fatal(err)
+        }
+
+        if err := robustMove(src, dst); err != nil {
+                t.Fatalf("robustMove: %v", err)
+        }
+        if content, err := os.ReadFile(dst); err != nil || string(content) != "receipt" {
+                t.Errorf("destination = %q, %v; want the source content", content, err)
+        }
+        if _, err := os.Stat(src); !os.IsNotExist(err) {
+                t.Errorf("source still exists after the move: %v", err)
+        }
+        if tmps, _ := filepath.Glob(filepath.Join(dir, ".*.tmp")); len(tmps) > 0 {
+                t.Errorf("temp files left behind: %v", tmps)
+        }
+}
+
+func TestRobustMoveKeepsSourceWhenCopyFails(t *testing.T) {
+        crossDeviceRename(t)
+        dir := t.TempDir()
+        src := filepath.Join(dir, "scan.jpg")
+        if err := os.WriteFile(src, []byte("receipt"), 0644); err != nil {
+                t.Fatal(err)
+        }
+
+        // The destination folder doesn't exist, so the copy cannot be written
+        if err := robustMove(src, filepath.Join(dir, "missing", "filed.jpg")); err == nil {
+                t.Fatal("robustMove succeeded, want the copy error")
+        }
+        if content, err := os.ReadFile(src); err != nil || string(content) != "receipt" {
+                t.Errorf("source = %q, %v; want it left intact", content, err)
+        }
+}
+
+func TestRobustMoveReturnsOtherRenameErrors(t *testing.T) {
+        dir := t.TempDir()
+        err := robustMove(filepath.Join(dir, "missing.jpg"), filepath.Join(dir, "filed.jpg"))
+        if !os.IsNotExist(err) {
+                t.Errorf("robustMove of a missing file = %v, want a not-exist error", err)
+        }
+}
@@ -0,0 +1,18 @@
+//go:build windows
+
+package main
+
+import (
+        "errors"
+        "syscall"
+)
+
+// errorNotSameDevice is ERROR_NOT_SAME_DEVICE, which MoveFileEx returns when the
+// destination is on another volume
+const errorNotSameDevice syscall.Errno = 17
+
+// isCrossDevice reports whether a rename failed because src and dst are on different
+// volumes, which robustMove handles by copying instead
+func isCrossDevice(err error) bool {
+        return errors.Is(err, errorNotSameDevice)
+}
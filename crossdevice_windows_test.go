@@ -0,0 +1,6 @@
+//go:build windows
+
+package main
+
+// crossDeviceErrno is what a rename across volumes fails with here
+const crossDeviceErrno = errorNotSameDevice
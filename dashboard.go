@@ -0,0 +1,469 @@
+package main
+
+import (
+        "context"
+        "crypto/subtle"
+        "errors"
+        "fmt"
+        "html/template"
+        "log/slog"
+        "net/http"
+        "net/url"
+        "os"
+        "path/filepath"
+        "strconv"
+        "strings"
+        "sync"
+        "time"
+)
+
+// dashboardListLimit bounds the receipts listed on one page; search narrows it down
+const dashboardListLimit = 500
+
+// dashboardMu serializes edits, so two saves of one receipt never move it twice
+var dashboardMu sync.Mutex
+
+// startDashboard serves the receipt dashboard on addr in the background. Requests must
+// carry HTTP Basic credentials with DASHBOARD_PASSWORD as the password; the user name
+// is not checked.
+func startDashboard(addr, password string) *http.Server {
+        mux := http.NewServeMux()
+        mux.HandleFunc("GET /{$}", handleDashboardList)
+        mux.HandleFunc("GET /receipts/{id}", handleDashboardReceipt)
+        mux.HandleFunc("POST /receipts/{id}", handleDashboardEdit)
+        mux.HandleFunc("GET /receipts/{id}/file", handleDashboardFile)
+        mux.HandleFunc("GET /review", handleReviewQueue)
+        mux.HandleFunc("GET /review/item", handleReviewItem)
+        mux.HandleFunc("GET /review/file", handleReviewFile)
+        mux.HandleFunc("POST /review/approve", handleReviewApprove)
+        mux.HandleFunc("POST /review/reject", handleReviewReject)
+
+        srv := &http.Server{Addr: addr, Handler: dashboardAuth(password, mux), ReadHeaderTimeout: 10 * time.Second}
+        go func() {
+                if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+                        slog.Error("Dashboard server error", "error", err)
+                }
+        }()
+
+        slog.Info("Serving dashboard", "addr", addr)
+        return srv
+}
+
+// stopDashboard gives requests in progress a few seconds to finish
+func stopDashboard(srv *http.Server) {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        if err := srv.Shutdown(ctx); err != nil {
+                slog.Warn("Dashboard server shutdown error", "error", err)
+        }
+}
+
+// dashboardAuth checks the password, and refuses edits posted from pages on other sites,
+// which browsers would otherwise send with the saved credentials
+func dashboardAuth(password string, next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                _, given, ok := r.BasicAuth()
+                if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(password)) != 1 {
+                        w.Header().Set("WWW-Authenticate", `Basic realm="scanner-bot", charset="UTF-8"`)
+                        http.Error(w, "unauthorized", http.StatusUnauthorized)
+                        return
+                }
+                if r.Method != http.MethodGet && r.Method != http.MethodHead {
+                        if origin := r.Header.Get("Origin"); origin != "" {
+                                if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+                                        http.Error(w, "cross-origin request refused", http.StatusForbidden)
+                                        return
+                                }
+                        }
+                }
+                next.ServeHTTP(w, r)
+        })
+}
+
+// handleDashboardList lists the newest receipts, optionally only those whose vendor or
+// category contains ?q=
+func handleDashboardList(w http.ResponseWriter, r *http.Request) {
+        query := strings.TrimSpace(r.URL.Query().Get("q"))
+        receipts, err := receiptDB.ListReceipts(ReceiptQuery{Search: query, Limit: dashboardListLimit})
+        if err != nil {
+                slog.Error("Failed to list receipts", "event", "dashboard", "error", err)
+                http.Error(w, err.Error(), http.StatusInternalServerError)
+                return
+        }
+        review, err := listReviewItems()
+        if err != nil {
+                slog.Warn("Failed to list review queue", "event", "dashboard", "error", err)
+        }
+        renderDashboard(w, http.StatusOK, "list", struct {
+                Query    string
+                Receipts []StoredReceipt
+                Limit    int
+                Review   int
+        }{query, receipts, dashboardListLimit, len(review)})
+}
+
+// dashboardPage is what the receipt page shows
+type dashboardPage struct {
+        Receipt    *StoredReceipt
+        Data       ReceiptData
+        History    []SidecarRevision
+        Categories []string
+        Preview    string
+        Saved      bool
+        Error      string
+}
+
+func handleDashboardReceipt(w http.ResponseWriter, r *http.Request) {
+        receipt, ok := dashboardReceipt(w, r)
+        if !ok {
+                return
+        }
+        page := newDashboardPage(receipt)
+        page.Saved = r.URL.Query().Has("saved")
+        renderDashboard(w, http.StatusOK, "receipt", page)
+}
+
+// handleDashboardEdit saves the corrected fields, re-files the processed copy under the
+// name they give it, and updates the database, journal, and ledger
+func handleDashboardEdit(w http.ResponseWriter, r *http.Request) {
+        receipt, ok := dashboardReceipt(w, r)
+        if !ok {
+                return
+        }
+        page := newDashboardPage(receipt)
+
+        data, err := parseDashboardForm(r, page.Data, "")
+        if err == nil {
+                _, err = editReceipt(receipt, data)
+        }
+        if err != nil {
+                slog.Warn("Failed to edit receipt", "event", "edit", "path", receipt.ProcessedPath, "error", err)
+                page.Data, page.Error = data, err.Error()
+                renderDashboard(w, http.StatusBadRequest, "receipt", page)
+                return
+        }
+        http.Redirect(w, r, fmt.Sprintf("/receipts/%d?saved", receipt.ID), http.StatusSeeOther)
+}
+
+// handleDashboardFile serves the archived original when the browser can show it, and
+// the processed copy otherwise
+func handleDashboardFile(w http.ResponseWriter, r *http.Request) {
+        receipt, ok := dashboardReceipt(w, r)
+        if !ok {
+                return
+        }
+        path := previewFile(receipt)
+        if path == "" {
+                http.NotFound(w, r)
+                return
+        }
+        f, err := os.Open(path)
+        if err != nil {
+                http.Error(w, err.Error(), http.StatusNotFound)
+                return
+        }
+        defer f.Close()
+        info, err := f.Stat()
+        if err != nil {
+                http.Error(w, err.Error(), http.StatusInternalServerError)
+                return
+        }
+        w.Header().Set("Content-Type", mediaType(path))
+        http.ServeContent(w, r, filepath.Base(path), info.ModTime(), f)
+}
+
+// dashboardReceipt looks up the receipt named by the request's {id}, answering 404 when
+// there is none
+func dashboardReceipt(w http.ResponseWriter, r *http.Request) (*StoredReceipt, bool) {
+        id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+        if err != nil {
+                http.NotFound(w, r)
+                return nil, false
+        }
+        receipt, err := receiptDB.Receipt(id)
+        if err != nil {
+                slog.Error("Failed to look up receipt", "event", "dashboard", "id", id, "error", err)
+                http.Error(w, err.Error(), http.StatusInternalServerError)
+                return nil, false
+        }
+        if receipt == nil {
+                http.NotFound(w, r)
+                return nil, false
+        }
+        return receipt, true
+}
+
+// newDashboardPage fills the receipt page from the sidecar when there is one, which has
+// every extracted field and the history, and from the database row otherwise
+func newDashboardPage(receipt *StoredReceipt) dashboardPage {
+        page := dashboardPage{Receipt: receipt, Data: receipt.ReceiptData, Categories: categoryList()}
+        if sidecar, ok := readSidecar(receipt.ProcessedPath); ok {
+                page.Data, page.History = sidecar.ReceiptData, sidecar.History
+        }
+        if path := previewFile(receipt); path != "" {
+                page.Preview = "image"
+                if mediaType(path) == "application/pdf" {
+                        page.Preview = "pdf"
+                }
+        }
+        return page
+}
+
+// parseDashboardForm applies the posted date, vendor, category, amount, and currency to
+// data. Forms with several receipts put prefix, such as "2.", before each field's name.
+func parseDashboardForm(r *http.Request, data ReceiptData, prefix string) (ReceiptData, error) {
+        if err := r.ParseForm(); err != nil {
+                return data, err
+        }
+        data.Date = strings.TrimSpace(r.PostFormValue(prefix + "date"))
+        data.Vendor = strings.TrimSpace(r.PostFormValue(prefix + "vendor"))
+        data.Category = strings.TrimSpace(r.PostFormValue(prefix + "category"))
+        data.Currency = strings.ToUpper(strings.TrimSpace(r.PostFormValue(prefix + "currency")))
+        amount, err := parseDecimal(strings.ReplaceAll(strings.TrimSpace(r.PostFormValue(prefix+"amount")), ",", ""))
+        if err != nil {
+                return data, fmt.Errorf("invalid amount %q", r.PostFormValue(prefix+"amount"))
+        }
+        data.Amount = amount
+        return data, checkCorrection(data)
+}
+
+// checkCorrection rejects corrected values that would not make a valid file name
+func checkCorrection(data ReceiptData) error {
+        if data.Vendor == "" || data.Category == "" || data.Currency == "" {
+                return errors.New("vendor, category, and currency are required")
+        }
+        if _, err := time.Parse("2006-01-02", data.Date); err != nil {
+                return fmt.Errorf("invalid date %q (expected YYYY-MM-DD)", data.Date)
+        }
+        return nil
+}
+
+// editReceipt re-files a receipt under corrected values. The replaced values stay in the
+// sidecar's history with the provider that produced them, and the correction is recorded
+// with "manual" as its provider.
+func editReceipt(receipt *StoredReceipt, data ReceiptData) (string, error) {
+        dashboardMu.Lock()
+        defer dashboardMu.Unlock()
+
+        dest := destRootOf(receipt.ProcessedPath)
+        if dest == "" {
+                return "", fmt.Errorf("%s is not inside a destination", receipt.ProcessedPath)
+        }
+        if _, err := os.Stat(receipt.ProcessedPath); err != nil {
+                return "", fmt.Errorf("processed copy is missing: %w", err)
+        }
+
+        sidecar, ok := readSidecar(receipt.ProcessedPath)
+        if !ok {
+                sidecar.SourceFile = receipt.SourceFile
+                sidecar.ReceiptData = receipt.ReceiptData
+        }
+        before := modelReading(sidecar)
+        sidecar.ReceiptData = data
+        sidecar.ProcessedAt = time.Now().Format(time.RFC3339)
+        sidecar.Provider, sidecar.Model, sidecar.PromptVersion = "manual", "", ""
+
+        // Names follow the original, with the extension of the processed copy
+        named := strings.TrimSuffix(sidecar.SourceFile, filepath.Ext(sidecar.SourceFile)) + filepath.Ext(receipt.ProcessedPath)
+        newPath, err := refileReceipt(receipt.ProcessedPath, named, dest, sidecar, nil, "edit")
+        if err != nil {
+                return "", err
+        }
+        if err := receiptDB.ReviseJournal(receipt.ProcessedPath, newPath, data); err != nil {
+                slog.Warn("Failed to update journal", "path", newPath, "error", err)
+        }
+        recordCorrection(sidecar.SourceSHA256, before, data)
+        return newPath, nil
+}
+
+// previewFile returns the archived original when it is a JPEG, PNG, or PDF and still
+// holds what was analyzed, the processed copy otherwise, or "" when neither is there
+func previewFile(receipt *StoredReceipt) string {
+        dest := destRootOf(receipt.ProcessedPath)
+        if dest == "" {
+                return ""
+        }
+        original := filepath.Join(dest, "originals", filepath.Base(receipt.SourceFile))
+        if detected, err := sniffType(original); err == nil && receiptTypes[detected] != "" {
+                sidecar, ok := readSidecar(receipt.ProcessedPath)
+                if hash, err := fileSHA256(original); !ok || sidecar.SourceSHA256 == "" || (err == nil && hash == sidecar.SourceSHA256) {
+                        return original
+                }
+        }
+        if _, err := os.Stat(receipt.ProcessedPath); err != nil {
+                return ""
+        }
+        return receipt.ProcessedPath
+}
+
+// renderDashboard writes one of the dashboard's pages
+func renderDashboard(w http.ResponseWriter, status int, page string, data any) {
+        w.Header().Set("Content-Type", "text/html; charset=utf-8")
+        w.WriteHeader(status)
+        if err := dashboardHTML.ExecuteTemplate(w, page, data); err != nil {
+                slog.Error("Failed to render dashboard", "event", "dashboard", "page", page, "error", err)
+        }
+}
+
+var dashboardHTML = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+        "amount": amountLabel,
+        "base":   filepath.Base,
+        "join":   strings.Join,
+        "inc":    func(i int) int { return i + 1 },
+        "fields": func(prefix string, data ReceiptData) map[string]any {
+                return map[string]any{"Prefix": prefix, "Data": data}
+        },
+        // low reports whether the model scored a field below -min-confidence
+        "low": func(c Confidence, field string) bool {
+                score, ok := c[field]
+                return ok && score < minConfidence
+        },
+}).Parse(`
+{{- define "head" -}}
+<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { border-bottom: 1px solid #ddd; padding: 4px 12px; text-align: left; }
+td.n { text-align: right; }
+.receipt { display: flex; gap: 2em; align-items: flex-start; flex-wrap: wrap; }
+.receipt img { max-width: 600px; max-height: 90vh; border: 1px solid #ddd; }
+.receipt iframe { width: 600px; height: 90vh; border: 1px solid #ddd; }
+form label { display: block; margin-bottom: 0.8em; }
+form input { display: block; width: 20em; padding: 4px; }
+fieldset { margin-bottom: 1em; }
+.low { color: #c60; font-weight: bold; }
+.saved { color: #080; }
+.error { color: #c00; }
+</style>
+</head>
+<body>
+{{- end}}
+
+{{- define "fields"}}
+{{- $c := .Data.Confidence}}
+<label{{if low $c "date"}} class="low"{{end}}>Date <input name="{{.Prefix}}date" value="{{.Data.Date}}" placeholder="YYYY-MM-DD"></label>
+<label{{if low $c "vendor"}} class="low"{{end}}>Vendor <input name="{{.Prefix}}vendor" value="{{.Data.Vendor}}"></label>
+<label{{if low $c "category"}} class="low"{{end}}>Category <input name="{{.Prefix}}category" value="{{.Data.Category}}" list="categories"></label>
+<label{{if low $c "total_amount"}} class="low"{{end}}>Amount <input name="{{.Prefix}}amount" value="{{.Data.Amount}}" inputmode="decimal"></label>
+<label>Currency <input name="{{.Prefix}}currency" value="{{.Data.Currency}}"></label>
+{{- end}}
+
+{{- define "list" -}}
+{{template "head" "Receipts"}}
+<h1>Receipts</h1>
+<p><a href="/review">Review queue</a>{{with .Review}} ({{.}} waiting){{end}}</p>
+<form method="get" action="/"><input name="q" value="{{.Query}}" placeholder="Vendor or category"></form>
+<p>{{len .Receipts}} receipts{{if eq (len .Receipts) .Limit}} (the newest {{.Limit}}; search to find older ones){{end}}</p>
+<table>
+<tr><th>Date</th><th>Vendor</th><th>Category</th><th>Amount</th><th>File</th></tr>
+{{- range .Receipts}}
+<tr><td>{{.Date}}</td><td><a href="/receipts/{{.ID}}">{{.Vendor}}</a></td><td>{{.Category}}</td><td class="n">{{amount .Amount .Currency}}</td><td>{{.ProcessedPath}}</td></tr>
+{{- end}}
+</table>
+</body>
+</html>
+{{end}}
+
+{{- define "receipt" -}}
+{{template "head" .Data.Vendor}}
+<p><a href="/">All receipts</a></p>
+<h1>{{.Data.Vendor}} {{amount .Data.Amount .Data.Currency}}</h1>
+<div class="receipt">
+{{- if eq .Preview "pdf"}}
+<iframe src="/receipts/{{.Receipt.ID}}/file"></iframe>
+{{- else if .Preview}}
+<img src="/receipts/{{.Receipt.ID}}/file" alt="{{.Receipt.SourceFile}}">
+{{- else}}
+<p>Neither the original nor the processed copy is there any more.</p>
+{{- end}}
+<div>
+{{- if .Saved}}<p class="saved">Saved.</p>{{end}}
+{{- with .Error}}<p class="error">{{.}}</p>{{end}}
+<form method="post">
+{{template "fields" fields "" .Data}}
+<button type="submit">Save and re-file</button>
+</form>
+<datalist id="categories">{{range .Categories}}<option value="{{.}}">{{end}}</datalist>
+<p>Filed as {{.Receipt.ProcessedPath}}<br>from {{.Receipt.SourceFile}}</p>
+{{- with .History}}
+<h2>Earlier values</h2>
+<table>
+<tr><th>Replaced</th><th>Date</th><th>Vendor</th><th>Category</th><th>Amount</th><th>By</th></tr>
+{{- range .}}
+<tr><td>{{.ReplacedAt}}</td><td>{{.Date}}</td><td>{{.Vendor}}</td><td>{{.Category}}</td><td class="n">{{amount .Amount .Currency}}</td><td>{{.Provider}} {{.Model}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+</div>
+</div>
+</body>
+</html>
+{{end}}
+
+{{- define "queue" -}}
+{{template "head" "Review queue"}}
+<p><a href="/">All receipts</a></p>
+<h1>Review queue</h1>
+{{- with .Approved}}<p class="saved">Filed {{.}}.</p>{{end}}
+{{- with .Rejected}}<p class="saved">Moved {{.}} to failed.</p>{{end}}
+{{- if .Items}}
+<table>
+<tr><th>Since</th><th>File</th><th>Folder</th><th>Why</th></tr>
+{{- range .Items}}
+<tr><td>{{.Time}}</td><td><a href="/review/item?path={{.Path}}">{{base .Path}}</a></td><td>{{if .Failed}}failed{{else}}needs review{{end}}</td><td>{{join .Problems "; "}}</td></tr>
+{{- end}}
+</table>
+{{- else}}
+<p>Nothing is waiting for review.</p>
+{{- end}}
+</body>
+</html>
+{{end}}
+
+{{- define "item" -}}
+{{template "head" (base .Path)}}
+<p><a href="/review">Review queue</a></p>
+<h1>{{base .Path}}</h1>
+<div class="receipt">
+{{- if eq .Preview "pdf"}}
+<iframe src="/review/file?path={{.Path}}"></iframe>
+{{- else if .Preview}}
+<img src="/review/file?path={{.Path}}" alt="{{base .Path}}">
+{{- else}}
+<p>This file type cannot be shown in a browser.</p>
+{{- end}}
+<div>
+{{- with .Error}}<p class="error">{{.}}</p>{{end}}
+{{- with .Problems}}
+<ul>{{range .}}<li>{{.}}</li>{{end}}</ul>
+{{- end}}
+<form method="post" action="/review/approve">
+<input type="hidden" name="path" value="{{.Path}}">
+{{- range $i, $data := .Receipts}}
+<fieldset>
+{{- if gt (len $.Receipts) 1}}<legend>Receipt {{inc $i}}</legend>{{end}}
+{{template "fields" fields (printf "%d." $i) $data}}
+</fieldset>
+{{- end}}
+<button type="submit">Approve and file</button>
+</form>
+{{- if not .Failed}}
+<form method="post" action="/review/reject">
+<input type="hidden" name="path" value="{{.Path}}">
+<button type="submit">Reject</button>
+</form>
+{{- end}}
+<datalist id="categories">{{range .Categories}}<option value="{{.}}">{{end}}</datalist>
+<p>{{with .Origin}}Scanned as {{.}}<br>{{end}}in {{.Path}}</p>
+</div>
+</div>
+</body>
+</html>
+{{end}}
+`))
@@ -0,0 +1,115 @@
+package main
+
+import (
+        "fmt"
+        "log/slog"
+        "regexp"
+        "strconv"
+        "strings"
+        "time"
+)
+
+// dateLayouts are the formats the model has been seen returning. A single "1"/"2"
+// also accepts two-digit months and days, so "2024/11/5" and "2024/11/05" both match.
+var dateLayouts = []string{
+        "2006-1-2",
+        "2006/1/2",
+        "2006.1.2",
+        "2006年1月2日",
+        "20060102",
+        "2006-1-2T15:04:05Z07:00",
+}
+
+// eraStarts maps Japanese era names, and the initials printed on some receipts, to the
+// Gregorian year of their first year (元年)
+var eraStarts = map[string]int{
+        "令和": 2019, "R": 2019,
+        "平成": 1989, "H": 1989,
+        "昭和": 1926, "S": 1926,
+}
+
+// eraDate matches dates such as 令和6年5月2日, 令和元年5月2日, R6.5.2, and H31/4/30
+var eraDate = regexp.MustCompile(`^(令和|平成|昭和|R|H|S)\s*(\d{1,2}|元)\s*[年./-]\s*(\d{1,2})\s*[月./-]\s*(\d{1,2})`)
+
+// leadingDate finds a Gregorian date at the start of a longer string, such as one
+// followed by a weekday or a time ("2024年5月2日(木) 14:30")
+var leadingDate = regexp.MustCompile(`^(\d{4})\s*[-/.年]\s*(\d{1,2})\s*[-/.月]\s*(\d{1,2})`)
+
+// foldDate turns full-width digits, letters, and punctuation (２０２４／５／２) into ASCII
+func foldDate(raw string) string {
+        return strings.Map(func(r rune) rune {
+                switch {
+                case r >= '！' && r <= '～':
+                        return r - '！' + '!'
+                case r == '　':
+                        return ' '
+                }
+                return r
+        }, raw)
+}
+
+// gregorianDate rewrites a Japanese era date, or a date with trailing text, as YYYY-MM-DD.
+// Other strings are returned unchanged for the layouts in dateLayouts.
+func gregorianDate(raw string) string {
+        // Timestamps keep their offset so they are converted to -timezone below
+        if _, err := time.Parse(time.RFC3339, raw); err == nil {
+                return raw
+        }
+        if m := eraDate.FindStringSubmatch(strings.ToUpper(raw)); m != nil {
+                year := 1
+                if m[2] != "元" {
+                        year, _ = strconv.Atoi(m[2])
+                }
+                month, _ := strconv.Atoi(m[3])
+                day, _ := strconv.Atoi(m[4])
+                return fmt.Sprintf("%04d-%02d-%02d", eraStarts[m[1]]+year-1, month, day)
+        }
+        if m := leadingDate.FindStringSubmatch(raw); m != nil {
+                month, _ := strconv.Atoi(m[2])
+                day, _ := strconv.Atoi(m[3])
+                return fmt.Sprintf("%s-%02d-%02d", m[1], month, day)
+        }
+        return raw
+}
+
+// location is the -timezone used for "today" and for interpreting extracted dates
+var location = time.Local
+
+// maxFutureDate rejects dates too far ahead of today to be a real receipt
+const maxFutureDate = 7 * 24 * time.Hour
+
+// parseReceiptDate parses an extracted date in -timezone, converting full-width digits
+// and Japanese era dates first
+func parseReceiptDate(raw string) (time.Time, bool) {
+        raw = strings.TrimSpace(raw)
+        if raw == "" {
+                return time.Time{}, false
+        }
+        value := gregorianDate(foldDate(raw))
+
+        for _, layout := range dateLayouts {
+                if t, err := time.ParseInLocation(layout, value, location); err == nil {
+                        return t.In(location), true
+                }
+        }
+        return time.Time{}, false
+}
+
+// normalizeDate returns the date as YYYY-MM-DD, or today's date if it is missing,
+// unparseable, or implausibly far in the future
+func normalizeDate(raw string) string {
+        today := time.Now().In(location).Format("2006-01-02")
+
+        t, ok := parseReceiptDate(raw)
+        if !ok {
+                if strings.TrimSpace(raw) != "" {
+                        slog.Warn("Could not parse date, using today's date instead", "date", raw)
+                }
+                return today
+        }
+        if time.Until(t) > maxFutureDate {
+                slog.Warn("Date is in the future, using today's date instead", "date", raw)
+                return today
+        }
+        return t.Format("2006-01-02")
+}
@@ -0,0 +1,815 @@
+package main
+
+import (
+        "database/sql"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "io"
+        "path/filepath"
+        "strconv"
+        "strings"
+        "text/tabwriter"
+        "time"
+
+        _ "github.com/mattn/go-sqlite3"
+)
+
+const receiptsSchema = `
+CREATE TABLE IF NOT EXISTS receipts (
+        id             INTEGER PRIMARY KEY AUTOINCREMENT,
+        date           TEXT NOT NULL,
+        vendor         TEXT NOT NULL,
+        category       TEXT NOT NULL,
+        amount         INTEGER NOT NULL,
+        currency       TEXT NOT NULL,
+        registration   TEXT NOT NULL DEFAULT '',
+        payment_method TEXT NOT NULL DEFAULT '',
+        payment_brand  TEXT NOT NULL DEFAULT '',
+        card_last4     TEXT NOT NULL DEFAULT '',
+        source_file    TEXT NOT NULL,
+        processed_path TEXT NOT NULL UNIQUE,
+        processed_at   TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS receipts_date ON receipts(date);
+CREATE INDEX IF NOT EXISTS receipts_category ON receipts(category);
+
+CREATE TABLE IF NOT EXISTS receipt_items (
+        id          INTEGER PRIMARY KEY AUTOINCREMENT,
+        receipt_id  INTEGER NOT NULL REFERENCES receipts(id) ON DELETE CASCADE,
+        description TEXT NOT NULL,
+        quantity    REAL NOT NULL,
+        unit_price  REAL NOT NULL,
+        amount      REAL NOT NULL
+);
+CREATE INDEX IF NOT EXISTS receipt_items_receipt ON receipt_items(receipt_id);
+
+CREATE TABLE IF NOT EXISTS receipt_taxes (
+        id             INTEGER PRIMARY KEY AUTOINCREMENT,
+        receipt_id     INTEGER NOT NULL REFERENCES receipts(id) ON DELETE CASCADE,
+        rate           INTEGER NOT NULL,
+        taxable_amount INTEGER NOT NULL,
+        tax_amount     INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS receipt_taxes_receipt ON receipt_taxes(receipt_id);
+
+CREATE TABLE IF NOT EXISTS journal (
+        id          INTEGER PRIMARY KEY AUTOINCREMENT,
+        source_path TEXT NOT NULL,
+        sha256      TEXT NOT NULL,
+        phash       TEXT NOT NULL DEFAULT '',
+        status      TEXT NOT NULL,
+        error       TEXT NOT NULL DEFAULT '',
+        receipts    TEXT NOT NULL DEFAULT '[]',
+        dest_paths  TEXT NOT NULL DEFAULT '[]',
+        started_at  TEXT NOT NULL,
+        finished_at TEXT,
+        prompt_tokens INTEGER NOT NULL DEFAULT 0,
+        output_tokens INTEGER NOT NULL DEFAULT 0,
+        cost_usd      REAL NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS journal_sha256 ON journal(sha256, status);
+
+CREATE TABLE IF NOT EXISTS corrections (
+        id           INTEGER PRIMARY KEY AUTOINCREMENT,
+        sha256       TEXT NOT NULL,
+        before       TEXT NOT NULL,
+        after        TEXT NOT NULL,
+        corrected_at TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS corrections_sha256 ON corrections(sha256);
+`
+
+// Journal statuses. A row stays "processing" only if the bot stopped mid-file.
+const (
+        journalProcessing = "processing"
+        journalProcessed  = "processed"
+        journalFailed     = "failed"
+        journalIncomplete = "incomplete"
+        journalReview     = "review"
+)
+
+// ReceiptDB stores every saved receipt in SQLite
+type ReceiptDB struct {
+        db *sql.DB
+}
+
+// Optional receipt database, set by -db
+var receiptDB *ReceiptDB
+
+// openReceiptDB opens (or creates) the database and ensures the schema exists
+func openReceiptDB(path string) (*ReceiptDB, error) {
+        db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000&_journal_mode=WAL")
+        if err != nil {
+                return nil, fmt.Errorf("error opening database: %w", err)
+        }
+
+        // A single connection serializes writes from concurrent workers
+        db.SetMaxOpenConns(1)
+
+        if _, err := db.Exec(receiptsSchema); err != nil {
+                db.Close()
+                return nil, fmt.Errorf("error creating schema: %w", err)
+        }
+        if err := addMissingColumns(db, "receipts", receiptsAddedColumns); err != nil {
+                db.Close()
+                return nil, fmt.Errorf("error upgrading schema: %w", err)
+        }
+        if err := addMissingColumns(db, "journal", journalAddedColumns); err != nil {
+                db.Close()
+                return nil, fmt.Errorf("error upgrading schema: %w", err)
+        }
+        return &ReceiptDB{db: db}, nil
+}
+
+// receiptsAddedColumns are receipts columns newer than the original schema, added
+// to databases created by older versions
+var receiptsAddedColumns = []struct{ Name, Definition string }{
+        {"registration", "TEXT NOT NULL DEFAULT ''"},
+        {"payment_method", "TEXT NOT NULL DEFAULT ''"},
+        {"payment_brand", "TEXT NOT NULL DEFAULT ''"},
+        {"card_last4", "TEXT NOT NULL DEFAULT ''"},
+}
+
+// journalAddedColumns are journal columns newer than the original schema
+var journalAddedColumns = []struct{ Name, Definition string }{
+        {"phash", "TEXT NOT NULL DEFAULT ''"},
+        {"prompt_tokens", "INTEGER NOT NULL DEFAULT 0"},
+        {"output_tokens", "INTEGER NOT NULL DEFAULT 0"},
+        {"cost_usd", "REAL NOT NULL DEFAULT 0"},
+}
+
+func addMissingColumns(db *sql.DB, table string, columns []struct{ Name, Definition string }) error {
+        rows, err := db.Query(`SELECT name FROM pragma_table_info(?)`, table)
+        if err != nil {
+                return err
+        }
+        existing := map[string]bool{}
+        for rows.Next() {
+                var name string
+                if err := rows.Scan(&name); err != nil {
+                        rows.Close()
+                        return err
+                }
+                existing[name] = true
+        }
+        rows.Close()
+        if err := rows.Err(); err != nil {
+                return err
+        }
+
+        for _, column := range columns {
+                if existing[column.Name] {
+                        continue
+                }
+                if _, err := db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column.Name, column.Definition)); err != nil {
+                        return err
+                }
+        }
+        return nil
+}
+
+func (r *ReceiptDB) Close() error {
+        return r.db.Close()
+}
+
+// InsertReceipt records a saved receipt with its line items and tax breakdown. Reprocessing
+// into the same processed path updates the existing row and replaces its items and taxes
+// instead of adding duplicates.
+func (r *ReceiptDB) InsertReceipt(data ReceiptData, srcPath, processedPath string) error {
+        tx, err := r.db.Begin()
+        if err != nil {
+                return fmt.Errorf("error inserting receipt: %w", err)
+        }
+        defer tx.Rollback()
+
+        _, err = tx.Exec(`
+                INSERT INTO receipts (date, vendor, category, amount, currency, registration, payment_method, payment_brand, card_last4, source_file, processed_path, processed_at)
+                VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+                ON CONFLICT(processed_path) DO UPDATE SET
+                        date = excluded.date,
+                        vendor = excluded.vendor,
+                        category = excluded.category,
+                        amount = excluded.amount,
+                        currency = excluded.currency,
+                        registration = excluded.registration,
+                        payment_method = excluded.payment_method,
+                        payment_brand = excluded.payment_brand,
+                        card_last4 = excluded.card_last4,
+                        source_file = excluded.source_file,
+                        processed_at = excluded.processed_at`,
+                data.Date, data.Vendor, data.Category, data.Amount.Float64(), data.Currency, data.RegistrationNumber,
+                data.PaymentMethod, data.PaymentBrand, data.CardLast4,
+                filepath.Base(srcPath), processedPath, time.Now().Format(time.RFC3339))
+        if err != nil {
+                return fmt.Errorf("error inserting receipt: %w", err)
+        }
+
+        // LastInsertId is not reliable after an upsert that updated, so look the row up
+        var receiptID int64
+        if err := tx.QueryRow(`SELECT id FROM receipts WHERE processed_path = ?`, processedPath).Scan(&receiptID); err != nil {
+                return fmt.Errorf("error inserting receipt: %w", err)
+        }
+        for _, table := range []string{"receipt_items", "receipt_taxes"} {
+                if _, err := tx.Exec(`DELETE FROM `+table+` WHERE receipt_id = ?`, receiptID); err != nil {
+                        return fmt.Errorf("error replacing %s: %w", table, err)
+                }
+        }
+        for _, item := range data.Items {
+                _, err := tx.Exec(`
+                        INSERT INTO receipt_items (receipt_id, description, quantity, unit_price, amount)
+                        VALUES (?, ?, ?, ?, ?)`,
+                        receiptID, item.Description, item.Quantity, item.UnitPrice.Float64(), item.Amount.Float64())
+                if err != nil {
+                        return fmt.Errorf("error inserting line item: %w", err)
+                }
+        }
+        for _, tax := range data.TaxBreakdown {
+                _, err := tx.Exec(`
+                        INSERT INTO receipt_taxes (receipt_id, rate, taxable_amount, tax_amount)
+                        VALUES (?, ?, ?, ?)`,
+                        receiptID, tax.Rate, tax.TaxableAmount, tax.TaxAmount)
+                if err != nil {
+                        return fmt.Errorf("error inserting tax breakdown: %w", err)
+                }
+        }
+
+        if err := tx.Commit(); err != nil {
+                return fmt.Errorf("error inserting receipt: %w", err)
+        }
+        return nil
+}
+
+// StartJournal records that processing of a source file has begun and returns the row id.
+// phash is the file's perceptual hash, or empty for PDFs.
+func (r *ReceiptDB) StartJournal(srcPath, hash, phash string) (int64, error) {
+        res, err := r.db.Exec(`
+                INSERT INTO journal (source_path, sha256, phash, status, started_at)
+                VALUES (?, ?, ?, ?, ?)`,
+                stateKey(srcPath), hash, phash, journalProcessing, time.Now().Format(time.RFC3339))
+        if err != nil {
+                return 0, fmt.Errorf("error writing journal: %w", err)
+        }
+        return res.LastInsertId()
+}
+
+// FinishJournal stores the outcome of a journal entry: its status, the extracted data,
+// where each receipt was saved, the tokens and estimated cost of analyzing it, and the
+// error if there was one
+func (r *ReceiptDB) FinishJournal(id int64, status string, dataList []ReceiptData, destPaths []string, usage *tokenUsage, procErr error) error {
+        if dataList == nil {
+                dataList = []ReceiptData{}
+        }
+        if destPaths == nil {
+                destPaths = []string{}
+        }
+        receipts, err := json.Marshal(dataList)
+        if err != nil {
+                return err
+        }
+        paths, err := json.Marshal(destPaths)
+        if err != nil {
+                return err
+        }
+        errText := ""
+        if procErr != nil {
+                errText = procErr.Error()
+        }
+
+        promptTokens, outputTokens, cost := usage.Totals()
+
+        _, err = r.db.Exec(`
+                UPDATE journal SET status = ?, error = ?, receipts = ?, dest_paths = ?, finished_at = ?,
+                        prompt_tokens = ?, output_tokens = ?, cost_usd = ?
+                WHERE id = ?`,
+                status, errText, string(receipts), string(paths), time.Now().Format(time.RFC3339),
+                promptTokens, outputTokens, cost, id)
+        if err != nil {
+                return fmt.Errorf("error updating journal: %w", err)
+        }
+        return nil
+}
+
+// JournalHash returns the content hash of the file a journal entry processed
+func (r *ReceiptDB) JournalHash(id int64) (string, error) {
+        var hash string
+        err := r.db.QueryRow(`SELECT sha256 FROM journal WHERE id = ?`, id).Scan(&hash)
+        if errors.Is(err, sql.ErrNoRows) {
+                return "", fmt.Errorf("no journal entry %d", id)
+        }
+        if err != nil {
+                return "", fmt.Errorf("error querying journal: %w", err)
+        }
+        return hash, nil
+}
+
+// ProcessedPaths returns where the receipts of the latest successful processing of a
+// file with this content were saved
+func (r *ReceiptDB) ProcessedPaths(hash string) ([]string, error) {
+        var paths string
+        err := r.db.QueryRow(`
+                SELECT dest_paths FROM journal
+                WHERE sha256 = ? AND status = ?
+                ORDER BY id DESC LIMIT 1`, hash, journalProcessed).Scan(&paths)
+        if errors.Is(err, sql.ErrNoRows) {
+                return nil, nil
+        }
+        if err != nil {
+                return nil, fmt.Errorf("error querying journal: %w", err)
+        }
+        var destPaths []string
+        if err := json.Unmarshal([]byte(paths), &destPaths); err != nil {
+                return nil, fmt.Errorf("invalid dest_paths in journal: %w", err)
+        }
+        return destPaths, nil
+}
+
+// MoveReceipt points the receipt saved at oldPath to its new processed path
+func (r *ReceiptDB) MoveReceipt(oldPath, newPath string) error {
+        if _, err := r.db.Exec(`UPDATE receipts SET processed_path = ? WHERE processed_path = ?`, newPath, oldPath); err != nil {
+                return fmt.Errorf("error moving receipt: %w", err)
+        }
+        return nil
+}
+
+// StoredReceipt is a row of the receipts table
+type StoredReceipt struct {
+        ReceiptData
+        ID            int64  `json:"id"`
+        SourceFile    string `json:"source_file"`
+        ProcessedPath string `json:"processed_path"`
+        ProcessedAt   string `json:"processed_at"`
+}
+
+const storedReceiptColumns = `id, date, vendor, category, CAST(amount AS TEXT), currency, registration, payment_method, source_file, processed_path, processed_at`
+
+func scanStoredReceipt(row interface{ Scan(...any) error }) (StoredReceipt, error) {
+        var r StoredReceipt
+        var amount string
+        err := row.Scan(&r.ID, &r.Date, &r.Vendor, &r.Category, &amount, &r.Currency, &r.RegistrationNumber, &r.PaymentMethod, &r.SourceFile, &r.ProcessedPath, &r.ProcessedAt)
+        if err != nil {
+                return r, err
+        }
+        if r.Amount, err = parseDecimal(amount); err != nil {
+                return r, fmt.Errorf("invalid amount %q for receipt %d: %w", amount, r.ID, err)
+        }
+        return r, nil
+}
+
+// ReceiptQuery selects receipts. Each condition applies only when set: Search is
+// contained in the vendor or category, Category matches exactly, and the receipt is
+// dated From through To (YYYY-MM-DD).
+type ReceiptQuery struct {
+        Search   string
+        Category string
+        From     string
+        To       string
+        Limit    int
+        Offset   int
+}
+
+// where returns the query's conditions as an SQL WHERE clause and its arguments
+func (q ReceiptQuery) where() (string, []any) {
+        clauses := []string{"1 = 1"}
+        var args []any
+        if q.Search != "" {
+                pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(q.Search) + "%"
+                clauses = append(clauses, `(vendor LIKE ? ESCAPE '\' OR category LIKE ? ESCAPE '\')`)
+                args = append(args, pattern, pattern)
+        }
+        if q.Category != "" {
+                clauses = append(clauses, "category = ?")
+                args = append(args, q.Category)
+        }
+        if q.From != "" {
+                clauses = append(clauses, "date >= ?")
+                args = append(args, q.From)
+        }
+        if q.To != "" {
+                clauses = append(clauses, "date <= ?")
+                args = append(args, q.To)
+        }
+        return "WHERE " + strings.Join(clauses, " AND "), args
+}
+
+// ListReceipts returns the receipts the query selects, newest first, up to its limit
+func (r *ReceiptDB) ListReceipts(q ReceiptQuery) ([]StoredReceipt, error) {
+        where, args := q.where()
+        rows, err := r.db.Query(`
+                SELECT `+storedReceiptColumns+`
+                FROM receipts
+                `+where+`
+                ORDER BY date DESC, id DESC
+                LIMIT ? OFFSET ?`, append(args, q.Limit, q.Offset)...)
+        if err != nil {
+                return nil, fmt.Errorf("error querying receipts: %w", err)
+        }
+        defer rows.Close()
+
+        var receipts []StoredReceipt
+        for rows.Next() {
+                receipt, err := scanStoredReceipt(rows)
+                if err != nil {
+                        return nil, fmt.Errorf("error querying receipts: %w", err)
+                }
+                receipts = append(receipts, receipt)
+        }
+        return receipts, rows.Err()
+}
+
+// Receipt returns the receipt with this id, or nil if there is none
+func (r *ReceiptDB) Receipt(id int64) (*StoredReceipt, error) {
+        receipt, err := scanStoredReceipt(r.db.QueryRow(`SELECT `+storedReceiptColumns+` FROM receipts WHERE id = ?`, id))
+        if errors.Is(err, sql.ErrNoRows) {
+                return nil, nil
+        }
+        if err != nil {
+                return nil, fmt.Errorf("error querying receipts: %w", err)
+        }
+        return &receipt, nil
+}
+
+// ReceiptTotal is the number and sum of receipts in one category or month and currency
+type ReceiptTotal struct {
+        Category string  `json:"category,omitempty"`
+        Month    string  `json:"month,omitempty"`
+        Currency string  `json:"currency"`
+        Count    int     `json:"count"`
+        Total    float64 `json:"total"`
+}
+
+// ReceiptStats totals the receipts a query selects, per category and per month
+type ReceiptStats struct {
+        Receipts   int            `json:"receipts"`
+        Categories []ReceiptTotal `json:"categories"`
+        Months     []ReceiptTotal `json:"months"`
+}
+
+// Stats totals the receipts the query selects; its limit and offset are ignored
+func (r *ReceiptDB) Stats(q ReceiptQuery) (*ReceiptStats, error) {
+        where, args := q.where()
+        stats := &ReceiptStats{Categories: []ReceiptTotal{}, Months: []ReceiptTotal{}}
+        for _, group := range []struct {
+                Column string
+                Totals *[]ReceiptTotal
+                Key    func(*ReceiptTotal) *string
+        }{
+                {"category", &stats.Categories, func(t *ReceiptTotal) *string { return &t.Category }},
+                {"substr(date, 1, 7)", &stats.Months, func(t *ReceiptTotal) *string { return &t.Month }},
+        } {
+                rows, err := r.db.Query(`
+                        SELECT `+group.Column+` AS key, currency, COUNT(*), ROUND(SUM(amount), 3)
+                        FROM receipts
+                        `+where+`
+                        GROUP BY key, currency
+                        ORDER BY key, currency`, args...)
+                if err != nil {
+                        return nil, fmt.Errorf("error querying stats: %w", err)
+                }
+                for rows.Next() {
+                        var total ReceiptTotal
+                        if err := rows.Scan(group.Key(&total), &total.Currency, &total.Count, &total.Total); err != nil {
+                                rows.Close()
+                                return nil, fmt.Errorf("error querying stats: %w", err)
+                        }
+                        *group.Totals = append(*group.Totals, total)
+                }
+                rows.Close()
+                if err := rows.Err(); err != nil {
+                        return nil, fmt.Errorf("error querying stats: %w", err)
+                }
+        }
+        for _, total := range stats.Categories {
+                stats.Receipts += total.Count
+        }
+        return stats, nil
+}
+
+// RecordCorrection stores what the model read from the file with this hash and what it
+// was corrected to
+func (r *ReceiptDB) RecordCorrection(hash string, before, after ReceiptData) error {
+        beforeJSON, err := json.Marshal(before)
+        if err != nil {
+                return err
+        }
+        afterJSON, err := json.Marshal(after)
+        if err != nil {
+                return err
+        }
+        _, err = r.db.Exec(`
+                INSERT INTO corrections (sha256, before, after, corrected_at)
+                VALUES (?, ?, ?, ?)`,
+                hash, string(beforeJSON), string(afterJSON), time.Now().Format(time.RFC3339))
+        if err != nil {
+                return fmt.Errorf("error writing correction: %w", err)
+        }
+        return nil
+}
+
+// RecentCorrections returns up to limit corrections, newest first
+func (r *ReceiptDB) RecentCorrections(limit int) ([]Correction, error) {
+        rows, err := r.db.Query(`SELECT sha256, before, after, corrected_at FROM corrections ORDER BY id DESC LIMIT ?`, limit)
+        if err != nil {
+                return nil, fmt.Errorf("error querying corrections: %w", err)
+        }
+        defer rows.Close()
+
+        var corrections []Correction
+        for rows.Next() {
+                var c Correction
+                var before, after string
+                if err := rows.Scan(&c.Hash, &before, &after, &c.CorrectedAt); err != nil {
+                        return nil, fmt.Errorf("error querying corrections: %w", err)
+                }
+                if json.Unmarshal([]byte(before), &c.Before) != nil || json.Unmarshal([]byte(after), &c.After) != nil {
+                        continue
+                }
+                corrections = append(corrections, c)
+        }
+        return corrections, rows.Err()
+}
+
+// VendorNames returns every vendor in the receipts table, most receipts first
+func (r *ReceiptDB) VendorNames() ([]string, error) {
+        rows, err := r.db.Query(`SELECT vendor FROM receipts WHERE vendor != '' GROUP BY vendor ORDER BY COUNT(*) DESC, vendor`)
+        if err != nil {
+                return nil, fmt.Errorf("error querying vendors: %w", err)
+        }
+        defer rows.Close()
+
+        var vendors []string
+        for rows.Next() {
+                var vendor string
+                if err := rows.Scan(&vendor); err != nil {
+                        return nil, fmt.Errorf("error querying vendors: %w", err)
+                }
+                vendors = append(vendors, vendor)
+        }
+        return vendors, rows.Err()
+}
+
+// ReviseJournal updates the journal entries that saved a receipt at oldPath to its
+// corrected values and new path, so the journal agrees with the receipts table
+func (r *ReceiptDB) ReviseJournal(oldPath, newPath string, data ReceiptData) error {
+        quoted, err := json.Marshal(oldPath)
+        if err != nil {
+                return err
+        }
+        rows, err := r.db.Query(`SELECT id, receipts, dest_paths FROM journal WHERE instr(dest_paths, ?) > 0`, string(quoted))
+        if err != nil {
+                return fmt.Errorf("error querying journal: %w", err)
+        }
+        type entry struct {
+                id       int64
+                receipts []ReceiptData
+                paths    []string
+        }
+        var entries []entry
+        for rows.Next() {
+                var e entry
+                var receipts, paths string
+                if err := rows.Scan(&e.id, &receipts, &paths); err != nil {
+                        rows.Close()
+                        return fmt.Errorf("error querying journal: %w", err)
+                }
+                if json.Unmarshal([]byte(receipts), &e.receipts) != nil || json.Unmarshal([]byte(paths), &e.paths) != nil {
+                        continue
+                }
+                entries = append(entries, e)
+        }
+        rows.Close()
+        if err := rows.Err(); err != nil {
+                return fmt.Errorf("error querying journal: %w", err)
+        }
+
+        for _, e := range entries {
+                for i, path := range e.paths {
+                        if path != oldPath {
+                                continue
+                        }
+                        e.paths[i] = newPath
+                        // Receipts and paths line up unless saving stopped partway
+                        if i < len(e.receipts) {
+                                e.receipts[i] = data
+                        }
+                }
+                receipts, _ := json.Marshal(e.receipts)
+                paths, _ := json.Marshal(e.paths)
+                if _, err := r.db.Exec(`UPDATE journal SET receipts = ?, dest_paths = ? WHERE id = ?`, string(receipts), string(paths), e.id); err != nil {
+                        return fmt.Errorf("error updating journal: %w", err)
+                }
+        }
+        return nil
+}
+
+// HashProcessed reports whether a file with this content was already processed successfully,
+// from any path
+func (r *ReceiptDB) HashProcessed(hash string) (bool, error) {
+        var count int
+        err := r.db.QueryRow(`SELECT COUNT(*) FROM journal WHERE sha256 = ? AND status = ?`, hash, journalProcessed).Scan(&count)
+        if err != nil {
+                return false, fmt.Errorf("error querying journal: %w", err)
+        }
+        return count > 0, nil
+}
+
+// HashReviewed reports whether a file with this content was already held for review,
+// meaning a person has seen it and put it back
+func (r *ReceiptDB) HashReviewed(hash string) (bool, error) {
+        var count int
+        err := r.db.QueryRow(`SELECT COUNT(*) FROM journal WHERE sha256 = ? AND status = ?`, hash, journalReview).Scan(&count)
+        if err != nil {
+                return false, fmt.Errorf("error querying journal: %w", err)
+        }
+        return count > 0, nil
+}
+
+// NearDuplicate returns the source path of a successfully processed file whose perceptual
+// hash is within maxDistance bits of phash, and the distance, or "" if there is none
+func (r *ReceiptDB) NearDuplicate(hash, phash string, maxDistance int) (string, int, error) {
+        rows, err := r.db.Query(`
+                SELECT source_path, phash FROM journal
+                WHERE status = ? AND phash != '' AND sha256 != ?
+                ORDER BY id DESC`,
+                journalProcessed, hash)
+        if err != nil {
+                return "", 0, fmt.Errorf("error querying journal: %w", err)
+        }
+        defer rows.Close()
+
+        for rows.Next() {
+                var source, other string
+                if err := rows.Scan(&source, &other); err != nil {
+                        return "", 0, fmt.Errorf("error querying journal: %w", err)
+                }
+                if distance := hashDistance(phash, other); distance >= 0 && distance <= maxDistance {
+                        return source, distance, nil
+                }
+        }
+        return "", 0, rows.Err()
+}
+
+// ReceiptsBetween returns the receipts dated from from up to, but not including, to
+func (r *ReceiptDB) ReceiptsBetween(from, to time.Time) ([]ReceiptData, error) {
+        rows, err := r.db.Query(`
+                SELECT date, vendor, category, CAST(amount AS TEXT), currency
+                FROM receipts
+                WHERE date >= ? AND date < ?
+                ORDER BY date, id`, from.Format("2006-01-02"), to.Format("2006-01-02"))
+        if err != nil {
+                return nil, fmt.Errorf("error querying receipts: %w", err)
+        }
+        defer rows.Close()
+
+        var receipts []ReceiptData
+        for rows.Next() {
+                var data ReceiptData
+                var amount string
+                if err := rows.Scan(&data.Date, &data.Vendor, &data.Category, &amount, &data.Currency); err != nil {
+                        return nil, err
+                }
+                if data.Amount, err = parseDecimal(amount); err != nil {
+                        return nil, fmt.Errorf("invalid amount %q for %s on %s: %w", amount, data.Vendor, data.Date, err)
+                }
+                receipts = append(receipts, data)
+        }
+        return receipts, rows.Err()
+}
+
+// WriteMonthlySummary prints total spend per category per month
+func (r *ReceiptDB) WriteMonthlySummary(out io.Writer) error {
+        rows, err := r.db.Query(`
+                SELECT substr(date, 1, 7) AS month, category, currency, COUNT(*), ROUND(SUM(amount), 3)
+                FROM receipts
+                GROUP BY month, category, currency
+                ORDER BY month, category`)
+        if err != nil {
+                return fmt.Errorf("error querying summary: %w", err)
+        }
+        defer rows.Close()
+
+        w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+        fmt.Fprintln(w, "MONTH\tCATEGORY\tRECEIPTS\tTOTAL")
+        for rows.Next() {
+                var month, category, currency string
+                var count int
+                var total float64
+                if err := rows.Scan(&month, &category, &currency, &count, &total); err != nil {
+                        return err
+                }
+                fmt.Fprintf(w, "%s\t%s\t%d\t%s %s\n", month, category, count, strconv.FormatFloat(total, 'f', -1, 64), currency)
+        }
+        if err := rows.Err(); err != nil {
+                return err
+        }
+        return w.Flush()
+}
+
+// WriteCostReport prints the tokens and estimated cost of every file analyzed, per day
+// and then per month. Failed and held files count too, since their calls were paid for.
+func (r *ReceiptDB) WriteCostReport(out io.Writer) error {
+        for i, period := range []struct {
+                Heading string
+                Length  int
+        }{{"DAY", 10}, {"MONTH", 7}} {
+                rows, err := r.db.Query(`
+                        SELECT substr(started_at, 1, ?) AS period, COUNT(*),
+                                SUM(CASE WHEN status = ? THEN json_array_length(receipts) ELSE 0 END),
+                                SUM(prompt_tokens), SUM(output_tokens), SUM(cost_usd)
+                        FROM journal
+                        GROUP BY period
+                        ORDER BY period`,
+                        period.Length, journalProcessed)
+                if err != nil {
+                        return fmt.Errorf("error querying costs: %w", err)
+                }
+
+                if i > 0 {
+                        fmt.Fprintln(out)
+                }
+                w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+                fmt.Fprintf(w, "%s\tFILES\tRECEIPTS\tPROMPT TOKENS\tOUTPUT TOKENS\tCOST (USD)\n", period.Heading)
+                var files, receipts, promptTokens, outputTokens int64
+                var cost float64
+                for rows.Next() {
+                        var key string
+                        var f, n, p, o int64
+                        var c float64
+                        if err := rows.Scan(&key, &f, &n, &p, &o, &c); err != nil {
+                                rows.Close()
+                                return err
+                        }
+                        fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%.4f\n", key, f, n, p, o, c)
+                        files, receipts, promptTokens, outputTokens, cost = files+f, receipts+n, promptTokens+p, outputTokens+o, cost+c
+                }
+                rows.Close()
+                if err := rows.Err(); err != nil {
+                        return err
+                }
+                fmt.Fprintf(w, "TOTAL\t%d\t%d\t%d\t%d\t%.4f\n", files, receipts, promptTokens, outputTokens, cost)
+                if err := w.Flush(); err != nil {
+                        return err
+                }
+        }
+        return nil
+}
+
+// Digest gathers what a -digest email reports for the period from since to until:
+// receipts filed with totals per category, files held or failed, and API usage
+func (r *ReceiptDB) Digest(since, until time.Time) (*DigestData, error) {
+        from, to := since.Format(time.RFC3339), until.Format(time.RFC3339)
+        data := &DigestData{Since: since, Until: until}
+
+        rows, err := r.db.Query(`
+                SELECT category, currency, COUNT(*), ROUND(SUM(amount), 3)
+                FROM receipts
+                WHERE processed_at >= ? AND processed_at < ?
+                GROUP BY category, currency
+                ORDER BY category, currency`, from, to)
+        if err != nil {
+                return nil, fmt.Errorf("error querying digest: %w", err)
+        }
+        for rows.Next() {
+                var total DigestTotal
+                if err := rows.Scan(&total.Category, &total.Currency, &total.Count, &total.Total); err != nil {
+                        rows.Close()
+                        return nil, err
+                }
+                data.Totals = append(data.Totals, total)
+                data.Receipts += total.Count
+        }
+        rows.Close()
+        if err := rows.Err(); err != nil {
+                return nil, err
+        }
+
+        rows, err = r.db.Query(`
+                SELECT source_path, error FROM journal
+                WHERE status IN (?, ?) AND started_at >= ? AND started_at < ?
+                ORDER BY id`, journalFailed, journalIncomplete, from, to)
+        if err != nil {
+                return nil, fmt.Errorf("error querying digest: %w", err)
+        }
+        for rows.Next() {
+                var failure DigestFailure
+                if err := rows.Scan(&failure.Path, &failure.Error); err != nil {
+                        rows.Close()
+                        return nil, err
+                }
+                data.Failed = append(data.Failed, failure)
+        }
+        rows.Close()
+        if err := rows.Err(); err != nil {
+                return nil, err
+        }
+
+        err = r.db.QueryRow(`
+                SELECT COUNT(*), COALESCE(SUM(status = ?), 0), COALESCE(SUM(prompt_tokens), 0), COALESCE(SUM(output_tokens), 0), COALESCE(SUM(cost_usd), 0)
+                FROM journal
+                WHERE started_at >= ? AND started_at < ?`, journalReview, from, to).
+                Scan(&data.Files, &data.Review, &data.PromptTokens, &data.OutputTokens, &data.CostUSD)
+        if err != nil {
+                return nil, fmt.Errorf("error querying digest: %w", err)
+        }
+        return data, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+        "sync"
+        "time"
+)
+
+// debouncer coalesces bursts of events per key and runs the callback once the key
+// has been quiet for the window
+type debouncer struct {
+        mu     sync.Mutex
+        window time.Duration
+        timers map[string]*debounceTimer
+}
+
+// debounceTimer is one quiet period. A callback fires only while its timer is still the
+// key's current one, so a period replaced after its timer fired never runs fn twice.
+type debounceTimer struct {
+        timer *time.Timer
+}
+
+func newDebouncer(window time.Duration) *debouncer {
+        return &debouncer{window: window, timers: map[string]*debounceTimer{}}
+}
+
+// Trigger (re)starts the quiet period for key; fn runs when it expires.
+// With a zero window fn runs immediately.
+func (d *debouncer) Trigger(key string, fn func()) {
+        if d.window <= 0 {
+                fn()
+                return
+        }
+
+        d.mu.Lock()
+        defer d.mu.Unlock()
+
+        if pending, ok := d.timers[key]; ok {
+                pending.timer.Stop()
+        }
+
+        pending := &debounceTimer{}
+        pending.timer = time.AfterFunc(d.window, func() {
+                d.mu.Lock()
+                if d.timers[key] != pending {
+                        d.mu.Unlock()
+                        return
+                }
+                delete(d.timers, key)
+                d.mu.Unlock()
+                fn()
+        })
+        d.timers[key] = pending
+}
+
+// Stop cancels every pending callback
+func (d *debouncer) Stop() {
+        d.mu.Lock()
+        defer d.mu.Unlock()
+
+        for key, pending := range d.timers {
+                pending.timer.Stop()
+                delete(d.timers, key)
+        }
+}
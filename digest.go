@@ -0,0 +1,192 @@
+package main
+
+import (
+        "context"
+        "crypto/tls"
+        "fmt"
+        "log/slog"
+        "net"
+        "net/smtp"
+        "os"
+        "strconv"
+        "strings"
+        "time"
+)
+
+// DigestData is what the -digest email summarizes for one period
+type DigestData struct {
+        Since, Until time.Time
+        Receipts     int
+        Totals       []DigestTotal
+        Failed       []DigestFailure
+        Review       int
+        Files        int
+        PromptTokens int64
+        OutputTokens int64
+        CostUSD      float64
+}
+
+// DigestTotal is the spend in one category and currency
+type DigestTotal struct {
+        Category string
+        Currency string
+        Count    int
+        Total    float64
+}
+
+// DigestFailure is one file that failed in the period
+type DigestFailure struct {
+        Path  string
+        Error string
+}
+
+// digestPeriod is how far back a -digest email looks
+func digestPeriod(schedule string) time.Duration {
+        if schedule == "weekly" {
+                return 7 * 24 * time.Hour
+        }
+        return 24 * time.Hour
+}
+
+// nextDigest returns when the next -digest email is due: every day at -digest-time,
+// or on Mondays for weekly digests
+func nextDigest(now time.Time, schedule string, at time.Duration) time.Time {
+        now = now.In(location)
+        y, m, d := now.Date()
+        next := time.Date(y, m, d, 0, 0, 0, 0, location).Add(at)
+        for !next.After(now) || (schedule == "weekly" && next.Weekday() != time.Monday) {
+                y, m, d = next.Date()
+                next = time.Date(y, m, d+1, 0, 0, 0, 0, location).Add(at)
+        }
+        return next
+}
+
+// parseDigestTime parses -digest-time as HH:MM
+func parseDigestTime(value string) (time.Duration, error) {
+        t, err := time.Parse("15:04", value)
+        if err != nil {
+                return 0, fmt.Errorf("expected HH:MM: %w", err)
+        }
+        return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// runDigests sends a digest at every scheduled time until ctx is cancelled
+func runDigests(ctx context.Context, db *ReceiptDB, schedule string, at time.Duration) {
+        for {
+                next := nextDigest(time.Now(), schedule, at)
+                slog.Debug("Next digest scheduled", "time", next.Format(time.RFC3339))
+                timer := time.NewTimer(time.Until(next))
+                select {
+                case <-timer.C:
+                case <-ctx.Done():
+                        timer.Stop()
+                        return
+                }
+                if err := sendDigest(db, schedule, time.Now()); err != nil {
+                        slog.Error("Failed to send digest", "event", "digest", "error", err)
+                }
+        }
+}
+
+// sendDigest emails the summary of the period ending at until
+func sendDigest(db *ReceiptDB, schedule string, until time.Time) error {
+        data, err := db.Digest(until.Add(-digestPeriod(schedule)), until)
+        if err != nil {
+                return err
+        }
+        subject := fmt.Sprintf("Scanner Bot %s digest: %d receipts, %d failed", schedule, data.Receipts, len(data.Failed))
+        if err := sendMail(subject, formatDigest(data)); err != nil {
+                return err
+        }
+        slog.Info("Sent digest", "event", "digest", "to", digestTo, "receipts", data.Receipts, "failed", len(data.Failed))
+        return nil
+}
+
+// formatDigest renders the digest as plain text
+func formatDigest(data *DigestData) string {
+        var b strings.Builder
+        fmt.Fprintf(&b, "Receipts from %s to %s\n\n", data.Since.In(location).Format("2006-01-02 15:04"), data.Until.In(location).Format("2006-01-02 15:04"))
+
+        fmt.Fprintf(&b, "Filed: %d receipts\n", data.Receipts)
+        for _, total := range data.Totals {
+                fmt.Fprintf(&b, "  %-20s %4d  %s %s\n", total.Category, total.Count, strconv.FormatFloat(total.Total, 'f', -1, 64), total.Currency)
+        }
+
+        fmt.Fprintf(&b, "\nHeld for review: %d\n", data.Review)
+        fmt.Fprintf(&b, "Failed: %d\n", len(data.Failed))
+        for _, failure := range data.Failed {
+                fmt.Fprintf(&b, "  %s: %s\n", failure.Path, failure.Error)
+        }
+
+        fmt.Fprintf(&b, "\nAPI usage: %d files, %d prompt tokens, %d output tokens, about $%.2f\n", data.Files, data.PromptTokens, data.OutputTokens, data.CostUSD)
+        return b.String()
+}
+
+// sendMail sends a plain-text email through -smtp-host. Port 465 uses TLS from the start;
+// other ports upgrade with STARTTLS when the server offers it. The password is read from
+// SMTP_PASSWORD.
+func sendMail(subject, body string) error {
+        recipients := strings.Split(digestTo, ",")
+        for i := range recipients {
+                recipients[i] = strings.TrimSpace(recipients[i])
+        }
+        from := digestFrom
+        if from == "" {
+                from = smtpUser
+        }
+
+        var msg strings.Builder
+        fmt.Fprintf(&msg, "From: %s\r\n", from)
+        fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(recipients, ", "))
+        fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+        fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+        msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n")
+        msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+        addr := net.JoinHostPort(smtpHost, strconv.Itoa(smtpPort))
+        var auth smtp.Auth
+        if smtpUser != "" {
+                auth = smtp.PlainAuth("", smtpUser, os.Getenv("SMTP_PASSWORD"), smtpHost)
+        }
+        if smtpPort != 465 {
+                if err := smtp.SendMail(addr, auth, from, recipients, []byte(msg.String())); err != nil {
+                        return fmt.Errorf("failed to send email: %w", err)
+                }
+                return nil
+        }
+
+        conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: smtpHost})
+        if err != nil {
+                return fmt.Errorf("failed to connect to %s: %w", addr, err)
+        }
+        client, err := smtp.NewClient(conn, smtpHost)
+        if err != nil {
+                conn.Close()
+                return fmt.Errorf("failed to connect to %s: %w", addr, err)
+        }
+        defer client.Close()
+        if auth != nil {
+                if err := client.Auth(auth); err != nil {
+                        return fmt.Errorf("failed to log in to %s: %w", addr, err)
+                }
+        }
+        if err := client.Mail(from); err != nil {
+                return fmt.Errorf("failed to send email: %w", err)
+        }
+        for _, recipient := range recipients {
+                if err := client.Rcpt(recipient); err != nil {
+                        return fmt.Errorf("failed to send email to %s: %w", recipient, err)
+                }
+        }
+        w, err := client.Data()
+        if err != nil {
+                return fmt.Errorf("failed to send email: %w", err)
+        }
+        if _, err := w.Write([]byte(msg.String())); err != nil {
+                return fmt.Errorf("failed to send email: %w", err)
+        }
+        if err := w.Close(); err != nil {
+                return fmt.Errorf("failed to send email: %w", err)
+        }
+        return client.Quit()
+}
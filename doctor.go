@@ -0,0 +1,370 @@
+package main
+
+import (
+        "context"
+        "errors"
+        "fmt"
+        "net/url"
+        "os"
+        "os/exec"
+        "path/filepath"
+        "strings"
+        "text/tabwriter"
+        "time"
+
+        "github.com/fsnotify/fsnotify"
+)
+
+// doctorCheck is one thing the doctor command verifies. A check returns a short
+// description of what it found, or an error. Warnings are printed but do not fail.
+type doctorCheck struct {
+        Name  string
+        Skip  bool
+        Warn  bool
+        Check func() (string, error)
+}
+
+// runDoctor checks the settings and environment the bot would start with, printing one
+// line per check, and reports whether everything required is in order. Nothing is
+// processed: the providers are only asked about their models, and the only files written
+// are temporary ones in the watch directories and destinations.
+func runDoctor() bool {
+        checks := []doctorCheck{
+                {Name: "provider", Check: doctorProvider},
+                {Name: "directories", Check: doctorDirectories},
+                {Name: "file events", Skip: len(watchDirs) == 0, Check: doctorFileEvents},
+                {Name: "moves", Warn: true, Skip: len(watchDirs)+len(pollDirs) == 0, Check: doctorMoves},
+                {Name: "convert command", Warn: true, Check: func() (string, error) {
+                        path, err := exec.LookPath(convertCommand)
+                        if err != nil {
+                                return "", fmt.Errorf("%s not found; HEIC, WebP, and TIFF files and -preprocess need ImageMagick", convertCommand)
+                        }
+                        return path, nil
+                }},
+                {Name: "database", Skip: dbPath == "", Check: func() (string, error) {
+                        db, err := openReceiptDB(dbPath)
+                        if err != nil {
+                                return "", err
+                        }
+                        return dbPath, db.Close()
+                }},
+                {Name: "prompt template", Skip: promptFile == "", Check: func() (string, error) {
+                        tmpl, err := loadPromptTemplate(promptFile)
+                        if err != nil {
+                                return "", err
+                        }
+                        promptTemplate = tmpl
+                        _, err = extractionPrompt(1)
+                        return promptFile, err
+                }},
+                {Name: "filename template", Skip: fileNameFormat == "", Check: func() (string, error) {
+                        _, err := loadFileNameTemplate(fileNameFormat)
+                        return fileNameFormat, err
+                }},
+                {Name: "category map", Skip: categoryMapPath == "", Check: func() (string, error) {
+                        _, err := loadCategoryMap(categoryMapPath)
+                        return categoryMapPath, err
+                }},
+                {Name: "vendor aliases", Skip: vendorAliasesPath == "", Check: func() (string, error) {
+                        aliases, err := loadVendorAliases(vendorAliasesPath)
+                        return fmt.Sprintf("%s (%d names)", vendorAliasesPath, len(aliases)), err
+                }},
+                {Name: "account map", Skip: accountMapPath == "", Check: func() (string, error) {
+                        _, err := loadAccountMap(accountMapPath)
+                        return accountMapPath, err
+                }},
+                {Name: "push notifications", Skip: ntfyURL == "" && !pushover, Check: func() (string, error) {
+                        notifiers, err := setupPushNotifiers()
+                        return fmt.Sprintf("%d configured", len(notifiers)), err
+                }},
+                {Name: "email", Skip: imapURL == "" && !gmailInbox, Check: func() (string, error) {
+                        sources, err := setupMailSources()
+                        return fmt.Sprintf("%d mailboxes", len(sources)), err
+                }},
+                {Name: "upload server", Skip: uploadAddr == "", Check: func() (string, error) {
+                        if os.Getenv("UPLOAD_TOKEN") == "" {
+                                return "", errors.New("-upload-addr requires the UPLOAD_TOKEN environment variable")
+                        }
+                        return uploadAddr, nil
+                }},
+                {Name: "dashboard", Skip: dashboardAddr == "", Check: func() (string, error) {
+                        if os.Getenv("DASHBOARD_PASSWORD") == "" {
+                                return "", errors.New("-dashboard-addr requires the DASHBOARD_PASSWORD environment variable")
+                        }
+                        if dbPath == "" {
+                                return "", errors.New("-dashboard-addr requires -db")
+                        }
+                        return dashboardAddr, nil
+                }},
+                {Name: "api", Skip: apiAddr == "" && grpcAddr == "", Check: func() (string, error) {
+                        if os.Getenv("API_TOKEN") == "" {
+                                return "", errors.New("-api-addr and -grpc-addr require the API_TOKEN environment variable")
+                        }
+                        if dbPath == "" {
+                                return "", errors.New("-api-addr and -grpc-addr require -db")
+                        }
+                        return strings.TrimSpace(apiAddr + " " + grpcAddr), nil
+                }},
+                {Name: "storage", Skip: storageName == "local", Check: func() (string, error) {
+                        _, err := setupStorage()
+                        return storageName, err
+                }},
+                {Name: "google sheet", Skip: sheetID == "", Check: func() (string, error) {
+                        _, err := newSheetLedger(sheetID, sheetName)
+                        return sheetID, err
+                }},
+                {Name: "s3 archive", Skip: archiveS3 == "", Check: func() (string, error) {
+                        _, err := newS3Archive(archiveS3, s3Endpoint, s3Region, s3SSE)
+                        return archiveS3, err
+                }},
+                {Name: "paperless", Skip: paperlessURL == "", Check: func() (string, error) {
+                        _, err := newPaperlessClient(paperlessURL, os.Getenv("PAPERLESS_TOKEN"))
+                        return paperlessURL, err
+                }},
+                {Name: "digest", Skip: digestSchedule == "", Check: func() (string, error) {
+                        if smtpUser != "" && os.Getenv("SMTP_PASSWORD") == "" {
+                                return "", errors.New("-smtp-user requires the SMTP_PASSWORD environment variable")
+                        }
+                        return fmt.Sprintf("%s to %s via %s:%d", digestSchedule, digestTo, smtpHost, smtpPort), nil
+                }},
+        }
+
+        w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+        problems := 0
+        for _, check := range checks {
+                if check.Skip {
+                        continue
+                }
+                detail, err := check.Check()
+                status := "ok"
+                if err != nil {
+                        status, detail = "FAIL", err.Error()
+                        if check.Warn {
+                                status = "warn"
+                        } else {
+                                problems++
+                        }
+                }
+                fmt.Fprintf(w, "%s\t%s\t%s\n", status, check.Name, detail)
+        }
+        w.Flush()
+
+        if problems > 0 {
+                fmt.Printf("\n%d problem(s) found\n", problems)
+                return false
+        }
+        fmt.Println("\nNo problems found")
+        return true
+}
+
+// doctorBackend is one provider and model the bot may call
+type doctorBackend struct {
+        Label   string
+        Name    string
+        Model   string
+        BaseURL string
+}
+
+// doctorBackends lists the backends of -provider (with -large-model), -fallback, and -verify
+func doctorBackends() []doctorBackend {
+        backends := []doctorBackend{{Label: provider, Name: provider, Model: modelName, BaseURL: apiBaseURL}}
+        if largeModel != "" {
+                backends = append(backends, doctorBackend{Label: provider, Name: provider, Model: largeModel, BaseURL: apiBaseURL})
+        }
+        for _, entry := range fallbacks {
+                name, model, _ := strings.Cut(entry, ":")
+                if model == "" {
+                        model = providerDefaultModels[name]
+                }
+                backends = append(backends, doctorBackend{Label: "fallback " + name, Name: name, Model: model})
+        }
+        if verifyWith != "" {
+                name, model, _ := strings.Cut(verifyWith, ":")
+                if model == "" {
+                        model = providerDefaultModels[name]
+                }
+                backends = append(backends, doctorBackend{Label: "verify " + name, Name: name, Model: model})
+        }
+        return backends
+}
+
+// doctorProvider builds the analyzers, which checks the provider names and that API keys
+// are set, then asks each backend about its model. That small, free request fails when
+// the key is rejected, the model does not exist, or (for Ollama) the model is not pulled.
+func doctorProvider() (string, error) {
+        ctx := context.Background()
+        analyzer, err := newAnalyzer(ctx)
+        if err != nil {
+                return "", err
+        }
+        analyzer.Close()
+
+        var checked []string
+        for _, backend := range doctorBackends() {
+                analyzer, err := newProviderAnalyzer(ctx, backend.Name, backend.Model, backend.BaseURL)
+                if err != nil {
+                        return "", fmt.Errorf("%s: %w", backend.Label, err)
+                }
+                pingCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+                err = pingAnalyzer(pingCtx, analyzer, backend.Model)
+                cancel()
+                analyzer.Close()
+                if err != nil {
+                        return "", fmt.Errorf("%s (%s): %w", backend.Label, backend.Model, err)
+                }
+                checked = append(checked, fmt.Sprintf("%s (%s)", backend.Label, backend.Model))
+        }
+        return strings.Join(checked, ", "), nil
+}
+
+// pingAnalyzer looks up model with the analyzer's provider
+func pingAnalyzer(ctx context.Context, analyzer ReceiptAnalyzer, model string) error {
+        var discard struct{}
+        switch a := analyzer.(type) {
+        case *geminiAnalyzer:
+                _, err := a.client.GenerativeModel(model).Info(ctx)
+                return err
+        case *openAIAnalyzer:
+                return getJSON(ctx, a.baseURL+"/v1/models/"+url.PathEscape(model), map[string]string{"Authorization": "Bearer " + a.apiKey}, &discard)
+        case *anthropicAnalyzer:
+                headers := map[string]string{"x-api-key": a.apiKey, "anthropic-version": anthropicAPIVersion}
+                return getJSON(ctx, a.baseURL+"/v1/models/"+url.PathEscape(model), headers, &discard)
+        case *ollamaAnalyzer:
+                return postJSONWith(ctx, ollamaClient, a.baseURL+"/api/show", nil, map[string]string{"model": model}, &discard)
+        }
+        return nil
+}
+
+// doctorDirectories checks that every watch directory can be read and written to, since
+// originals are moved out of it, and that every destination can be written to
+func doctorDirectories() (string, error) {
+        roots, err := parseWatchRoots(watchDirs, pollDirs, destDir)
+        if err != nil {
+                return "", err
+        }
+        dests := map[string]bool{}
+        if destDir != "" {
+                dests[destDir] = true
+        }
+        for _, root := range roots {
+                if _, err := os.ReadDir(root.Dir); err != nil {
+                        return "", fmt.Errorf("cannot read watch directory: %w", err)
+                }
+                if err := doctorWrite(root.Dir); err != nil {
+                        return "", fmt.Errorf("cannot write to watch directory: %w", err)
+                }
+                dests[root.Dest] = true
+        }
+        if len(dests) == 0 {
+                return "", errors.New("neither -watch nor -dest is set")
+        }
+
+        for dest := range dests {
+                if err := doctorWrite(existingParent(dest)); err != nil {
+                        return "", fmt.Errorf("cannot write to destination: %w", err)
+                }
+        }
+        return fmt.Sprintf("%d watched, %d destinations", len(roots), len(dests)), nil
+}
+
+// doctorFileEvents writes a file into each -watch directory and waits for fsnotify to
+// report it. Network mounts often raise no events, and then need -poll-watch instead.
+func doctorFileEvents() (string, error) {
+        roots, err := parseWatchRoots(watchDirs, nil, destDir)
+        if err != nil {
+                return "", err
+        }
+        watcher, err := fsnotify.NewWatcher()
+        if err != nil {
+                return "", fmt.Errorf("failed to create watcher: %w", err)
+        }
+        defer watcher.Close()
+
+        const timeout = 2 * time.Second
+        for _, root := range roots {
+                if err := watcher.Add(root.Dir); err != nil {
+                        return "", fmt.Errorf("failed to watch directory %s: %w", root.Dir, err)
+                }
+                f, err := os.CreateTemp(root.Dir, ".scanner-bot-doctor-*")
+                if err != nil {
+                        return "", err
+                }
+                f.Close()
+                seen := waitForEvent(watcher, f.Name(), timeout)
+                os.Remove(f.Name())
+                watcher.Remove(root.Dir)
+                if !seen {
+                        return "", fmt.Errorf("no event for a new file in %s within %s; use -poll-watch for this directory", root.Dir, timeout)
+                }
+        }
+        return fmt.Sprintf("events seen in %d watched", len(roots)), nil
+}
+
+// waitForEvent reports whether the watcher sees path created within timeout
+func waitForEvent(watcher *fsnotify.Watcher, path string, timeout time.Duration) bool {
+        deadline := time.After(timeout)
+        for {
+                select {
+                case event := <-watcher.Events:
+                        if event.Name == path && event.Has(fsnotify.Create) {
+                                return true
+                        }
+                case <-watcher.Errors:
+                case <-deadline:
+                        return false
+                }
+        }
+}
+
+// doctorMoves renames a file from each watch directory into its destination to see whether
+// originals can be moved with a rename, or sit on another filesystem and are copied and
+// then deleted. Both work; copying is slower and briefly leaves the file in two places.
+func doctorMoves() (string, error) {
+        roots, err := parseWatchRoots(watchDirs, pollDirs, destDir)
+        if err != nil {
+                return "", err
+        }
+        var copied []string
+        for _, root := range roots {
+                f, err := os.CreateTemp(root.Dir, ".scanner-bot-doctor-*")
+                if err != nil {
+                        return "", err
+                }
+                f.Close()
+                dst := filepath.Join(existingParent(root.Dest), filepath.Base(f.Name()))
+                err = os.Rename(f.Name(), dst)
+                os.Remove(f.Name())
+                os.Remove(dst)
+                switch {
+                case isCrossDevice(err):
+                        copied = append(copied, root.Dir)
+                case err != nil:
+                        return "", fmt.Errorf("failed to move a file from %s to %s: %w", root.Dir, root.Dest, err)
+                }
+        }
+        if len(copied) > 0 {
+                return fmt.Sprintf("%s on another filesystem: originals are copied, then deleted", strings.Join(copied, ", ")), nil
+        }
+        return "same filesystem: originals are renamed into place", nil
+}
+
+// doctorWrite creates and removes a temporary file in dir
+func doctorWrite(dir string) error {
+        f, err := os.CreateTemp(dir, ".scanner-bot-doctor-*")
+        if err != nil {
+                return err
+        }
+        f.Close()
+        return os.Remove(f.Name())
+}
+
+// existingParent returns dir, or its nearest ancestor that exists. A destination that does
+// not exist yet is created on first use, so that ancestor is the one that must be writable.
+func existingParent(dir string) string {
+        for {
+                if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+                        return dir
+                }
+                dir = filepath.Dir(dir)
+        }
+}
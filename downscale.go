@@ -0,0 +1,95 @@
+package main
+
+import (
+        "fmt"
+        "image"
+        "image/jpeg"
+        "log/slog"
+        "os"
+        "path/filepath"
+        "strings"
+)
+
+// downscaleForUpload writes a JPEG copy of a photo whose longest side is over
+// -max-dimension, shrunk to fit and encoded at -upload-quality, into a temp directory
+// that the caller removes. Only the model sees the copy; the full-size file is still what
+// gets filed. PDFs, and images already small enough, are returned unchanged with no directory.
+func downscaleForUpload(path string) (string, string, error) {
+        if format := mediaType(path); format != "image/jpeg" && format != "image/png" {
+                return path, "", nil
+        }
+
+        f, err := os.Open(path)
+        if err != nil {
+                return "", "", err
+        }
+        defer f.Close()
+
+        config, _, err := image.DecodeConfig(f)
+        if err != nil {
+                return "", "", fmt.Errorf("failed to read image size: %w", err)
+        }
+        longest := max(config.Width, config.Height)
+        if longest <= maxDimension {
+                return path, "", nil
+        }
+
+        if _, err := f.Seek(0, 0); err != nil {
+                return "", "", err
+        }
+        img, _, err := image.Decode(f)
+        if err != nil {
+                return "", "", fmt.Errorf("failed to decode image: %w", err)
+        }
+        w := max(config.Width*maxDimension/longest, 1)
+        h := max(config.Height*maxDimension/longest, 1)
+        small := shrinkRGBA(img, w, h)
+
+        dir, err := os.MkdirTemp("", "scanner-bot-upload-*")
+        if err != nil {
+                return "", "", err
+        }
+        out := filepath.Join(dir, strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))+".jpg")
+        file, err := os.Create(out)
+        if err == nil {
+                err = jpeg.Encode(file, small, &jpeg.Options{Quality: uploadQuality})
+                if closeErr := file.Close(); err == nil {
+                        err = closeErr
+                }
+        }
+        if err != nil {
+                os.RemoveAll(dir)
+                return "", "", fmt.Errorf("failed to write upload copy: %w", err)
+        }
+
+        slog.Debug("Downscaled image for upload", "path", path, "from", fmt.Sprintf("%dx%d", config.Width, config.Height), "to", fmt.Sprintf("%dx%d", w, h))
+        return out, dir, nil
+}
+
+// shrinkRGBA scales an image down to w x h by averaging every source pixel under each
+// destination pixel, which keeps thin receipt print legible where sampling would drop it
+func shrinkRGBA(img image.Image, w, h int) *image.RGBA {
+        b := img.Bounds()
+        dst := image.NewRGBA(image.Rect(0, 0, w, h))
+        for dy := 0; dy < h; dy++ {
+                y0, y1 := b.Min.Y+dy*b.Dy()/h, b.Min.Y+(dy+1)*b.Dy()/h
+                for dx := 0; dx < w; dx++ {
+                        x0, x1 := b.Min.X+dx*b.Dx()/w, b.Min.X+(dx+1)*b.Dx()/w
+
+                        var r, g, bl, a, n uint64
+                        for y := y0; y < max(y1, y0+1); y++ {
+                                for x := x0; x < max(x1, x0+1); x++ {
+                                        pr, pg, pb, pa := img.At(x, y).RGBA()
+                                        r, g, bl, a = r+uint64(pr), g+uint64(pg), bl+uint64(pb), a+uint64(pa)
+                                        n++
+                                }
+                        }
+                        i := dst.PixOffset(dx, dy)
+                        dst.Pix[i+0] = uint8(r / n >> 8)
+                        dst.Pix[i+1] = uint8(g / n >> 8)
+                        dst.Pix[i+2] = uint8(bl / n >> 8)
+                        dst.Pix[i+3] = uint8(a / n >> 8)
+                }
+        }
+        return dst
+}
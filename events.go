@@ -0,0 +1,97 @@
+package main
+
+import (
+        "sync"
+        "time"
+)
+
+// eventKind names a step of a file through the pipeline. The names are the ones the log
+// records of the step carry as "event", and the ones WatchEvents clients filter on.
+type eventKind string
+
+const (
+        eventDetected        eventKind = "detected"
+        eventResume          eventKind = "resume"
+        eventStable          eventKind = "stable"
+        eventStabilityFailed eventKind = "stability_failed"
+        eventDuplicate       eventKind = "duplicate"
+        eventAnalysisStart   eventKind = "analysis_start"
+        eventAnalysisEnd     eventKind = "analysis_end"
+        eventSave            eventKind = "save"
+        eventArchive         eventKind = "archive"
+        eventReview          eventKind = "review"
+        eventRetry           eventKind = "retry"
+        eventDeadLetter      eventKind = "dead_letter"
+        eventQuarantine      eventKind = "quarantine"
+)
+
+// eventBuffer is how many events a subscriber can fall behind before it misses some
+const eventBuffer = 256
+
+// pipelineEvent is one step of a file through the pipeline
+type pipelineEvent struct {
+        Time time.Time
+        Kind eventKind
+        // Source is the file as it was found in the watch directory
+        Source string
+        // Path is where the step put it: the processed copy, the archived original, or the
+        // file held in needs-review or failed
+        Path string
+        // Err is why the step failed, or for retry and quarantine why the analysis did
+        Err    error
+        DryRun bool
+
+        // Receipt is what a save filed
+        Receipt *ReceiptData
+        // Receipts is how many receipts an analysis found
+        Receipts int
+        // Duration is how long the file took to stabilize or to analyze
+        Duration time.Duration
+        // Failures counts the failed analyses of a file that is retried or given up on
+        Failures int
+        // Problems are why a file was held for review
+        Problems []string
+}
+
+// pipelineEvents carries the steps of every file to the gRPC WatchEvents stream and the
+// -tui view
+var pipelineEvents = &eventBus{subs: map[chan pipelineEvent]struct{}{}}
+
+// eventBus fans pipeline events out to its subscribers
+type eventBus struct {
+        mu   sync.Mutex
+        subs map[chan pipelineEvent]struct{}
+}
+
+// subscribe returns a channel of the events published from now on and the function that
+// ends the subscription and closes the channel
+func (b *eventBus) subscribe() (<-chan pipelineEvent, func()) {
+        b.mu.Lock()
+        defer b.mu.Unlock()
+        events := make(chan pipelineEvent, eventBuffer)
+        b.subs[events] = struct{}{}
+        return events, func() {
+                b.mu.Lock()
+                defer b.mu.Unlock()
+                if _, ok := b.subs[events]; ok {
+                        delete(b.subs, events)
+                        close(events)
+                }
+        }
+}
+
+// publish never waits: a subscriber too slow to keep up misses events rather than
+// holding up the pipeline
+func (b *eventBus) publish(event pipelineEvent) {
+        if event.Time.IsZero() {
+                event.Time = time.Now()
+        }
+        b.mu.Lock()
+        defer b.mu.Unlock()
+        for events := range b.subs {
+                select {
+                case events <- event:
+                default:
+                }
+        }
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+        "bufio"
+        "fmt"
+        "log/slog"
+        "os"
+        "path/filepath"
+        "strings"
+)
+
+// errorReportSuffix is appended to a quarantined file's name for its error report
+const errorReportSuffix = ".error.txt"
+
+// retryOrQuarantine handles a file whose analysis failed. Until it has failed
+// -max-failures times it stays where it is and errRetryLater tells the worker to try
+// again after -retry-delay; then it is quarantined with its last error and an alert.
+// Without a work queue (-file, -dry-run) there are no retries.
+func retryOrQuarantine(srcPath, hash string, reason error) error {
+        if maxFailures <= 1 || workQueue == nil {
+                quarantineFile(srcPath, reason)
+                return reason
+        }
+
+        failures, err := workQueue.Failed(srcPath, hash, reason)
+        if err != nil {
+                slog.Warn("Failed to update work queue", "path", srcPath, "error", err)
+        }
+        if failures < maxFailures {
+                slog.Warn("Will retry file", "event", "retry", "path", srcPath, "failures", failures, "max_failures", maxFailures, "delay", retryDelay.String(), "error", reason)
+                pipelineEvents.publish(pipelineEvent{Kind: eventRetry, Source: srcPath, Err: reason, Failures: failures})
+                return fmt.Errorf("%w: %w", errRetryLater, reason)
+        }
+
+        metricDeadLetter.Inc()
+        reason = fmt.Errorf("failed %d times, last error: %w", failures, reason)
+        slog.Error("Giving up on file", "event", "dead_letter", "path", srcPath, "failures", failures, "error", reason)
+        pipelineEvents.publish(pipelineEvent{Kind: eventDeadLetter, Source: srcPath, Err: reason, Failures: failures})
+        quarantineFile(srcPath, reason)
+        if webhookURL != "" && !dryRun {
+                notifyDeadLetter(srcPath, failures, reason)
+        }
+        return reason
+}
+
+// retryFailed moves every quarantined file under each destination's failed/ folder back
+// to the directory it originally came from, where the watcher (or the startup scan) picks
+// it up again. Files whose origin is unknown go to fallbackDir.
+func retryFailed(dests []string, fallbackDir string) (int, error) {
+        moved := 0
+        for _, dest := range dests {
+                failedDir := filepath.Join(dest, "failed")
+                entries, err := os.ReadDir(failedDir)
+                if os.IsNotExist(err) {
+                        continue
+                }
+                if err != nil {
+                        return moved, fmt.Errorf("failed to read %s: %w", failedDir, err)
+                }
+
+                for _, entry := range entries {
+                        if entry.IsDir() || strings.HasSuffix(entry.Name(), errorReportSuffix) {
+                                continue
+                        }
+
+                        failedPath := filepath.Join(failedDir, entry.Name())
+                        reportPath := failedPath + errorReportSuffix
+
+                        targetDir := fallbackDir
+                        if origin := quarantineOrigin(reportPath); origin != "" {
+                                targetDir = filepath.Dir(origin)
+                        }
+                        if targetDir == "" {
+                                slog.Warn("Skipping quarantined file: origin unknown and no -watch directory given", "event", "requeue", "source", failedPath)
+                                continue
+                        }
+                        target := filepath.Join(targetDir, entry.Name())
+
+                        if dryRun {
+                                slog.Info("[dry-run] Would re-queue quarantined file", "event", "requeue", "dry_run", true, "path", target, "source", failedPath)
+                                moved++
+                                continue
+                        }
+
+                        if _, err := os.Stat(target); err == nil {
+                                slog.Warn("Skipping quarantined file: target already exists", "event", "requeue", "path", target, "source", failedPath)
+                                continue
+                        }
+                        if err := os.MkdirAll(targetDir, 0755); err != nil {
+                                return moved, fmt.Errorf("failed to create directory %s: %w", targetDir, err)
+                        }
+                        if err := robustMove(failedPath, target); err != nil {
+                                slog.Error("Failed to re-queue quarantined file", "event", "requeue", "path", target, "source", failedPath, "error", err)
+                                continue
+                        }
+                        if err := os.Remove(reportPath); err != nil && !os.IsNotExist(err) {
+                                slog.Warn("Failed to remove error report", "event", "requeue", "path", reportPath, "error", err)
+                        }
+
+                        slog.Info("Re-queued quarantined file", "event", "requeue", "path", target, "source", failedPath)
+                        moved++
+                }
+        }
+        return moved, nil
+}
+
+// quarantineOrigin reads the "file:" line written by quarantineFile
+func quarantineOrigin(reportPath string) string {
+        f, err := os.Open(reportPath)
+        if err != nil {
+                return ""
+        }
+        defer f.Close()
+
+        scanner := bufio.NewScanner(f)
+        for scanner.Scan() {
+                if origin, ok := strings.CutPrefix(scanner.Text(), "file: "); ok {
+                        return origin
+                }
+        }
+        return ""
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+        "context"
+        "errors"
+        "fmt"
+        "log/slog"
+        "sync"
+        "time"
+)
+
+// backendCooldown is how long a backend that just failed is tried last instead of first,
+// so an outage costs one file's retries rather than every file's
+const backendCooldown = 5 * time.Minute
+
+// analysisBackend identifies the provider and model that analyzed a file
+type analysisBackend struct {
+        Provider string
+        Model    string
+}
+
+// chainBackend is one provider in the chain with its own quota and failure state
+type chainBackend struct {
+        provider  string
+        model     string // empty for -provider, which follows -model and -large-model
+        analyzer  ReceiptAnalyzer
+        quota     *quotaGate
+        downUntil time.Time
+}
+
+// analyzerChain tries -provider first and then each -fallback backend in order
+// until one of them returns receipt data
+type analyzerChain struct {
+        mu       sync.Mutex
+        backends []*chainBackend
+}
+
+func (c *analyzerChain) add(provider, model string, analyzer ReceiptAnalyzer, quota *quotaGate) {
+        c.backends = append(c.backends, &chainBackend{provider: provider, model: model, analyzer: analyzer, quota: quota})
+}
+
+// ordered returns healthy backends in configured order, followed by those still cooling down
+func (c *analyzerChain) ordered() []*chainBackend {
+        c.mu.Lock()
+        defer c.mu.Unlock()
+
+        now := time.Now()
+        var healthy, cooling []*chainBackend
+        for _, b := range c.backends {
+                if now.Before(b.downUntil) {
+                        cooling = append(cooling, b)
+                } else {
+                        healthy = append(healthy, b)
+                }
+        }
+        return append(healthy, cooling...)
+}
+
+func (c *analyzerChain) setDown(b *chainBackend, down bool) {
+        c.mu.Lock()
+        defer c.mu.Unlock()
+
+        if down {
+                b.downUntil = time.Now().Add(backendCooldown)
+        } else {
+                b.downUntil = time.Time{}
+        }
+}
+
+func (c *analyzerChain) Analyze(ctx context.Context, path string) ([]ReceiptData, error) {
+        var errs []error
+        for i, b := range c.ordered() {
+                used := analysisBackend{Provider: b.provider, Model: pickModel(b.model, path)}
+
+                dataList, err := b.analyzer.Analyze(withQuota(ctx, b.quota), path)
+                if err == nil {
+                        c.setDown(b, false)
+                        if i > 0 {
+                                slog.Info("Fallback backend succeeded", "path", path, "provider", used.Provider, "model", used.Model)
+                        }
+                        for j := range dataList {
+                                dataList[j].Backend = used
+                        }
+                        return dataList, nil
+                }
+                if len(c.backends) == 1 || ctx.Err() != nil {
+                        return nil, err
+                }
+
+                c.setDown(b, true)
+                slog.Warn("Backend failed, trying the next one", "path", path, "provider", used.Provider, "model", used.Model, "error", err)
+                errs = append(errs, fmt.Errorf("%s: %w", used.Provider, err))
+        }
+        return nil, errors.Join(errs...)
+}
+
+func (c *analyzerChain) Close() error {
+        var errs []error
+        for _, b := range c.backends {
+                errs = append(errs, b.analyzer.Close())
+        }
+        return errors.Join(errs...)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+        "context"
+        "fmt"
+        "log/slog"
+        "strings"
+)
+
+// correctionScan bounds how many of the latest corrections are searched for examples
+const correctionScan = 200
+
+// Correction is a receipt corrected by hand: what the model read from the file with
+// this hash, and what it was corrected to
+type Correction struct {
+        Hash        string
+        Before      ReceiptData
+        After       ReceiptData
+        CorrectedAt string
+}
+
+type sourceHashContextKey struct{}
+
+// withSourceHash tells the analyzers under ctx the SHA-256 of the source file, since the
+// file they are given may be a converted, preprocessed, or split copy of it
+func withSourceHash(ctx context.Context, hash string) context.Context {
+        return context.WithValue(ctx, sourceHashContextKey{}, hash)
+}
+
+func sourceHashFrom(ctx context.Context) string {
+        hash, _ := ctx.Value(sourceHashContextKey{}).(string)
+        return hash
+}
+
+// correctedFields keeps the fields a correction can change, for storing
+func correctedFields(data ReceiptData) ReceiptData {
+        return ReceiptData{Date: data.Date, Vendor: data.Vendor, Category: data.Category, Amount: data.Amount, Currency: data.Currency}
+}
+
+// recordCorrection remembers a receipt corrected in the dashboard or API, so later
+// prompts can learn from it with -prompt-corrections
+func recordCorrection(hash string, before, after ReceiptData) {
+        before, after = correctedFields(before), correctedFields(after)
+        if receiptDB == nil || len(receiptChanges(before, after)) == 0 {
+                return
+        }
+        if err := receiptDB.RecordCorrection(hash, before, after); err != nil {
+                slog.Warn("Failed to record correction", "event", "edit", "error", err)
+        }
+}
+
+// modelReading returns the values the model read for a filed receipt: the sidecar's,
+// unless they were corrected already, in which case the last ones a model produced
+func modelReading(sidecar Sidecar) ReceiptData {
+        if sidecar.Provider != "manual" {
+                return sidecar.ReceiptData
+        }
+        for i := len(sidecar.History) - 1; i >= 0; i-- {
+                if sidecar.History[i].Provider != "manual" {
+                        return sidecar.History[i].ReceiptData
+                }
+        }
+        return sidecar.ReceiptData
+}
+
+// correctionExamples is the part of the prompt that shows the model how it was corrected
+// before: the correction of the source file with this hash, if it was corrected, and the
+// latest corrections of vendor and category names, one per vendor, up to -prompt-corrections
+func correctionExamples(hash string) (string, error) {
+        corrections, err := receiptDB.RecentCorrections(correctionScan)
+        if err != nil {
+                return "", err
+        }
+
+        var b strings.Builder
+        var examples []string
+        seen := map[string]bool{}
+        for _, c := range corrections {
+                if c.Hash != "" && c.Hash == hash && b.Len() == 0 {
+                        fmt.Fprintf(&b, "\nThis file was analyzed before, and the result was corrected by hand to: %s.", correctionValues(c.After, true))
+                }
+                if len(examples) >= promptCorrections || seen[c.After.Vendor] || (c.Before.Vendor == c.After.Vendor && c.Before.Category == c.After.Category) {
+                        continue
+                }
+                seen[c.After.Vendor] = true
+                examples = append(examples, fmt.Sprintf("- read as %s; corrected to %s", correctionValues(c.Before, false), correctionValues(c.After, false)))
+        }
+        if len(examples) > 0 {
+                b.WriteString("\nEarlier results were corrected by hand. If this receipt is from one of these vendors, use the corrected name and category:\n")
+                b.WriteString(strings.Join(examples, "\n"))
+        }
+        return b.String(), nil
+}
+
+// correctionValues describes the vendor and category, or every field a correction keeps
+func correctionValues(data ReceiptData, every bool) string {
+        values := fmt.Sprintf("vendor %q, category %q", data.Vendor, data.Category)
+        if every {
+                values = fmt.Sprintf("date %q, %s, total_amount %s, currency %q", data.Date, values, data.Amount, data.Currency)
+        }
+        return values
+}
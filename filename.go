@@ -0,0 +1,149 @@
+package main
+
+import (
+        "errors"
+        "fmt"
+        "io/fs"
+        "os"
+        "path/filepath"
+        "slices"
+        "strings"
+        "text/template"
+)
+
+// fileNameTemplate is -filename-template, parsed at startup; nil keeps the built-in
+// <category>/<date>_<vendor>_<amount>.ext layout, or <category>/<YYYY>/<MM>/... with -date-folders
+var fileNameTemplate *template.Template
+
+// reservedDirs are the folders the bot keeps for itself under each destination
+var reservedDirs = []string{"originals", "failed", "reports", reviewDirName}
+
+// fileNameData holds the variables available to -filename-template. Text fields
+// are already safe to use as a single path component.
+type fileNameData struct {
+        Date               string // YYYY-MM-DD
+        Year               string
+        Month              string
+        Day                string
+        Vendor             string
+        Category           string
+        Amount             string // 1200 or 12.34
+        Currency           string
+        AmountLabel        string // 1200円 or 12.34EUR, as in the built-in names
+        RegistrationNumber string
+        PaymentMethod      string
+        Original           string // source file name without its extension
+        Ext                string // source extension including the dot
+}
+
+// loadFileNameTemplate parses -filename-template and renders it once with sample data,
+// so typos in field names fail at startup instead of on the first receipt
+func loadFileNameTemplate(text string) (*template.Template, error) {
+        tmpl, err := template.New("filename").Option("missingkey=error").Parse(text)
+        if err != nil {
+                return nil, fmt.Errorf("error parsing filename template: %w", err)
+        }
+        sample := ReceiptData{Date: "2024-05-02", Vendor: "Vendor", Category: "Other", Currency: "JPY"}
+        sample.Amount, _ = parseDecimal("1200")
+        if _, err := renderFileName(tmpl, "scan.jpg", sample); err != nil {
+                return nil, err
+        }
+        return tmpl, nil
+}
+
+// processedRelPath returns where a receipt is filed, relative to its destination directory
+func processedRelPath(srcPath string, data ReceiptData) (string, error) {
+        if fileNameTemplate != nil {
+                return renderFileName(fileNameTemplate, srcPath, data)
+        }
+
+        // Everything but the vendor has a known length, so only the vendor is shortened
+        suffix := "_" + amountLabel(data.Amount, data.Currency)
+        if nameWithRegNo && data.RegistrationNumber != "" {
+                suffix += "_" + data.RegistrationNumber
+        }
+        suffix += receiptExt(srcPath)
+        budget := min(maxFileNameBytes-len(data.Date)-1-len(suffix), maxFieldBytes)
+        vendor := sanitizeName(strings.Join(strings.Fields(data.Vendor), ""), budget)
+
+        name := data.Date + "_" + vendor + suffix
+        category := safeComponent(sanitizeName(data.Category, maxFieldBytes))
+        if dateFolders && len(data.Date) == len("2006-01-02") {
+                return filepath.Join(category, data.Date[:4], data.Date[5:7], name), nil
+        }
+        return filepath.Join(category, name), nil
+}
+
+func renderFileName(tmpl *template.Template, srcPath string, data ReceiptData) (string, error) {
+        ext := receiptExt(srcPath)
+        year, month, day := "", "", ""
+        if parts := strings.Split(data.Date, "-"); len(parts) == 3 {
+                year, month, day = parts[0], parts[1], parts[2]
+        }
+
+        var b strings.Builder
+        err := tmpl.Execute(&b, fileNameData{
+                Date:               data.Date,
+                Year:               year,
+                Month:              month,
+                Day:                day,
+                Vendor:             sanitizeName(strings.Join(strings.Fields(data.Vendor), ""), maxFieldBytes),
+                Category:           sanitizeName(data.Category, maxFieldBytes),
+                Amount:             data.Amount.String(),
+                Currency:           data.Currency,
+                AmountLabel:        amountLabel(data.Amount, data.Currency),
+                RegistrationNumber: data.RegistrationNumber,
+                PaymentMethod:      sanitizeName(data.PaymentMethod, maxFieldBytes),
+                Original:           sanitizeName(strings.TrimSuffix(filepath.Base(srcPath), filepath.Ext(srcPath)), maxFieldBytes),
+                Ext:                ext,
+        })
+        if err != nil {
+                return "", fmt.Errorf("failed to render filename template: %w", err)
+        }
+
+        rel := filepath.Clean(filepath.FromSlash(strings.TrimSpace(b.String())))
+        if rel == "." || filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+                return "", fmt.Errorf("filename template produced %q, which is not a path inside the destination", b.String())
+        }
+        parts := strings.Split(rel, string(filepath.Separator))
+        if slices.Contains(reservedDirs, parts[0]) {
+                return "", fmt.Errorf("filename template produced %q, inside the reserved %s folder", rel, parts[0])
+        }
+        // Literal text in the template, or fields joined by it, may still be too long or reserved
+        for i, part := range parts {
+                parts[i] = safeComponent(fitFileName(part))
+        }
+        return filepath.Join(parts...), nil
+}
+
+// maxNameSuffix bounds the search for a free name; reaching it means something is wrong
+const maxNameSuffix = 1000
+
+// availablePath returns path, or path with a _2, _3, ... suffix before the extension,
+// so a different receipt never overwrites one already filed there. A destination that
+// already holds exactly the source's content is reused, since overwriting it loses
+// nothing and reprocessing the same scan should not pile up copies. Paths in taken are
+// skipped even so, for several receipts saved from one scan.
+func availablePath(path, srcPath string, taken []string) (string, error) {
+        ext := filepath.Ext(path)
+        base := strings.TrimSuffix(path, ext)
+
+        for n := 1; n <= maxNameSuffix; n++ {
+                candidate := path
+                if n > 1 {
+                        candidate = fmt.Sprintf("%s_%d%s", base, n, ext)
+                }
+                if slices.Contains(taken, candidate) {
+                        continue
+                }
+                if _, err := os.Stat(candidate); errors.Is(err, fs.ErrNotExist) {
+                        return candidate, nil
+                } else if err != nil {
+                        return "", err
+                }
+                if verifyCopy(srcPath, candidate) == nil {
+                        return candidate, nil
+                }
+        }
+        return "", fmt.Errorf("no free name for %s after %d attempts", path, maxNameSuffix)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+        "io"
+        "mime"
+        "net/http"
+        "os"
+        "path/filepath"
+        "strings"
+)
+
+// receiptTypes maps the media types sent for analysis to the extension given to
+// processed copies of files that had none, or the wrong one
+var receiptTypes = map[string]string{
+        "image/jpeg":      ".jpg",
+        "image/png":       ".png",
+        "application/pdf": ".pdf",
+}
+
+// extensionTypes is the media type each receipt extension claims to be
+var extensionTypes = map[string]string{
+        ".jpg":  "image/jpeg",
+        ".jpeg": "image/jpeg",
+        ".png":  "image/png",
+        ".pdf":  "application/pdf",
+        ".heic": "image/heic",
+        ".heif": "image/heif",
+        ".webp": "image/webp",
+        ".tif":  "image/tiff",
+        ".tiff": "image/tiff",
+}
+
+// sniffType detects a file's media type from its first bytes, whatever its name says
+func sniffType(path string) (string, error) {
+        f, err := os.Open(path)
+        if err != nil {
+                return "", err
+        }
+        defer f.Close()
+
+        head := make([]byte, 512)
+        n, err := io.ReadFull(f, head)
+        if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+                return "", err
+        }
+        if convertible := sniffConvertible(head[:n]); convertible != "" {
+                return convertible, nil
+        }
+        mediaType, _, _ := mime.ParseMediaType(http.DetectContentType(head[:n]))
+        return mediaType, nil
+}
+
+// mediaType returns the MIME type of a scan from its content, falling back to its
+// extension if the file cannot be read
+func mediaType(path string) string {
+        if sniffed, err := sniffType(path); err == nil {
+                if _, ok := receiptTypes[sniffed]; ok {
+                        return sniffed
+                }
+        }
+        if claimed, ok := extensionTypes[strings.ToLower(filepath.Ext(path))]; ok && receiptTypes[claimed] != "" {
+                return claimed
+        }
+        return "image/jpeg"
+}
+
+// receiptExt is the extension for a processed copy: the file's own when it matches
+// its content (so .jpeg and .JPG are kept), otherwise the one for the detected type
+func receiptExt(path string) string {
+        ext := filepath.Ext(path)
+        detected := mediaType(path)
+        if extensionTypes[strings.ToLower(ext)] == detected {
+                return ext
+        }
+        return receiptTypes[detected]
+}
+
+// isReceiptCandidate reports whether a file is worth waiting on: it has a receipt
+// extension, or none at all, as with photos shared from some phones
+func isReceiptCandidate(path string) bool {
+        ext := filepath.Ext(path)
+        if ext == "" {
+                return true
+        }
+        _, ok := extensionTypes[strings.ToLower(ext)]
+        return ok
+}
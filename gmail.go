@@ -0,0 +1,144 @@
+package main
+
+import (
+        "context"
+        "encoding/base64"
+        "fmt"
+        "log/slog"
+        "net/http"
+        "net/url"
+        "strconv"
+        "strings"
+        "sync"
+        "time"
+)
+
+// gmailAPI is the Gmail endpoint used by -gmail
+const gmailAPI = "https://gmail.googleapis.com/gmail/v1/users/me"
+
+// gmailSource polls Gmail through its REST API with an OAuth refresh token that has the
+// gmail.modify scope. Ingested messages get the scanner-bot label.
+type gmailSource struct {
+        auth *oauthToken
+
+        mu      sync.Mutex
+        labelID string
+}
+
+func (g *gmailSource) Name() string { return "gmail" }
+
+func (g *gmailSource) Poll(ctx context.Context, handle func(raw []byte) error) error {
+        labelID, err := g.label(ctx)
+        if err != nil {
+                return err
+        }
+
+        query := url.Values{"q": {gmailQuery()}}
+        for {
+                var list struct {
+                        Messages []struct {
+                                ID string `json:"id"`
+                        } `json:"messages"`
+                        NextPageToken string `json:"nextPageToken"`
+                }
+                if err := g.call(ctx, http.MethodGet, "/messages?"+query.Encode(), nil, &list); err != nil {
+                        return fmt.Errorf("failed to search Gmail: %w", err)
+                }
+
+                for _, item := range list.Messages {
+                        if ctx.Err() != nil {
+                                return ctx.Err()
+                        }
+                        var msg struct {
+                                Raw string `json:"raw"`
+                        }
+                        if err := g.call(ctx, http.MethodGet, "/messages/"+item.ID+"?format=raw", nil, &msg); err != nil {
+                                return fmt.Errorf("failed to fetch message %s: %w", item.ID, err)
+                        }
+                        raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(msg.Raw, "="))
+                        if err != nil {
+                                return fmt.Errorf("failed to decode message %s: %w", item.ID, err)
+                        }
+                        if err := handle(raw); err != nil {
+                                slog.Error("Failed to ingest message", "event", "mail", "source", g.Name(), "id", item.ID, "error", err)
+                                continue
+                        }
+                        modify := map[string][]string{"addLabelIds": {labelID}}
+                        if err := g.call(ctx, http.MethodPost, "/messages/"+item.ID+"/modify", modify, &struct{}{}); err != nil {
+                                slog.Warn("Failed to label message", "event", "mail", "source", g.Name(), "id", item.ID, "error", err)
+                        }
+                }
+
+                if list.NextPageToken == "" {
+                        return nil
+                }
+                query.Set("pageToken", list.NextPageToken)
+        }
+}
+
+// gmailQuery builds the Gmail search from the -mail-* filters
+func gmailQuery() string {
+        terms := []string{"has:attachment", "-label:" + mailLabel}
+        if mailMaxAge > 0 {
+                terms = append(terms, "newer_than:"+strconv.Itoa(int((mailMaxAge+23*time.Hour)/(24*time.Hour)))+"d")
+        }
+        if senders := mailSenders(); len(senders) > 0 {
+                terms = append(terms, "from:("+strings.Join(senders, " OR ")+")")
+        }
+        if mailSubject != "" {
+                terms = append(terms, "subject:("+mailSubject+")")
+        }
+        return strings.Join(terms, " ")
+}
+
+// label returns the ID of the scanner-bot label, creating it the first time
+func (g *gmailSource) label(ctx context.Context) (string, error) {
+        g.mu.Lock()
+        labelID := g.labelID
+        g.mu.Unlock()
+        if labelID != "" {
+                return labelID, nil
+        }
+
+        var labels struct {
+                Labels []struct {
+                        ID   string `json:"id"`
+                        Name string `json:"name"`
+                } `json:"labels"`
+        }
+        if err := g.call(ctx, http.MethodGet, "/labels", nil, &labels); err != nil {
+                return "", fmt.Errorf("failed to list Gmail labels: %w", err)
+        }
+        for _, label := range labels.Labels {
+                if label.Name == mailLabel {
+                        labelID = label.ID
+                }
+        }
+        if labelID == "" {
+                var created struct {
+                        ID string `json:"id"`
+                }
+                if err := g.call(ctx, http.MethodPost, "/labels", map[string]string{"name": mailLabel}, &created); err != nil {
+                        return "", fmt.Errorf("failed to create Gmail label %s: %w", mailLabel, err)
+                }
+                labelID = created.ID
+        }
+
+        g.mu.Lock()
+        g.labelID = labelID
+        g.mu.Unlock()
+        return labelID, nil
+}
+
+// call sends one Gmail API request and decodes the JSON response into out
+func (g *gmailSource) call(ctx context.Context, method, path string, body, out any) error {
+        token, err := g.auth.Token(ctx)
+        if err != nil {
+                return err
+        }
+        headers := map[string]string{"Authorization": "Bearer " + token}
+        if method == http.MethodPost {
+                return postJSON(ctx, gmailAPI+path, headers, body, out)
+        }
+        return getJSON(ctx, gmailAPI+path, headers, out)
+}
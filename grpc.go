@@ -0,0 +1,324 @@
+package main
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative scannerbot.proto
+
+import (
+        "context"
+        "crypto/subtle"
+        "errors"
+        "log/slog"
+        "net"
+        "slices"
+        "strconv"
+        "strings"
+        "time"
+
+        "google.golang.org/grpc"
+        "google.golang.org/grpc/codes"
+        "google.golang.org/grpc/metadata"
+        "google.golang.org/grpc/peer"
+        "google.golang.org/grpc/status"
+)
+
+// eventMessages describe each kind of event in the message of a PipelineEvent
+var eventMessages = map[eventKind]string{
+        eventDetected:        "Detected file, waiting for write to complete",
+        eventResume:          "Resuming file from the last run",
+        eventStable:          "File is stable",
+        eventStabilityFailed: "Processing aborted",
+        eventDuplicate:       "Skipping file: already processed",
+        eventAnalysisStart:   "Analyzing receipt",
+        eventAnalysisEnd:     "Analysis complete",
+        eventSave:            "Saved processed file",
+        eventArchive:         "Archived original",
+        eventReview:          "Holding file for review",
+        eventRetry:           "Will retry file",
+        eventDeadLetter:      "Giving up on file",
+        eventQuarantine:      "Quarantined file",
+}
+
+// grpcEvent converts a pipeline event for WatchEvents, at the level its log record has
+func grpcEvent(event pipelineEvent) *PipelineEvent {
+        level := slog.LevelInfo
+        switch {
+        case event.Kind == eventDeadLetter:
+                level = slog.LevelError
+        case event.Kind == eventRetry || event.Kind == eventReview || event.Kind == eventQuarantine || event.Kind == eventStabilityFailed:
+                level = slog.LevelWarn
+        case event.Err != nil:
+                level = slog.LevelError
+        }
+
+        out := &PipelineEvent{
+                Time:    event.Time.Format(time.RFC3339Nano),
+                Level:   level.String(),
+                Event:   string(event.Kind),
+                Message: eventMessages[event.Kind],
+                Path:    event.Path,
+                Source:  event.Source,
+                Fields:  map[string]string{},
+        }
+        if event.Err != nil {
+                out.Error = event.Err.Error()
+        }
+        if event.DryRun {
+                out.Fields["dry_run"] = "true"
+        }
+        if data := event.Receipt; data != nil {
+                out.Fields["date"] = data.Date
+                out.Fields["vendor"] = data.Vendor
+                out.Fields["category"] = data.Category
+                out.Fields["amount"] = data.Amount.String()
+                out.Fields["currency"] = data.Currency
+        }
+        if event.Receipts > 0 {
+                out.Fields["receipts"] = strconv.Itoa(event.Receipts)
+        }
+        if event.Duration > 0 {
+                out.Fields["duration_ms"] = strconv.FormatInt(event.Duration.Milliseconds(), 10)
+        }
+        if event.Failures > 0 {
+                out.Fields["failures"] = strconv.Itoa(event.Failures)
+        }
+        if len(event.Problems) > 0 {
+                out.Fields["problems"] = strings.Join(event.Problems, "; ")
+        }
+        return out
+}
+
+// grpcServer serves the ScannerBot service of scannerbot.proto over the database and
+// re-filing behind the JSON API
+type grpcServer struct {
+        UnimplementedScannerBotServer
+        server *grpc.Server
+        // done is closed on shutdown, ending the WatchEvents streams
+        done chan struct{}
+}
+
+// startGRPCServer serves the ScannerBot service on addr in the background. Calls must
+// carry "authorization: Bearer <API_TOKEN>" metadata.
+func startGRPCServer(addr, token string) *grpcServer {
+        srv := grpc.NewServer(
+                grpc.UnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+                        if err := grpcAuth(ctx, token); err != nil {
+                                return nil, err
+                        }
+                        return handler(ctx, req)
+                }),
+                grpc.StreamInterceptor(func(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+                        if err := grpcAuth(stream.Context(), token); err != nil {
+                                return err
+                        }
+                        return handler(srv, stream)
+                }),
+        )
+        s := &grpcServer{server: srv, done: make(chan struct{})}
+        RegisterScannerBotServer(srv, s)
+
+        go func() {
+                lis, err := net.Listen("tcp", addr)
+                if err == nil {
+                        err = srv.Serve(lis)
+                }
+                if err != nil {
+                        slog.Error("gRPC server error", "error", err)
+                }
+        }()
+
+        slog.Info("Serving gRPC", "addr", addr)
+        return s
+}
+
+// stopGRPCServer ends the event streams and gives other calls a few seconds to finish
+func stopGRPCServer(s *grpcServer) {
+        close(s.done)
+        stopped := make(chan struct{})
+        go func() {
+                s.server.GracefulStop()
+                close(stopped)
+        }()
+        select {
+        case <-stopped:
+        case <-time.After(5 * time.Second):
+                slog.Warn("gRPC server shutdown error", "error", "calls still running")
+                s.server.Stop()
+        }
+}
+
+// grpcAuth checks the bearer token in the call's metadata
+func grpcAuth(ctx context.Context, token string) error {
+        md, _ := metadata.FromIncomingContext(ctx)
+        given := ""
+        if values := md.Get("authorization"); len(values) > 0 {
+                given, _ = strings.CutPrefix(values[0], "Bearer ")
+        }
+        if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+                remote := ""
+                if p, ok := peer.FromContext(ctx); ok {
+                        remote = p.Addr.String()
+                }
+                slog.Warn("Rejected gRPC call", "event", "api", "remote", remote, "error", "invalid token")
+                return status.Error(codes.Unauthenticated, "invalid token")
+        }
+        return nil
+}
+
+func (s *grpcServer) ListReceipts(ctx context.Context, req *ListReceiptsRequest) (*ListReceiptsResponse, error) {
+        query := grpcReceiptQuery(req.GetFilter())
+        query.Limit, query.Offset = int(req.GetLimit()), int(req.GetOffset())
+        query, err := checkReceiptQuery(query)
+        if err != nil {
+                return nil, status.Error(codes.InvalidArgument, err.Error())
+        }
+        receipts, err := receiptDB.ListReceipts(query)
+        if err != nil {
+                slog.Error("Failed to list receipts", "event", "api", "error", err)
+                return nil, status.Error(codes.Internal, err.Error())
+        }
+        resp := &ListReceiptsResponse{Limit: int32(query.Limit), Offset: int32(query.Offset)}
+        for _, receipt := range receipts {
+                resp.Receipts = append(resp.Receipts, receiptMessage(apiReceipt{StoredReceipt: receipt}))
+        }
+        return resp, nil
+}
+
+func (s *grpcServer) GetReceipt(ctx context.Context, req *GetReceiptRequest) (*Receipt, error) {
+        receipt, err := grpcLookup(req.GetId())
+        if err != nil {
+                return nil, err
+        }
+        return receiptMessage(newAPIReceipt(receipt)), nil
+}
+
+func (s *grpcServer) UpdateReceipt(ctx context.Context, req *UpdateReceiptRequest) (*Receipt, error) {
+        receipt, err := grpcLookup(req.GetId())
+        if err != nil {
+                return nil, err
+        }
+        patch := receiptPatch{Date: req.Date, Vendor: req.Vendor, Category: req.Category, Currency: req.Currency}
+        if req.TotalAmount != nil {
+                amount, err := parseDecimal(strings.ReplaceAll(strings.TrimSpace(*req.TotalAmount), ",", ""))
+                if err != nil {
+                        return nil, status.Errorf(codes.InvalidArgument, "invalid amount %q", *req.TotalAmount)
+                }
+                patch.Amount = &amount
+        }
+
+        if receipt, err = applyPatch(receipt, patch); err != nil {
+                if errors.Is(err, errInvalidCorrection) {
+                        return nil, status.Error(codes.InvalidArgument, err.Error())
+                }
+                return nil, status.Error(codes.FailedPrecondition, err.Error())
+        }
+        return receiptMessage(newAPIReceipt(receipt)), nil
+}
+
+func (s *grpcServer) GetStats(ctx context.Context, req *GetStatsRequest) (*GetStatsResponse, error) {
+        query, err := checkReceiptQuery(grpcReceiptQuery(req.GetFilter()))
+        if err != nil {
+                return nil, status.Error(codes.InvalidArgument, err.Error())
+        }
+        stats, err := receiptDB.Stats(query)
+        if err != nil {
+                slog.Error("Failed to total receipts", "event", "api", "error", err)
+                return nil, status.Error(codes.Internal, err.Error())
+        }
+        resp := &GetStatsResponse{Receipts: int32(stats.Receipts)}
+        for _, group := range []struct {
+                totals []ReceiptTotal
+                into   *[]*StatsTotal
+        }{{stats.Categories, &resp.Categories}, {stats.Months, &resp.Months}} {
+                for _, total := range group.totals {
+                        *group.into = append(*group.into, &StatsTotal{
+                                Category: total.Category,
+                                Month:    total.Month,
+                                Currency: total.Currency,
+                                Count:    int32(total.Count),
+                                Total:    total.Total,
+                        })
+                }
+        }
+        return resp, nil
+}
+
+func (s *grpcServer) WatchEvents(req *WatchEventsRequest, stream ScannerBot_WatchEventsServer) error {
+        events, unsubscribe := pipelineEvents.subscribe()
+        defer unsubscribe()
+        for {
+                select {
+                case <-stream.Context().Done():
+                        return nil
+                case <-s.done:
+                        return nil
+                case event := <-events:
+                        if len(req.GetEvents()) > 0 && !slices.Contains(req.GetEvents(), string(event.Kind)) {
+                                continue
+                        }
+                        if err := stream.Send(grpcEvent(event)); err != nil {
+                                return err
+                        }
+                }
+        }
+}
+
+// grpcReceiptQuery selects receipts as a ReceiptFilter does
+func grpcReceiptQuery(filter *ReceiptFilter) ReceiptQuery {
+        return ReceiptQuery{
+                Search:   strings.TrimSpace(filter.GetQuery()),
+                Category: strings.TrimSpace(filter.GetCategory()),
+                From:     filter.GetFrom(),
+                To:       filter.GetTo(),
+        }
+}
+
+// grpcLookup returns the receipt with this id, or a NotFound error
+func grpcLookup(id int64) (*StoredReceipt, error) {
+        receipt, err := receiptDB.Receipt(id)
+        if err != nil {
+                slog.Error("Failed to look up receipt", "event", "api", "id", id, "error", err)
+                return nil, status.Error(codes.Internal, err.Error())
+        }
+        if receipt == nil {
+                return nil, status.Errorf(codes.NotFound, "no receipt %d", id)
+        }
+        return receipt, nil
+}
+
+// receiptMessage converts a receipt for the ScannerBot service
+func receiptMessage(receipt apiReceipt) *Receipt {
+        msg := &Receipt{
+                Id:                 receipt.ID,
+                Date:               receipt.Date,
+                Vendor:             receipt.Vendor,
+                Category:           receipt.Category,
+                TotalAmount:        receipt.Amount.String(),
+                Currency:           receipt.Currency,
+                RegistrationNumber: receipt.RegistrationNumber,
+                PaymentMethod:      receipt.PaymentMethod,
+                SourceFile:         receipt.SourceFile,
+                ProcessedPath:      receipt.ProcessedPath,
+                ProcessedAt:        receipt.ProcessedAt,
+        }
+        for _, item := range receipt.Items {
+                msg.Items = append(msg.Items, &ReceiptLineItem{
+                        Description: item.Description,
+                        Quantity:    item.Quantity,
+                        UnitPrice:   item.UnitPrice.String(),
+                        Amount:      item.Amount.String(),
+                })
+        }
+        for _, revision := range receipt.History {
+                msg.History = append(msg.History, &ReceiptRevision{
+                        Date:          revision.Date,
+                        Vendor:        revision.Vendor,
+                        Category:      revision.Category,
+                        TotalAmount:   revision.Amount.String(),
+                        Currency:      revision.Currency,
+                        ProcessedPath: revision.ProcessedPath,
+                        Provider:      revision.Provider,
+                        Model:         revision.Model,
+                        ReplacedAt:    revision.ReplacedAt,
+                })
+        }
+        return msg
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+        "encoding/json"
+        "net/http"
+        "sync"
+        "time"
+)
+
+// healthState is what /healthz and /status report, updated as the bot runs
+type healthState struct {
+        mu sync.Mutex
+
+        startedAt time.Time
+        watching  bool
+        pool      *workerPool
+
+        lastSuccess    time.Time
+        lastFailure    time.Time
+        lastWatcherErr string
+        apiOK          *bool
+        apiCheckedAt   time.Time
+        apiErr         string
+}
+
+var health = healthState{startedAt: time.Now()}
+
+// statusReport is the JSON body of /status
+type statusReport struct {
+        Status         string     `json:"status"`
+        StartedAt      time.Time  `json:"started_at"`
+        Watching       bool       `json:"watching"`
+        WatchDirs      []string   `json:"watch_dirs"`
+        QueueLength    int        `json:"queue_length"`
+        ActiveFiles    int        `json:"active_files"`
+        LastSuccess    *time.Time `json:"last_success,omitempty"`
+        LastFailure    *time.Time `json:"last_failure,omitempty"`
+        LastWatcherErr string     `json:"last_watcher_error,omitempty"`
+        Provider       string     `json:"provider"`
+        API            string     `json:"api"`
+        APICheckedAt   *time.Time `json:"api_checked_at,omitempty"`
+        APIError       string     `json:"api_error,omitempty"`
+}
+
+func (h *healthState) SetWatching(watching bool, pool *workerPool) {
+        h.mu.Lock()
+        defer h.mu.Unlock()
+        h.watching = watching
+        h.pool = pool
+}
+
+// RecordResult notes the outcome of a processed file
+func (h *healthState) RecordResult(err error) {
+        h.mu.Lock()
+        defer h.mu.Unlock()
+        if err == nil {
+                h.lastSuccess = time.Now()
+        } else {
+                h.lastFailure = time.Now()
+        }
+}
+
+func (h *healthState) RecordWatcherError(err error) {
+        h.mu.Lock()
+        defer h.mu.Unlock()
+        h.lastWatcherErr = err.Error()
+}
+
+// RecordAPI notes whether the latest model API call got through
+func (h *healthState) RecordAPI(err error) {
+        h.mu.Lock()
+        defer h.mu.Unlock()
+        ok := err == nil
+        h.apiOK = &ok
+        h.apiCheckedAt = time.Now()
+        h.apiErr = ""
+        if err != nil {
+                h.apiErr = err.Error()
+        }
+}
+
+func (h *healthState) report() statusReport {
+        h.mu.Lock()
+        defer h.mu.Unlock()
+
+        r := statusReport{
+                Status:         "ok",
+                StartedAt:      h.startedAt,
+                Watching:       h.watching,
+                LastWatcherErr: h.lastWatcherErr,
+                Provider:       provider,
+                API:            "unknown",
+                APIError:       h.apiErr,
+        }
+        if !h.watching {
+                r.Status = "not watching"
+        }
+        for _, root := range watchRoots {
+                r.WatchDirs = append(r.WatchDirs, root.Dir)
+        }
+        if h.pool != nil {
+                r.QueueLength = h.pool.Queued()
+        }
+        activeFiles.Range(func(_, _ any) bool {
+                r.ActiveFiles++
+                return true
+        })
+        if !h.lastSuccess.IsZero() {
+                r.LastSuccess = &h.lastSuccess
+        }
+        if !h.lastFailure.IsZero() {
+                r.LastFailure = &h.lastFailure
+        }
+        if h.apiOK != nil {
+                r.API = "ok"
+                if !*h.apiOK {
+                        r.API = "error"
+                }
+                r.APICheckedAt = &h.apiCheckedAt
+        }
+        return r
+}
+
+// handleHealthz is a liveness probe: 200 while the watcher is running, 503 otherwise
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+        report := health.report()
+        if !report.Watching {
+                http.Error(w, report.Status, http.StatusServiceUnavailable)
+                return
+        }
+        w.Write([]byte("ok\n"))
+}
+
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+        enc := json.NewEncoder(w)
+        enc.SetIndent("", "  ")
+        enc.Encode(health.report())
+}
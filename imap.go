@@ -0,0 +1,268 @@
+package main
+
+import (
+        "bufio"
+        "context"
+        "crypto/tls"
+        "fmt"
+        "io"
+        "log/slog"
+        "net"
+        "net/url"
+        "regexp"
+        "strconv"
+        "strings"
+        "time"
+)
+
+// imapKeyword is the IMAP keyword set on ingested messages
+const imapKeyword = "$" + mailLabel
+
+// imapSource polls one mailbox over IMAP. The connection lasts for one poll, so idle
+// timeouts and server restarts between polls do not matter.
+type imapSource struct {
+        addr     string
+        host     string
+        implicit bool
+        user     string
+        password string
+        mailbox  string
+}
+
+// newIMAPSource parses -imap-url: imaps://user@host[:port]/mailbox, or imap:// for a
+// server that upgrades with STARTTLS. The mailbox defaults to INBOX.
+func newIMAPSource(rawURL, password string) (*imapSource, error) {
+        u, err := url.Parse(rawURL)
+        if err != nil || (u.Scheme != "imaps" && u.Scheme != "imap") || u.Hostname() == "" || u.User.Username() == "" {
+                return nil, fmt.Errorf("invalid -imap-url %q: expected imaps://user@host/mailbox", rawURL)
+        }
+        if password == "" {
+                return nil, fmt.Errorf("-imap-url requires the IMAP_PASSWORD environment variable")
+        }
+
+        source := &imapSource{
+                host:     u.Hostname(),
+                implicit: u.Scheme == "imaps",
+                user:     u.User.Username(),
+                password: password,
+                mailbox:  strings.TrimPrefix(u.Path, "/"),
+        }
+        port := u.Port()
+        if port == "" {
+                port = "143"
+                if source.implicit {
+                        port = "993"
+                }
+        }
+        source.addr = net.JoinHostPort(source.host, port)
+        if source.mailbox == "" {
+                source.mailbox = "INBOX"
+        }
+        return source, nil
+}
+
+func (s *imapSource) Name() string { return "imap" }
+
+func (s *imapSource) Poll(ctx context.Context, handle func(raw []byte) error) error {
+        conn, err := s.dial(ctx)
+        if err != nil {
+                return err
+        }
+        defer conn.Close()
+        // Shutdown interrupts a fetch in progress
+        stop := context.AfterFunc(ctx, func() { conn.Close() })
+        defer stop()
+
+        if _, err := conn.Command("LOGIN %s %s", imapQuote(s.user), imapQuote(s.password)); err != nil {
+                return fmt.Errorf("failed to log in to %s: %w", s.addr, err)
+        }
+        if _, err := conn.Command("SELECT %s", imapQuote(s.mailbox)); err != nil {
+                return fmt.Errorf("failed to open mailbox %s: %w", s.mailbox, err)
+        }
+
+        responses, err := conn.Command("UID SEARCH %s", imapCriteria(time.Now()))
+        if err != nil {
+                return fmt.Errorf("failed to search mailbox %s: %w", s.mailbox, err)
+        }
+        var uids []string
+        for _, resp := range responses {
+                if fields := strings.Fields(resp.Line); len(fields) > 1 && strings.EqualFold(fields[1], "SEARCH") {
+                        uids = append(uids, fields[2:]...)
+                }
+        }
+
+        for _, uid := range uids {
+                if ctx.Err() != nil {
+                        return ctx.Err()
+                }
+                responses, err := conn.Command("UID FETCH %s (BODY.PEEK[])", uid)
+                if err != nil {
+                        return fmt.Errorf("failed to fetch message %s: %w", uid, err)
+                }
+                var raw []byte
+                for _, resp := range responses {
+                        if len(resp.Literals) > 0 {
+                                raw = resp.Literals[0]
+                        }
+                }
+                if raw == nil {
+                        continue
+                }
+                if err := handle(raw); err != nil {
+                        slog.Error("Failed to ingest message", "event", "mail", "source", s.Name(), "uid", uid, "error", err)
+                        continue
+                }
+                // Servers without custom keywords still get the message marked read; the
+                // Message-ID record keeps it from being ingested twice
+                if _, err := conn.Command("UID STORE %s +FLAGS.SILENT (%s \\Seen)", uid, imapKeyword); err != nil {
+                        if _, err := conn.Command("UID STORE %s +FLAGS.SILENT (\\Seen)", uid); err != nil {
+                                slog.Warn("Failed to mark message", "event", "mail", "source", s.Name(), "uid", uid, "error", err)
+                        }
+                }
+        }
+
+        conn.Command("LOGOUT")
+        return nil
+}
+
+// imapCriteria builds the UID SEARCH criteria from the -mail-* filters
+func imapCriteria(now time.Time) string {
+        criteria := []string{"UNKEYWORD " + imapKeyword}
+        if mailMaxAge > 0 {
+                criteria = append(criteria, "SINCE "+now.Add(-mailMaxAge).Format("2-Jan-2006"))
+        }
+        if senders := mailSenders(); len(senders) > 0 {
+                // OR takes two keys, so n senders need n-1 of them in front
+                criteria = append(criteria, strings.Repeat("OR ", len(senders)-1)+"FROM "+strings.Join(quoteAll(senders), " FROM "))
+        }
+        if mailSubject != "" {
+                criteria = append(criteria, "SUBJECT "+imapQuote(mailSubject))
+        }
+        return strings.Join(criteria, " ")
+}
+
+func quoteAll(values []string) []string {
+        quoted := make([]string, len(values))
+        for i, value := range values {
+                quoted[i] = imapQuote(value)
+        }
+        return quoted
+}
+
+// imapQuote makes an IMAP quoted string
+func imapQuote(s string) string {
+        return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// imapConn is a minimal IMAP4rev1 client: enough to log in, search, fetch, and flag
+type imapConn struct {
+        conn net.Conn
+        r    *bufio.Reader
+        tag  int
+}
+
+// imapResponse is one untagged response line; each {n} literal in it is read into Literals
+type imapResponse struct {
+        Line     string
+        Literals [][]byte
+}
+
+// imapLiteral matches the {n} that announces a literal at the end of a line
+var imapLiteral = regexp.MustCompile(`\{(\d+)\}$`)
+
+func (s *imapSource) dial(ctx context.Context) (*imapConn, error) {
+        dialer := &net.Dialer{Timeout: 30 * time.Second}
+        var conn net.Conn
+        var err error
+        if s.implicit {
+                conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: s.host}}).DialContext(ctx, "tcp", s.addr)
+        } else {
+                conn, err = dialer.DialContext(ctx, "tcp", s.addr)
+        }
+        if err != nil {
+                return nil, fmt.Errorf("failed to connect to %s: %w", s.addr, err)
+        }
+
+        c := &imapConn{conn: conn, r: bufio.NewReader(conn)}
+        conn.SetDeadline(time.Now().Add(time.Minute))
+        if _, err := c.readLine(); err != nil {
+                conn.Close()
+                return nil, fmt.Errorf("failed to connect to %s: %w", s.addr, err)
+        }
+        if !s.implicit {
+                if _, err := c.Command("STARTTLS"); err != nil {
+                        conn.Close()
+                        return nil, fmt.Errorf("%s does not support STARTTLS: %w", s.addr, err)
+                }
+                tlsConn := tls.Client(conn, &tls.Config{ServerName: s.host})
+                if err := tlsConn.HandshakeContext(ctx); err != nil {
+                        conn.Close()
+                        return nil, fmt.Errorf("failed to start TLS with %s: %w", s.addr, err)
+                }
+                c.conn, c.r = tlsConn, bufio.NewReader(tlsConn)
+        }
+        return c, nil
+}
+
+func (c *imapConn) Close() error {
+        return c.conn.Close()
+}
+
+// Command sends one tagged command and returns its untagged responses, or an error
+// unless the server answers OK
+func (c *imapConn) Command(format string, args ...any) ([]imapResponse, error) {
+        c.tag++
+        tag := "a" + strconv.Itoa(c.tag)
+        c.conn.SetDeadline(time.Now().Add(2 * time.Minute))
+        if _, err := fmt.Fprintf(c.conn, "%s "+format+"\r\n", append([]any{tag}, args...)...); err != nil {
+                return nil, err
+        }
+
+        var responses []imapResponse
+        for {
+                resp, err := c.readResponse()
+                if err != nil {
+                        return nil, err
+                }
+                if rest, ok := strings.CutPrefix(resp.Line, tag+" "); ok {
+                        if !strings.HasPrefix(strings.ToUpper(rest), "OK") {
+                                return nil, fmt.Errorf("%s", rest)
+                        }
+                        return responses, nil
+                }
+                responses = append(responses, resp)
+        }
+}
+
+// readResponse reads a line and every literal it continues with
+func (c *imapConn) readResponse() (imapResponse, error) {
+        var resp imapResponse
+        for {
+                line, err := c.readLine()
+                if err != nil {
+                        return resp, err
+                }
+                resp.Line += line
+                match := imapLiteral.FindStringSubmatch(line)
+                if match == nil {
+                        return resp, nil
+                }
+                size, err := strconv.Atoi(match[1])
+                if err != nil {
+                        return resp, err
+                }
+                literal := make([]byte, size)
+                if _, err := io.ReadFull(c.r, literal); err != nil {
+                        return resp, err
+                }
+                resp.Literals = append(resp.Literals, literal)
+        }
+}
+
+func (c *imapConn) readLine() (string, error) {
+        line, err := c.r.ReadString('\n')
+        if err != nil {
+                return "", err
+        }
+        return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+        "log/slog"
+        "strings"
+)
+
+// normalizeRegistrationNumber returns a qualified invoice issuer number as "T" plus
+// 13 digits, folding full-width characters and dropping the spaces and hyphens some
+// receipts print. Anything else is dropped with a warning, so a misread number never
+// reaches a filename or the books.
+func normalizeRegistrationNumber(raw string) string {
+        var b strings.Builder
+        for _, r := range strings.TrimSpace(raw) {
+                switch {
+                case r >= '０' && r <= '９':
+                        b.WriteRune('0' + (r - '０'))
+                case r == 'Ｔ' || r == 'ｔ' || r == 't':
+                        b.WriteRune('T')
+                case r == ' ' || r == '　' || r == '-' || r == '－' || r == 'ー':
+                        continue
+                default:
+                        b.WriteRune(r)
+                }
+        }
+        number := b.String()
+        if number == "" {
+                return ""
+        }
+
+        if !isRegistrationNumber(number) {
+                slog.Warn("Ignoring invalid invoice registration number", "registration_number", raw)
+                return ""
+        }
+        if !registrationCheckDigitOK(number[1:]) {
+                slog.Warn("Invoice registration number fails its check digit, it may be misread", "registration_number", number)
+        }
+        return number
+}
+
+func isRegistrationNumber(s string) bool {
+        if len(s) != 14 || s[0] != 'T' {
+                return false
+        }
+        for _, c := range s[1:] {
+                if c < '0' || c > '9' {
+                        return false
+                }
+        }
+        return true
+}
+
+// registrationCheckDigitOK verifies the leading check digit of the 13 digits, which
+// follow the corporate number scheme: 9 minus the weighted sum of the other twelve
+// (weights 1 and 2 alternating from the right) modulo 9
+func registrationCheckDigitOK(digits string) bool {
+        sum := 0
+        for i := 1; i < len(digits); i++ {
+                digit := int(digits[len(digits)-i] - '0')
+                if i%2 == 0 {
+                        sum += digit * 2
+                } else {
+                        sum += digit
+                }
+        }
+        return int(digits[0]-'0') == 9-sum%9
+}
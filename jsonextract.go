@@ -0,0 +1,84 @@
+package main
+
+import (
+        "strings"
+)
+
+// maxJSONCandidates bounds how many opening brackets jsonCandidates collects for
+// parseReceiptResponse before giving up
+const maxJSONCandidates = 20
+
+// jsonCandidates returns the balanced JSON objects and arrays in text, in order of
+// their opening bracket. Models wrap their answer in ```json fences, or add a sentence
+// before or after it; whatever surrounds the JSON is skipped. An unclosed value runs to
+// the end of the text.
+func jsonCandidates(text string) []string {
+        var candidates []string
+        for start := 0; start < len(text) && len(candidates) < maxJSONCandidates; start++ {
+                if text[start] != '{' && text[start] != '[' {
+                        continue
+                }
+                candidates = append(candidates, text[start:balancedEnd(text, start)])
+        }
+        return candidates
+}
+
+// balancedEnd returns the index just past the bracket that closes text[start],
+// ignoring brackets inside strings, or len(text) if it is never closed
+func balancedEnd(text string, start int) int {
+        depth := 0
+        inString, escaped := false, false
+        for i := start; i < len(text); i++ {
+                c := text[i]
+                switch {
+                case inString:
+                        if escaped {
+                                escaped = false
+                        } else if c == '\\' {
+                                escaped = true
+                        } else if c == '"' {
+                                inString = false
+                        }
+                case c == '"':
+                        inString = true
+                case c == '{' || c == '[':
+                        depth++
+                case c == '}' || c == ']':
+                        depth--
+                        if depth == 0 {
+                                return i + 1
+                        }
+                }
+        }
+        return len(text)
+}
+
+// repairJSON fixes the small mistakes models make that encoding/json rejects:
+// typographic quotes in place of ASCII ones and trailing commas before } or ]
+func repairJSON(text string) string {
+        text = strings.NewReplacer("“", `"`, "”", `"`).Replace(text)
+
+        var b strings.Builder
+        inString, escaped := false, false
+        for i := 0; i < len(text); i++ {
+                c := text[i]
+                switch {
+                case inString:
+                        if escaped {
+                                escaped = false
+                        } else if c == '\\' {
+                                escaped = true
+                        } else if c == '"' {
+                                inString = false
+                        }
+                case c == '"':
+                        inString = true
+                case c == ',':
+                        if next := strings.TrimLeft(text[i+1:], " \t\r\n"); strings.HasPrefix(next, "}") || strings.HasPrefix(next, "]") {
+                                continue
+                        }
+                }
+                b.WriteByte(c)
+        }
+        return b.String()
+}
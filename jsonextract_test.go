@@ -0,0 +1,87 @@
+package main
+
+import (
+        "slices"
+        "testing"
+)
+
+func TestJSONCandidates(t *testing.T) {
+        tests := []struct {
+                name string
+                in   string
+                want []string
+        }{
+                {"bare", `{"vendor":"A"}`, []string{`{"vendor":"A"}`}},
+                {"fenced", "```json\n{\"vendor\":\"A\"}\n```", []string{`{"vendor":"A"}`}},
+                {"prose around", `Here is the receipt: {"vendor":"A"} Let me know if you need more.`, []string{`{"vendor":"A"}`}},
+                // Brackets in strings don't end the object; they are tried as candidates of their own later
+                {"brackets in strings", `{"vendor":"A {B} [C]"}`, []string{`{"vendor":"A {B} [C]"}`, `{B}`, `[C]`}},
+                {"escaped quote", `{"vendor":"A \"}\" B"} done`, []string{`{"vendor":"A \"}\" B"}`}},
+                {"escaped backslash", `{"vendor":"A\\"} done`, []string{`{"vendor":"A\\"}`}},
+                {"unclosed", `Result: {"vendor":"A", "total_amount": 1`, []string{`{"vendor":"A", "total_amount": 1`}},
+                {"array then elements", `[{"vendor":"A"},{"vendor":"B"}]`, []string{`[{"vendor":"A"},{"vendor":"B"}]`, `{"vendor":"A"}`, `{"vendor":"B"}`}},
+                {"none", "no receipt found", nil},
+        }
+        for _, tt := range tests {
+                if got := jsonCandidates(tt.in); !slices.Equal(got, tt.want) {
+                        t.Errorf("%s: jsonCandidates(%q) = %q, want %q", tt.name, tt.in, got, tt.want)
+                }
+        }
+}
+
+func TestRepairJSON(t *testing.T) {
+        tests := []struct {
+                name string
+                in   string
+                want string
+        }{
+                {"trailing comma in object", `{"vendor":"A",}`, `{"vendor":"A"}`},
+                {"trailing comma in array", "[{\"vendor\":\"A\"},\n]", "[{\"vendor\":\"A\"}\n]"},
+                {"comma inside string kept", `{"vendor":"A,}"}`, `{"vendor":"A,}"}`},
+                {"comma after escaped quote kept", `{"vendor":"A\",}"}`, `{"vendor":"A\",}"}`},
+                {"typographic quotes", `{“vendor”: “A”}`, `{"vendor": "A"}`},
+                {"valid unchanged", `{"vendor":"A","total_amount":1}`, `{"vendor":"A","total_amount":1}`},
+        }
+        for _, tt := range tests {
+                if got := repairJSON(tt.in); got != tt.want {
+                        t.Errorf("%s: repairJSON(%q) = %q, want %q", tt.name, tt.in, got, tt.want)
+                }
+        }
+}
+
+func TestParseReceiptResponse(t *testing.T) {
+        tests := []struct {
+                name    string
+                in      string
+                vendors []string
+        }{
+                {"fenced object", "```json\n{\"vendor\":\"A\",\"total_amount\":1200}\n```", []string{"A"}},
+                {"prose and trailing comma", "Sure! {\"vendor\":\"A\",\"total_amount\":1200,}\nHope that helps.", []string{"A"}},
+                {"typographic quotes", `{“vendor”: “A”, “total_amount”: 1200}`, []string{"A"}},
+                // The array comes first, so its first element is not taken as the whole answer
+                {"array", `[{"vendor":"A","total_amount":1},{"vendor":"B","total_amount":2}]`, []string{"A", "B"}},
+                {"fenced array", "```json\n[\n  {\"vendor\":\"A\"},\n  {\"vendor\":\"B\"},\n]\n```", []string{"A", "B"}},
+                // An unclosed array falls back to the first complete object inside it
+                {"unclosed array", `[{"vendor":"A"},{"vendor":"B"`, []string{"A"}},
+        }
+        for _, tt := range tests {
+                dataList, err := parseReceiptResponse(tt.in)
+                if err != nil {
+                        t.Errorf("%s: parseReceiptResponse error: %v", tt.name, err)
+                        continue
+                }
+                var vendors []string
+                for _, data := range dataList {
+                        vendors = append(vendors, data.Vendor)
+                }
+                if !slices.Equal(vendors, tt.vendors) {
+                        t.Errorf("%s: vendors = %q, want %q", tt.name, vendors, tt.vendors)
+                }
+        }
+
+        for _, in := range []string{"", "I could not read this receipt.", `{"vendor":"A", "total_amount": 1`} {
+                if dataList, err := parseReceiptResponse(in); err == nil {
+                        t.Errorf("parseReceiptResponse(%q) = %+v, want an error", in, dataList)
+                }
+        }
+}
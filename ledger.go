@@ -0,0 +1,96 @@
+package main
+
+import (
+        "bufio"
+        "bytes"
+        "encoding/csv"
+        "errors"
+        "fmt"
+        "io/fs"
+        "os"
+        "strings"
+        "sync"
+)
+
+var ledgerHeader = []string{"date", "vendor", "category", "amount", "source_file", "dest_file", "currency"}
+
+// ledgerMu serializes appends from concurrent workers
+var ledgerMu sync.Mutex
+
+// appendLedger adds one row per saved receipt to the -ledger CSV, writing the header
+// first when the file is new or empty. Ledgers started before the currency column
+// existed keep their six columns.
+func appendLedger(path string, data ReceiptData, srcPath, processedPath string) error {
+        ledgerMu.Lock()
+        defer ledgerMu.Unlock()
+
+        f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0644)
+        if err != nil {
+                return fmt.Errorf("failed to open ledger: %w", err)
+        }
+        defer f.Close()
+
+        info, err := f.Stat()
+        if err != nil {
+                return err
+        }
+
+        row := []string{data.Date, data.Vendor, data.Category, data.Amount.String(), srcPath, processedPath, data.Currency}
+
+        w := csv.NewWriter(f)
+        if info.Size() == 0 {
+                w.Write(ledgerHeader)
+        } else if header, _ := bufio.NewReader(f).ReadString('\n'); !strings.Contains(header, "currency") {
+                row = row[:6]
+        }
+        w.Write(row)
+        w.Flush()
+        if err := w.Error(); err != nil {
+                return fmt.Errorf("failed to write ledger: %w", err)
+        }
+        return f.Sync()
+}
+
+// updateLedger rewrites the -ledger row of a receipt that was re-filed from oldPath to
+// newPath with its new values. Receipts saved before the ledger was set up have no row.
+func updateLedger(path, oldPath, newPath string, data ReceiptData) error {
+        ledgerMu.Lock()
+        defer ledgerMu.Unlock()
+
+        content, err := os.ReadFile(path)
+        if errors.Is(err, fs.ErrNotExist) {
+                return nil
+        }
+        if err != nil {
+                return fmt.Errorf("failed to read ledger: %w", err)
+        }
+        r := csv.NewReader(bytes.NewReader(content))
+        r.FieldsPerRecord = -1
+        rows, err := r.ReadAll()
+        if err != nil {
+                return fmt.Errorf("failed to read ledger: %w", err)
+        }
+
+        found := false
+        for i, row := range rows {
+                if i == 0 || len(row) < 6 || row[5] != oldPath {
+                        continue
+                }
+                row[0], row[1], row[2], row[3], row[5] = data.Date, data.Vendor, data.Category, data.Amount.String(), newPath
+                if len(row) > 6 {
+                        row[6] = data.Currency
+                }
+                found = true
+        }
+        if !found {
+                return nil
+        }
+
+        var b bytes.Buffer
+        w := csv.NewWriter(&b)
+        w.WriteAll(rows)
+        if err := w.Error(); err != nil {
+                return fmt.Errorf("failed to write ledger: %w", err)
+        }
+        return writeFileAtomic(path, b.Bytes())
+}
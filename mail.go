@@ -0,0 +1,285 @@
+package main
+
+import (
+        "bytes"
+        "context"
+        "crypto/sha256"
+        "encoding/base64"
+        "encoding/hex"
+        "encoding/json"
+        "fmt"
+        "io"
+        "log/slog"
+        "mime"
+        "mime/multipart"
+        "mime/quotedprintable"
+        "net/mail"
+        "net/textproto"
+        "os"
+        "path/filepath"
+        "strings"
+        "sync"
+        "time"
+)
+
+// mailFileName lives next to the state file and records the Message-ID of every email
+// whose attachments were downloaded, so a message is ingested once even if marking it
+// on the server fails or it arrives in both an IMAP mailbox and Gmail
+const mailFileName = ".scanner-bot-mail.json"
+
+// mailLabel marks ingested messages on the server: a Gmail label, or an IMAP keyword
+const mailLabel = "scanner-bot"
+
+// mailSource finds messages matching the -mail-* filters that have not been marked yet.
+// Poll calls handle with each raw RFC 5322 message and marks the message on the server
+// once handle returns nil.
+type mailSource interface {
+        Name() string
+        Poll(ctx context.Context, handle func(raw []byte) error) error
+}
+
+// mailSources are configured at startup by -imap-url and -gmail
+var mailSources []mailSource
+
+// setupMailSources builds the mailboxes requested by flags, reading their secrets from
+// the environment like the API keys
+func setupMailSources() ([]mailSource, error) {
+        var sources []mailSource
+        if imapURL != "" {
+                source, err := newIMAPSource(imapURL, os.Getenv("IMAP_PASSWORD"))
+                if err != nil {
+                        return nil, err
+                }
+                sources = append(sources, source)
+        }
+        if gmailInbox {
+                clientID, secret, refresh := os.Getenv("GMAIL_CLIENT_ID"), os.Getenv("GMAIL_CLIENT_SECRET"), os.Getenv("GMAIL_REFRESH_TOKEN")
+                if clientID == "" || secret == "" || refresh == "" {
+                        return nil, fmt.Errorf("-gmail requires the GMAIL_CLIENT_ID, GMAIL_CLIENT_SECRET, and GMAIL_REFRESH_TOKEN environment variables")
+                }
+                sources = append(sources, &gmailSource{auth: newOAuthToken("Gmail", googleTokenURL, clientID, secret, refresh)})
+        }
+        return sources, nil
+}
+
+// mailSenders splits -mail-from into its addresses or domains
+func mailSenders() []string {
+        var senders []string
+        for _, sender := range strings.Split(mailFrom, ",") {
+                if sender = strings.TrimSpace(sender); sender != "" {
+                        senders = append(senders, sender)
+                }
+        }
+        return senders
+}
+
+// MailState tracks the Message-IDs already ingested
+type MailState struct {
+        mu       sync.Mutex
+        path     string
+        Messages map[string]time.Time `json:"messages"`
+}
+
+// loadMailState reads the mail state file, starting empty if it doesn't exist yet
+func loadMailState(path string) (*MailState, error) {
+        state := &MailState{path: path, Messages: map[string]time.Time{}}
+
+        content, err := os.ReadFile(path)
+        if os.IsNotExist(err) {
+                return state, nil
+        }
+        if err != nil {
+                return nil, fmt.Errorf("error reading mail state file: %w", err)
+        }
+
+        if err := json.Unmarshal(content, state); err != nil {
+                return nil, fmt.Errorf("error parsing mail state file %s: %w", path, err)
+        }
+        if state.Messages == nil {
+                state.Messages = map[string]time.Time{}
+        }
+        return state, nil
+}
+
+// Seen reports whether the message was already ingested
+func (s *MailState) Seen(messageID string) bool {
+        s.mu.Lock()
+        defer s.mu.Unlock()
+
+        _, ok := s.Messages[messageID]
+        return ok
+}
+
+// MarkSeen records the message and atomically rewrites the mail state file. Entries
+// older than -mail-max-age, which no search returns any more, are dropped.
+func (s *MailState) MarkSeen(messageID string) error {
+        s.mu.Lock()
+        defer s.mu.Unlock()
+
+        now := time.Now()
+        s.Messages[messageID] = now
+        for id, seen := range s.Messages {
+                if now.Sub(seen) > 2*mailMaxAge {
+                        delete(s.Messages, id)
+                }
+        }
+
+        content, err := json.MarshalIndent(s, "", "  ")
+        if err != nil {
+                return err
+        }
+        return writeFileAtomic(s.path, content)
+}
+
+// pollMail checks every mailbox now and then every -mail-interval until ctx is cancelled,
+// saving matching attachments into dir, where the watcher picks them up
+func pollMail(ctx context.Context, state *MailState, dir string) {
+        ticker := time.NewTicker(mailInterval)
+        defer ticker.Stop()
+
+        for {
+                for _, source := range mailSources {
+                        err := source.Poll(ctx, func(raw []byte) error {
+                                return ingestMessage(state, raw, dir)
+                        })
+                        if err != nil && ctx.Err() == nil {
+                                slog.Error("Failed to check mailbox", "event", "mail", "source", source.Name(), "error", err)
+                        }
+                }
+
+                select {
+                case <-ticker.C:
+                case <-ctx.Done():
+                        return
+                }
+        }
+}
+
+// ingestMessage saves the attachments of a message not ingested before
+func ingestMessage(state *MailState, raw []byte, dir string) error {
+        msg, err := mail.ReadMessage(bytes.NewReader(raw))
+        if err != nil {
+                return fmt.Errorf("failed to parse message: %w", err)
+        }
+
+        // Messages without a Message-ID are identified by their content
+        messageID := strings.TrimSpace(msg.Header.Get("Message-Id"))
+        if messageID == "" {
+                sum := sha256.Sum256(raw)
+                messageID = "sha256:" + hex.EncodeToString(sum[:])
+        }
+        subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+        if state.Seen(messageID) {
+                slog.Debug("Skipping message already ingested", "event", "mail", "message_id", messageID)
+                return nil
+        }
+
+        attachments, err := mailAttachments(textproto.MIMEHeader(msg.Header), msg.Body)
+        if err != nil {
+                return fmt.Errorf("failed to read attachments of %q: %w", subject, err)
+        }
+
+        // The prefix keeps attachments of different messages apart, even with the same name
+        sum := sha256.Sum256([]byte(messageID))
+        prefix := time.Now().Format("20060102") + "-" + hex.EncodeToString(sum[:4]) + "-"
+        for _, attachment := range attachments {
+                path := filepath.Join(dir, fitFileName(safeComponent(prefix+sanitizeName(attachment.Name, maxFileNameBytes))))
+                path, err := writeIncoming(path, attachment.Data)
+                if err != nil {
+                        return fmt.Errorf("failed to save attachment %s: %w", attachment.Name, err)
+                }
+                slog.Info("Saved email attachment", "event", "mail", "path", path, "subject", subject, "from", msg.Header.Get("From"))
+        }
+        if len(attachments) == 0 {
+                slog.Debug("No receipt attachments in message", "event", "mail", "subject", subject)
+        }
+        return state.MarkSeen(messageID)
+}
+
+// mailAttachment is one file attached to an email
+type mailAttachment struct {
+        Name string
+        Data []byte
+}
+
+// mailAttachments walks a MIME entity and returns the attachments of a receipt file type
+// whose name matches -mail-attachment, descending into nested multiparts
+func mailAttachments(header textproto.MIMEHeader, body io.Reader) ([]mailAttachment, error) {
+        mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+        if err != nil {
+                mediaType = "text/plain"
+        }
+
+        if strings.HasPrefix(mediaType, "multipart/") {
+                var attachments []mailAttachment
+                reader := multipart.NewReader(body, params["boundary"])
+                for {
+                        part, err := reader.NextRawPart()
+                        if err == io.EOF {
+                                return attachments, nil
+                        }
+                        if err != nil {
+                                return nil, err
+                        }
+                        found, err := mailAttachments(part.Header, part)
+                        if err != nil {
+                                return nil, err
+                        }
+                        attachments = append(attachments, found...)
+                }
+        }
+
+        name := ""
+        if _, disposition, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+                name = disposition["filename"]
+        }
+        if name == "" {
+                name = params["name"]
+        }
+        if decoded, err := new(mime.WordDecoder).DecodeHeader(name); err == nil {
+                name = decoded
+        }
+        name = filepath.Base(strings.ReplaceAll(name, `\`, "/"))
+        if filepath.Ext(name) == "" || !isReceiptCandidate(name) {
+                return nil, nil
+        }
+        if mailAttachmentGlob != "" {
+                if matched, _ := filepath.Match(strings.ToLower(mailAttachmentGlob), strings.ToLower(name)); !matched {
+                        return nil, nil
+                }
+        }
+
+        reader := body
+        switch strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding"))) {
+        case "base64":
+                reader = base64.NewDecoder(base64.StdEncoding, body)
+        case "quoted-printable":
+                reader = quotedprintable.NewReader(body)
+        }
+        data, err := io.ReadAll(reader)
+        if err != nil {
+                return nil, fmt.Errorf("failed to decode %s: %w", name, err)
+        }
+        return []mailAttachment{{Name: name, Data: data}}, nil
+}
+
+// writeIncoming writes a file for the watcher under a temporary name it ignores, then
+// renames it, so the file is only picked up once complete. An existing file is never
+// overwritten; the path actually written is returned.
+func writeIncoming(path string, data []byte) (string, error) {
+        ext := filepath.Ext(path)
+        base := strings.TrimSuffix(path, ext)
+        for i := 2; ; i++ {
+                if _, err := os.Lstat(path); os.IsNotExist(err) {
+                        break
+                }
+                path = fmt.Sprintf("%s_%d%s", base, i, ext)
+        }
+
+        tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".part")
+        if err := os.WriteFile(tmp, data, 0644); err != nil {
+                os.Remove(tmp)
+                return "", err
+        }
+        return path, os.Rename(tmp, path)
+}
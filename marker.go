@@ -0,0 +1,115 @@
+package main
+
+import (
+        "bytes"
+        "encoding/binary"
+        "fmt"
+        "hash/crc32"
+        "io"
+        "os"
+        "path/filepath"
+)
+
+// processedMarker is embedded into processed copies so the bot can recognise its own output
+const processedMarker = "scanner-bot:processed"
+
+// Where each format keeps the marker: JPEG right after SOI, PNG right before IEND,
+// PDF after the final %%EOF. Scanning both ends of the file is enough to find it.
+const (
+        markerHeadBytes = 64 * 1024
+        markerTailBytes = 4 * 1024
+)
+
+// hasProcessedMarker reports whether the file already carries the processed marker
+func hasProcessedMarker(path string) (bool, error) {
+        f, err := os.Open(path)
+        if err != nil {
+                return false, err
+        }
+        defer f.Close()
+
+        info, err := f.Stat()
+        if err != nil {
+                return false, err
+        }
+
+        head := make([]byte, min(info.Size(), markerHeadBytes))
+        if _, err := io.ReadFull(f, head); err != nil {
+                return false, err
+        }
+        if bytes.Contains(head, []byte(processedMarker)) {
+                return true, nil
+        }
+
+        if info.Size() <= markerHeadBytes {
+                return false, nil
+        }
+
+        tail := make([]byte, min(info.Size(), markerTailBytes))
+        if _, err := f.ReadAt(tail, info.Size()-int64(len(tail))); err != nil && err != io.EOF {
+                return false, err
+        }
+        return bytes.Contains(tail, []byte(processedMarker)), nil
+}
+
+// embedProcessedMarker rewrites a processed copy with the marker in a place
+// viewers ignore: a JPEG comment segment, a PNG tEXt chunk, or a PDF comment
+func embedProcessedMarker(path string) error {
+        content, err := os.ReadFile(path)
+        if err != nil {
+                return err
+        }
+
+        var marked []byte
+        switch mediaType(path) {
+        case "image/jpeg":
+                marked, err = markJPEG(content)
+        case "image/png":
+                marked, err = markPNG(content)
+        case "application/pdf":
+                marked = append(content, []byte("\n%"+processedMarker+"\n")...)
+        default:
+                return fmt.Errorf("unsupported file type for marker: %s", filepath.Ext(path))
+        }
+        if err != nil {
+                return err
+        }
+
+        return os.WriteFile(path, marked, 0644)
+}
+
+func markJPEG(content []byte) ([]byte, error) {
+        if len(content) < 2 || content[0] != 0xFF || content[1] != 0xD8 {
+                return nil, fmt.Errorf("not a JPEG file")
+        }
+
+        // COM segment: FF FE, then a big-endian length that includes its own two bytes
+        segment := []byte{0xFF, 0xFE, 0, 0}
+        binary.BigEndian.PutUint16(segment[2:], uint16(len(processedMarker)+2))
+        segment = append(segment, processedMarker...)
+
+        marked := make([]byte, 0, len(content)+len(segment))
+        marked = append(marked, content[:2]...)
+        marked = append(marked, segment...)
+        return append(marked, content[2:]...), nil
+}
+
+func markPNG(content []byte) ([]byte, error) {
+        // IEND is always the final 12 bytes: zero length, type, CRC
+        iend := len(content) - 12
+        if iend < 8 || !bytes.Equal(content[iend+4:iend+8], []byte("IEND")) {
+                return nil, fmt.Errorf("not a PNG file")
+        }
+
+        data := append([]byte("Software\x00"), processedMarker...)
+        chunk := make([]byte, 4, 12+len(data))
+        binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+        chunk = append(chunk, "tEXt"...)
+        chunk = append(chunk, data...)
+        chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+
+        marked := make([]byte, 0, len(content)+len(chunk))
+        marked = append(marked, content[:iend]...)
+        marked = append(marked, chunk...)
+        return append(marked, content[iend:]...), nil
+}
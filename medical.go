@@ -0,0 +1,223 @@
+package main
+
+import (
+        "encoding/csv"
+        "fmt"
+        "log/slog"
+        "os"
+        "path/filepath"
+        "sort"
+        "strconv"
+        "strings"
+        "time"
+)
+
+// medicalTypes are the values medical_type is normalized to, one per 医療費の区分
+// column of the National Tax Agency's 医療費集計フォーム
+var medicalTypes = []string{"treatment", "medicine", "care", "other"}
+
+// medicalTypeColumns are the form's 区分 columns, in medicalTypes order
+var medicalTypeColumns = []string{"診療・治療", "医薬品購入", "介護保険サービス", "その他の医療費"}
+
+// medicalTypeAliases maps other answers seen from the model to a medical type
+var medicalTypeAliases = map[string]string{
+        "診療":       "treatment",
+        "治療":       "treatment",
+        "診療・治療":    "treatment",
+        "dental":   "treatment",
+        "hospital": "treatment",
+        "clinic":   "treatment",
+        "医薬品":      "medicine",
+        "医薬品購入":    "medicine",
+        "pharmacy": "medicine",
+        "drug":     "medicine",
+        "介護":       "care",
+        "介護保険サービス": "care",
+}
+
+// pharmacyKeywords mark a vendor as a pharmacy or drugstore when the receipt was read
+// without -medical-details
+var pharmacyKeywords = []string{"薬局", "薬店", "ドラッグ", "pharmacy", "drug"}
+
+// normalizeMedicalType folds the model's answer into one of medicalTypes, or "" when
+// the receipt is not medical
+func normalizeMedicalType(raw string) string {
+        kind := strings.ToLower(strings.TrimSpace(raw))
+        if kind == "" {
+                return ""
+        }
+        for _, known := range medicalTypes {
+                if kind == known {
+                        return known
+                }
+        }
+        if alias, ok := medicalTypeAliases[kind]; ok {
+                return alias
+        }
+
+        slog.Warn("Unknown medical expense type, recording it as other", "medical_type", raw)
+        return "other"
+}
+
+// medicalRow is one line of the deduction form: what one patient paid one institution
+// for one kind of expense over the year
+type medicalRow struct {
+        Patient     string
+        Institution string
+        Type        string
+        Amount      int64
+        Receipts    int
+        LastPaid    string
+}
+
+// medicalTypeOf guesses the kind of expense for receipts read without -medical-details
+func medicalTypeOf(receipt FiledReceipt) string {
+        if kind := normalizeMedicalType(receipt.MedicalType); kind != "" {
+                return kind
+        }
+        vendor := strings.ToLower(receipt.Vendor)
+        for _, keyword := range pharmacyKeywords {
+                if strings.Contains(vendor, keyword) {
+                        return "medicine"
+                }
+        }
+        return "treatment"
+}
+
+// exportMedicalReport writes dest/reports/medical-<year>.csv in the column layout of the
+// 医療費集計フォーム, with one row per patient, institution, and kind of expense, so the
+// rows can be pasted into the form or entered in e-Tax. The deduction is for the calendar
+// year regardless of -fiscal-year-start. 補填される金額 (insurance payouts) is left for the
+// user to fill in.
+func exportMedicalReport(year int) error {
+        receipts, err := collectFiledReceipts(destDir)
+        if err != nil {
+                return fmt.Errorf("failed to scan %s: %w", destDir, err)
+        }
+
+        start := time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)
+        end := start.AddDate(1, 0, 0)
+        defaultPatient := medicalPatient
+        if defaultPatient == "" {
+                defaultPatient = "本人"
+        }
+
+        rows := map[[3]string]*medicalRow{}
+        var total int64
+        count := 0
+        for _, receipt := range receipts {
+                if !strings.EqualFold(receipt.Category, medicalCategory) {
+                        continue
+                }
+                date, err := time.Parse("2006-01-02", receipt.Date)
+                if err != nil || date.Before(start) || !date.Before(end) {
+                        continue
+                }
+                if receipt.Currency != "JPY" {
+                        slog.Warn("Skipping receipt: amount is not in yen", "event", "report", "path", receipt.Path, "currency", receipt.Currency)
+                        continue
+                }
+                amount, err := strconv.ParseInt(receipt.Amount.Round(0).String(), 10, 64)
+                if err != nil {
+                        return fmt.Errorf("invalid amount in %s: %w", receipt.Path, err)
+                }
+
+                patient := strings.TrimSpace(receipt.PatientName)
+                if patient == "" {
+                        patient = defaultPatient
+                }
+                key := [3]string{patient, receipt.Vendor, medicalTypeOf(receipt)}
+                row := rows[key]
+                if row == nil {
+                        row = &medicalRow{Patient: key[0], Institution: key[1], Type: key[2]}
+                        rows[key] = row
+                }
+                row.Amount += amount
+                row.Receipts++
+                if receipt.Date > row.LastPaid {
+                        row.LastPaid = receipt.Date
+                }
+                total += amount
+                count++
+        }
+
+        if count == 0 {
+                return fmt.Errorf("no %s receipts in yen found for %d", medicalCategory, year)
+        }
+
+        var sorted []*medicalRow
+        for _, row := range rows {
+                sorted = append(sorted, row)
+        }
+        sort.Slice(sorted, func(i, j int) bool {
+                a, b := sorted[i], sorted[j]
+                if a.Patient != b.Patient {
+                        return a.Patient < b.Patient
+                }
+                if a.Institution != b.Institution {
+                        return a.Institution < b.Institution
+                }
+                return a.Type < b.Type
+        })
+
+        outPath := filepath.Join(destDir, "reports", fmt.Sprintf("medical-%d.csv", year))
+        if dryRun {
+                slog.Info("[dry-run] Would write medical report", "event", "report", "dry_run", true, "path", outPath, "receipts", count, "rows", len(sorted), "total", total)
+                return nil
+        }
+        if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+                return fmt.Errorf("failed to create directory %s: %w", filepath.Dir(outPath), err)
+        }
+        f, err := os.Create(outPath)
+        if err != nil {
+                return fmt.Errorf("failed to create report: %w", err)
+        }
+        defer f.Close()
+
+        // A byte order mark makes Excel open the UTF-8 file correctly
+        if _, err := f.WriteString("\ufeff"); err != nil {
+                return fmt.Errorf("failed to write report: %w", err)
+        }
+        w := csv.NewWriter(f)
+        w.UseCRLF = true
+
+        header := []string{"No.", "医療を受けた人", "病院・薬局などの支払先の名称"}
+        header = append(header, medicalTypeColumns...)
+        header = append(header, "支払った医療費の金額", "左のうち、補填される金額", "支払年月日", "領収書の枚数")
+        w.Write(header)
+
+        for i, row := range sorted {
+                record := []string{strconv.Itoa(i + 1), row.Patient, row.Institution}
+                for _, kind := range medicalTypes {
+                        mark := ""
+                        if kind == row.Type {
+                                mark = "該当する"
+                        }
+                        record = append(record, mark)
+                }
+                // The payment date is only meaningful for a single receipt
+                paid := ""
+                if row.Receipts == 1 {
+                        paid = strings.ReplaceAll(row.LastPaid, "-", "/")
+                }
+                record = append(record, strconv.FormatInt(row.Amount, 10), "", paid, strconv.Itoa(row.Receipts))
+                w.Write(record)
+        }
+
+        totalRow := make([]string, len(header))
+        totalRow[2] = "合計"
+        totalRow[len(medicalTypeColumns)+3] = strconv.FormatInt(total, 10)
+        totalRow[len(header)-1] = strconv.Itoa(count)
+        w.Write(totalRow)
+
+        w.Flush()
+        if err := w.Error(); err != nil {
+                return fmt.Errorf("failed to write report: %w", err)
+        }
+
+        slog.Info("Wrote medical report", "event", "report", "path", outPath, "receipts", count, "total", total)
+        if total < 100000 {
+                slog.Info("Medical expenses total less than 100,000 円; a deduction applies only if that is more than 5% of your income", "event", "report", "total", total)
+        }
+        return nil
+}
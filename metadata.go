@@ -0,0 +1,225 @@
+package main
+
+import (
+        "bytes"
+        "encoding/binary"
+        "encoding/hex"
+        "encoding/xml"
+        "fmt"
+        "hash/crc32"
+        "os"
+        "path/filepath"
+        "regexp"
+        "strconv"
+        "strings"
+        "unicode/utf16"
+)
+
+// xmpNamespace starts the APP1 segment that holds XMP in a JPEG
+const xmpNamespace = "http://ns.adobe.com/xap/1.0/\x00"
+
+// embedMetadata writes the extracted fields into a processed copy where desktop search
+// and document managers look for them: an XMP packet in JPEG and PNG files, and the
+// document information dictionary of a PDF, added as an incremental update
+func embedMetadata(path string, data ReceiptData) error {
+        content, err := os.ReadFile(path)
+        if err != nil {
+                return err
+        }
+
+        var updated []byte
+        switch mediaType(path) {
+        case "image/jpeg":
+                updated, err = jpegWithXMP(content, xmpPacket(data))
+        case "image/png":
+                updated, err = pngWithXMP(content, xmpPacket(data))
+        case "application/pdf":
+                updated, err = pdfWithInfo(content, data)
+        default:
+                return fmt.Errorf("unsupported file type for metadata: %s", filepath.Ext(path))
+        }
+        if err != nil {
+                return err
+        }
+        return writeFileAtomic(path, updated)
+}
+
+// metadataTitle is the one-line summary used as the document title
+func metadataTitle(data ReceiptData) string {
+        return fmt.Sprintf("%s %s %s", data.Date, data.Vendor, amountLabel(data.Amount, data.Currency))
+}
+
+// xmpPacket describes the receipt with Dublin Core fields, which indexers map to title,
+// subject/tags, and description, and the receipt date as the creation date
+func xmpPacket(data ReceiptData) []byte {
+        esc := func(s string) string {
+                var b strings.Builder
+                xml.EscapeText(&b, []byte(s))
+                return b.String()
+        }
+
+        var b strings.Builder
+        b.WriteString("<?xpacket begin=\"\uFEFF\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+        b.WriteString(`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` + "\n")
+        b.WriteString(`<rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmlns:photoshop="http://ns.adobe.com/photoshop/1.0/">` + "\n")
+        fmt.Fprintf(&b, "<dc:title><rdf:Alt><rdf:li xml:lang=\"x-default\">%s</rdf:li></rdf:Alt></dc:title>\n", esc(metadataTitle(data)))
+        fmt.Fprintf(&b, "<dc:description><rdf:Alt><rdf:li xml:lang=\"x-default\">%s</rdf:li></rdf:Alt></dc:description>\n",
+                esc(fmt.Sprintf("Date: %s, Vendor: %s, Amount: %s %s, Category: %s", data.Date, data.Vendor, data.Amount, data.Currency, data.Category)))
+        fmt.Fprintf(&b, "<dc:subject><rdf:Bag><rdf:li>%s</rdf:li><rdf:li>%s</rdf:li></rdf:Bag></dc:subject>\n", esc(data.Category), esc(data.Vendor))
+        fmt.Fprintf(&b, "<photoshop:DateCreated>%s</photoshop:DateCreated>\n", esc(data.Date))
+        b.WriteString("<xmp:CreatorTool>scanner-bot</xmp:CreatorTool>\n")
+        b.WriteString("</rdf:Description></rdf:RDF></x:xmpmeta>\n")
+        b.WriteString(`<?xpacket end="w"?>`)
+        return []byte(b.String())
+}
+
+// jpegWithXMP replaces any XMP segment with a new one placed after the leading APPn and
+// comment segments, so EXIF and JFIF headers stay first
+func jpegWithXMP(content, packet []byte) ([]byte, error) {
+        if len(content) < 4 || content[0] != 0xFF || content[1] != 0xD8 {
+                return nil, fmt.Errorf("not a JPEG file")
+        }
+        if len(xmpNamespace)+len(packet)+2 > 0xFFFF {
+                return nil, fmt.Errorf("metadata too large for a JPEG segment")
+        }
+
+        var kept []byte
+        pos := 2
+        for pos+4 <= len(content) && content[pos] == 0xFF {
+                marker := content[pos+1]
+                if (marker < 0xE0 || marker > 0xEF) && marker != 0xFE {
+                        break
+                }
+                end := pos + 2 + int(binary.BigEndian.Uint16(content[pos+2:]))
+                if end > len(content) {
+                        return nil, fmt.Errorf("truncated JPEG segment")
+                }
+                if !(marker == 0xE1 && bytes.HasPrefix(content[pos+4:end], []byte(xmpNamespace))) {
+                        kept = append(kept, content[pos:end]...)
+                }
+                pos = end
+        }
+
+        segment := []byte{0xFF, 0xE1, 0, 0}
+        binary.BigEndian.PutUint16(segment[2:], uint16(len(xmpNamespace)+len(packet)+2))
+        segment = append(segment, xmpNamespace...)
+        segment = append(segment, packet...)
+
+        updated := make([]byte, 0, len(content)+len(segment))
+        updated = append(updated, content[:2]...)
+        updated = append(updated, kept...)
+        updated = append(updated, segment...)
+        return append(updated, content[pos:]...), nil
+}
+
+// pngWithXMP replaces any XMP chunk with a new iTXt chunk right before IEND, where
+// markPNG puts the processed marker
+func pngWithXMP(content, packet []byte) ([]byte, error) {
+        iend := len(content) - 12
+        if iend < 8 || !bytes.Equal(content[iend+4:iend+8], []byte("IEND")) {
+                return nil, fmt.Errorf("not a PNG file")
+        }
+        const keyword = "XML:com.adobe.xmp\x00"
+
+        // Copy every chunk after the 8-byte signature except an existing XMP one
+        kept := append([]byte(nil), content[:8]...)
+        for pos := 8; pos < iend; {
+                if pos+12 > iend {
+                        return nil, fmt.Errorf("truncated PNG chunk")
+                }
+                end := pos + 12 + int(binary.BigEndian.Uint32(content[pos:]))
+                if end > iend || end < pos {
+                        return nil, fmt.Errorf("truncated PNG chunk")
+                }
+                if !(string(content[pos+4:pos+8]) == "iTXt" && bytes.HasPrefix(content[pos+8:], []byte(keyword))) {
+                        kept = append(kept, content[pos:end]...)
+                }
+                pos = end
+        }
+
+        // keyword, compression flag and method, empty language tag and translated keyword
+        data := append([]byte(keyword+"\x00\x00\x00\x00"), packet...)
+        chunk := make([]byte, 4, 12+len(data))
+        binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+        chunk = append(chunk, "iTXt"...)
+        chunk = append(chunk, data...)
+        chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+
+        kept = append(kept, chunk...)
+        return append(kept, content[iend:]...), nil
+}
+
+var (
+        pdfStartXrefRe = regexp.MustCompile(`startxref\s+(\d+)\s*%%EOF\s*$`)
+        pdfSizeRe      = regexp.MustCompile(`/Size\s+(\d+)`)
+        pdfRootRe      = regexp.MustCompile(`/Root\s+(\d+\s+\d+\s+R)`)
+        pdfIDRe        = regexp.MustCompile(`/ID\s*\[[^\]]*\]`)
+)
+
+// pdfWithInfo appends an incremental update with a new document information dictionary,
+// leaving the original bytes untouched. Only PDFs with a classic xref table and trailer,
+// which is what scanners write, are supported.
+func pdfWithInfo(content []byte, data ReceiptData) ([]byte, error) {
+        m := pdfStartXrefRe.FindSubmatch(content[max(len(content)-1024, 0):])
+        if m == nil {
+                return nil, fmt.Errorf("no startxref at the end of the PDF")
+        }
+        prev, err := strconv.Atoi(string(m[1]))
+        if err != nil || prev >= len(content) {
+                return nil, fmt.Errorf("invalid startxref in PDF")
+        }
+        if !bytes.HasPrefix(content[prev:], []byte("xref")) {
+                return nil, fmt.Errorf("PDFs with a cross-reference stream are not supported")
+        }
+        trailerAt := bytes.Index(content[prev:], []byte("trailer"))
+        if trailerAt < 0 {
+                return nil, fmt.Errorf("no trailer in PDF")
+        }
+        trailer := content[prev+trailerAt:]
+        if end := bytes.Index(trailer, []byte("startxref")); end >= 0 {
+                trailer = trailer[:end]
+        }
+        if bytes.Contains(trailer, []byte("/Encrypt")) {
+                return nil, fmt.Errorf("encrypted PDFs are not supported")
+        }
+        sizeMatch := pdfSizeRe.FindSubmatch(trailer)
+        rootMatch := pdfRootRe.FindSubmatch(trailer)
+        if sizeMatch == nil || rootMatch == nil {
+                return nil, fmt.Errorf("incomplete PDF trailer")
+        }
+        infoNum, _ := strconv.Atoi(string(sizeMatch[1]))
+
+        var b bytes.Buffer
+        b.Write(content)
+        if !bytes.HasSuffix(content, []byte("\n")) {
+                b.WriteByte('\n')
+        }
+        objAt := b.Len()
+        fmt.Fprintf(&b, "%d 0 obj\n<< /Title %s /Subject %s /Keywords %s /Creator %s >>\nendobj\n",
+                infoNum,
+                pdfText(metadataTitle(data)),
+                pdfText(data.Category),
+                pdfText(strings.Join([]string{data.Date, data.Vendor, data.Amount.String() + " " + data.Currency, data.Category}, ", ")),
+                pdfText("scanner-bot"))
+
+        xrefAt := b.Len()
+        fmt.Fprintf(&b, "xref\n%d 1\n%010d 00000 n \ntrailer\n<< /Size %d /Root %s /Info %d 0 R /Prev %d", infoNum, objAt, infoNum+1, rootMatch[1], infoNum, prev)
+        if id := pdfIDRe.Find(trailer); id != nil {
+                b.WriteString(" ")
+                b.Write(id)
+        }
+        fmt.Fprintf(&b, " >>\nstartxref\n%d\n%%%%EOF\n", xrefAt)
+        return b.Bytes(), nil
+}
+
+// pdfText encodes a string as a UTF-16BE hex string, which every reader decodes
+// regardless of the characters in it
+func pdfText(s string) string {
+        units := utf16.Encode([]rune(s))
+        raw := make([]byte, 2, 2+2*len(units))
+        raw[0], raw[1] = 0xFE, 0xFF
+        for _, u := range units {
+                raw = binary.BigEndian.AppendUint16(raw, u)
+        }
+        return "<" + strings.ToUpper(hex.EncodeToString(raw)) + ">"
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+        "context"
+        "errors"
+        "log/slog"
+        "net/http"
+        "time"
+
+        "github.com/prometheus/client_golang/prometheus"
+        "github.com/prometheus/client_golang/prometheus/promauto"
+        "github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+        metricDetected = promauto.NewCounter(prometheus.CounterOpts{
+                Name: "scanner_bot_files_detected_total",
+                Help: "Files picked up from the watch directory.",
+        })
+        metricProcessed = promauto.NewCounter(prometheus.CounterOpts{
+                Name: "scanner_bot_files_processed_total",
+                Help: "Files analyzed, saved, and archived successfully.",
+        })
+        metricFailed = promauto.NewCounter(prometheus.CounterOpts{
+                Name: "scanner_bot_files_failed_total",
+                Help: "Files whose analysis or filing failed.",
+        })
+        metricDeadLetter = promauto.NewCounter(prometheus.CounterOpts{
+                Name: "scanner_bot_files_dead_letter_total",
+                Help: "Files quarantined after failing -max-failures attempts.",
+        })
+        metricReview = promauto.NewCounter(prometheus.CounterOpts{
+                Name: "scanner_bot_files_review_total",
+                Help: "Files held in needs-review because the extracted data looked wrong.",
+        })
+        metricDuplicates = promauto.NewCounter(prometheus.CounterOpts{
+                Name: "scanner_bot_files_duplicate_total",
+                Help: "Files skipped because they were already processed.",
+        })
+        metricAnalysisSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+                Name:    "scanner_bot_analysis_duration_seconds",
+                Help:    "Time spent uploading a file to Gemini and extracting receipt data.",
+                Buckets: []float64{1, 2, 5, 10, 20, 30, 60, 120, 300},
+        })
+        metricActiveFiles = promauto.NewGauge(prometheus.GaugeOpts{
+                Name: "scanner_bot_active_files",
+                Help: "Files currently being processed.",
+        })
+)
+
+// startMetricsServer serves /metrics, /healthz, and /status on addr in the background
+func startMetricsServer(addr string) *http.Server {
+        mux := http.NewServeMux()
+        mux.Handle("/metrics", promhttp.Handler())
+        mux.HandleFunc("/healthz", handleHealthz)
+        mux.HandleFunc("/status", handleStatus)
+
+        srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+        go func() {
+                if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+                        slog.Error("Metrics server error", "error", err)
+                }
+        }()
+
+        slog.Info("Serving metrics", "addr", addr)
+        return srv
+}
+
+// stopMetricsServer gives in-flight scrapes a few seconds to finish
+func stopMetricsServer(srv *http.Server) {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        if err := srv.Shutdown(ctx); err != nil {
+                slog.Warn("Metrics server shutdown error", "error", err)
+        }
+}
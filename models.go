@@ -0,0 +1,32 @@
+package main
+
+import "os"
+
+// modelFor picks the model for a file: -large-model for PDFs with at least
+// -large-min-pages pages or files of at least -large-min-bytes, -model otherwise
+func modelFor(path string) string {
+        if largeModel == "" {
+                return modelName
+        }
+
+        if largeMinBytes > 0 {
+                if info, err := os.Stat(path); err == nil && info.Size() >= largeMinBytes {
+                        return largeModel
+                }
+        }
+
+        if largeMinPages > 0 && mediaType(path) == "application/pdf" {
+                if pages, err := countPDFPages(path); err == nil && pages >= largeMinPages {
+                        return largeModel
+                }
+        }
+        return modelName
+}
+
+// pickModel returns model when a backend names its own (fallbacks do), otherwise modelFor(path)
+func pickModel(model, path string) string {
+        if model != "" {
+                return model
+        }
+        return modelFor(path)
+}
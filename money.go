@@ -0,0 +1,232 @@
+package main
+
+import (
+        "bytes"
+        "encoding/json"
+        "fmt"
+        "math"
+        "strconv"
+        "strings"
+)
+
+// Decimal is an exact decimal amount, Units × 10^-Scale, so 12.34 stays 12.34
+// instead of picking up float rounding on its way into filenames and totals
+type Decimal struct {
+        Units int64
+        Scale int
+}
+
+// currencyDecimals lists the ISO 4217 currencies whose minor unit is not two digits
+var currencyDecimals = map[string]int{
+        "JPY": 0, "KRW": 0, "VND": 0, "CLP": 0, "ISK": 0, "PYG": 0, "UGX": 0, "XAF": 0, "XOF": 0,
+        "BHD": 3, "JOD": 3, "KWD": 3, "OMR": 3, "TND": 3,
+}
+
+// currencyAliases maps symbols and names the model returns instead of a code
+var currencyAliases = map[string]string{
+        "¥": "JPY", "￥": "JPY", "円": "JPY", "YEN": "JPY",
+        "$": "USD", "US$": "USD",
+        "€": "EUR", "£": "GBP", "₩": "KRW", "원": "KRW",
+        "元": "CNY", "RMB": "CNY", "NT$": "TWD", "HK$": "HKD", "S$": "SGD", "A$": "AUD", "C$": "CAD",
+        "฿": "THB", "₫": "VND", "₱": "PHP", "₹": "INR",
+}
+
+// parseDecimal reads an amount as printed or returned by the model: "1200", "12.34",
+// "¥1,200", "1.234,56", or "12,50 €". A lone comma followed by exactly three digits is
+// a thousands separator; otherwise it is the decimal point.
+func parseDecimal(s string) (Decimal, error) {
+        cleaned := strings.Map(func(r rune) rune {
+                switch {
+                case r >= '0' && r <= '9', r == '.', r == ',', r == '-':
+                        return r
+                case r >= '０' && r <= '９':
+                        return '0' + (r - '０')
+                case r == '．':
+                        return '.'
+                case r == '，':
+                        return ','
+                case r == '−' || r == '－' || r == '▲':
+                        return '-'
+                }
+                return -1
+        }, s)
+        if cleaned == "" {
+                return Decimal{}, fmt.Errorf("no amount in %q", s)
+        }
+
+        dot, comma := strings.LastIndex(cleaned, "."), strings.LastIndex(cleaned, ",")
+        switch {
+        case dot >= 0 && comma >= 0:
+                // Whichever comes last is the decimal point
+                if comma > dot {
+                        cleaned = strings.ReplaceAll(cleaned, ".", "")
+                        cleaned = strings.Replace(cleaned, ",", ".", 1)
+                } else {
+                        cleaned = strings.ReplaceAll(cleaned, ",", "")
+                }
+        case comma >= 0:
+                if strings.Count(cleaned, ",") == 1 && len(cleaned)-comma-1 != 3 {
+                        cleaned = strings.Replace(cleaned, ",", ".", 1)
+                } else {
+                        cleaned = strings.ReplaceAll(cleaned, ",", "")
+                }
+        }
+
+        whole, frac, _ := strings.Cut(cleaned, ".")
+        units, err := strconv.ParseInt(whole+frac, 10, 64)
+        if err != nil || strings.Contains(frac, ".") || strings.Contains(frac, "-") {
+                return Decimal{}, fmt.Errorf("invalid amount %q", s)
+        }
+        return Decimal{Units: units, Scale: len(frac)}.normalize(), nil
+}
+
+// normalize drops trailing fractional zeros, so 12.50 and 12.5 compare equal
+func (d Decimal) normalize() Decimal {
+        for d.Scale > 0 && d.Units%10 == 0 {
+                d.Units /= 10
+                d.Scale--
+        }
+        return d
+}
+
+func (d *Decimal) UnmarshalJSON(b []byte) error {
+        b = bytes.TrimSpace(b)
+        if bytes.Equal(b, []byte("null")) {
+                *d = Decimal{}
+                return nil
+        }
+
+        text := string(b)
+        if len(b) > 0 && b[0] == '"' {
+                if err := json.Unmarshal(b, &text); err != nil {
+                        return err
+                }
+                if strings.TrimSpace(text) == "" {
+                        *d = Decimal{}
+                        return nil
+                }
+        } else if strings.ContainsAny(text, "eE") {
+                // Exponent notation never appears on receipts but is valid JSON
+                f, err := strconv.ParseFloat(text, 64)
+                if err != nil {
+                        return err
+                }
+                text = strconv.FormatFloat(f, 'f', -1, 64)
+        }
+
+        parsed, err := parseDecimal(text)
+        if err != nil {
+                return err
+        }
+        *d = parsed
+        return nil
+}
+
+func (d Decimal) MarshalJSON() ([]byte, error) {
+        return []byte(d.String()), nil
+}
+
+// String renders the amount without thousands separators: "1200", "12.34", "-0.5"
+func (d Decimal) String() string {
+        if d.Scale <= 0 {
+                return strconv.FormatInt(d.Units, 10)
+        }
+
+        sign, digits := "", strconv.FormatInt(d.Units, 10)
+        if d.Units < 0 {
+                sign, digits = "-", digits[1:]
+        }
+        if len(digits) <= d.Scale {
+                digits = strings.Repeat("0", d.Scale-len(digits)+1) + digits
+        }
+        return sign + digits[:len(digits)-d.Scale] + "." + digits[len(digits)-d.Scale:]
+}
+
+func (d Decimal) Sign() int {
+        switch {
+        case d.Units > 0:
+                return 1
+        case d.Units < 0:
+                return -1
+        }
+        return 0
+}
+
+func (d Decimal) IsZero() bool {
+        return d.Units == 0
+}
+
+// Add returns d + o at the larger of the two scales
+func (d Decimal) Add(o Decimal) Decimal {
+        for d.Scale < o.Scale {
+                d.Units *= 10
+                d.Scale++
+        }
+        for o.Scale < d.Scale {
+                o.Units *= 10
+                o.Scale++
+        }
+        return Decimal{Units: d.Units + o.Units, Scale: d.Scale}.normalize()
+}
+
+// Cmp compares d and o, returning -1, 0, or +1
+func (d Decimal) Cmp(o Decimal) int {
+        return d.Add(Decimal{Units: -o.Units, Scale: o.Scale}).Sign()
+}
+
+// Round rounds half away from zero to at most scale fractional digits. The dropped digits
+// are looked at together, since rounding one digit at a time turns 1.249 into 1.3.
+func (d Decimal) Round(scale int) Decimal {
+        if d.Scale <= scale {
+                return d.normalize()
+        }
+        pow := int64(1)
+        for i := scale; i < d.Scale; i++ {
+                pow *= 10
+        }
+        units, rest := d.Units/pow, d.Units%pow
+        if rest*2 >= pow {
+                units++
+        } else if rest*2 <= -pow {
+                units--
+        }
+        return Decimal{Units: units, Scale: scale}.normalize()
+}
+
+// Float64 is for storage in SQLite only; arithmetic stays in Decimal
+func (d Decimal) Float64() float64 {
+        return float64(d.Units) / math.Pow10(d.Scale)
+}
+
+// normalizeCurrency returns an ISO 4217 code for the model's currency answer,
+// or -default-currency when it is missing or unrecognized
+func normalizeCurrency(raw string) string {
+        code := strings.ToUpper(strings.TrimSpace(raw))
+        if code == "" {
+                return defaultCurrency
+        }
+        if alias, ok := currencyAliases[code]; ok {
+                return alias
+        }
+        if len(code) == 3 && strings.Trim(code, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") == "" {
+                return code
+        }
+        return defaultCurrency
+}
+
+// currencyScale is the number of minor-unit digits for a currency (2 unless listed)
+func currencyScale(currency string) int {
+        if scale, ok := currencyDecimals[currency]; ok {
+                return scale
+        }
+        return 2
+}
+
+// amountLabel renders an amount the way filenames and notifications show it:
+// "1200円" for yen, and the ISO code after everything else ("12.34EUR")
+func amountLabel(amount Decimal, currency string) string {
+        if currency == "JPY" {
+                return amount.String() + "円"
+        }
+        return amount.String() + currency
+}
@@ -0,0 +1,90 @@
+package main
+
+import "testing"
+
+func TestParseDecimal(t *testing.T) {
+        tests := []struct {
+                in   string
+                want Decimal
+        }{
+                {"1200", Decimal{1200, 0}},
+                {"12.34", Decimal{1234, 2}},
+                {"12.50", Decimal{125, 1}},
+                {"1,200", Decimal{1200, 0}},
+                {"1,234,567", Decimal{1234567, 0}},
+                {"12,50 €", Decimal{125, 1}},
+                {"12,5", Decimal{125, 1}},
+                {"1.234,56", Decimal{123456, 2}},
+                {"1,234.56", Decimal{123456, 2}},
+                {"¥1,200", Decimal{1200, 0}},
+                {"￥１，２００", Decimal{1200, 0}},
+                {"1,200円", Decimal{1200, 0}},
+                {"▲500", Decimal{-500, 0}},
+                {"-12.5", Decimal{-125, 1}},
+                {"１２．３４", Decimal{1234, 2}},
+                {"0.10", Decimal{1, 1}},
+        }
+        for _, tt := range tests {
+                got, err := parseDecimal(tt.in)
+                if err != nil {
+                        t.Errorf("parseDecimal(%q) error: %v", tt.in, err)
+                        continue
+                }
+                if got != tt.want {
+                        t.Errorf("parseDecimal(%q) = %+v, want %+v", tt.in, got, tt.want)
+                }
+        }
+}
+
+func TestParseDecimalInvalid(t *testing.T) {
+        for _, in := range []string{"", "free", "1.2.3", "12-5"} {
+                if got, err := parseDecimal(in); err == nil {
+                        t.Errorf("parseDecimal(%q) = %+v, want an error", in, got)
+                }
+        }
+}
+
+func TestDecimalRound(t *testing.T) {
+        tests := []struct {
+                in    Decimal
+                scale int
+                want  Decimal
+        }{
+                {Decimal{1234, 2}, 0, Decimal{12, 0}},
+                {Decimal{125, 1}, 0, Decimal{13, 0}},
+                {Decimal{1249, 3}, 1, Decimal{12, 1}},
+                {Decimal{1250, 3}, 1, Decimal{13, 1}},
+                {Decimal{-125, 1}, 0, Decimal{-13, 0}},
+                {Decimal{-124, 1}, 0, Decimal{-12, 0}},
+                {Decimal{-1249, 3}, 1, Decimal{-12, 1}},
+                {Decimal{-5, 1}, 0, Decimal{-1, 0}},
+                {Decimal{-4, 1}, 0, Decimal{0, 0}},
+                {Decimal{1234, 2}, 2, Decimal{1234, 2}},
+                {Decimal{1200, 2}, 3, Decimal{12, 0}},
+        }
+        for _, tt := range tests {
+                if got := tt.in.Round(tt.scale); got != tt.want {
+                        t.Errorf("%+v.Round(%d) = %+v, want %+v", tt.in, tt.scale, got, tt.want)
+                }
+        }
+}
+
+func TestDecimalString(t *testing.T) {
+        tests := []struct {
+                in   Decimal
+                want string
+        }{
+                {Decimal{1200, 0}, "1200"},
+                {Decimal{1234, 2}, "12.34"},
+                {Decimal{-5, 1}, "-0.5"},
+                {Decimal{5, 3}, "0.005"},
+                {Decimal{-5, 3}, "-0.005"},
+                {Decimal{12, 2}, "0.12"},
+                {Decimal{0, 2}, "0.00"},
+        }
+        for _, tt := range tests {
+                if got := tt.in.String(); got != tt.want {
+                        t.Errorf("%+v.String() = %q, want %q", tt.in, got, tt.want)
+                }
+        }
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+        "bytes"
+        "encoding/json"
+        "fmt"
+        "log/slog"
+        "net/http"
+        "path/filepath"
+        "sync"
+        "time"
+)
+
+// webhookPayload is generic JSON. "text" is what Slack incoming webhooks display and
+// "content" is what Discord displays; other endpoints can use the structured fields.
+type webhookPayload struct {
+        Text          string  `json:"text"`
+        Content       string  `json:"content"`
+        Date          string  `json:"date"`
+        Vendor        string  `json:"vendor"`
+        Category      string  `json:"category"`
+        Amount        Decimal `json:"amount"`
+        Currency      string  `json:"currency"`
+        ProcessedPath string  `json:"processed_path"`
+        Timestamp     string  `json:"timestamp"`
+}
+
+// deadLetterPayload alerts that a file was quarantined after -max-failures attempts
+type deadLetterPayload struct {
+        Text       string `json:"text"`
+        Content    string `json:"content"`
+        Event      string `json:"event"`
+        SourceFile string `json:"source_file"`
+        Attempts   int    `json:"attempts"`
+        Error      string `json:"error"`
+        Timestamp  string `json:"timestamp"`
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// pendingNotifications lets one-shot runs wait for deliveries before exiting
+var pendingNotifications sync.WaitGroup
+
+// notifyWebhook posts the saved receipt to -webhook-url in the background.
+// Delivery failures are logged and never affect processing.
+func notifyWebhook(data ReceiptData, processedPath string) {
+        summary := fmt.Sprintf("Receipt filed: %s %s (%s, %s)", data.Vendor, amountLabel(data.Amount, data.Currency), data.Category, data.Date)
+        payload := webhookPayload{
+                Text:          summary,
+                Content:       summary,
+                Date:          data.Date,
+                Vendor:        data.Vendor,
+                Category:      data.Category,
+                Amount:        data.Amount,
+                Currency:      data.Currency,
+                ProcessedPath: processedPath,
+                Timestamp:     time.Now().Format(time.RFC3339),
+        }
+
+        postWebhook(webhookURL, payload, processedPath)
+}
+
+// notifyDeadLetter alerts -webhook-url that a file gave up after repeated failures
+func notifyDeadLetter(srcPath string, attempts int, reason error) {
+        summary := fmt.Sprintf("Receipt failed %d times and was quarantined: %s", attempts, filepath.Base(srcPath))
+        postWebhook(webhookURL, deadLetterPayload{
+                Text:       summary,
+                Content:    summary,
+                Event:      "dead_letter",
+                SourceFile: srcPath,
+                Attempts:   attempts,
+                Error:      reason.Error(),
+                Timestamp:  time.Now().Format(time.RFC3339),
+        }, srcPath)
+}
+
+// postWebhook delivers a JSON payload in the background
+func postWebhook(url string, payload any, path string) {
+        body, err := json.Marshal(payload)
+        if err != nil {
+                slog.Error("Failed to encode webhook payload", "error", err)
+                return
+        }
+        deliverWebhook(url, "application/json", body, path)
+}
+
+// deliverWebhook posts a body in the background. Delivery failures are logged and never
+// affect processing.
+func deliverWebhook(url, contentType string, body []byte, path string) {
+        pendingNotifications.Add(1)
+        go func() {
+                defer pendingNotifications.Done()
+
+                resp, err := webhookClient.Post(url, contentType, bytes.NewReader(body))
+                if err != nil {
+                        slog.Warn("Webhook delivery failed", "event", "notify", "path", path, "error", err)
+                        return
+                }
+                defer resp.Body.Close()
+
+                if resp.StatusCode < 200 || resp.StatusCode > 299 {
+                        slog.Warn("Webhook delivery failed", "event", "notify", "path", path, "status", resp.Status)
+                }
+        }()
+}
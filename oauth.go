@@ -0,0 +1,75 @@
+package main
+
+import (
+        "context"
+        "encoding/json"
+        "fmt"
+        "net/http"
+        "net/url"
+        "strings"
+        "sync"
+        "time"
+)
+
+// googleTokenURL exchanges Google OAuth refresh tokens, for -gmail and -storage drive
+const googleTokenURL = "https://oauth2.googleapis.com/token"
+
+// oauthToken turns a long-lived OAuth refresh token into access tokens, reusing each
+// until shortly before it expires
+type oauthToken struct {
+        service      string
+        tokenURL     string
+        clientID     string
+        clientSecret string
+        refreshToken string
+
+        mu          sync.Mutex
+        accessToken string
+        expires     time.Time
+}
+
+func newOAuthToken(service, tokenURL, clientID, clientSecret, refreshToken string) *oauthToken {
+        return &oauthToken{service: service, tokenURL: tokenURL, clientID: clientID, clientSecret: clientSecret, refreshToken: refreshToken}
+}
+
+// Token returns a valid access token, refreshing it when needed
+func (o *oauthToken) Token(ctx context.Context) (string, error) {
+        o.mu.Lock()
+        defer o.mu.Unlock()
+        if o.accessToken != "" && time.Now().Before(o.expires) {
+                return o.accessToken, nil
+        }
+
+        form := url.Values{
+                "client_id":     {o.clientID},
+                "client_secret": {o.clientSecret},
+                "refresh_token": {o.refreshToken},
+                "grant_type":    {"refresh_token"},
+        }
+        req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.tokenURL, strings.NewReader(form.Encode()))
+        if err != nil {
+                return "", err
+        }
+        req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+        resp, err := apiClient.Do(req)
+        if err != nil {
+                return "", fmt.Errorf("failed to refresh %s token: %w", o.service, err)
+        }
+        defer resp.Body.Close()
+
+        var result struct {
+                AccessToken string `json:"access_token"`
+                ExpiresIn   int    `json:"expires_in"`
+                Error       string `json:"error_description"`
+        }
+        if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+                return "", fmt.Errorf("failed to refresh %s token: %s", o.service, resp.Status)
+        }
+        if resp.StatusCode != http.StatusOK || result.AccessToken == "" {
+                return "", fmt.Errorf("failed to refresh %s token: %s %s", o.service, resp.Status, result.Error)
+        }
+
+        o.accessToken = result.AccessToken
+        o.expires = time.Now().Add(time.Duration(result.ExpiresIn)*time.Second - time.Minute)
+        return o.accessToken, nil
+}
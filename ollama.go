@@ -0,0 +1,129 @@
+package main
+
+import (
+        "context"
+        "fmt"
+        "net/http"
+        "os"
+        "strings"
+        "time"
+)
+
+// ollamaAnalyzer runs a local vision model (llava and similar) through Ollama,
+// so scans never leave the machine
+type ollamaAnalyzer struct {
+        model   string
+        baseURL string
+}
+
+// ollamaClient allows for slow CPU-only inference
+var ollamaClient = &http.Client{Timeout: 30 * time.Minute}
+
+type ollamaRequest struct {
+        Model    string          `json:"model"`
+        Messages []ollamaMessage `json:"messages"`
+        Stream   bool            `json:"stream"`
+        Format   string          `json:"format"`
+        Options  map[string]any  `json:"options,omitempty"`
+}
+
+type ollamaMessage struct {
+        Role    string   `json:"role"`
+        Content string   `json:"content"`
+        Images  []string `json:"images,omitempty"`
+}
+
+type ollamaResponse struct {
+        Message struct {
+                Content string `json:"content"`
+        } `json:"message"`
+        DoneReason      string `json:"done_reason"`
+        PromptEvalCount int64  `json:"prompt_eval_count"`
+        EvalCount       int64  `json:"eval_count"`
+}
+
+// ollamaBaseURL follows -api-base-url, then OLLAMA_HOST, then Ollama's default port
+func ollamaBaseURL(baseURL string) string {
+        if baseURL != "" {
+                return strings.TrimRight(baseURL, "/")
+        }
+        if host := os.Getenv("OLLAMA_HOST"); host != "" {
+                if !strings.Contains(host, "://") {
+                        host = "http://" + host
+                }
+                return strings.TrimRight(host, "/")
+        }
+        return "http://localhost:11434"
+}
+
+func (a *ollamaAnalyzer) Analyze(ctx context.Context, path string) ([]ReceiptData, error) {
+        // Ollama only takes images, so a PDF is sent as one image per page
+        images := []string{path}
+        if mediaType(path) == "application/pdf" {
+                pages, dir, err := rasterizePDF(ctx, path)
+                if err != nil {
+                        return nil, err
+                }
+                defer os.RemoveAll(dir)
+                images = pages
+        }
+
+        prompt, err := receiptPrompt(ctx, path, len(images))
+        if err != nil {
+                return nil, err
+        }
+        encoded := make([]string, len(images))
+        for i, image := range images {
+                if encoded[i], err = readBase64(image); err != nil {
+                        return nil, err
+                }
+        }
+
+        req := ollamaRequest{
+                Model:    pickModel(a.model, path),
+                Messages: []ollamaMessage{{Role: "user", Content: prompt, Images: encoded}},
+                Format:   "json",
+                Options:  map[string]any{},
+        }
+        if temperature >= 0 {
+                req.Options["temperature"] = temperature
+        }
+        if maxOutputTokens > 0 {
+                req.Options["num_predict"] = maxOutputTokens
+        }
+
+        send := func() (string, error) {
+                var resp ollamaResponse
+                err := withRetry(ctx, "generate", func() error {
+                        return postJSONWith(ctx, ollamaClient, a.baseURL+"/api/chat", nil, req, &resp)
+                })
+                if err != nil {
+                        return "", fmt.Errorf("ollama request failed: %w", err)
+                }
+                recordUsage(ctx, "ollama", req.Model, resp.PromptEvalCount, resp.EvalCount)
+
+                switch {
+                case resp.DoneReason == "length":
+                        return "", errTruncated
+                case strings.TrimSpace(resp.Message.Content) == "":
+                        return "", fmt.Errorf("empty response from model: done reason %s", resp.DoneReason)
+                }
+                return resp.Message.Content, nil
+        }
+
+        text, err := send()
+        if err != nil {
+                return nil, err
+        }
+        return parseWithCorrection(path, text, func(invalid, correction string) (string, error) {
+                req.Messages = append(req.Messages,
+                        ollamaMessage{Role: "assistant", Content: invalid},
+                        ollamaMessage{Role: "user", Content: correction},
+                )
+                return send()
+        })
+}
+
+func (a *ollamaAnalyzer) Close() error {
+        return nil
+}
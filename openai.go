@@ -0,0 +1,133 @@
+package main
+
+import (
+        "context"
+        "fmt"
+        "path/filepath"
+        "strings"
+)
+
+// openAIAnalyzer sends scans inline to the OpenAI Chat Completions API
+type openAIAnalyzer struct {
+        apiKey  string
+        model   string
+        baseURL string
+}
+
+type openAIRequest struct {
+        Model               string          `json:"model"`
+        Messages            []openAIMessage `json:"messages"`
+        Temperature         *float64        `json:"temperature,omitempty"`
+        MaxCompletionTokens int             `json:"max_completion_tokens,omitempty"`
+}
+
+type openAIMessage struct {
+        Role    string          `json:"role"`
+        Content []openAIContent `json:"content"`
+}
+
+type openAIContent struct {
+        Type     string           `json:"type"`
+        Text     string           `json:"text,omitempty"`
+        ImageURL *openAIImageURL  `json:"image_url,omitempty"`
+        File     *openAIFileInput `json:"file,omitempty"`
+}
+
+type openAIImageURL struct {
+        URL string `json:"url"`
+}
+
+type openAIFileInput struct {
+        Filename string `json:"filename"`
+        FileData string `json:"file_data"`
+}
+
+type openAIResponse struct {
+        Choices []struct {
+                Message struct {
+                        Content string `json:"content"`
+                        Refusal string `json:"refusal"`
+                } `json:"message"`
+                FinishReason string `json:"finish_reason"`
+        } `json:"choices"`
+        Usage struct {
+                PromptTokens     int64 `json:"prompt_tokens"`
+                CompletionTokens int64 `json:"completion_tokens"`
+        } `json:"usage"`
+}
+
+func (a *openAIAnalyzer) Analyze(ctx context.Context, path string) ([]ReceiptData, error) {
+        pages, err := pdfPageCount(path)
+        if err != nil {
+                return nil, err
+        }
+        prompt, err := receiptPrompt(ctx, path, pages)
+        if err != nil {
+                return nil, err
+        }
+        encoded, err := readBase64(path)
+        if err != nil {
+                return nil, err
+        }
+
+        dataURL := "data:" + mediaType(path) + ";base64," + encoded
+        attachment := openAIContent{Type: "image_url", ImageURL: &openAIImageURL{URL: dataURL}}
+        if mediaType(path) == "application/pdf" {
+                attachment = openAIContent{Type: "file", File: &openAIFileInput{Filename: filepath.Base(path), FileData: dataURL}}
+        }
+
+        req := openAIRequest{
+                Model: pickModel(a.model, path),
+                Messages: []openAIMessage{{
+                        Role:    "user",
+                        Content: []openAIContent{{Type: "text", Text: prompt}, attachment},
+                }},
+                MaxCompletionTokens: maxOutputTokens,
+        }
+        if temperature >= 0 {
+                req.Temperature = &temperature
+        }
+
+        send := func() (string, error) {
+                var resp openAIResponse
+                err := withRetry(ctx, "generate", func() error {
+                        return postJSON(ctx, a.baseURL+"/v1/chat/completions", map[string]string{"Authorization": "Bearer " + a.apiKey}, req, &resp)
+                })
+                if err != nil {
+                        return "", fmt.Errorf("openai request failed: %w", err)
+                }
+                recordUsage(ctx, "openai", req.Model, resp.Usage.PromptTokens, resp.Usage.CompletionTokens)
+
+                if len(resp.Choices) == 0 {
+                        return "", fmt.Errorf("empty response from model: no choices")
+                }
+                choice := resp.Choices[0]
+                switch {
+                case choice.Message.Refusal != "":
+                        return "", fmt.Errorf("blocked: %s", choice.Message.Refusal)
+                case choice.FinishReason == "length":
+                        return "", errTruncated
+                case choice.FinishReason == "content_filter":
+                        return "", fmt.Errorf("blocked: content_filter")
+                case strings.TrimSpace(choice.Message.Content) == "":
+                        return "", fmt.Errorf("empty response from model: finish reason %s", choice.FinishReason)
+                }
+                return choice.Message.Content, nil
+        }
+
+        text, err := send()
+        if err != nil {
+                return nil, err
+        }
+        return parseWithCorrection(path, text, func(invalid, correction string) (string, error) {
+                req.Messages = append(req.Messages,
+                        openAIMessage{Role: "assistant", Content: []openAIContent{{Type: "text", Text: invalid}}},
+                        openAIMessage{Role: "user", Content: []openAIContent{{Type: "text", Text: correction}}},
+                )
+                return send()
+        })
+}
+
+func (a *openAIAnalyzer) Close() error {
+        return nil
+}
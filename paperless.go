@@ -0,0 +1,235 @@
+package main
+
+import (
+        "bytes"
+        "context"
+        "fmt"
+        "io"
+        "log/slog"
+        "mime/multipart"
+        "net/http"
+        "net/url"
+        "os"
+        "path/filepath"
+        "regexp"
+        "strconv"
+        "strings"
+        "sync"
+        "time"
+)
+
+// paperlessTaskTimeout is how long to wait for Paperless to consume an upload
+const paperlessTaskTimeout = 2 * time.Minute
+
+// paperlessDuplicate finds the existing document in Paperless's "It is a duplicate of
+// <title> (#<id>)" error, so a file sent again after a partial failure counts as sent
+var paperlessDuplicate = regexp.MustCompile(`duplicate of .*\(#(\d+)\)`)
+
+// paperlessClient sends documents to the Paperless-ngx REST API with a token from
+// PAPERLESS_TOKEN. Correspondents, tags, and document types are looked up by name and
+// created when missing; their IDs are cached for the life of the process.
+type paperlessClient struct {
+        baseURL string
+        token   string
+
+        mu  sync.Mutex
+        ids map[string]int
+}
+
+// paperless is set up in main when -paperless-url is given
+var paperless *paperlessClient
+
+func newPaperlessClient(baseURL, token string) (*paperlessClient, error) {
+        if _, err := url.ParseRequestURI(baseURL); err != nil {
+                return nil, fmt.Errorf("invalid -paperless-url %q: %w", baseURL, err)
+        }
+        if token == "" {
+                return nil, fmt.Errorf("-paperless-url requires the PAPERLESS_TOKEN environment variable")
+        }
+        return &paperlessClient{baseURL: strings.TrimRight(baseURL, "/"), token: token, ids: map[string]int{}}, nil
+}
+
+// Send uploads content as a Paperless document titled after the receipt, with its date,
+// the vendor as correspondent, and the category and -paperless-tags as tags. It waits for
+// Paperless to consume the upload and returns the URL of the new document.
+func (p *paperlessClient) Send(ctx context.Context, content, name string, data ReceiptData) (string, error) {
+        fields := map[string][]string{
+                "title": {strings.TrimSpace(data.Vendor + " " + amountLabel(data.Amount, data.Currency))},
+        }
+        if _, err := time.Parse("2006-01-02", data.Date); err == nil {
+                fields["created"] = []string{data.Date}
+        }
+        if data.Vendor != "" {
+                id, err := p.lookup(ctx, "correspondents", data.Vendor)
+                if err != nil {
+                        return "", err
+                }
+                fields["correspondent"] = []string{strconv.Itoa(id)}
+        }
+        if paperlessDocumentType != "" {
+                id, err := p.lookup(ctx, "document_types", paperlessDocumentType)
+                if err != nil {
+                        return "", err
+                }
+                fields["document_type"] = []string{strconv.Itoa(id)}
+        }
+        for _, tag := range append([]string{data.Category}, strings.Split(paperlessTags, ",")...) {
+                if tag = strings.TrimSpace(tag); tag == "" {
+                        continue
+                }
+                id, err := p.lookup(ctx, "tags", tag)
+                if err != nil {
+                        return "", err
+                }
+                fields["tags"] = append(fields["tags"], strconv.Itoa(id))
+        }
+
+        body, contentType, err := paperlessForm(content, name, fields)
+        if err != nil {
+                return "", err
+        }
+        req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/api/documents/post_document/", bytes.NewReader(body))
+        if err != nil {
+                return "", err
+        }
+        req.Header.Set("Content-Type", contentType)
+        var taskID string
+        if err := doJSON(apiClient, req, p.headers(), &taskID); err != nil {
+                return "", fmt.Errorf("failed to upload to Paperless: %w", err)
+        }
+
+        id, err := p.waitForTask(ctx, taskID)
+        if err != nil {
+                return "", err
+        }
+        return fmt.Sprintf("%s/documents/%d/details", p.baseURL, id), nil
+}
+
+// waitForTask polls the consumption task until Paperless reports the new document
+func (p *paperlessClient) waitForTask(ctx context.Context, taskID string) (int, error) {
+        ctx, cancel := context.WithTimeout(ctx, paperlessTaskTimeout)
+        defer cancel()
+
+        for {
+                var tasks []struct {
+                        Status          string `json:"status"`
+                        Result          string `json:"result"`
+                        RelatedDocument any    `json:"related_document"`
+                }
+                if err := getJSON(ctx, p.baseURL+"/api/tasks/?task_id="+url.QueryEscape(taskID), p.headers(), &tasks); err != nil {
+                        return 0, fmt.Errorf("failed to check Paperless task %s: %w", taskID, err)
+                }
+                if len(tasks) > 0 {
+                        task := tasks[0]
+                        switch task.Status {
+                        case "SUCCESS":
+                                return strconv.Atoi(fmt.Sprint(task.RelatedDocument))
+                        case "FAILURE", "REVOKED":
+                                if match := paperlessDuplicate.FindStringSubmatch(task.Result); match != nil {
+                                        slog.Warn("Document already in Paperless", "event", "paperless", "document", match[1])
+                                        return strconv.Atoi(match[1])
+                                }
+                                return 0, fmt.Errorf("paperless could not consume the document: %s", task.Result)
+                        }
+                }
+
+                select {
+                case <-time.After(2 * time.Second):
+                case <-ctx.Done():
+                        return 0, fmt.Errorf("timed out waiting for Paperless task %s: %w", taskID, ctx.Err())
+                }
+        }
+}
+
+// lookup returns the ID of the correspondent, tag, or document type with this name,
+// creating it if Paperless does not have one yet
+func (p *paperlessClient) lookup(ctx context.Context, kind, name string) (int, error) {
+        key := kind + "/" + strings.ToLower(name)
+        p.mu.Lock()
+        id, ok := p.ids[key]
+        p.mu.Unlock()
+        if ok {
+                return id, nil
+        }
+
+        var found struct {
+                Results []struct {
+                        ID int `json:"id"`
+                } `json:"results"`
+        }
+        endpoint := p.baseURL + "/api/" + kind + "/"
+        if err := getJSON(ctx, endpoint+"?name__iexact="+url.QueryEscape(name), p.headers(), &found); err != nil {
+                return 0, fmt.Errorf("failed to look up Paperless %s %q: %w", kind, name, err)
+        }
+        if len(found.Results) > 0 {
+                id = found.Results[0].ID
+        } else {
+                // Paperless's automatic matching is left off; the bot assigns these itself
+                var created struct {
+                        ID int `json:"id"`
+                }
+                if err := postJSON(ctx, endpoint, p.headers(), map[string]any{"name": name, "matching_algorithm": 0}, &created); err != nil {
+                        return 0, fmt.Errorf("failed to create Paperless %s %q: %w", kind, name, err)
+                }
+                id = created.ID
+                slog.Info("Created in Paperless", "event", "paperless", "kind", kind, "name", name)
+        }
+
+        p.mu.Lock()
+        p.ids[key] = id
+        p.mu.Unlock()
+        return id, nil
+}
+
+func (p *paperlessClient) headers() map[string]string {
+        return map[string]string{"Authorization": "Token " + p.token, "Accept": "application/json"}
+}
+
+// paperlessForm builds the multipart body of post_document
+func paperlessForm(content, name string, fields map[string][]string) ([]byte, string, error) {
+        var body bytes.Buffer
+        w := multipart.NewWriter(&body)
+        for key, values := range fields {
+                for _, value := range values {
+                        if err := w.WriteField(key, value); err != nil {
+                                return nil, "", err
+                        }
+                }
+        }
+
+        part, err := w.CreateFormFile("document", filepath.Base(name))
+        if err != nil {
+                return nil, "", err
+        }
+        f, err := os.Open(content)
+        if err != nil {
+                return nil, "", err
+        }
+        defer f.Close()
+        if _, err := io.Copy(part, f); err != nil {
+                return nil, "", err
+        }
+        if err := w.Close(); err != nil {
+                return nil, "", err
+        }
+        return body.Bytes(), w.FormDataContentType(), nil
+}
+
+// sendToPaperless files one receipt in Paperless, returning the document URL
+func sendToPaperless(srcPath, content string, data ReceiptData) (string, error) {
+        rel, err := processedRelPath(content, data)
+        if err != nil {
+                return "", err
+        }
+        if dryRun {
+                slog.Info("[dry-run] Would send to Paperless", "event", "paperless", "dry_run", true, "name", filepath.Base(rel), "source", srcPath, "vendor", data.Vendor, "category", data.Category)
+                return paperless.baseURL, nil
+        }
+
+        docURL, err := paperless.Send(context.Background(), content, filepath.Base(rel), data)
+        if err != nil {
+                return "", err
+        }
+        slog.Info("Sent to Paperless", "event", "paperless", "url", docURL, "source", srcPath, "date", data.Date, "vendor", data.Vendor, "category", data.Category, "amount", data.Amount, "currency", data.Currency)
+        return docURL, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+        "log/slog"
+        "strings"
+)
+
+// paymentMethods are the values payment_method is normalized to
+var paymentMethods = []string{"cash", "credit_card", "debit_card", "ic_card", "qr", "other"}
+
+// paymentAliases maps other answers seen from the model to a payment method
+var paymentAliases = map[string]string{
+        "現金":          "cash",
+        "credit":      "credit_card",
+        "card":        "credit_card",
+        "クレジット":       "credit_card",
+        "クレジットカード":    "credit_card",
+        "debit":       "debit_card",
+        "デビット":        "debit_card",
+        "ic":          "ic_card",
+        "電子マネー":       "ic_card",
+        "交通系ic":       "ic_card",
+        "qr_code":     "qr",
+        "qrコード":       "qr",
+        "コード決済":       "qr",
+        "barcode":     "qr",
+        "mobile":      "qr",
+        "unknown":     "",
+        "not_printed": "",
+}
+
+// normalizePaymentMethod folds the model's answer into one of paymentMethods, or ""
+// when the receipt does not say
+func normalizePaymentMethod(raw string) string {
+        method := strings.ToLower(strings.TrimSpace(raw))
+        method = strings.NewReplacer(" ", "_", "-", "_").Replace(method)
+        if method == "" {
+                return ""
+        }
+        for _, known := range paymentMethods {
+                if method == known {
+                        return known
+                }
+        }
+        if alias, ok := paymentAliases[method]; ok {
+                return alias
+        }
+
+        slog.Warn("Unknown payment method, recording it as other", "payment_method", raw)
+        return "other"
+}
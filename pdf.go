@@ -0,0 +1,37 @@
+package main
+
+import (
+        "os"
+        "regexp"
+        "strconv"
+)
+
+// Page objects are "/Type /Page"; the page tree nodes are "/Type /Pages"
+var (
+        pdfPageRe  = regexp.MustCompile(`/Type\s*/Page\b`)
+        pdfCountRe = regexp.MustCompile(`/Type\s*/Pages\b[^>]*?/Count\s+(\d+)|/Count\s+(\d+)[^>]*?/Type\s*/Pages\b`)
+)
+
+// countPDFPages returns a best-effort page count without a full PDF parser.
+// PDFs that hide their page tree in compressed object streams report 0.
+func countPDFPages(path string) (int, error) {
+        content, err := os.ReadFile(path)
+        if err != nil {
+                return 0, err
+        }
+
+        // Prefer the largest /Count on a page tree node, which is the root's total
+        maxCount := 0
+        for _, m := range pdfCountRe.FindAllSubmatch(content, -1) {
+                for _, group := range m[1:] {
+                        if n, err := strconv.Atoi(string(group)); err == nil && n > maxCount {
+                                maxCount = n
+                        }
+                }
+        }
+        if maxCount > 0 {
+                return maxCount, nil
+        }
+
+        return len(pdfPageRe.FindAll(content, -1)), nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+        "bytes"
+        "context"
+        "fmt"
+        "log/slog"
+        "os"
+        "os/exec"
+        "path/filepath"
+        "sort"
+        "strings"
+)
+
+// splitPDF writes each page of a PDF to its own file with qpdf, losslessly, and returns
+// them in page order with the temp directory holding them, which the caller removes
+func splitPDF(ctx context.Context, path string) ([]string, string, error) {
+        dir, err := os.MkdirTemp("", "scanner-bot-split-*")
+        if err != nil {
+                return nil, "", err
+        }
+
+        // qpdf numbers the pages with zero padding: page-01.pdf, page-02.pdf, ...
+        var stderr bytes.Buffer
+        cmd := exec.CommandContext(ctx, "qpdf", "--split-pages", path, filepath.Join(dir, "page.pdf"))
+        cmd.Stderr = &stderr
+        if err := cmd.Run(); err != nil {
+                os.RemoveAll(dir)
+                if msg := strings.TrimSpace(stderr.String()); msg != "" {
+                        err = fmt.Errorf("%w: %s", err, msg)
+                }
+                return nil, "", fmt.Errorf("failed to split PDF with qpdf: %w", err)
+        }
+
+        pages, err := filepath.Glob(filepath.Join(dir, "page-*.pdf"))
+        if err != nil || len(pages) == 0 {
+                os.RemoveAll(dir)
+                return nil, "", fmt.Errorf("qpdf produced no pages")
+        }
+        sort.Strings(pages)
+        return pages, dir, nil
+}
+
+// analyzePages analyzes path, or each of pages on its own when the PDF was split,
+// recording which page every receipt came from. Blank pages, such as batch separator
+// sheets, yield nothing.
+func analyzePages(ctx context.Context, analyzer ReceiptAnalyzer, path string, pages []string) ([]ReceiptData, error) {
+        if len(pages) == 0 {
+                return analyzer.Analyze(ctx, path)
+        }
+
+        var all []ReceiptData
+        for i, page := range pages {
+                dataList, err := analyzer.Analyze(ctx, page)
+                if err != nil {
+                        return nil, fmt.Errorf("page %d: %w", i+1, err)
+                }
+                for _, data := range dataList {
+                        if strings.TrimSpace(data.Date) == "" && strings.TrimSpace(data.Vendor) == "" && data.Amount.IsZero() {
+                                slog.Info("No receipt on page", "path", path, "page", i+1)
+                                continue
+                        }
+                        data.Page = i + 1
+                        all = append(all, data)
+                }
+        }
+        return all, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+        "encoding/hex"
+        "fmt"
+        "image"
+        _ "image/jpeg"
+        _ "image/png"
+        "log/slog"
+        "math/bits"
+        "os"
+)
+
+// phashSize is the side of the difference-hash grid; 16 gives a 256-bit hash, enough
+// to tell apart different receipts that share a shop's layout
+const phashSize = 16
+
+// perceptualHash returns a difference hash of an image: the picture is shrunk to a
+// 17x16 grayscale grid and each bit records whether a cell is brighter than its right
+// neighbour. Re-scans of the same paper, slightly shifted, rotated, or recompressed,
+// differ in only a few bits. It returns "" for PDFs.
+func perceptualHash(path string) (string, error) {
+        if mediaType(path) == "application/pdf" {
+                return "", nil
+        }
+        f, err := os.Open(path)
+        if err != nil {
+                return "", err
+        }
+        defer f.Close()
+
+        img, _, err := image.Decode(f)
+        if err != nil {
+                return "", fmt.Errorf("failed to decode image: %w", err)
+        }
+
+        grid := shrinkGray(img, phashSize+1, phashSize)
+        hash := make([]byte, phashSize*phashSize/8)
+        for y := 0; y < phashSize; y++ {
+                for x := 0; x < phashSize; x++ {
+                        if grid[y][x] > grid[y][x+1] {
+                                bit := y*phashSize + x
+                                hash[bit/8] |= 1 << (7 - bit%8)
+                        }
+                }
+        }
+        return hex.EncodeToString(hash), nil
+}
+
+// shrinkGray averages the image's luminance over a w x h grid of cells, sampling at most
+// 16x16 pixels per cell so full-resolution scans stay cheap
+func shrinkGray(img image.Image, w, h int) [][]float64 {
+        b := img.Bounds()
+        grid := make([][]float64, h)
+        for gy := 0; gy < h; gy++ {
+                grid[gy] = make([]float64, w)
+                y0, y1 := b.Min.Y+gy*b.Dy()/h, b.Min.Y+(gy+1)*b.Dy()/h
+                for gx := 0; gx < w; gx++ {
+                        x0, x1 := b.Min.X+gx*b.Dx()/w, b.Min.X+(gx+1)*b.Dx()/w
+                        stepX, stepY := max((x1-x0)/16, 1), max((y1-y0)/16, 1)
+
+                        var sum float64
+                        var n int
+                        for y := y0; y < y1; y += stepY {
+                                for x := x0; x < x1; x += stepX {
+                                        r, g, bl, _ := img.At(x, y).RGBA()
+                                        sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)
+                                        n++
+                                }
+                        }
+                        if n > 0 {
+                                grid[gy][gx] = sum / float64(n)
+                        }
+                }
+        }
+        return grid
+}
+
+// hashDistance counts the bits that differ between two perceptual hashes, or returns -1
+// if they cannot be compared
+func hashDistance(a, b string) int {
+        x, errA := hex.DecodeString(a)
+        y, errB := hex.DecodeString(b)
+        if errA != nil || errB != nil || len(x) != len(y) || len(x) == 0 {
+                return -1
+        }
+        distance := 0
+        for i := range x {
+                distance += bits.OnesCount8(x[i] ^ y[i])
+        }
+        return distance
+}
+
+// nearDuplicateProblem describes why a file looks like a re-scan of one already processed,
+// or returns "" if it does not. A file that was already held for review once and put back
+// is not checked again, so a person can overrule the match.
+func nearDuplicateProblem(path, hash, phash string) string {
+        if phash == "" {
+                return ""
+        }
+        reviewed, err := receiptDB.HashReviewed(hash)
+        if err != nil {
+                slog.Warn("Failed to check journal", "path", path, "error", err)
+                return ""
+        }
+        if reviewed {
+                return ""
+        }
+        match, distance, err := receiptDB.NearDuplicate(hash, phash, nearDuplicateDistance)
+        if err != nil {
+                slog.Warn("Failed to check journal", "path", path, "error", err)
+                return ""
+        }
+        if match == "" {
+                return ""
+        }
+        return fmt.Sprintf("looks like a re-scan of %s (%d of %d bits differ)", match, distance, phashSize*phashSize)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+        "context"
+        "io/fs"
+        "log/slog"
+        "path/filepath"
+        "time"
+)
+
+// fileSignature is what the poller compares between scans to spot new or changed files
+type fileSignature struct {
+        size    int64
+        modTime time.Time
+}
+
+// pollDir watches dir by scanning it every interval, for network shares (SMB, NFS) where
+// inotify events never arrive. The first scan passes existing files to initial (which may
+// be nil to ignore them); after that every new or changed file is passed to changed.
+func pollDir(ctx context.Context, dir string, interval time.Duration, initial, changed func(path string)) {
+        seen := map[string]fileSignature{}
+        scan := func(notify func(path string)) {
+                current := map[string]fileSignature{}
+                err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+                        if err != nil {
+                                if path == dir {
+                                        return err
+                                }
+                                return nil
+                        }
+                        if d.IsDir() {
+                                if path != dir && (!recursive || isIgnoredFile(path) || isDestRoot(path)) {
+                                        return filepath.SkipDir
+                                }
+                                return nil
+                        }
+                        if isIgnoredFile(path) {
+                                return nil
+                        }
+
+                        info, err := d.Info()
+                        if err != nil {
+                                return nil
+                        }
+                        sig := fileSignature{size: info.Size(), modTime: info.ModTime()}
+                        current[path] = sig
+                        if prev, ok := seen[path]; (!ok || prev != sig) && notify != nil {
+                                notify(path)
+                        }
+                        return nil
+                })
+                if err != nil {
+                        // Keep the previous listing so a share that drops out briefly doesn't
+                        // make every file look new when it comes back
+                        slog.Warn("Failed to scan directory", "path", dir, "error", err)
+                        return
+                }
+                seen = current
+        }
+
+        scan(initial)
+
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        for {
+                select {
+                case <-ticker.C:
+                        scan(changed)
+                case <-ctx.Done():
+                        return
+                }
+        }
+}
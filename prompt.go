@@ -0,0 +1,145 @@
+package main
+
+import (
+        "crypto/sha256"
+        "encoding/hex"
+        "fmt"
+        "os"
+        "strings"
+        "text/template"
+)
+
+// defaultCategories is the category list offered to the model unless -categories is set
+const defaultCategories = "Medical,Grocery,Tax,Utilities,Septic,Other"
+
+// defaultPromptTemplate renders the built-in prompt; -prompt-template replaces it
+const defaultPromptTemplate = `Analyze this {{.Language}} receipt or certificate. Extract JSON with these keys:
+{{- range $i, $field := .Fields}}{{if $i}},{{end}}
+    "{{$field.Name}}" ({{$field.Description}})
+{{- end}}.`
+
+// promptField describes one JSON key the model must return
+type promptField struct {
+        Name        string
+        Description string
+}
+
+// promptData holds the variables available to prompt templates
+type promptData struct {
+        Language   string
+        Categories []string
+        Fields     []promptField
+        Pages      int
+}
+
+// promptTemplate is parsed once at startup from -prompt-template or the built-in text
+var promptTemplate = template.Must(template.New("prompt").Parse(defaultPromptTemplate))
+
+// loadPromptTemplate parses a text/template file used in place of the built-in prompt
+func loadPromptTemplate(path string) (*template.Template, error) {
+        content, err := os.ReadFile(path)
+        if err != nil {
+                return nil, fmt.Errorf("error reading prompt template: %w", err)
+        }
+        tmpl, err := template.New(path).Option("missingkey=error").Parse(string(content))
+        if err != nil {
+                return nil, fmt.Errorf("error parsing prompt template %s: %w", path, err)
+        }
+        return tmpl, nil
+}
+
+// categoryList splits -categories into trimmed names
+func categoryList() []string {
+        var list []string
+        for _, category := range strings.Split(categories, ",") {
+                if category = strings.TrimSpace(category); category != "" {
+                        list = append(list, category)
+                }
+        }
+        return list
+}
+
+// promptFields lists the keys parseReceiptResponse expects, described for the model
+func promptFields() []promptField {
+        fields := []promptField{
+                {Name: "date", Description: "YYYY-MM-DD"},
+                {Name: "vendor", Description: promptLanguage + " name, if medical use clinic name"},
+                {Name: "category", Description: strings.Join(categoryList(), ", ")},
+                {Name: "total_amount", Description: "number as printed, without currency symbols or thousands separators"},
+                {Name: "currency", Description: "ISO 4217 code such as JPY, USD, or EUR"},
+        }
+        if lineItems {
+                fields = append(fields, promptField{
+                        Name:        "items",
+                        Description: `array with one object per purchased line: "description" (` + promptLanguage + ` as printed), "quantity" (number, 1 if not shown), "unit_price" (number), "amount" (number, line total after line discounts)`,
+                })
+        }
+        if invoiceDetails {
+                fields = append(fields, promptField{
+                        Name:        "tax_breakdown",
+                        Description: `array with one object per consumption tax rate shown: "rate" (percent, e.g. 8 or 10), "taxable_amount" (integer amount subject to that rate, as printed), "tax_amount" (integer tax at that rate); empty array if not shown`,
+                })
+        }
+        if invoiceDetails || nameWithRegNo {
+                fields = append(fields, promptField{
+                        Name:        "registration_number",
+                        Description: `qualified invoice issuer registration number, "T" followed by 13 digits; empty string if not printed`,
+                })
+        }
+        if paymentDetails {
+                fields = append(fields,
+                        promptField{Name: "payment_method", Description: strings.Join(paymentMethods, ", ") + `; empty string if not printed`},
+                        promptField{Name: "payment_brand", Description: `card brand or payment service as printed, e.g. VISA, JCB, Suica, PayPay; empty string if none`},
+                        promptField{Name: "card_last4", Description: `last four digits of the card number if printed, otherwise empty string`},
+                )
+        }
+        if medicalDetails {
+                fields = append(fields,
+                        promptField{Name: "patient_name", Description: `for medical receipts, the name of the patient as printed; empty string otherwise`},
+                        promptField{Name: "medical_type", Description: `for medical receipts, one of ` + strings.Join(medicalTypes, ", ") + ` (doctor or dentist visit, pharmacy or drugstore medicine, nursing care insurance service, anything else); empty string otherwise`},
+                )
+        }
+        if cropReceipts {
+                fields = append(fields, promptField{
+                        Name:        "bounding_box",
+                        Description: `object locating this receipt in the image: "left", "top", "right", "bottom" as fractions of the image width and height from 0 to 1; null for PDFs`,
+                })
+        }
+        if minConfidence > 0 {
+                fields = append(fields, promptField{
+                        Name:        "confidence",
+                        Description: `object scoring how sure you are of each value, from 0 (guess) to 1 (clearly printed): "` + strings.Join(confidenceFields, `", "`) + `"`,
+                })
+        }
+        return fields
+}
+
+// promptVersion identifies the prompt in effect, so results from different prompts
+// (a new -prompt-template, or flags that add fields) can be told apart later
+func promptVersion() (string, error) {
+        prompt, err := extractionPrompt(1)
+        if err != nil {
+                return "", err
+        }
+        sum := sha256.Sum256([]byte(prompt))
+        return hex.EncodeToString(sum[:6]), nil
+}
+
+// extractionPrompt is the instruction sent alongside each file. -prompt replaces it entirely.
+func extractionPrompt(pages int) (string, error) {
+        if customPrompt != "" {
+                return customPrompt, nil
+        }
+
+        var b strings.Builder
+        data := promptData{
+                Language:   promptLanguage,
+                Categories: categoryList(),
+                Fields:     promptFields(),
+                Pages:      pages,
+        }
+        if err := promptTemplate.Execute(&b, data); err != nil {
+                return "", fmt.Errorf("failed to render prompt: %w", err)
+        }
+        return b.String(), nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+        "context"
+        "fmt"
+        "log/slog"
+        "net/http"
+        "net/url"
+        "os"
+        "strings"
+)
+
+// pushNotifier sends a short alert to a phone when a file needs attention
+type pushNotifier interface {
+        Name() string
+        Push(ctx context.Context, alert pushAlert) error
+}
+
+// pushAlert is one notification; Link is the file under -notify-link-base, if set
+type pushAlert struct {
+        Title   string
+        Message string
+        Link    string
+        Urgent  bool
+}
+
+// pushNotifiers are configured at startup by -ntfy-url and -pushover
+var pushNotifiers []pushNotifier
+
+// setupPushNotifiers builds the notifiers requested by flags, reading their secrets from
+// the environment like the API keys
+func setupPushNotifiers() ([]pushNotifier, error) {
+        var notifiers []pushNotifier
+        if ntfyURL != "" {
+                if _, err := url.ParseRequestURI(ntfyURL); err != nil {
+                        return nil, fmt.Errorf("invalid -ntfy-url %q: %w", ntfyURL, err)
+                }
+                notifiers = append(notifiers, &ntfyNotifier{topicURL: ntfyURL, token: os.Getenv("NTFY_TOKEN")})
+        }
+        if pushover {
+                token, user := os.Getenv("PUSHOVER_TOKEN"), os.Getenv("PUSHOVER_USER")
+                if token == "" || user == "" {
+                        return nil, fmt.Errorf("-pushover requires the PUSHOVER_TOKEN and PUSHOVER_USER environment variables")
+                }
+                notifiers = append(notifiers, &pushoverNotifier{token: token, user: user})
+        }
+        return notifiers, nil
+}
+
+// notifyPush alerts every push notifier in the background. Delivery failures are
+// logged and never affect processing.
+func notifyPush(alert pushAlert, path string) {
+        for _, notifier := range pushNotifiers {
+                pendingNotifications.Add(1)
+                go func() {
+                        defer pendingNotifications.Done()
+                        if err := notifier.Push(context.Background(), alert); err != nil {
+                                slog.Warn("Push notification failed", "event", "notify", "notifier", notifier.Name(), "path", path, "error", err)
+                        }
+                }()
+        }
+}
+
+// ntfyNotifier publishes to a topic on ntfy.sh or a self-hosted ntfy server
+type ntfyNotifier struct {
+        topicURL string
+        token    string
+}
+
+func (n *ntfyNotifier) Name() string { return "ntfy" }
+
+func (n *ntfyNotifier) Push(ctx context.Context, alert pushAlert) error {
+        req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.topicURL, strings.NewReader(alert.Message))
+        if err != nil {
+                return err
+        }
+        req.Header.Set("Title", alert.Title)
+        req.Header.Set("Tags", "receipt")
+        if alert.Urgent {
+                req.Header.Set("Priority", "high")
+                req.Header.Set("Tags", "warning,receipt")
+        }
+        if alert.Link != "" {
+                req.Header.Set("Click", alert.Link)
+        }
+        if n.token != "" {
+                req.Header.Set("Authorization", "Bearer "+n.token)
+        }
+        return sendPush(req)
+}
+
+// pushoverEndpoint is the Pushover message API
+const pushoverEndpoint = "https://api.pushover.net/1/messages.json"
+
+// pushoverNotifier sends through the Pushover app
+type pushoverNotifier struct {
+        token string
+        user  string
+}
+
+func (p *pushoverNotifier) Name() string { return "pushover" }
+
+func (p *pushoverNotifier) Push(ctx context.Context, alert pushAlert) error {
+        form := url.Values{
+                "token":   {p.token},
+                "user":    {p.user},
+                "title":   {alert.Title},
+                "message": {alert.Message},
+        }
+        if alert.Urgent {
+                form.Set("priority", "1")
+        }
+        if alert.Link != "" {
+                form.Set("url", alert.Link)
+        }
+        req, err := http.NewRequestWithContext(ctx, http.MethodPost, pushoverEndpoint, strings.NewReader(form.Encode()))
+        if err != nil {
+                return err
+        }
+        req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+        return sendPush(req)
+}
+
+func sendPush(req *http.Request) error {
+        resp, err := webhookClient.Do(req)
+        if err != nil {
+                return err
+        }
+        defer resp.Body.Close()
+        if resp.StatusCode < 200 || resp.StatusCode > 299 {
+                return fmt.Errorf("unexpected status %s", resp.Status)
+        }
+        return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+        "encoding/json"
+        "fmt"
+        "os"
+        "sync"
+        "time"
+)
+
+// queueFileName lives next to the state file and lists files the bot has seen but not
+// finished, so a crash or restart picks them up where it left off
+const queueFileName = ".scanner-bot-queue.json"
+
+// Work queue stages. A file leaves the queue once it is filed, quarantined, held for
+// review, or skipped; one waiting for another attempt after a failure is "retry".
+const (
+        queueDetected = "detected"
+        queueStable   = "stable"
+        queueAnalyzed = "analyzed"
+        queueRetry    = "retry"
+)
+
+// QueueEntry is one unfinished file. An analyzed file keeps its results, so it is filed
+// after a restart without calling the model again. Failures counts the failed attempts
+// on this content, for -max-failures.
+type QueueEntry struct {
+        Stage     string        `json:"stage"`
+        SHA256    string        `json:"sha256,omitempty"`
+        Receipts  []ReceiptData `json:"receipts,omitempty"`
+        Failures  int           `json:"failures,omitempty"`
+        LastError string        `json:"last_error,omitempty"`
+        UpdatedAt time.Time     `json:"updated_at"`
+}
+
+// WorkQueue persists the stage of every file in progress, keyed by absolute path.
+// A nil queue (with -file or -dry-run) records nothing.
+type WorkQueue struct {
+        mu    sync.Mutex
+        path  string
+        Files map[string]QueueEntry `json:"files"`
+}
+
+// workQueue is loaded at startup in watch mode
+var workQueue *WorkQueue
+
+// loadWorkQueue reads the queue file, starting empty if it doesn't exist yet
+func loadWorkQueue(path string) (*WorkQueue, error) {
+        queue := &WorkQueue{path: path, Files: map[string]QueueEntry{}}
+
+        content, err := os.ReadFile(path)
+        if os.IsNotExist(err) {
+                return queue, nil
+        }
+        if err != nil {
+                return nil, fmt.Errorf("error reading queue file: %w", err)
+        }
+
+        if err := json.Unmarshal(content, queue); err != nil {
+                return nil, fmt.Errorf("error parsing queue file %s: %w", path, err)
+        }
+        if queue.Files == nil {
+                queue.Files = map[string]QueueEntry{}
+        }
+        return queue, nil
+}
+
+// Pending returns a copy of the unfinished files
+func (q *WorkQueue) Pending() map[string]QueueEntry {
+        if q == nil {
+                return nil
+        }
+        q.mu.Lock()
+        defer q.mu.Unlock()
+
+        pending := make(map[string]QueueEntry, len(q.Files))
+        for path, entry := range q.Files {
+                pending[path] = entry
+        }
+        return pending
+}
+
+// Detected records a file that is waiting to finish writing
+func (q *WorkQueue) Detected(srcPath string) error {
+        return q.update(srcPath, QueueEntry{Stage: queueDetected})
+}
+
+// Stable records a file that finished writing and waits for a worker
+func (q *WorkQueue) Stable(srcPath string) error {
+        return q.update(srcPath, QueueEntry{Stage: queueStable})
+}
+
+// Analyzed records the results that passed validation for a file with this content
+func (q *WorkQueue) Analyzed(srcPath, hash string, dataList []ReceiptData) error {
+        return q.update(srcPath, QueueEntry{Stage: queueAnalyzed, SHA256: hash, Receipts: dataList})
+}
+
+// Analysis returns the saved results for srcPath if its content has not changed since
+func (q *WorkQueue) Analysis(srcPath, hash string) ([]ReceiptData, bool) {
+        if q == nil {
+                return nil, false
+        }
+        q.mu.Lock()
+        defer q.mu.Unlock()
+
+        entry, ok := q.Files[stateKey(srcPath)]
+        if !ok || entry.Stage != queueAnalyzed || entry.SHA256 != hash || len(entry.Receipts) == 0 {
+                return nil, false
+        }
+        return entry.Receipts, true
+}
+
+// Failed records a failed attempt and returns how many attempts on this content have
+// failed. Changed content starts counting again.
+func (q *WorkQueue) Failed(srcPath, hash string, reason error) (int, error) {
+        if q == nil {
+                return 1, nil
+        }
+        q.mu.Lock()
+        defer q.mu.Unlock()
+
+        key := stateKey(srcPath)
+        entry := q.Files[key]
+        if entry.SHA256 != hash {
+                entry.Failures = 0
+        }
+        entry.Stage = queueRetry
+        entry.SHA256 = hash
+        entry.Receipts = nil
+        entry.Failures++
+        entry.LastError = reason.Error()
+        entry.UpdatedAt = time.Now()
+        q.Files[key] = entry
+        return entry.Failures, q.save()
+}
+
+// Done removes a file that needs no more work
+func (q *WorkQueue) Done(srcPath string) error {
+        if q == nil {
+                return nil
+        }
+        q.mu.Lock()
+        defer q.mu.Unlock()
+
+        key := stateKey(srcPath)
+        if _, ok := q.Files[key]; !ok {
+                return nil
+        }
+        delete(q.Files, key)
+        return q.save()
+}
+
+func (q *WorkQueue) update(srcPath string, entry QueueEntry) error {
+        if q == nil {
+                return nil
+        }
+        q.mu.Lock()
+        defer q.mu.Unlock()
+
+        // Failed attempts carry over while the file moves through the stages again
+        key := stateKey(srcPath)
+        if previous, ok := q.Files[key]; ok && (entry.SHA256 == "" || entry.SHA256 == previous.SHA256) {
+                entry.Failures = previous.Failures
+                entry.LastError = previous.LastError
+                if entry.SHA256 == "" {
+                        entry.SHA256 = previous.SHA256
+                }
+        }
+        entry.UpdatedAt = time.Now()
+        q.Files[key] = entry
+        return q.save()
+}
+
+// save atomically rewrites the queue file; the caller holds mu
+func (q *WorkQueue) save() error {
+        content, err := json.MarshalIndent(q, "", "  ")
+        if err != nil {
+                return err
+        }
+        if err := writeFileAtomic(q.path, content); err != nil {
+                return fmt.Errorf("failed to write queue file: %w", err)
+        }
+        return nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+        "context"
+        "fmt"
+        "log/slog"
+        "sync"
+        "time"
+)
+
+// usageLimits keeps the -provider backend within a plan's quota: generate calls are
+// spread out by a token bucket holding -requests-per-minute, and once -tokens-per-day
+// have been used, files are handed back until the next day (and -quota-window, if set)
+type usageLimits struct {
+        perMinute    int
+        tokensPerDay int64
+        window       *quotaWindow
+
+        mu        sync.Mutex
+        available float64
+        refilled  time.Time
+        day       string
+        used      int64
+        deferred  bool
+}
+
+func newUsageLimits(perMinute int, tokensPerDay int64, window *quotaWindow) *usageLimits {
+        return &usageLimits{
+                perMinute:    perMinute,
+                tokensPerDay: tokensPerDay,
+                window:       window,
+                available:    float64(perMinute),
+                refilled:     time.Now(),
+        }
+}
+
+// quotaDeferredError is returned instead of waiting once the daily budget is used up, so
+// a worker gives the file back rather than sleeping on it. It is an errRetryLater.
+type quotaDeferredError struct {
+        resume time.Time
+}
+
+func (e *quotaDeferredError) Error() string {
+        return "daily token budget used up until " + e.resume.Format(time.RFC3339)
+}
+
+func (e *quotaDeferredError) Unwrap() error {
+        return errRetryLater
+}
+
+// Acquire blocks until a request can be made this minute. It returns a
+// *quotaDeferredError at once when the daily budget is used up.
+func (l *usageLimits) Acquire(ctx context.Context) error {
+        if err := l.Deferred(); err != nil {
+                return err
+        }
+        for {
+                delay := l.reserve()
+                if delay <= 0 {
+                        return nil
+                }
+
+                timer := time.NewTimer(delay)
+                select {
+                case <-timer.C:
+                case <-ctx.Done():
+                        timer.Stop()
+                        return ctx.Err()
+                }
+        }
+}
+
+// Deferred returns a *quotaDeferredError while the daily budget is used up. It is checked
+// before a file is uploaded, so no upload is left waiting for the budget to reset.
+func (l *usageLimits) Deferred() error {
+        if l == nil {
+                return nil
+        }
+        l.mu.Lock()
+        defer l.mu.Unlock()
+
+        now := time.Now()
+        l.rollDay(now)
+        if l.tokensPerDay <= 0 || l.used < l.tokensPerDay {
+                return nil
+        }
+        resume := nextDay(now)
+        if l.window != nil {
+                resume = l.window.next(resume)
+        }
+        if !l.deferred {
+                l.deferred = true
+                slog.Warn("Daily token budget used up, deferring analysis", "tokens_used", l.used, "tokens_per_day", l.tokensPerDay, "resume", resume.Format(time.RFC3339))
+        }
+        return &quotaDeferredError{resume: resume}
+}
+
+// reserve takes a request from the bucket, or returns how long to wait before trying again
+func (l *usageLimits) reserve() time.Duration {
+        l.mu.Lock()
+        defer l.mu.Unlock()
+
+        now := time.Now()
+        if l.perMinute <= 0 {
+                return 0
+        }
+        l.available = min(l.available+now.Sub(l.refilled).Minutes()*float64(l.perMinute), float64(l.perMinute))
+        l.refilled = now
+        if l.available >= 1 {
+                l.available--
+                return 0
+        }
+        return time.Duration((1 - l.available) / float64(l.perMinute) * float64(time.Minute))
+}
+
+// RecordTokens counts a response's tokens against today's budget
+func (l *usageLimits) RecordTokens(tokens int64) {
+        l.mu.Lock()
+        defer l.mu.Unlock()
+
+        l.rollDay(time.Now())
+        l.used += tokens
+}
+
+// rollDay starts a fresh budget at midnight in -timezone
+func (l *usageLimits) rollDay(now time.Time) {
+        if day := now.In(location).Format("2006-01-02"); day != l.day {
+                if l.deferred {
+                        slog.Info("Daily token budget reset, resuming analysis", "day", day)
+                }
+                l.day = day
+                l.used = 0
+                l.deferred = false
+        }
+}
+
+// nextDay returns the coming midnight in -timezone
+func nextDay(now time.Time) time.Time {
+        y, m, d := now.In(location).Date()
+        return time.Date(y, m, d+1, 0, 0, 0, 0, location)
+}
+
+// quotaWindow is -quota-window: the hours of the day, such as 22:00-06:00, when work
+// deferred by an exhausted daily budget may run. It may wrap past midnight.
+type quotaWindow struct {
+        start, end time.Duration
+}
+
+// parseQuotaWindow parses HH:MM-HH:MM
+func parseQuotaWindow(value string) (*quotaWindow, error) {
+        var startH, startM, endH, endM int
+        if _, err := fmt.Sscanf(value, "%d:%d-%d:%d", &startH, &startM, &endH, &endM); err != nil {
+                return nil, fmt.Errorf("expected HH:MM-HH:MM: %w", err)
+        }
+        w := &quotaWindow{
+                start: time.Duration(startH)*time.Hour + time.Duration(startM)*time.Minute,
+                end:   time.Duration(endH)*time.Hour + time.Duration(endM)*time.Minute,
+        }
+        if startH > 23 || endH > 24 || startM > 59 || endM > 59 || startH < 0 || endH < 0 || startM < 0 || endM < 0 || w.end > 24*time.Hour || w.start == w.end {
+                return nil, fmt.Errorf("expected two different times of day as HH:MM-HH:MM")
+        }
+        return w, nil
+}
+
+// next returns t if it falls inside the window, otherwise the window's next start
+func (w *quotaWindow) next(t time.Time) time.Time {
+        t = t.In(location)
+        y, m, d := t.Date()
+        midnight := time.Date(y, m, d, 0, 0, 0, 0, location)
+        offset := t.Sub(midnight)
+
+        inside := offset >= w.start && offset < w.end
+        if w.start > w.end {
+                inside = offset >= w.start || offset < w.end
+        }
+        if inside {
+                return t
+        }
+        if offset < w.start {
+                return midnight.Add(w.start)
+        }
+        return time.Date(y, m, d+1, 0, 0, 0, 0, location).Add(w.start)
+}
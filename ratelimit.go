@@ -0,0 +1,214 @@
+package main
+
+import (
+        "context"
+        "errors"
+        "fmt"
+        "io"
+        "log/slog"
+        "math/rand"
+        "net"
+        "net/http"
+        "strconv"
+        "strings"
+        "sync"
+        "time"
+
+        "google.golang.org/api/googleapi"
+)
+
+const (
+        rateLimitBaseDelay = 15 * time.Second
+        rateLimitMaxDelay  = 10 * time.Minute
+
+        // Server errors and dropped connections usually clear up within seconds
+        transientBaseDelay = 2 * time.Second
+        transientMaxDelay  = 1 * time.Minute
+)
+
+// quotaGate pauses every API call after any worker hits a 429, since the quota is shared
+type quotaGate struct {
+        mu    sync.Mutex
+        until time.Time
+
+        // limits is set on apiQuota by -requests-per-minute and -tokens-per-day
+        limits *usageLimits
+}
+
+// apiQuota is the -provider backend's gate; each -fallback backend has its own
+var apiQuota quotaGate
+
+type quotaContextKey struct{}
+
+// withQuota makes withRetry calls under ctx use gate instead of apiQuota
+func withQuota(ctx context.Context, gate *quotaGate) context.Context {
+        return context.WithValue(ctx, quotaContextKey{}, gate)
+}
+
+func quotaFrom(ctx context.Context) *quotaGate {
+        if gate, ok := ctx.Value(quotaContextKey{}).(*quotaGate); ok {
+                return gate
+        }
+        return &apiQuota
+}
+
+// Wait blocks until the current pause (if any) has passed
+func (g *quotaGate) Wait(ctx context.Context) error {
+        g.mu.Lock()
+        delay := time.Until(g.until)
+        g.mu.Unlock()
+
+        if delay <= 0 {
+                return nil
+        }
+
+        timer := time.NewTimer(delay)
+        defer timer.Stop()
+        select {
+        case <-timer.C:
+                return nil
+        case <-ctx.Done():
+                return ctx.Err()
+        }
+}
+
+// Pause holds all callers for at least d; it never shortens an existing pause
+func (g *quotaGate) Pause(d time.Duration) {
+        g.mu.Lock()
+        defer g.mu.Unlock()
+
+        if until := time.Now().Add(d); until.After(g.until) {
+                g.until = until
+        }
+}
+
+// rateLimitDelay reports whether err is a 429 / RESOURCE_EXHAUSTED response and how long
+// to wait, preferring the server's Retry-After over exponential backoff
+func rateLimitDelay(err error, attempt int) (time.Duration, bool) {
+        if err == nil {
+                return 0, false
+        }
+
+        var apiErr *googleapi.Error
+        if errors.As(err, &apiErr) && apiErr.Code == http.StatusTooManyRequests {
+                if d, ok := parseRetryAfter(apiErr.Header.Get("Retry-After")); ok {
+                        return d, true
+                }
+                return backoffDelay(rateLimitBaseDelay, rateLimitMaxDelay, attempt), true
+        }
+
+        var statusErr *httpStatusError
+        if errors.As(err, &statusErr) && statusErr.Code == http.StatusTooManyRequests {
+                if d, ok := parseRetryAfter(statusErr.Header.Get("Retry-After")); ok {
+                        return d, true
+                }
+                return backoffDelay(rateLimitBaseDelay, rateLimitMaxDelay, attempt), true
+        }
+
+        if strings.Contains(err.Error(), "RESOURCE_EXHAUSTED") {
+                return backoffDelay(rateLimitBaseDelay, rateLimitMaxDelay, attempt), true
+        }
+        return 0, false
+}
+
+// isTransientError reports whether err is a 5xx response or a network failure that is
+// likely to succeed if the same call is repeated
+func isTransientError(err error) bool {
+        if err == nil {
+                return false
+        }
+
+        var apiErr *googleapi.Error
+        if errors.As(err, &apiErr) {
+                return apiErr.Code >= 500
+        }
+
+        // Includes Anthropic's 529 "overloaded"
+        var statusErr *httpStatusError
+        if errors.As(err, &statusErr) {
+                return statusErr.Code >= 500
+        }
+
+        var netErr net.Error
+        if errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+                return true
+        }
+
+        msg := err.Error()
+        for _, status := range []string{"UNAVAILABLE", "INTERNAL", "DEADLINE_EXCEEDED", "connection reset"} {
+                if strings.Contains(msg, status) {
+                        return true
+                }
+        }
+        return false
+}
+
+// parseRetryAfter accepts either delay-seconds or an HTTP date
+func parseRetryAfter(value string) (time.Duration, bool) {
+        if value == "" {
+                return 0, false
+        }
+        if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+                return time.Duration(seconds) * time.Second, true
+        }
+        if t, err := http.ParseTime(value); err == nil {
+                return max(time.Until(t), 0), true
+        }
+        return 0, false
+}
+
+// backoffDelay doubles base for every attempt up to maxDelay, with equal jitter
+// (half fixed, half random) so workers that failed together don't retry together
+func backoffDelay(base, maxDelay time.Duration, attempt int) time.Duration {
+        delay := base << (attempt - 1)
+        if delay <= 0 || delay > maxDelay {
+                delay = maxDelay
+        }
+        half := delay / 2
+        return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// withRetry runs a model API call, waiting out rate limits and retrying transient
+// failures instead of failing the file. It gives up after -max-attempts calls.
+func withRetry(ctx context.Context, op string, fn func() error) error {
+        quota := quotaFrom(ctx)
+        for attempt := 1; ; attempt++ {
+                if err := quota.Wait(ctx); err != nil {
+                        return err
+                }
+                // The per-minute and daily quotas count generate calls, not uploads
+                if quota.limits != nil && op == "generate" {
+                        if err := quota.limits.Acquire(ctx); err != nil {
+                                return err
+                        }
+                }
+
+                err := fn()
+                health.RecordAPI(err)
+                delay, limited := rateLimitDelay(err, attempt)
+                transient := !limited && isTransientError(err)
+                if !limited && !transient {
+                        return err
+                }
+                if attempt >= maxAttempts {
+                        return fmt.Errorf("%s still failing after %d attempts: %w", op, attempt, err)
+                }
+
+                if limited {
+                        slog.Warn("Rate limit hit, pausing all workers", "op", op, "delay", delay.Round(time.Second).String())
+                        quota.Pause(delay)
+                        continue
+                }
+
+                // A server error only affects this call, so only this worker backs off
+                delay = backoffDelay(transientBaseDelay, transientMaxDelay, attempt)
+                slog.Warn("Transient API error, retrying", "op", op, "attempt", attempt, "max_attempts", maxAttempts, "delay", delay.Round(time.Millisecond).String(), "error", err)
+                timer := time.NewTimer(delay)
+                select {
+                case <-timer.C:
+                case <-ctx.Done():
+                        timer.Stop()
+                        return ctx.Err()
+                }
+        }
+}
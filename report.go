@@ -0,0 +1,284 @@
+package main
+
+import (
+        "encoding/csv"
+        "fmt"
+        "io/fs"
+        "log/slog"
+        "os"
+        "path/filepath"
+        "regexp"
+        "slices"
+        "sort"
+        "strconv"
+        "strings"
+        "time"
+)
+
+// FiledReceipt is a processed receipt found under destDir
+type FiledReceipt struct {
+        ReceiptData
+        Path string
+}
+
+// ExpenseReport describes which filed receipts belong to a report
+type ExpenseReport struct {
+        Name string
+        From time.Time
+        To   time.Time
+        Tags []string
+}
+
+// collectFiledReceipts walks destDir and recovers receipt data from processed files,
+// preferring the .json sidecar when there is one and falling back to the file name.
+// Files without a sidecar that don't follow the YYYY-MM-DD_Vendor_Amount円.ext scheme
+// (or its 12.34EUR, registration-number, and numbered variants) are skipped, so receipts filed
+// with -filename-template need -write-sidecar to be found.
+func collectFiledReceipts(root string) ([]FiledReceipt, error) {
+        var receipts []FiledReceipt
+
+        err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+                if err != nil {
+                        return err
+                }
+                if d.IsDir() {
+                        if path != root && slices.Contains(reservedDirs, d.Name()) {
+                                return filepath.SkipDir
+                        }
+                        return nil
+                }
+                if strings.HasSuffix(path, ".json") {
+                        return nil
+                }
+
+                data, ok := parseProcessedFileName(d.Name())
+                sidecar, hasSidecar := readSidecar(path)
+                switch {
+                case hasSidecar:
+                        data = sidecar.ReceiptData
+                        if data.Currency == "" {
+                                data.Currency = "JPY" // sidecars from before currencies were extracted
+                        }
+                case !ok:
+                        return nil
+                }
+
+                // In the built-in layout the top folder is the category, which may have been
+                // corrected by moving the file
+                if fileNameFormat == "" {
+                        if rel, err := filepath.Rel(root, filepath.Dir(path)); err == nil && rel != "." {
+                                data.Category = strings.Split(rel, string(filepath.Separator))[0]
+                        }
+                }
+                receipts = append(receipts, FiledReceipt{ReceiptData: data, Path: path})
+                return nil
+        })
+
+        return receipts, err
+}
+
+// fileAmount matches the amount part of a processed file name: "1200円" or "12.34EUR"
+var fileAmount = regexp.MustCompile(`^(-?[0-9]+(?:\.[0-9]+)?)(円|[A-Z]{3})$`)
+
+// parseProcessedFileName reverses the naming scheme used by saveProcessedFile
+func parseProcessedFileName(name string) (ReceiptData, bool) {
+        base := strings.TrimSuffix(name, filepath.Ext(name))
+        first := strings.Index(base, "_")
+        last := strings.LastIndex(base, "_")
+        if first < 0 || first == last {
+                return ReceiptData{}, false
+        }
+
+        date := base[:first]
+        if _, err := time.Parse("2006-01-02", date); err != nil {
+                return ReceiptData{}, false
+        }
+
+        // availablePath adds _2, _3, ... when the name was already taken
+        if suffix := base[last+1:]; suffix != "" && strings.Trim(suffix, "0123456789") == "" {
+                base = base[:last]
+                last = strings.LastIndex(base, "_")
+                if first == last {
+                        return ReceiptData{}, false
+                }
+        }
+
+        // -filename-registration adds the T-number after the amount
+        registration := ""
+        if isRegistrationNumber(base[last+1:]) {
+                registration = base[last+1:]
+                base = base[:last]
+                last = strings.LastIndex(base, "_")
+                if first == last {
+                        return ReceiptData{}, false
+                }
+        }
+
+        m := fileAmount.FindStringSubmatch(base[last+1:])
+        if m == nil {
+                return ReceiptData{}, false
+        }
+        amount, err := parseDecimal(m[1])
+        if err != nil {
+                return ReceiptData{}, false
+        }
+        currency := m[2]
+        if currency == "円" {
+                currency = "JPY"
+        }
+
+        return ReceiptData{Date: date, Vendor: base[first+1 : last], Amount: amount, Currency: currency, RegistrationNumber: registration}, true
+}
+
+// matches reports whether a filed receipt falls inside the report's date range and tags
+func (r ExpenseReport) matches(receipt FiledReceipt) bool {
+        date, err := time.Parse("2006-01-02", receipt.Date)
+        if err != nil {
+                return false
+        }
+        if !r.From.IsZero() && date.Before(r.From) {
+                return false
+        }
+        if !r.To.IsZero() && date.After(r.To) {
+                return false
+        }
+        if len(r.Tags) == 0 {
+                return true
+        }
+
+        // Tags match the category exactly or appear anywhere in the vendor name
+        for _, tag := range r.Tags {
+                if strings.EqualFold(tag, receipt.Category) || strings.Contains(strings.ToLower(receipt.Vendor), strings.ToLower(tag)) {
+                        return true
+                }
+        }
+        return false
+}
+
+// buildExpenseReport writes dest/reports/<name>/ containing a summary spreadsheet
+// and copies of every matching receipt
+func buildExpenseReport(report ExpenseReport) error {
+        receipts, err := collectFiledReceipts(destDir)
+        if err != nil {
+                return fmt.Errorf("failed to scan %s: %w", destDir, err)
+        }
+
+        var matched []FiledReceipt
+        for _, receipt := range receipts {
+                if report.matches(receipt) {
+                        matched = append(matched, receipt)
+                }
+        }
+        if len(matched) == 0 {
+                return fmt.Errorf("no receipts match report %q", report.Name)
+        }
+
+        sort.Slice(matched, func(i, j int) bool {
+                if matched[i].Date != matched[j].Date {
+                        return matched[i].Date < matched[j].Date
+                }
+                return matched[i].Path < matched[j].Path
+        })
+
+        // The name is typed by the user, so it is made a single safe component like a category
+        name := safeComponent(sanitizeName(report.Name, maxFieldBytes))
+        reportDir := filepath.Join(destDir, "reports", name)
+        attachDir := filepath.Join(reportDir, "receipts")
+
+        if dryRun {
+                slog.Info("[dry-run] Would write expense report", "event", "report", "dry_run", true, "path", reportDir, "receipts", len(matched))
+                return nil
+        }
+
+        if err := os.MkdirAll(attachDir, 0755); err != nil {
+                return fmt.Errorf("failed to create directory %s: %w", attachDir, err)
+        }
+
+        f, err := os.Create(filepath.Join(reportDir, name+".csv"))
+        if err != nil {
+                return fmt.Errorf("failed to create report: %w", err)
+        }
+        defer f.Close()
+
+        w := csv.NewWriter(f)
+
+        // Cover summary: totals per category and the grand total, kept apart per currency
+        type categoryCurrency struct{ category, currency string }
+        totals := map[categoryCurrency]Decimal{}
+        var keys []categoryCurrency
+        grandTotals := map[string]Decimal{}
+        for _, receipt := range matched {
+                key := categoryCurrency{receipt.Category, receipt.Currency}
+                if _, seen := totals[key]; !seen {
+                        keys = append(keys, key)
+                }
+                totals[key] = totals[key].Add(receipt.Amount)
+                grandTotals[receipt.Currency] = grandTotals[receipt.Currency].Add(receipt.Amount)
+        }
+        sort.Slice(keys, func(i, j int) bool {
+                if keys[i].category != keys[j].category {
+                        return keys[i].category < keys[j].category
+                }
+                return keys[i].currency < keys[j].currency
+        })
+        currencies := sortedKeys(grandTotals)
+
+        w.Write([]string{"Expense Report", report.Name})
+        w.Write([]string{"Period", formatReportDate(report.From), formatReportDate(report.To)})
+        if len(report.Tags) > 0 {
+                w.Write([]string{"Tags", strings.Join(report.Tags, ", ")})
+        }
+        w.Write([]string{"Receipts", strconv.Itoa(len(matched))})
+        w.Write(nil)
+        w.Write([]string{"Category", "Total", "Currency"})
+        for _, key := range keys {
+                w.Write([]string{key.category, totals[key].String(), key.currency})
+        }
+        for _, currency := range currencies {
+                w.Write([]string{"Grand Total", grandTotals[currency].String(), currency})
+        }
+        w.Write(nil)
+
+        // Itemized list, referencing the attached copies
+        w.Write([]string{"Date", "Vendor", "Category", "Amount", "Currency", "Attachment"})
+        for _, receipt := range matched {
+                attachName := filepath.Base(receipt.Path)
+                if err := robustCopy(receipt.Path, filepath.Join(attachDir, attachName)); err != nil {
+                        return fmt.Errorf("failed to attach %s: %w", receipt.Path, err)
+                }
+                w.Write([]string{receipt.Date, receipt.Vendor, receipt.Category, receipt.Amount.String(), receipt.Currency, filepath.Join("receipts", attachName)})
+        }
+
+        w.Flush()
+        if err := w.Error(); err != nil {
+                return fmt.Errorf("failed to write report: %w", err)
+        }
+
+        slog.Info("Wrote expense report", "event", "report", "path", reportDir, "receipts", len(matched), "total", formatTotals(grandTotals))
+        return nil
+}
+
+// formatTotals lists per-currency totals, e.g. "12000円, 45.6EUR"
+func formatTotals(totals map[string]Decimal) string {
+        var parts []string
+        for _, currency := range sortedKeys(totals) {
+                parts = append(parts, amountLabel(totals[currency], currency))
+        }
+        return strings.Join(parts, ", ")
+}
+
+func sortedKeys(m map[string]Decimal) []string {
+        keys := make([]string, 0, len(m))
+        for key := range m {
+                keys = append(keys, key)
+        }
+        sort.Strings(keys)
+        return keys
+}
+
+func formatReportDate(t time.Time) string {
+        if t.IsZero() {
+                return "-"
+        }
+        return t.Format("2006-01-02")
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+        "context"
+        "errors"
+        "fmt"
+        "io/fs"
+        "log/slog"
+        "os"
+        "path/filepath"
+        "slices"
+        "sort"
+        "strconv"
+        "strings"
+        "time"
+)
+
+// reprocessTarget is a filed scan: its archived original and the processed copies made from it
+type reprocessTarget struct {
+        Original string
+        Hash     string
+        Copies   []string
+}
+
+// resolveReprocessTarget finds the original and processed copies for -reprocess, given
+// a journal id (with -db), an archived original, or a processed copy
+func resolveReprocessTarget(arg string) (*reprocessTarget, error) {
+        target := &reprocessTarget{}
+        originalsDir := filepath.Join(destDir, "originals")
+
+        if id, err := strconv.ParseInt(arg, 10, 64); err == nil {
+                if receiptDB == nil {
+                        return nil, errors.New("a journal id needs -db")
+                }
+                if target.Hash, err = receiptDB.JournalHash(id); err != nil {
+                        return nil, err
+                }
+        } else if abs, err := filepath.Abs(arg); err != nil {
+                return nil, err
+        } else if originals, _ := filepath.Abs(originalsDir); strings.HasPrefix(abs, originals+string(filepath.Separator)) {
+                target.Original = abs
+                if target.Hash, err = fileSHA256(abs); err != nil {
+                        return nil, err
+                }
+        } else {
+                sidecar, ok := readSidecar(abs)
+                if !ok || sidecar.SourceSHA256 == "" {
+                        return nil, fmt.Errorf("%s has no sidecar naming its original; give the original in %s instead", arg, originalsDir)
+                }
+                target.Hash = sidecar.SourceSHA256
+        }
+
+        if target.Original == "" {
+                original, err := findByHash(originalsDir, target.Hash)
+                if err != nil {
+                        return nil, err
+                }
+                if original == "" {
+                        return nil, fmt.Errorf("the original is no longer in %s", originalsDir)
+                }
+                target.Original = original
+        }
+
+        copies, err := findCopies(target.Hash)
+        if err != nil {
+                return nil, err
+        }
+        if len(copies) == 0 {
+                return nil, fmt.Errorf("no processed copies of %s found under %s", target.Original, destDir)
+        }
+        target.Copies = copies
+        return target, nil
+}
+
+// findByHash returns the file under dir with this SHA-256, or ""
+func findByHash(dir, hash string) (string, error) {
+        found := ""
+        err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+                if err != nil || d.IsDir() || found != "" {
+                        return err
+                }
+                if sum, err := fileSHA256(path); err == nil && sum == hash {
+                        found = path
+                }
+                return nil
+        })
+        if errors.Is(err, fs.ErrNotExist) {
+                return "", nil
+        }
+        return found, err
+}
+
+// findCopies lists the processed copies made from the original with this hash: those
+// whose sidecar names it, ordered by page and name as the receipts come back from the
+// model, or else those the journal recorded, in the order they were saved
+func findCopies(hash string) ([]string, error) {
+        type copyInfo struct {
+                path string
+                page int
+        }
+        var copies []copyInfo
+        err := filepath.WalkDir(destDir, func(path string, d fs.DirEntry, err error) error {
+                if err != nil {
+                        return err
+                }
+                if d.IsDir() {
+                        if path != destDir && slices.Contains(reservedDirs, d.Name()) {
+                                return filepath.SkipDir
+                        }
+                        return nil
+                }
+                if !strings.HasSuffix(path, ".json") {
+                        return nil
+                }
+                processed := strings.TrimSuffix(path, ".json")
+                if sidecar, ok := readSidecar(processed); ok && sidecar.SourceSHA256 == hash {
+                        if _, err := os.Stat(processed); err == nil {
+                                copies = append(copies, copyInfo{processed, sidecar.Page})
+                        }
+                }
+                return nil
+        })
+        if err != nil {
+                return nil, err
+        }
+
+        var paths []string
+        if len(copies) == 0 && receiptDB != nil {
+                recorded, err := receiptDB.ProcessedPaths(hash)
+                if err != nil {
+                        return nil, err
+                }
+                for _, path := range recorded {
+                        if _, err := os.Stat(path); err == nil {
+                                paths = append(paths, path)
+                        }
+                }
+                return paths, nil
+        }
+
+        sort.Slice(copies, func(i, j int) bool {
+                if copies[i].page != copies[j].page {
+                        return copies[i].page < copies[j].page
+                }
+                return copies[i].path < copies[j].path
+        })
+        for _, c := range copies {
+                paths = append(paths, c.path)
+        }
+        return paths, nil
+}
+
+// reprocessFile analyzes an already filed original again, for example after the prompt
+// was improved, and re-files its processed copies under the names the new values give
+// them. Each sidecar keeps the values it replaced in its history, and -db gets the new
+// values and a journal entry. The copies themselves are moved, not recreated, so crops
+// and pages filed before stay as they were; the model must find as many receipts as
+// were filed.
+func reprocessFile(ctx context.Context, analyzer ReceiptAnalyzer, arg string) error {
+        target, err := resolveReprocessTarget(arg)
+        if err != nil {
+                return err
+        }
+        slog.Info("Reprocessing receipt", "event", "reprocess", "path", target.Original, "copies", len(target.Copies))
+
+        usage := &tokenUsage{}
+        ctx = withUsage(ctx, usage)
+        var journalID int64
+        if receiptDB != nil {
+                if journalID, err = receiptDB.StartJournal(target.Original, target.Hash, ""); err != nil {
+                        slog.Warn("Failed to journal file", "path", target.Original, "error", err)
+                }
+        }
+        finishJournal := func(status string, dataList []ReceiptData, destPaths []string, procErr error) {
+                if journalID == 0 {
+                        return
+                }
+                if err := receiptDB.FinishJournal(journalID, status, dataList, destPaths, usage, procErr); err != nil {
+                        slog.Warn("Failed to update journal", "path", target.Original, "error", err)
+                }
+        }
+
+        dataList, err := analyzeOriginal(withSourceHash(ctx, target.Hash), analyzer, target.Original)
+        if err == nil && len(dataList) != len(target.Copies) {
+                err = fmt.Errorf("the model found %d receipts where %d were filed; move or delete the copies and process the original again instead", len(dataList), len(target.Copies))
+        }
+        if err == nil && (validate || minConfidence > 0 || verifyWith != "") {
+                if problems := validateReceipts(dataList); len(problems) > 0 {
+                        err = fmt.Errorf("%w: %s", errNeedsReview, strings.Join(problems, "; "))
+                }
+        }
+        if err != nil {
+                finishJournal(journalFailed, dataList, nil, err)
+                return err
+        }
+
+        var destPaths []string
+        for i, data := range dataList {
+                newPath, err := refileCopy(target, target.Copies[i], normalizeReceipt(data), destPaths)
+                if err != nil {
+                        finishJournal(journalIncomplete, dataList, destPaths, err)
+                        return err
+                }
+                destPaths = append(destPaths, newPath)
+        }
+        finishJournal(journalProcessed, dataList, destPaths, nil)
+        return nil
+}
+
+// analyzeOriginal runs the model on an archived original, converting it first if needed
+func analyzeOriginal(ctx context.Context, analyzer ReceiptAnalyzer, original string) ([]ReceiptData, error) {
+        detected, err := sniffType(original)
+        if err != nil {
+                return nil, err
+        }
+        content := original
+        if _, convertible := convertTargets[detected]; convertible {
+                converted, tmpDir, err := convertForAnalysis(ctx, original, detected)
+                if err != nil {
+                        return nil, err
+                }
+                defer os.RemoveAll(tmpDir)
+                content = converted
+        }
+
+        start := time.Now()
+        dataList, err := analyzer.Analyze(ctx, content)
+        if err != nil {
+                return nil, fmt.Errorf("analysis failed: %w", err)
+        }
+        slog.Info("Analysis complete", "event", "analysis_end", "path", original, "duration_ms", time.Since(start).Milliseconds(), "receipts", len(dataList))
+        return dataList, nil
+}
+
+// refileCopy moves one processed copy to the name its new values give it and records
+// the values it had before
+func refileCopy(target *reprocessTarget, oldPath string, data ReceiptData, taken []string) (string, error) {
+        // Names follow the original, with the extension of the copy filed from it
+        named := strings.TrimSuffix(target.Original, filepath.Ext(target.Original)) + filepath.Ext(oldPath)
+        return refileReceipt(oldPath, named, destDir, newSidecar(target.Original, data), taken, "reprocess")
+}
+
+// refileReceipt moves a processed copy under dest to the name sidecar's values give it,
+// named as if filed from named, and writes the sidecar with the replaced values added to
+// its history. The database and -ledger follow the copy to its new path.
+func refileReceipt(oldPath, named, dest string, sidecar Sidecar, taken []string, event string) (string, error) {
+        data := sidecar.ReceiptData
+        rel, err := processedRelPath(named, data)
+        if err != nil {
+                return "", err
+        }
+        newPath, err := availablePath(filepath.Join(dest, rel), oldPath, taken)
+        if err != nil {
+                return "", err
+        }
+
+        old, hasSidecar := readSidecar(oldPath)
+        if !hasSidecar {
+                old.ReceiptData, _ = parseProcessedFileName(filepath.Base(oldPath))
+        }
+        if changes := receiptChanges(old.ReceiptData, data); len(changes) == 0 && newPath == oldPath {
+                slog.Info("Receipt unchanged", "event", event, "path", oldPath)
+        } else {
+                slog.Info("Receipt re-filed", "event", event, "path", newPath, "previous_path", oldPath, "changes", strings.Join(changes, "; "))
+        }
+
+        if dryRun {
+                slog.Info("[dry-run] Would re-file receipt", "event", event, "dry_run", true, "path", newPath, "previous_path", oldPath)
+                return newPath, nil
+        }
+
+        if newPath != oldPath {
+                if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+                        return "", fmt.Errorf("failed to create directory %s: %w", filepath.Dir(newPath), err)
+                }
+                if err := robustMove(oldPath, newPath); err != nil {
+                        return "", fmt.Errorf("failed to move %s: %w", oldPath, err)
+                }
+        }
+
+        // The sidecar is written even without -write-sidecar, since it is where the history is kept
+        sidecar.History = append(old.History, SidecarRevision{
+                ReceiptData:   old.ReceiptData,
+                ProcessedPath: oldPath,
+                ProcessedAt:   old.ProcessedAt,
+                Provider:      old.Provider,
+                Model:         old.Model,
+                PromptVersion: old.PromptVersion,
+                ReplacedAt:    time.Now().Format(time.RFC3339),
+        })
+        if err := saveSidecar(newPath, sidecar); err != nil {
+                return newPath, fmt.Errorf("failed to write sidecar: %w", err)
+        }
+        if newPath != oldPath {
+                if err := os.Remove(sidecarPath(oldPath)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+                        slog.Warn("Failed to remove old sidecar", "path", sidecarPath(oldPath), "error", err)
+                }
+        }
+
+        if receiptDB != nil {
+                if newPath != oldPath {
+                        if err := receiptDB.MoveReceipt(oldPath, newPath); err != nil {
+                                slog.Warn("Failed to update database", "path", newPath, "error", err)
+                        }
+                }
+                if err := receiptDB.InsertReceipt(data, sidecar.SourceFile, newPath); err != nil {
+                        slog.Warn("Failed to update database", "path", newPath, "error", err)
+                }
+        }
+        if ledgerPath != "" {
+                if err := updateLedger(ledgerPath, oldPath, newPath, data); err != nil {
+                        slog.Warn("Failed to update ledger", "path", newPath, "error", err)
+                }
+        }
+        return newPath, nil
+}
+
+// receiptChanges describes the fields that differ, e.g. "vendor: Lawson → ローソン"
+func receiptChanges(old, data ReceiptData) []string {
+        var changes []string
+        for _, field := range []struct{ name, old, new string }{
+                {"date", old.Date, data.Date},
+                {"vendor", old.Vendor, data.Vendor},
+                {"category", old.Category, data.Category},
+                {"amount", amountLabel(old.Amount, old.Currency), amountLabel(data.Amount, data.Currency)},
+                {"registration_number", old.RegistrationNumber, data.RegistrationNumber},
+                {"payment_method", old.PaymentMethod, data.PaymentMethod},
+        } {
+                if field.old != field.new {
+                        changes = append(changes, fmt.Sprintf("%s: %s → %s", field.name, field.old, field.new))
+                }
+        }
+        return changes
+}
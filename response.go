@@ -0,0 +1,105 @@
+package main
+
+import (
+        "errors"
+        "fmt"
+
+        "github.com/google/generative-ai-go/genai"
+)
+
+// errTruncated means the model stopped at its output-token limit mid-answer
+var errTruncated = errors.New("truncated: MAX_TOKENS")
+
+const (
+        // maxTruncationRetries is how many times a truncated answer is retried with a bigger budget
+        maxTruncationRetries  = 2
+        defaultOutputTokens   = 8192
+        maxOutputTokenCeiling = 65536
+)
+
+// checkGenerateResult turns the outcome of GenerateContent into a distinct, actionable error:
+// "blocked: ..." for safety/recitation blocks, errTruncated for token limits, and
+// "empty response" only when the model genuinely returned nothing.
+func checkGenerateResult(resp *genai.GenerateContentResponse, err error) error {
+        var blocked *genai.BlockedError
+        if errors.As(err, &blocked) {
+                if blocked.PromptFeedback != nil {
+                        return fmt.Errorf("blocked: %s (prompt)", blockReasonName(blocked.PromptFeedback.BlockReason))
+                }
+                if blocked.Candidate != nil {
+                        return fmt.Errorf("blocked: %s", finishReasonName(blocked.Candidate.FinishReason))
+                }
+                return fmt.Errorf("blocked: %w", err)
+        }
+        if err != nil {
+                return fmt.Errorf("gemini generate error: %w", err)
+        }
+
+        if resp == nil {
+                return fmt.Errorf("empty response from model")
+        }
+        if resp.PromptFeedback != nil && resp.PromptFeedback.BlockReason != genai.BlockReasonUnspecified {
+                return fmt.Errorf("blocked: %s (prompt)", blockReasonName(resp.PromptFeedback.BlockReason))
+        }
+        if len(resp.Candidates) == 0 {
+                return fmt.Errorf("empty response from model: no candidates")
+        }
+
+        candidate := resp.Candidates[0]
+        switch candidate.FinishReason {
+        case genai.FinishReasonSafety, genai.FinishReasonRecitation:
+                return fmt.Errorf("blocked: %s", finishReasonName(candidate.FinishReason))
+        case genai.FinishReasonMaxTokens:
+                return errTruncated
+        }
+
+        if candidate.Content == nil || len(candidate.Content.Parts) == 0 {
+                return fmt.Errorf("empty response from model (finish reason: %s)", finishReasonName(candidate.FinishReason))
+        }
+        return nil
+}
+
+// nextOutputBudget doubles the output-token limit for a retry after truncation
+func nextOutputBudget(current int32) int32 {
+        if current <= 0 {
+                current = defaultOutputTokens
+        }
+        return min(current*2, maxOutputTokenCeiling)
+}
+
+func finishReasonName(r genai.FinishReason) string {
+        switch r {
+        case genai.FinishReasonStop:
+                return "STOP"
+        case genai.FinishReasonMaxTokens:
+                return "MAX_TOKENS"
+        case genai.FinishReasonSafety:
+                return "SAFETY"
+        case genai.FinishReasonRecitation:
+                return "RECITATION"
+        case genai.FinishReasonOther:
+                return "OTHER"
+        }
+        return "UNSPECIFIED"
+}
+
+func blockReasonName(r genai.BlockReason) string {
+        switch r {
+        case genai.BlockReasonSafety:
+                return "SAFETY"
+        case genai.BlockReasonOther:
+                return "OTHER"
+        }
+        return "UNSPECIFIED"
+}
+
+// candidateText returns the text of the first candidate, which checkGenerateResult has vetted
+func candidateText(resp *genai.GenerateContentResponse) string {
+        var text string
+        for _, part := range resp.Candidates[0].Content.Parts {
+                if txt, ok := part.(genai.Text); ok {
+                        text += string(txt)
+                }
+        }
+        return text
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+        "encoding/json"
+        "errors"
+        "fmt"
+        "log/slog"
+        "os"
+        "path/filepath"
+        "strings"
+        "time"
+)
+
+// reviewDirName is the folder under the destination for results that look wrong
+const reviewDirName = "needs-review"
+
+// reviewReportSuffix is appended to a file held for review for the report next to it
+const reviewReportSuffix = ".review.json"
+
+// errNeedsReview marks a file that was analyzed but held back for a human to check
+var errNeedsReview = errors.New("needs review")
+
+// maxAmount is -max-amount, parsed at startup; zero disables the check
+var maxAmount Decimal
+
+// ReviewReport is written next to a file held for review so the extracted data can be
+// checked without running the model again
+type ReviewReport struct {
+        SourceFile string        `json:"source_file"`
+        Time       string        `json:"time"`
+        Problems   []string      `json:"problems"`
+        Receipts   []ReceiptData `json:"receipts"`
+}
+
+// validateReceipts returns what looks wrong with the extracted results, or what the model
+// was unsure of, before they are normalized (which would otherwise paper over a missing
+// or impossible date)
+func validateReceipts(dataList []ReceiptData) []string {
+        var problems []string
+        for i, data := range dataList {
+                prefix := ""
+                if len(dataList) > 1 {
+                        prefix = fmt.Sprintf("receipt %d: ", i+1)
+                }
+                for _, problem := range validateReceipt(data) {
+                        problems = append(problems, prefix+problem)
+                }
+        }
+        return problems
+}
+
+func validateReceipt(data ReceiptData) []string {
+        problems := append([]string(nil), data.Disagreements...)
+
+        if minConfidence > 0 {
+                problems = append(problems, lowConfidence(data.Confidence)...)
+        }
+        if !validate {
+                return problems
+        }
+
+        if date, ok := parseReceiptDate(data.Date); !ok {
+                problems = append(problems, fmt.Sprintf("date %q could not be read", data.Date))
+        } else if time.Until(date) > maxFutureDate {
+                problems = append(problems, fmt.Sprintf("date %s is in the future", data.Date))
+        } else if maxReceiptAge > 0 && time.Since(date) > time.Duration(maxReceiptAge)*24*time.Hour {
+                problems = append(problems, fmt.Sprintf("date %s is more than %d days old", data.Date, maxReceiptAge))
+        }
+
+        if strings.TrimSpace(data.Vendor) == "" {
+                problems = append(problems, "vendor is empty")
+        }
+
+        if data.Amount.Sign() <= 0 {
+                problems = append(problems, fmt.Sprintf("amount %s is not positive", data.Amount))
+        } else if !maxAmount.IsZero() && normalizeCurrency(data.Currency) == defaultCurrency && data.Amount.Cmp(maxAmount) > 0 {
+                problems = append(problems, fmt.Sprintf("amount %s is above -max-amount %s", data.Amount, maxAmount))
+        }
+
+        // The line items are a second reading of the same total; a large gap means one of them is wrong
+        if len(data.Items) > 0 && data.Amount.Sign() > 0 {
+                var sum Decimal
+                for _, item := range data.Items {
+                        sum = sum.Add(item.Amount)
+                }
+                if sum.Sign() > 0 && (data.Amount.Cmp(sum.Add(sum)) > 0 || sum.Cmp(data.Amount.Add(data.Amount)) > 0) {
+                        problems = append(problems, fmt.Sprintf("amount %s does not match the line items (sum %s)", data.Amount, sum))
+                }
+        }
+        return problems
+}
+
+// holdForReview moves the original to <dest>/needs-review with a report listing the
+// problems and the extracted data, instead of filing it under a likely wrong name
+func holdForReview(srcPath string, dataList []ReceiptData, problems []string) error {
+        reviewDir := filepath.Join(destFor(srcPath), reviewDirName)
+        reviewPath, err := availablePath(filepath.Join(reviewDir, filepath.Base(srcPath)), srcPath, nil)
+        if err != nil {
+                return err
+        }
+        reportPath := reviewPath + reviewReportSuffix
+
+        if dryRun {
+                slog.Info("[dry-run] Would hold file for review", "event", "review", "dry_run", true, "path", reviewPath, "source", srcPath, "problems", problems)
+                pipelineEvents.publish(pipelineEvent{Kind: eventReview, Source: srcPath, Path: reviewPath, DryRun: true, Problems: problems})
+                return nil
+        }
+
+        if err := os.MkdirAll(reviewDir, 0755); err != nil {
+                return fmt.Errorf("failed to create directory %s: %w", reviewDir, err)
+        }
+        if err := robustMove(srcPath, reviewPath); err != nil {
+                return fmt.Errorf("failed to move file to review: %w", err)
+        }
+
+        if dataList == nil {
+                dataList = []ReceiptData{}
+        }
+        report, err := json.MarshalIndent(ReviewReport{
+                SourceFile: srcPath,
+                Time:       time.Now().Format(time.RFC3339),
+                Problems:   problems,
+                Receipts:   dataList,
+        }, "", "  ")
+        if err != nil {
+                return err
+        }
+        if err := writeFileAtomic(reportPath, report); err != nil {
+                slog.Error("Failed to write review report", "event", "review", "path", reportPath, "error", err)
+        }
+
+        slog.Warn("Holding file for review", "event", "review", "path", reviewPath, "source", srcPath, "problems", problems)
+        pipelineEvents.publish(pipelineEvent{Kind: eventReview, Source: srcPath, Path: reviewPath, Problems: problems})
+        notifyPush(pushAlert{
+                Title:   "Receipt needs review: " + filepath.Base(srcPath),
+                Message: strings.Join(problems, "\n"),
+                Link:    fileLink(srcPath, reviewPath),
+        }, reviewPath)
+        return nil
+}
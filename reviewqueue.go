@@ -0,0 +1,360 @@
+package main
+
+import (
+        "bufio"
+        "context"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "log/slog"
+        "net/http"
+        "net/url"
+        "os"
+        "path/filepath"
+        "slices"
+        "sort"
+        "strings"
+        "time"
+)
+
+// reviewItem is a file waiting for a person: held in needs-review/ because its results
+// looked wrong or scored below -min-confidence, or quarantined in failed/ because
+// analysis failed
+type reviewItem struct {
+        Path     string
+        Report   string
+        Failed   bool
+        Origin   string
+        Time     string
+        Problems []string
+        Receipts []ReceiptData
+        Preview  string
+}
+
+// listReviewItems returns the files in every destination's needs-review and failed
+// folders, oldest first
+func listReviewItems() ([]reviewItem, error) {
+        var items []reviewItem
+        for _, dest := range destRoots() {
+                for _, folder := range []string{reviewDirName, "failed"} {
+                        entries, err := os.ReadDir(filepath.Join(dest, folder))
+                        if errors.Is(err, os.ErrNotExist) {
+                                continue
+                        }
+                        if err != nil {
+                                return nil, err
+                        }
+                        for _, entry := range entries {
+                                name := entry.Name()
+                                if entry.IsDir() || strings.HasPrefix(name, ".") || strings.HasSuffix(name, reviewReportSuffix) || strings.HasSuffix(name, errorReportSuffix) {
+                                        continue
+                                }
+                                item, err := loadReviewItem(filepath.Join(dest, folder, name))
+                                if err != nil {
+                                        slog.Warn("Skipping file in review queue", "event", "review", "path", filepath.Join(dest, folder, name), "error", err)
+                                        continue
+                                }
+                                items = append(items, *item)
+                        }
+                }
+        }
+        sort.SliceStable(items, func(i, j int) bool { return items[i].Time < items[j].Time })
+        return items, nil
+}
+
+// loadReviewItem reads a held or quarantined file's report. Paths outside a destination's
+// needs-review and failed folders are refused, since they come from the browser.
+func loadReviewItem(path string) (*reviewItem, error) {
+        dest := destRootOf(path)
+        if dest == "" || path != filepath.Clean(path) {
+                return nil, fmt.Errorf("%s is not in the review queue", path)
+        }
+        item := &reviewItem{Path: path}
+        switch filepath.Dir(path) {
+        case filepath.Join(dest, reviewDirName):
+                item.Report = path + reviewReportSuffix
+        case filepath.Join(dest, "failed"):
+                item.Report, item.Failed = path+errorReportSuffix, true
+        default:
+                return nil, fmt.Errorf("%s is not in the review queue", path)
+        }
+        if strings.HasSuffix(path, reviewReportSuffix) || strings.HasSuffix(path, errorReportSuffix) {
+                return nil, fmt.Errorf("%s is a report", path)
+        }
+        info, err := os.Stat(path)
+        if err != nil {
+                return nil, err
+        }
+        if !info.Mode().IsRegular() {
+                return nil, fmt.Errorf("%s is not a file", path)
+        }
+        item.Time = info.ModTime().Format(time.RFC3339)
+
+        if item.Failed {
+                readErrorReport(item)
+        } else if content, err := os.ReadFile(item.Report); err == nil {
+                var report ReviewReport
+                if err := json.Unmarshal(content, &report); err != nil {
+                        return nil, fmt.Errorf("invalid review report %s: %w", item.Report, err)
+                }
+                item.Origin, item.Time, item.Problems, item.Receipts = report.SourceFile, report.Time, report.Problems, report.Receipts
+        }
+        // A failed file, or one held before anything was read, is filled in from scratch
+        if len(item.Receipts) == 0 {
+                item.Receipts = []ReceiptData{{}}
+        }
+        for i := range item.Receipts {
+                item.Receipts[i].Currency = normalizeCurrency(item.Receipts[i].Currency)
+        }
+
+        if detected, err := sniffType(path); err == nil && receiptTypes[detected] != "" {
+                item.Preview = "image"
+                if detected == "application/pdf" {
+                        item.Preview = "pdf"
+                }
+        }
+        return item, nil
+}
+
+// readErrorReport fills in the origin, time, and error written by quarantineFile
+func readErrorReport(item *reviewItem) {
+        f, err := os.Open(item.Report)
+        if err != nil {
+                return
+        }
+        defer f.Close()
+
+        scanner := bufio.NewScanner(f)
+        for scanner.Scan() {
+                key, value, _ := strings.Cut(scanner.Text(), ": ")
+                switch key {
+                case "file":
+                        item.Origin = value
+                case "time":
+                        item.Time = value
+                case "error":
+                        item.Problems = append(item.Problems, value)
+                }
+        }
+}
+
+// approveReviewItem files a held or quarantined file with the receipts as corrected in
+// the review queue, without calling the model again, and archives it as usual
+func approveReviewItem(item *reviewItem, dataList []ReceiptData) ([]string, error) {
+        dashboardMu.Lock()
+        defer dashboardMu.Unlock()
+
+        hash, err := fileSHA256(item.Path)
+        if err != nil {
+                return nil, err
+        }
+
+        // Formats browsers and the providers can't all read are filed as JPEG or PDF, as when scanned
+        content := item.Path
+        detected, err := sniffType(item.Path)
+        if err != nil {
+                return nil, err
+        }
+        if _, convertible := convertTargets[detected]; convertible {
+                converted, tmpDir, err := convertForAnalysis(context.Background(), item.Path, detected)
+                if err != nil {
+                        return nil, err
+                }
+                defer os.RemoveAll(tmpDir)
+                content = converted
+        }
+
+        // Receipts read from separate pages or crops are filed from them, as in processFile
+        var pages []string
+        if splitPages && mediaType(content) == "application/pdf" && slices.ContainsFunc(dataList, func(data ReceiptData) bool { return data.Page > 0 }) {
+                split, splitDir, err := splitPDF(context.Background(), content)
+                if err != nil {
+                        return nil, err
+                }
+                defer os.RemoveAll(splitDir)
+                pages = split
+        }
+        contents, cropDir := receiptContents(item.Path, content, pages, dataList)
+        if cropDir != "" {
+                defer os.RemoveAll(cropDir)
+        }
+
+        var journalID int64
+        if receiptDB != nil {
+                if journalID, err = receiptDB.StartJournal(item.Path, hash, ""); err != nil {
+                        slog.Warn("Failed to journal file", "path", item.Path, "error", err)
+                }
+        }
+        destPaths, err := saveAndArchive(item.Path, contents, dataList)
+        if journalID != 0 {
+                status := journalProcessed
+                if err != nil {
+                        status = journalIncomplete
+                }
+                if err := receiptDB.FinishJournal(journalID, status, dataList, destPaths, &tokenUsage{}, err); err != nil {
+                        slog.Warn("Failed to update journal", "path", item.Path, "error", err)
+                }
+        }
+        if err != nil {
+                return destPaths, err
+        }
+
+        // Recorded under the path it was scanned to, like a file filed without review, so
+        // the same scan turning up there again is skipped
+        if !dryRun {
+                origin := item.Origin
+                if origin == "" {
+                        origin = item.Path
+                }
+                if err := processedState.MarkProcessed(origin, hash); err != nil {
+                        slog.Error("Failed to record file as processed", "path", origin, "error", err)
+                }
+        }
+
+        if err := os.Remove(item.Report); err != nil && !errors.Is(err, os.ErrNotExist) {
+                slog.Warn("Failed to remove report", "path", item.Report, "error", err)
+        }
+        slog.Info("Approved receipt", "event", "review", "path", item.Path, "receipts", len(destPaths))
+        return destPaths, nil
+}
+
+// rejectReviewItem moves a held file to failed/ with an error report naming the folder it
+// was scanned into, so -retry-failed can still send it back there
+func rejectReviewItem(item *reviewItem) error {
+        dashboardMu.Lock()
+        defer dashboardMu.Unlock()
+
+        failedDir := filepath.Join(destRootOf(item.Path), "failed")
+        failedPath, err := availablePath(filepath.Join(failedDir, filepath.Base(item.Path)), item.Path, nil)
+        if err != nil {
+                return err
+        }
+        if err := os.MkdirAll(failedDir, 0755); err != nil {
+                return fmt.Errorf("failed to create directory %s: %w", failedDir, err)
+        }
+        if err := robustMove(item.Path, failedPath); err != nil {
+                return fmt.Errorf("failed to move file to %s: %w", failedDir, err)
+        }
+
+        reason := "rejected in review"
+        if len(item.Problems) > 0 {
+                reason += ": " + strings.Join(item.Problems, "; ")
+        }
+        report := fmt.Sprintf("file: %s\ntime: %s\nerror: %s\n", item.Origin, time.Now().Format(time.RFC3339), reason)
+        if err := os.WriteFile(failedPath+errorReportSuffix, []byte(report), 0644); err != nil {
+                slog.Error("Failed to write error report", "event", "review", "path", failedPath+errorReportSuffix, "error", err)
+        }
+        if err := os.Remove(item.Report); err != nil && !errors.Is(err, os.ErrNotExist) {
+                slog.Warn("Failed to remove report", "path", item.Report, "error", err)
+        }
+        slog.Info("Rejected receipt", "event", "review", "path", failedPath, "source", item.Path)
+        return nil
+}
+
+func handleReviewQueue(w http.ResponseWriter, r *http.Request) {
+        items, err := listReviewItems()
+        if err != nil {
+                slog.Error("Failed to list review queue", "event", "dashboard", "error", err)
+                http.Error(w, err.Error(), http.StatusInternalServerError)
+                return
+        }
+        renderDashboard(w, http.StatusOK, "queue", struct {
+                Items    []reviewItem
+                Approved string
+                Rejected string
+        }{items, r.URL.Query().Get("approved"), r.URL.Query().Get("rejected")})
+}
+
+// reviewPage is what the page of one file in the review queue shows
+type reviewPage struct {
+        *reviewItem
+        Categories []string
+        Error      string
+}
+
+func handleReviewItem(w http.ResponseWriter, r *http.Request) {
+        item, ok := requestReviewItem(w, r)
+        if !ok {
+                return
+        }
+        renderDashboard(w, http.StatusOK, "item", reviewPage{reviewItem: item, Categories: categoryList()})
+}
+
+func handleReviewFile(w http.ResponseWriter, r *http.Request) {
+        item, ok := requestReviewItem(w, r)
+        if !ok {
+                return
+        }
+        if item.Preview == "" {
+                http.NotFound(w, r)
+                return
+        }
+        w.Header().Set("Content-Type", mediaType(item.Path))
+        http.ServeFile(w, r, item.Path)
+}
+
+// handleReviewApprove files the receipts with the values in the form, one set of fields
+// per receipt the model found
+func handleReviewApprove(w http.ResponseWriter, r *http.Request) {
+        item, ok := requestReviewItem(w, r)
+        if !ok {
+                return
+        }
+        // What the model read, unless analysis failed and there was nothing to correct
+        var read []ReceiptData
+        if !item.Failed {
+                read = slices.Clone(item.Receipts)
+        }
+        hash, _ := fileSHA256(item.Path)
+
+        var problems []string
+        for i, data := range item.Receipts {
+                data, err := parseDashboardForm(r, data, fmt.Sprintf("%d.", i))
+                if err != nil {
+                        problems = append(problems, fmt.Sprintf("receipt %d: %v", i+1, err))
+                }
+                data.Backend = analysisBackend{Provider: "manual"}
+                item.Receipts[i] = data
+        }
+        if len(problems) > 0 {
+                renderDashboard(w, http.StatusBadRequest, "item", reviewPage{reviewItem: item, Categories: categoryList(), Error: strings.Join(problems, "; ")})
+                return
+        }
+        if _, err := approveReviewItem(item, item.Receipts); err != nil {
+                slog.Error("Failed to file approved receipt", "event", "review", "path", item.Path, "error", err)
+                renderDashboard(w, http.StatusInternalServerError, "item", reviewPage{reviewItem: item, Categories: categoryList(), Error: err.Error()})
+                return
+        }
+        for i := range read {
+                recordCorrection(hash, read[i], item.Receipts[i])
+        }
+        http.Redirect(w, r, "/review?approved="+url.QueryEscape(filepath.Base(item.Path)), http.StatusSeeOther)
+}
+
+func handleReviewReject(w http.ResponseWriter, r *http.Request) {
+        item, ok := requestReviewItem(w, r)
+        if !ok {
+                return
+        }
+        if item.Failed {
+                http.Error(w, "already in failed/", http.StatusBadRequest)
+                return
+        }
+        if err := rejectReviewItem(item); err != nil {
+                slog.Error("Failed to reject receipt", "event", "review", "path", item.Path, "error", err)
+                http.Error(w, err.Error(), http.StatusInternalServerError)
+                return
+        }
+        http.Redirect(w, r, "/review?rejected="+url.QueryEscape(filepath.Base(item.Path)), http.StatusSeeOther)
+}
+
+// requestReviewItem loads the file named by the request's path parameter, answering 404
+// when it is not in the review queue
+func requestReviewItem(w http.ResponseWriter, r *http.Request) (*reviewItem, bool) {
+        item, err := loadReviewItem(r.FormValue("path"))
+        if err != nil {
+                http.NotFound(w, r)
+                return nil, false
+        }
+        return item, true
+}
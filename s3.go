@@ -0,0 +1,229 @@
+package main
+
+import (
+        "bytes"
+        "context"
+        "crypto/hmac"
+        "crypto/sha256"
+        "encoding/hex"
+        "fmt"
+        "io"
+        "log/slog"
+        "net/http"
+        "net/url"
+        "os"
+        "path"
+        "path/filepath"
+        "sort"
+        "strings"
+        "time"
+)
+
+// s3Archive stores originals in an S3-compatible bucket (AWS, MinIO, Wasabi) under
+// originals/YYYY/MM/<sha256>.<ext>, so lifecycle rules can move or expire whole months
+// and the same scan archived twice lands on the same key
+type s3Archive struct {
+        endpoint  *url.URL
+        pathStyle bool
+        bucket    string
+        prefix    string
+        region    string
+        sse       string
+
+        accessKey    string
+        secretKey    string
+        sessionToken string
+}
+
+// originalsArchive is set up in main by -archive-s3; nil archives originals as usual
+var originalsArchive *s3Archive
+
+// newS3Archive parses -archive-s3 (s3://bucket/prefix) and reads the credentials from
+// the standard AWS environment variables. Without -s3-endpoint the AWS endpoint for
+// -s3-region is used with virtual-hosted bucket names; a custom endpoint, as MinIO
+// needs, gets path-style URLs.
+func newS3Archive(rawURL, endpoint, region, sse string) (*s3Archive, error) {
+        u, err := url.Parse(rawURL)
+        if err != nil || u.Scheme != "s3" || u.Host == "" {
+                return nil, fmt.Errorf("invalid -archive-s3 %q: expected s3://bucket/prefix", rawURL)
+        }
+        archive := &s3Archive{
+                bucket:       u.Host,
+                prefix:       strings.Trim(u.Path, "/"),
+                region:       region,
+                accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+                secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+                sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+        }
+        if archive.accessKey == "" || archive.secretKey == "" {
+                return nil, fmt.Errorf("-archive-s3 requires the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables")
+        }
+
+        switch sse {
+        case "AES256", "aws:kms":
+                archive.sse = sse
+        case "", "none":
+        default:
+                return nil, fmt.Errorf("invalid -s3-sse %q: expected AES256, aws:kms, or none", sse)
+        }
+
+        if endpoint == "" {
+                endpoint = "https://s3." + region + ".amazonaws.com"
+        } else {
+                archive.pathStyle = true
+        }
+        if archive.endpoint, err = url.Parse(endpoint); err != nil || archive.endpoint.Host == "" {
+                return nil, fmt.Errorf("invalid -s3-endpoint %q", endpoint)
+        }
+        return archive, nil
+}
+
+// key is where an original with this content, archived at t, is stored
+func (a *s3Archive) key(srcPath, hash string, t time.Time) string {
+        return path.Join(a.prefix, "originals", t.Format("2006"), t.Format("01"), hash+strings.ToLower(receiptExt(srcPath)))
+}
+
+// objectURL addresses key in the bucket, escaping each path segment once
+func (a *s3Archive) objectURL(key string) *url.URL {
+        u := *a.endpoint
+        segments := strings.Split(key, "/")
+        for i, segment := range segments {
+                segments[i] = s3Escape(segment)
+        }
+        escaped := strings.Join(segments, "/")
+        if a.pathStyle {
+                u.Path = "/" + a.bucket + "/" + key
+                u.RawPath = "/" + s3Escape(a.bucket) + "/" + escaped
+        } else {
+                u.Host = a.bucket + "." + u.Host
+                u.Path = "/" + key
+                u.RawPath = "/" + escaped
+        }
+        return &u
+}
+
+// Put uploads a file to key with server-side encryption and the original name as
+// metadata, and returns its s3:// location
+func (a *s3Archive) Put(ctx context.Context, srcPath, key string) (string, error) {
+        content, err := os.ReadFile(srcPath)
+        if err != nil {
+                return "", err
+        }
+
+        req, err := http.NewRequestWithContext(ctx, http.MethodPut, a.objectURL(key).String(), bytes.NewReader(content))
+        if err != nil {
+                return "", err
+        }
+        req.Header.Set("Content-Type", mediaType(srcPath))
+        req.Header.Set("X-Amz-Meta-Source-Name", url.QueryEscape(filepath.Base(srcPath)))
+        if a.sse != "" {
+                req.Header.Set("X-Amz-Server-Side-Encryption", a.sse)
+        }
+        if a.sessionToken != "" {
+                req.Header.Set("X-Amz-Security-Token", a.sessionToken)
+        }
+        sum := sha256.Sum256(content)
+        a.sign(req, hex.EncodeToString(sum[:]), time.Now())
+
+        resp, err := apiClient.Do(req)
+        if err != nil {
+                return "", err
+        }
+        defer resp.Body.Close()
+        if resp.StatusCode < 200 || resp.StatusCode > 299 {
+                text, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+                return "", &httpStatusError{Code: resp.StatusCode, Header: resp.Header, Body: strings.TrimSpace(string(text))}
+        }
+        return "s3://" + a.bucket + "/" + key, nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header covering the host and every
+// header already set on req
+func (a *s3Archive) sign(req *http.Request, payloadHash string, t time.Time) {
+        amzDate := t.UTC().Format("20060102T150405Z")
+        scope := amzDate[:8] + "/" + a.region + "/s3/aws4_request"
+        req.Header.Set("X-Amz-Date", amzDate)
+        req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+        headers := map[string]string{"host": req.URL.Host}
+        for name, values := range req.Header {
+                headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+        }
+        names := make([]string, 0, len(headers))
+        for name := range headers {
+                names = append(names, name)
+        }
+        sort.Strings(names)
+        var canonicalHeaders strings.Builder
+        for _, name := range names {
+                canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+        }
+        signedHeaders := strings.Join(names, ";")
+
+        canonicalRequest := strings.Join([]string{
+                req.Method,
+                req.URL.EscapedPath(),
+                req.URL.RawQuery,
+                canonicalHeaders.String(),
+                signedHeaders,
+                payloadHash,
+        }, "\n")
+        requestHash := sha256.Sum256([]byte(canonicalRequest))
+        stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+        key := []byte("AWS4" + a.secretKey)
+        for _, part := range []string{amzDate[:8], a.region, "s3", "aws4_request"} {
+                key = hmacSHA256(key, part)
+        }
+        signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+        req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+a.accessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+        mac := hmac.New(sha256.New, key)
+        mac.Write([]byte(data))
+        return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes everything but the characters SigV4 leaves unreserved
+func s3Escape(s string) string {
+        var b strings.Builder
+        for i := 0; i < len(s); i++ {
+                c := s[i]
+                if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~", c) >= 0 {
+                        b.WriteByte(c)
+                } else {
+                        fmt.Fprintf(&b, "%%%02X", c)
+                }
+        }
+        return b.String()
+}
+
+// archiveToS3 uploads the original to the -archive-s3 bucket and removes it from the
+// watch directory
+func archiveToS3(srcPath string) (string, error) {
+        hash, err := fileSHA256(srcPath)
+        if err != nil {
+                slog.Error("Failed to archive original", "event", "archive", "source", srcPath, "error", err)
+                return "", err
+        }
+        key := originalsArchive.key(srcPath, hash, time.Now().In(location))
+        if dryRun {
+                slog.Info("[dry-run] Would archive original", "event", "archive", "dry_run", true, "path", "s3://"+originalsArchive.bucket+"/"+key, "source", srcPath)
+                return "s3://" + originalsArchive.bucket + "/" + key, nil
+        }
+
+        stored, err := originalsArchive.Put(context.Background(), srcPath, key)
+        if err != nil {
+                slog.Error("Failed to archive original", "event", "archive", "source", srcPath, "error", err)
+                return "", fmt.Errorf("failed to upload original to S3: %w", err)
+        }
+        if err := os.Remove(srcPath); err != nil {
+                slog.Error("Failed to remove archived original", "event", "archive", "path", stored, "source", srcPath, "error", err)
+                return stored, err
+        }
+
+        slog.Info("Archived original", "event", "archive", "path", stored, "source", srcPath)
+        return stored, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+        "strings"
+        "unicode"
+        "unicode/utf8"
+
+        "golang.org/x/text/unicode/norm"
+)
+
+// maxFileNameBytes caps a processed file name well below the 255-byte limit of ext4 and
+// most other filesystems, leaving room for a _2 suffix, the .json sidecar, and the
+// hidden temp names used while writing
+const maxFileNameBytes = 200
+
+// maxFieldBytes caps a single extracted field used as a folder or part of a name
+const maxFieldBytes = 120
+
+// unsafeNameChars are rejected by Windows or SMB shares, or separate paths
+const unsafeNameChars = `<>:"/\|?*`
+
+// windowsReservedNames cannot be used as a file or folder name on Windows, with any extension
+var windowsReservedNames = map[string]bool{
+        "CON": true, "PRN": true, "AUX": true, "NUL": true,
+        "COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+        "LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// sanitizeName makes an extracted field safe as one path component on every platform:
+// NFC-normalized (macOS would otherwise store decomposed ダ and ガ differently from the
+// rest), without control characters or characters Windows rejects, without leading or
+// trailing dots and spaces, and at most maxBytes long. Empty results become "Unknown".
+// Use safeComponent as well when the result is a whole path component.
+func sanitizeName(s string, maxBytes int) string {
+        s = norm.NFC.String(s)
+
+        var b strings.Builder
+        lastDash := false
+        for _, r := range s {
+                switch {
+                case r == utf8.RuneError, unicode.IsControl(r), unicode.Is(unicode.Cf, r):
+                        r = ' '
+                case strings.ContainsRune(unsafeNameChars, r):
+                        r = '-'
+                }
+                if r == '-' && lastDash {
+                        continue
+                }
+                lastDash = r == '-'
+                b.WriteRune(r)
+        }
+
+        name := strings.Trim(truncateBytes(strings.Join(strings.Fields(b.String()), " "), maxBytes), " .-")
+        if name == "" {
+                return "Unknown"
+        }
+        return name
+}
+
+// safeComponent prefixes names Windows reserves for devices, such as NUL or COM1.txt
+func safeComponent(name string) string {
+        if stem, _, _ := strings.Cut(name, "."); windowsReservedNames[strings.ToUpper(stem)] {
+                return "_" + name
+        }
+        return name
+}
+
+// truncateBytes shortens s to at most n bytes without splitting a character
+func truncateBytes(s string, n int) string {
+        if len(s) <= n {
+                return s
+        }
+        for n > 0 && !utf8.RuneStart(s[n]) {
+                n--
+        }
+        return s[:n]
+}
+
+// fitFileName shortens a file name to maxFileNameBytes, keeping its extension
+func fitFileName(name string) string {
+        if len(name) <= maxFileNameBytes {
+                return name
+        }
+        ext := ""
+        if i := strings.LastIndex(name, "."); i > 0 && len(name)-i <= 10 {
+                ext = name[i:]
+        }
+        return strings.TrimRight(truncateBytes(strings.TrimSuffix(name, ext), maxFileNameBytes-len(ext)), " .") + ext
+}
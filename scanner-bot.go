@@ -3,164 +3,1658 @@ package main
 import (
         "context"
         "encoding/json"
+        "errors"
         "flag"
         "fmt"
         "io"
         "log"
+        "log/slog"
         "os"
+        "os/signal"
         "path/filepath"
+        "slices"
         "strings"
         "sync"
+        "syscall"
         "time"
 
         "github.com/fsnotify/fsnotify"
         "github.com/google/generative-ai-go/genai"
-        "google.golang.org/api/option"
 )
 
 // --- CONFIGURATION ---
 const (
+        // ModelName is the default for -model
         ModelName = "gemini-3-flash-preview"
 )
 
 var (
+        // Optional YAML/TOML file providing defaults for any flag
+        configPath string
+
         // Configurable paths via flags
-        watchDir string
-        destDir  string
+        watchDirs  stringList
+        pollDirs   stringList
+        destDir    string
+        dryRun     bool
+        singleFile string
+        recursive  bool
+        reprocess  string
+
+        scanExisting bool
+
+        ignoreGlobs    string
+        convertCommand string
+        splitPages     bool
+        cropReceipts   bool
+        preprocess     bool
+        minFileSize    int64
+        maxDimension   int
+        uploadQuality  int
+        inlineMaxSize  int64
+
+        categoryMapPath   string
+        vendorAliasesPath string
+        vendorMatch       float64
+        defaultCategory   string
+        defaultCurrency   string
+        timezone          string
+        validate          bool
+        maxReceiptAge     int
+        maxAmountFlag     string
+        minConfidence     float64
+
+        nearDuplicateDistance int
+
+        noQuarantine   bool
+        retryFailedRun bool
+        maxFailures    int
+        retryDelay     time.Duration
+        embedMarker    bool
+        embedMeta      bool
+        checkMarker    bool
+        writeSidecars  bool
+
+        // Gemini model settings
+        provider          string
+        apiBaseURL        string
+        modelName         string
+        largeModel        string
+        fallbacks         stringList
+        verifyWith        string
+        largeMinPages     int
+        largeMinBytes     int64
+        temperature       float64
+        maxOutputTokens   int
+        customPrompt      string
+        promptFile        string
+        promptLanguage    string
+        promptCorrections int
+        jsonRetries       int
+        categories        string
+        lineItems         bool
+        invoiceDetails    bool
+        nameWithRegNo     bool
+        fileNameFormat    string
+        dateFolders       bool
+        paymentDetails    bool
+        medicalDetails    bool
+
+        // File stability detection
+        stableFor    time.Duration
+        maxWait      time.Duration
+        pollInterval time.Duration
+        debounce     time.Duration
+        closeWrite   bool
+
+        pollWatchInterval time.Duration
+
+        // Number of files analyzed concurrently
+        workers int
+
+        // How long files in progress may take to finish after SIGINT/SIGTERM
+        shutdownTimeout time.Duration
+
+        // Gemini calls per file before a rate limit or transient error becomes a failure
+        maxAttempts int
+
+        // Quota-aware scheduling for the -provider backend
+        requestsPerMinute int
+        tokensPerDay      int64
+        quotaWindowFlag   string
+
+        logFormat   string
+        logLevel    string
+        tuiMode     bool
+        metricsAddr string
+        webhookURL  string
+
+        // Chat notifications
+        slackWebhookURL   string
+        discordWebhookURL string
+        linkBaseURL       string
+        ntfyURL           string
+        pushover          bool
+
+        // Email inboxes whose receipt attachments are saved into the first watch directory
+        imapURL            string
+        gmailInbox         bool
+        mailFrom           string
+        mailSubject        string
+        mailAttachmentGlob string
+        mailInterval       time.Duration
+        mailMaxAge         time.Duration
+
+        // Authenticated POST /upload that saves files into the first watch directory
+        uploadAddr    string
+        uploadMaxSize int64
+
+        // Web UI for browsing and correcting filed receipts
+        dashboardAddr string
+
+        // JSON and gRPC APIs over the receipts in -db, authenticated with API_TOKEN
+        apiAddr  string
+        grpcAddr string
+
+        // Cloud folder for processed copies and originals instead of -dest
+        storageName   string
+        storageFolder string
+
+        // S3-compatible bucket for originals
+        archiveS3  string
+        s3Endpoint string
+        s3Region   string
+        s3SSE      string
+
+        // Paperless-ngx as a destination alongside or instead of -dest
+        paperlessURL          string
+        paperlessOnly         bool
+        paperlessTags         string
+        paperlessDocumentType string
+
+        // Multi-page PDF handling
+        multiPage   bool
+        maxPDFPages int
+
+        // SQLite receipt database
+        dbPath     string
+        dbSummary  bool
+        costReport bool
+        pricesPath string
+
+        // Email digest sent through SMTP
+        digestSchedule string
+        digestTimeFlag string
+        digestTo       string
+        digestFrom     string
+        sendDigestNow  bool
+        smtpHost       string
+        smtpPort       int
+        smtpUser       string
+
+        // CSV ledger of every saved receipt
+        ledgerPath string
+
+        // Google Sheet with a row per saved receipt
+        sheetID   string
+        sheetName string
+
+        // Expense report mode
+        expenseReport string
+        reportFrom    string
+        reportTo      string
+        reportTags    string
+
+        // Accounting software export mode
+        accountingExport string
+        accountingOut    string
+        accountMapPath   string
+
+        // Medical expense deduction report mode
+        medicalReportYear int
+        medicalPatient    string
+        medicalCategory   string
+
+        // Spending report mode
+        spendingReport string
+        spendingFormat string
+        spendingOut    string
+
+        // Annual summary mode
+        exportAnnualYear int
+        fiscalYearStart  int
 )
 
 // ReceiptData maps the JSON response from Gemini
 type ReceiptData struct {
-        Date     string `json:"date"`
-        Vendor   string `json:"vendor"`
-        Category string `json:"category"`
-        Amount   int    `json:"total_amount"`
+        Date     string  `json:"date"`
+        Vendor   string  `json:"vendor"`
+        Category string  `json:"category"`
+        Amount   Decimal `json:"total_amount"`
+        Currency string  `json:"currency"`
+
+        // Items is only requested with -line-items
+        Items []LineItem `json:"items,omitempty"`
+
+        // Only requested with -invoice-details
+        TaxBreakdown       []TaxLine `json:"tax_breakdown,omitempty"`
+        RegistrationNumber string    `json:"registration_number,omitempty"`
+
+        // Only requested with -payment-method
+        PaymentMethod string `json:"payment_method,omitempty"`
+        PaymentBrand  string `json:"payment_brand,omitempty"`
+        CardLast4     string `json:"card_last4,omitempty"`
+
+        // Only requested with -medical-details
+        PatientName string `json:"patient_name,omitempty"`
+        MedicalType string `json:"medical_type,omitempty"`
+
+        // Disagreements lists where the -verify backend read the file differently
+        Disagreements []string `json:"-"`
+
+        // Confidence is only requested with -min-confidence
+        Confidence Confidence `json:"confidence,omitempty"`
+
+        // BoundingBox is only requested with -crop-receipts
+        BoundingBox *BoundingBox `json:"bounding_box,omitempty"`
+
+        // Page is the page of the original a receipt was filed from, with -split-pdf
+        Page int `json:"page,omitempty"`
+
+        // Backend is the provider and model that produced the data
+        Backend analysisBackend `json:"-"`
+}
+
+// LineItem is one line of an itemized receipt
+type LineItem struct {
+        Description string  `json:"description"`
+        Quantity    float64 `json:"quantity"`
+        UnitPrice   Decimal `json:"unit_price"`
+        Amount      Decimal `json:"amount"`
+}
+
+// TaxLine is the consumption tax at one rate (8% reduced or 10% standard), as printed
+// on receipts under the qualified invoice system
+type TaxLine struct {
+        Rate          int `json:"rate"`
+        TaxableAmount int `json:"taxable_amount"`
+        TaxAmount     int `json:"tax_amount"`
 }
 
 // Global tracker to prevent double-processing
 var activeFiles sync.Map
 
-func main() {
-        // 0. Parse Flags
-        flag.StringVar(&watchDir, "watch", "", "Directory to watch for new receipts (required)")
-        flag.StringVar(&destDir, "dest", "", "Directory to save processed receipts (required)")
-        flag.Parse()
+// Persistent record of fully processed files, stored in destDir
+var processedState *ProcessedState
+
+// defaultIgnorePatterns match temp names scanners and browsers write before renaming
+// to the final name (the rename produces its own event for the real file), and the
+// thumbnail caches and folder settings Windows and macOS drop into shared folders
+var defaultIgnorePatterns = []string{".*", "~*", "*.part", "*.tmp", "*.crdownload", "Thumbs.db", "ehthumbs.db", "desktop.ini", "Icon\r"}
+
+// ignorePatterns is defaultIgnorePatterns plus anything passed with -ignore
+var ignorePatterns []string
+
+// errUnsupportedFile is returned for files that aren't receipts (wrong extension)
+var errUnsupportedFile = errors.New("unsupported file type")
+
+// errRetryLater marks a failed file left in place for another attempt after -retry-delay
+var errRetryLater = errors.New("will retry")
+
+// errFileDisappeared is returned when a detected file is moved or deleted before it is stable
+var errFileDisappeared = errors.New("file disappeared")
+
+func main() {
+        os.Exit(run())
+}
+
+// run is the body of main. It returns the exit status instead of calling os.Exit, so
+// deferred cleanup runs first and a panic still reaches the runtime with its stack trace.
+func run() int {
+
+        // 0. Parse Flags
+        flag.StringVar(&configPath, "config", "", "YAML or TOML file with settings; keys are flag names, command-line flags take precedence")
+        flag.Var(&watchDirs, "watch", "Directory to watch for new receipts, optionally as dir=dest; repeat or comma-separate for several (required)")
+        flag.Var(&pollDirs, "poll-watch", "Directory to watch by periodic scanning instead of file events (for SMB/NFS mounts), optionally as dir=dest; repeatable")
+        flag.DurationVar(&pollWatchInterval, "poll-watch-interval", 10*time.Second, "How often -poll-watch directories are scanned")
+        flag.StringVar(&destDir, "dest", "", "Directory to save processed receipts (required unless every -watch entry has its own)")
+        flag.BoolVar(&recursive, "recursive", false, "Also watch subdirectories of each -watch directory, including ones created later")
+        flag.BoolVar(&scanExisting, "scan-existing", true, "On startup, process files already in the watch directories")
+        flag.StringVar(&reprocess, "reprocess", "", "Analyze a filed receipt's original again and re-file its processed copies; takes the original, a processed copy, or a -db journal id")
+        flag.StringVar(&singleFile, "file", "", "Process this one file, or every file now in this directory, and exit instead of watching")
+        flag.BoolVar(&dryRun, "dry-run", false, "Analyze files and log intended actions without touching the filesystem")
+        flag.StringVar(&provider, "provider", "gemini", "Model provider: gemini, openai, anthropic, or ollama")
+        flag.StringVar(&apiBaseURL, "api-base-url", "", "Override the openai, anthropic, or ollama API endpoint (for proxies and compatible servers)")
+        flag.StringVar(&modelName, "model", ModelName, "Model used for analysis (defaults to a suitable model for -provider)")
+        flag.StringVar(&largeModel, "large-model", "", "Model for multi-page PDFs and large files (see -large-min-pages, -large-min-bytes); empty uses -model for everything")
+        flag.Var(&fallbacks, "fallback", "Backend to try when -provider fails, as provider or provider:model (repeatable, tried in order)")
+        flag.StringVar(&verifyWith, "verify", "", "Second backend, as provider or provider:model, that re-reads each file; results whose date or total it disagrees with go to dest/needs-review")
+        flag.IntVar(&largeMinPages, "large-min-pages", 2, "PDFs with at least this many pages use -large-model (0 disables)")
+        flag.Int64Var(&largeMinBytes, "large-min-bytes", 0, "Files of at least this many bytes use -large-model (0 disables)")
+        flag.Float64Var(&temperature, "temperature", -1, "Sampling temperature for the model (unset uses the model default)")
+        flag.IntVar(&maxOutputTokens, "max-output-tokens", 0, "Maximum tokens in the model response (0 uses the model default)")
+        flag.StringVar(&customPrompt, "prompt", "", "Replace the built-in extraction prompt")
+        flag.StringVar(&promptFile, "prompt-template", "", "Go text/template file used as the extraction prompt")
+        flag.StringVar(&promptLanguage, "language", "Japanese", "Language of the receipts, as named in the prompt")
+        flag.IntVar(&promptCorrections, "prompt-corrections", 0, "Show the model up to this many vendor and category names corrected in the dashboard or API, one per vendor, and a file's own earlier correction; requires -db (0 disables)")
+        flag.IntVar(&jsonRetries, "json-retries", 2, "Ask the model to correct an answer that is not valid JSON up to this many times (0 to disable)")
+        flag.StringVar(&categories, "categories", defaultCategories, "Comma-separated categories offered to the model and accepted from it (empty accepts any)")
+        flag.BoolVar(&lineItems, "line-items", false, "Also extract each receipt's line items (description, quantity, unit price, amount)")
+        flag.BoolVar(&invoiceDetails, "invoice-details", false, "Also extract the consumption tax breakdown per rate and the invoice registration number")
+        flag.BoolVar(&nameWithRegNo, "filename-registration", false, "Extract the invoice registration number (T-number) and append it to processed filenames")
+        flag.BoolVar(&dateFolders, "date-folders", false, "File processed receipts under dest/<category>/<YYYY>/<MM>/ by receipt date")
+        flag.StringVar(&fileNameFormat, "filename-template", "", "Go text/template for the processed file's path under dest, e.g. {{.Category}}/{{.Year}}/{{.Date}}_{{.Vendor}}_{{.AmountLabel}}{{.Ext}}")
+        flag.BoolVar(&paymentDetails, "payment-method", false, "Also extract how each receipt was paid (cash, card brand, IC card, QR payment)")
+        flag.BoolVar(&medicalDetails, "medical-details", false, "Also extract the patient's name and kind of expense from medical receipts, for -medical-report")
+        flag.DurationVar(&stableFor, "stable-for", 10*time.Second, "How long a file's size must stay unchanged before it is processed")
+        flag.DurationVar(&maxWait, "max-wait", 5*time.Minute, "Give up on a file that hasn't stabilized after this long")
+        flag.BoolVar(&closeWrite, "close-write", true, "On Linux, treat a file as complete as soon as its writer closes it, skipping the size polling")
+        flag.DurationVar(&stableFor, "stability-window", 10*time.Second, "Alias for -stable-for")
+        flag.DurationVar(&maxWait, "stability-timeout", 5*time.Minute, "Alias for -max-wait")
+        flag.DurationVar(&pollInterval, "poll-interval", 1*time.Second, "How often to check a file's size while waiting for it to stabilize")
+        flag.StringVar(&categoryMapPath, "category-map", "", "JSON or key=value file mapping model categories to folder names")
+        flag.StringVar(&vendorAliasesPath, "vendor-aliases", "", "JSON or key=value file mapping vendor names as the model writes them to the name to file them under")
+        flag.Float64Var(&vendorMatch, "vendor-match", 0, "File a vendor under the name of one seen before whose spelling is at least this similar, from 0 to 1 (0 to disable; 0.8 is a good start)")
+        flag.StringVar(&defaultCategory, "default-category", "Unsorted", "Folder for receipts with no category or one missing from -categories and -category-map")
+        flag.StringVar(&defaultCurrency, "default-currency", "JPY", "ISO 4217 currency assumed when the model cannot tell which currency a receipt is in")
+        flag.BoolVar(&validate, "validate", true, "Hold results that look wrong (bad date, empty vendor, implausible amount) in dest/needs-review instead of filing them")
+        flag.IntVar(&maxReceiptAge, "max-receipt-age", 730, "Days before today after which a receipt date is treated as a misread (0 to disable)")
+        flag.IntVar(&nearDuplicateDistance, "near-duplicate-distance", 20, "With -db, hold images whose 256-bit perceptual hash is within this many bits of a processed file's in dest/needs-review (0 to disable)")
+        flag.StringVar(&maxAmountFlag, "max-amount", "1000000", "Amounts in -default-currency above this are treated as misreads (0 to disable)")
+        flag.Float64Var(&minConfidence, "min-confidence", 0, "Ask the model to score its confidence per field (0-1) and hold results with any score below this in dest/needs-review (0 to disable)")
+        flag.StringVar(&timezone, "timezone", "", "IANA time zone (e.g. Asia/Tokyo) for fallback dates and date parsing; defaults to local time")
+        flag.StringVar(&ignoreGlobs, "ignore", "", "Comma-separated extra glob patterns for file names to ignore (e.g. \"*.bak,scan_tmp*\")")
+        flag.BoolVar(&splitPages, "split-pdf", false, "Split multi-page PDFs with qpdf and analyze and file each page on its own")
+        flag.BoolVar(&cropReceipts, "crop-receipts", false, "Ask for each receipt's position in a photo of several and file each as its own crop")
+        flag.BoolVar(&preprocess, "preprocess", false, "Auto-rotate, deskew, trim, and boost the contrast of photos with ImageMagick before analysis")
+        flag.StringVar(&convertCommand, "convert-command", "magick", "ImageMagick command used to convert HEIC and WebP to JPEG and TIFF to PDF before analysis")
+        flag.IntVar(&maxDimension, "max-dimension", 0, "Upload a JPEG copy of photos whose longest side is over this many pixels, shrunk to fit (0 to upload as is)")
+        flag.IntVar(&uploadQuality, "upload-quality", 85, "JPEG quality (1-100) of the copies uploaded with -max-dimension")
+        flag.Int64Var(&inlineMaxSize, "inline-max-size", 4<<20, "Send files up to this many bytes to Gemini inline with the request instead of through the Files API (0 to always upload)")
+        flag.Int64Var(&minFileSize, "min-size", 1024, "Skip receipts smaller than this many bytes once they have finished writing")
+        flag.IntVar(&maxAttempts, "max-attempts", 8, "Attempts per Gemini call on rate limits and transient 5xx/network errors before the file fails")
+        flag.IntVar(&requestsPerMinute, "requests-per-minute", 0, "Spread generate calls to the -provider backend so at most this many start per minute (0 for no limit)")
+        flag.Int64Var(&tokensPerDay, "tokens-per-day", 0, "Stop analyzing for the rest of the day (in -timezone) once Gemini reports this many tokens used (0 for no limit)")
+        flag.StringVar(&quotaWindowFlag, "quota-window", "", "With -tokens-per-day, resume deferred work only within this time of day, such as 22:00-06:00")
+        flag.IntVar(&workers, "workers", 3, "Maximum number of files analyzed at the same time")
+        flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 2*time.Minute, "On SIGINT/SIGTERM, wait this long for files in progress before cancelling them")
+        flag.DurationVar(&debounce, "debounce", 2*time.Second, "Wait until a file's events have been quiet this long before processing it")
+        flag.BoolVar(&noQuarantine, "no-quarantine", false, "Leave files that fail analysis in the watch directory instead of moving them to dest/failed")
+        flag.IntVar(&maxFailures, "max-failures", 1, "Attempts at analyzing a file, -retry-delay apart, before it is quarantined in dest/failed with an alert")
+        flag.DurationVar(&retryDelay, "retry-delay", 10*time.Minute, "Wait this long before another attempt at a file that failed analysis (see -max-failures)")
+        flag.BoolVar(&retryFailedRun, "retry-failed", false, "Move every quarantined file in dest/failed back to its watch directory and exit")
+        flag.BoolVar(&writeSidecars, "write-sidecar", false, "Write a <file>.json sidecar with the full extracted data next to each processed file")
+        flag.BoolVar(&embedMarker, "embed-marker", false, "Embed a processed marker into processed copies")
+        flag.BoolVar(&embedMeta, "embed-metadata", false, "Write the date, vendor, amount, and category into processed copies (XMP for JPEG and PNG, document info for PDF)")
+        flag.BoolVar(&checkMarker, "check-marker", true, "Skip incoming files that already carry the processed marker")
+        flag.StringVar(&logFormat, "log-format", "text", "Log output format: text or json")
+        flag.StringVar(&logLevel, "log-level", "info", "Minimum log level: debug, info, warn, or error")
+        flag.BoolVar(&tuiMode, "tui", false, "Show a live terminal view of the queue, each file's stage, recent results, and errors instead of log lines; r retries and o opens the selected file")
+        flag.StringVar(&webhookURL, "webhook-url", "", "POST a JSON notification to this URL after each saved receipt")
+        flag.StringVar(&slackWebhookURL, "slack-webhook-url", "", "Post each filed receipt, and each file that fails, to this Slack incoming webhook")
+        flag.StringVar(&discordWebhookURL, "discord-webhook-url", "", "Post each filed receipt, with a thumbnail, and each file that fails, to this Discord webhook")
+        flag.StringVar(&ntfyURL, "ntfy-url", "", "Push an alert to this ntfy topic URL (e.g. https://ntfy.sh/my-receipts) when a file fails or is held for review; NTFY_TOKEN is sent if set")
+        flag.BoolVar(&pushover, "pushover", false, "Push an alert through Pushover (PUSHOVER_TOKEN and PUSHOVER_USER) when a file fails or is held for review")
+        flag.StringVar(&linkBaseURL, "notify-link-base", "", "URL at which the destination folder is shared, used to link Slack and Discord messages to the filed copy")
+        flag.StringVar(&imapURL, "imap-url", "", "Save receipt attachments from this IMAP mailbox (imaps://user@host/mailbox; password in IMAP_PASSWORD) into the first -watch directory")
+        flag.BoolVar(&gmailInbox, "gmail", false, "Save receipt attachments from Gmail (GMAIL_CLIENT_ID, GMAIL_CLIENT_SECRET, and GMAIL_REFRESH_TOKEN) into the first -watch directory")
+        flag.StringVar(&mailFrom, "mail-from", "", "Only ingest email from these comma-separated addresses or domains")
+        flag.StringVar(&mailSubject, "mail-subject", "", "Only ingest email whose subject contains this text")
+        flag.StringVar(&mailAttachmentGlob, "mail-attachment", "", "Only save attachments whose name matches this pattern (e.g. *.pdf); any receipt file type by default")
+        flag.DurationVar(&mailInterval, "mail-interval", 5*time.Minute, "How often -imap-url and -gmail are checked for new email")
+        flag.DurationVar(&mailMaxAge, "mail-max-age", 30*24*time.Hour, "Ignore email older than this (0 for no limit)")
+        flag.StringVar(&uploadAddr, "upload-addr", "", "Accept receipts by POST /upload on this address (e.g. :8080), authenticated with UPLOAD_TOKEN; disabled when empty")
+        flag.Int64Var(&uploadMaxSize, "upload-max-size", 50<<20, "Largest request accepted by /upload, in bytes")
+        flag.StringVar(&dashboardAddr, "dashboard-addr", "", "Serve a web dashboard for browsing and correcting filed receipts on this address (e.g. :8081), protected by DASHBOARD_PASSWORD; requires -db; disabled when empty")
+        flag.StringVar(&apiAddr, "api-addr", "", "Serve a JSON API for listing, totaling, and correcting receipts in -db on this address (e.g. :8082), authenticated with API_TOKEN; disabled when empty")
+        flag.StringVar(&grpcAddr, "grpc-addr", "", "Serve the gRPC service of scannerbot.proto, mirroring -api-addr and streaming pipeline events, on this address (e.g. :8083), authenticated with API_TOKEN; disabled when empty")
+        flag.StringVar(&storageName, "storage", "local", "Where processed copies and originals are filed: local (under -dest), drive, or dropbox")
+        flag.StringVar(&storageFolder, "storage-folder", "", "Google Drive folder ID or Dropbox folder path (e.g. /Receipts) that -storage files into")
+        flag.StringVar(&archiveS3, "archive-s3", "", "Archive originals in this S3-compatible bucket (s3://bucket/prefix) under originals/YYYY/MM/<sha256>.<ext>; credentials in AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+        flag.StringVar(&s3Endpoint, "s3-endpoint", "", "S3 endpoint for MinIO, Wasabi, and other S3-compatible services (e.g. https://s3.wasabisys.com); AWS when empty")
+        flag.StringVar(&s3Region, "s3-region", "us-east-1", "Region used to sign -archive-s3 requests")
+        flag.StringVar(&s3SSE, "s3-sse", "AES256", "Server-side encryption of archived originals: AES256, aws:kms, or none")
+        flag.StringVar(&paperlessURL, "paperless-url", "", "Also send each receipt to this Paperless-ngx instance (token in PAPERLESS_TOKEN), with its title, date, vendor as correspondent, and category as a tag")
+        flag.BoolVar(&paperlessOnly, "paperless-only", false, "Send receipts to -paperless-url instead of saving processed copies under -dest")
+        flag.StringVar(&paperlessTags, "paperless-tags", "", "Comma-separated tags added to every document sent to Paperless")
+        flag.StringVar(&paperlessDocumentType, "paperless-document-type", "", "Paperless document type given to every receipt (e.g. Receipt)")
+        flag.StringVar(&metricsAddr, "metrics-addr", "", "Serve Prometheus metrics, /healthz, and /status on this address (e.g. :9090); disabled when empty")
+        flag.BoolVar(&multiPage, "multi-page", true, "Ask for one result per receipt when a PDF has several pages")
+        flag.IntVar(&maxPDFPages, "max-pdf-pages", 20, "Reject PDFs with more pages than this (0 for no limit)")
+        flag.StringVar(&dbPath, "db", "", "SQLite database file recording every saved receipt")
+        flag.StringVar(&ledgerPath, "ledger", "", "Append a CSV row for every saved receipt to this file")
+        flag.StringVar(&sheetID, "sheet-id", "", "Append a row for every saved receipt to this Google Sheet (the ID from its URL); credentials in SHEETS_CLIENT_ID, SHEETS_CLIENT_SECRET, and SHEETS_REFRESH_TOKEN")
+        flag.StringVar(&sheetName, "sheet-name", "Sheet1", "Tab of -sheet-id that rows are appended to")
+        flag.BoolVar(&dbSummary, "db-summary", false, "Print total spend per category per month from -db and exit")
+        flag.BoolVar(&costReport, "cost-report", false, "Print the model tokens used and their estimated cost per day and per month from -db and exit")
+        flag.StringVar(&digestSchedule, "digest", "", "Email a summary of filed receipts, totals per category, failures, and API cost: daily or weekly (on Mondays); requires -db")
+        flag.StringVar(&digestTimeFlag, "digest-time", "08:00", "Local time (HH:MM) at which the -digest email is sent")
+        flag.StringVar(&digestTo, "digest-to", "", "Comma-separated addresses the digest is sent to")
+        flag.StringVar(&digestFrom, "digest-from", "", "Sender address of the digest (defaults to -smtp-user)")
+        flag.BoolVar(&sendDigestNow, "send-digest", false, "Send the -digest email for the period ending now and exit")
+        flag.StringVar(&smtpHost, "smtp-host", "", "SMTP server the digest is sent through")
+        flag.IntVar(&smtpPort, "smtp-port", 587, "SMTP server port; 465 uses TLS from the start, others STARTTLS when offered")
+        flag.StringVar(&smtpUser, "smtp-user", "", "SMTP login; the password is read from SMTP_PASSWORD")
+        flag.StringVar(&pricesPath, "prices", "", "JSON file of model prices in USD per million tokens, adding to or overriding the built-in list")
+        flag.StringVar(&expenseReport, "expense-report", "", "Build the named expense report from processed receipts and exit")
+        flag.StringVar(&reportFrom, "report-from", "", "First date (YYYY-MM-DD) included in the expense report")
+        flag.StringVar(&reportTo, "report-to", "", "Last date (YYYY-MM-DD) included in the expense report")
+        flag.StringVar(&reportTags, "report-tags", "", "Comma-separated categories or vendor keywords to include in the expense report")
+        flag.StringVar(&accountingExport, "accounting-export", "", "Export processed receipts as journal entries for freee, moneyforward, or yayoi and exit")
+        flag.StringVar(&accountingOut, "accounting-out", "", "Path of the accounting export (default dest/reports/<format>.csv)")
+        flag.StringVar(&accountMapPath, "account-map", "", "JSON or key=value file mapping categories to debit accounts and payment:<method> to credit accounts")
+        flag.IntVar(&medicalReportYear, "medical-report", 0, "Write the medical expense deduction (医療費控除) summary for the given calendar year and exit")
+        flag.StringVar(&medicalPatient, "medical-patient", "", "Patient name used for medical receipts that do not name one")
+        flag.StringVar(&medicalCategory, "medical-category", "Medical", "Category whose receipts are medical expenses")
+        flag.StringVar(&spendingReport, "spending-report", "", "Print totals per category and vendor for a month (YYYY-MM or month) or year (YYYY or year), compared with the one before, and exit")
+        flag.StringVar(&spendingFormat, "spending-format", "text", "Format of the spending report: text, csv, or html")
+        flag.StringVar(&spendingOut, "spending-out", "", "Write the spending report to this file instead of standard output")
+        flag.IntVar(&exportAnnualYear, "export-annual-pdf", 0, "Write a PDF summary of totals per category per month for the given fiscal year and exit")
+        flag.IntVar(&fiscalYearStart, "fiscal-year-start", 1, "Month (1-12) in which the fiscal year starts")
+        flag.Usage = usage
+        command, args, commandLine := parseCommandLine(os.Args[1:])
+
+        switch command {
+        case "version":
+                fmt.Println(versionString())
+                return 0
+        case "help":
+                flag.CommandLine.SetOutput(os.Stdout)
+                usage()
+                return 0
+        }
+
+        if configPath != "" {
+                if err := applyConfigFile(configPath, commandLine); err != nil {
+                        log.Fatal(err)
+                }
+        }
+
+        setupLogging()
+        applyCommand(command, args)
+
+        // Reports total per currency too, so check it before any mode runs
+        defaultCurrency = strings.ToUpper(strings.TrimSpace(defaultCurrency))
+        if len(defaultCurrency) != 3 {
+                log.Fatalf("Invalid -default-currency %q: expected an ISO 4217 code such as JPY", defaultCurrency)
+        }
+        if limit, err := parseDecimal(maxAmountFlag); err != nil {
+                log.Fatalf("Invalid -max-amount %q: %v", maxAmountFlag, err)
+        } else {
+                maxAmount = limit
+        }
+        if minConfidence < 0 || minConfidence > 1 {
+                log.Fatalf("Invalid -min-confidence %v: expected a value between 0 and 1", minConfidence)
+        }
+        if uploadQuality < 1 || uploadQuality > 100 {
+                log.Fatalf("Invalid -upload-quality %d: expected a value between 1 and 100", uploadQuality)
+        }
+        if maxDimension < 0 {
+                log.Fatalf("Invalid -max-dimension %d: must not be negative", maxDimension)
+        }
+
+        var digestAt time.Duration
+        if digestSchedule != "" {
+                if digestSchedule != "daily" && digestSchedule != "weekly" {
+                        log.Fatalf("Invalid -digest %q: expected daily or weekly", digestSchedule)
+                }
+                if dbPath == "" || smtpHost == "" || digestTo == "" {
+                        flag.Usage()
+                        log.Fatal("-digest requires -db, -smtp-host, and -digest-to")
+                }
+                at, err := parseDigestTime(digestTimeFlag)
+                if err != nil {
+                        log.Fatalf("Invalid -digest-time %q: %v", digestTimeFlag, err)
+                }
+                digestAt = at
+        } else if sendDigestNow {
+                log.Fatal("-send-digest requires -digest")
+        }
+
+        // -model defaults to a Gemini model; other providers get their own default
+        if modelName == ModelName {
+                if model, ok := providerDefaultModels[provider]; ok {
+                        modelName = model
+                }
+        }
+
+        if command == "doctor" {
+                if !runDoctor() {
+                        return 1
+                }
+                return 0
+        }
+
+        if expenseReport != "" {
+                runExpenseReport()
+                return 0
+        }
+
+        if accountingExport != "" {
+                runAccountingExport()
+                return 0
+        }
+
+        if medicalReportYear != 0 {
+                if destDir == "" {
+                        flag.Usage()
+                        log.Fatal("-dest is required for -medical-report")
+                }
+                if err := exportMedicalReport(medicalReportYear); err != nil {
+                        log.Fatalf("Medical report failed: %v", err)
+                }
+                return 0
+        }
+
+        if spendingReport != "" {
+                runSpendingReport()
+                return 0
+        }
+
+        if exportAnnualYear != 0 {
+                if destDir == "" {
+                        flag.Usage()
+                        log.Fatal("-dest is required to export an annual summary")
+                }
+                if fiscalYearStart < 1 || fiscalYearStart > 12 {
+                        log.Fatalf("Invalid -fiscal-year-start %d (expected 1-12)", fiscalYearStart)
+                }
+                if err := exportAnnualPDF(exportAnnualYear, time.Month(fiscalYearStart)); err != nil {
+                        log.Fatalf("Annual summary failed: %v", err)
+                }
+                return 0
+        }
+
+        if retryFailedRun {
+                runRetryFailed()
+                return 0
+        }
+
+        if dbSummary {
+                if dbPath == "" {
+                        flag.Usage()
+                        log.Fatal("-db is required for -db-summary")
+                }
+                db, err := openReceiptDB(dbPath)
+                if err != nil {
+                        log.Fatal(err)
+                }
+                defer db.Close()
+                if err := db.WriteMonthlySummary(os.Stdout); err != nil {
+                        log.Fatal(err)
+                }
+                return 0
+        }
+
+        if costReport {
+                if dbPath == "" {
+                        flag.Usage()
+                        log.Fatal("-db is required for -cost-report")
+                }
+                db, err := openReceiptDB(dbPath)
+                if err != nil {
+                        log.Fatal(err)
+                }
+                defer db.Close()
+                if err := db.WriteCostReport(os.Stdout); err != nil {
+                        log.Fatal(err)
+                }
+                return 0
+        }
+
+        if sendDigestNow {
+                if timezone != "" {
+                        loc, err := time.LoadLocation(timezone)
+                        if err != nil {
+                                log.Fatalf("Invalid -timezone %q: %v", timezone, err)
+                        }
+                        location = loc
+                }
+                db, err := openReceiptDB(dbPath)
+                if err != nil {
+                        log.Fatal(err)
+                }
+                defer db.Close()
+                if err := sendDigest(db, digestSchedule, time.Now()); err != nil {
+                        log.Fatal(err)
+                }
+                return 0
+        }
+
+        if (singleFile != "" || reprocess != "") && len(watchDirs)+len(pollDirs) > 0 {
+                flag.Usage()
+                log.Fatal("-file and -reprocess cannot be used with -watch")
+        }
+        if reprocess != "" {
+                if destDir == "" {
+                        flag.Usage()
+                        log.Fatal("-dest is required for -reprocess")
+                }
+                if storageName != "local" || paperlessOnly {
+                        log.Fatal("-reprocess only re-files receipts saved under -dest")
+                }
+        } else if singleFile == "" && len(watchDirs)+len(pollDirs) == 0 {
+                flag.Usage()
+                log.Fatal("-watch is required (or -file to process a single file)")
+        }
+        if singleFile != "" && destDir == "" {
+                flag.Usage()
+                log.Fatal("-dest is required")
+        }
+
+        var err error
+        watchRoots, err = parseWatchRoots(watchDirs, pollDirs, destDir)
+        if err != nil {
+                flag.Usage()
+                log.Fatal(err)
+        }
+
+        if timezone != "" {
+                loc, err := time.LoadLocation(timezone)
+                if err != nil {
+                        log.Fatalf("Invalid -timezone %q: %v", timezone, err)
+                }
+                location = loc
+        }
+
+        if promptFile != "" {
+                if promptTemplate, err = loadPromptTemplate(promptFile); err != nil {
+                        log.Fatal(err)
+                }
+        }
+
+        if fileNameFormat != "" {
+                if dateFolders {
+                        log.Fatal("-date-folders and -filename-template cannot be used together; add {{.Year}}/{{.Month}} to the template instead")
+                }
+                if fileNameTemplate, err = loadFileNameTemplate(fileNameFormat); err != nil {
+                        log.Fatal(err)
+                }
+        }
+
+        if categoryMapPath != "" {
+                categoryMap, err = loadCategoryMap(categoryMapPath)
+                if err != nil {
+                        log.Fatal(err)
+                }
+        }
+        if vendorAliasesPath != "" {
+                if vendorAliases, err = loadVendorAliases(vendorAliasesPath); err != nil {
+                        log.Fatal(err)
+                }
+        }
+        if vendorMatch < 0 || vendorMatch > 1 {
+                log.Fatal("-vendor-match must be between 0 and 1")
+        }
+
+        if pushNotifiers, err = setupPushNotifiers(); err != nil {
+                log.Fatal(err)
+        }
+
+        if imapURL != "" || gmailInbox {
+                if singleFile != "" {
+                        log.Fatal("-imap-url and -gmail require -watch")
+                }
+                if _, err := filepath.Match(mailAttachmentGlob, ""); err != nil {
+                        log.Fatalf("Invalid -mail-attachment %q: %v", mailAttachmentGlob, err)
+                }
+                if mailInterval <= 0 {
+                        log.Fatalf("Invalid -mail-interval %v: must be positive", mailInterval)
+                }
+                if mailSources, err = setupMailSources(); err != nil {
+                        log.Fatal(err)
+                }
+        }
+
+        if storage, err = setupStorage(); err != nil {
+                log.Fatal(err)
+        }
+        if sheetID != "" {
+                if sheets, err = newSheetLedger(sheetID, sheetName); err != nil {
+                        log.Fatal(err)
+                }
+        }
+        if archiveS3 != "" {
+                if originalsArchive, err = newS3Archive(archiveS3, s3Endpoint, s3Region, s3SSE); err != nil {
+                        log.Fatal(err)
+                }
+        }
+
+        if paperlessURL != "" {
+                if paperless, err = newPaperlessClient(paperlessURL, os.Getenv("PAPERLESS_TOKEN")); err != nil {
+                        log.Fatal(err)
+                }
+        } else if paperlessOnly {
+                log.Fatal("-paperless-only requires -paperless-url")
+        }
+
+        uploadToken := os.Getenv("UPLOAD_TOKEN")
+        if uploadAddr != "" {
+                if singleFile != "" {
+                        log.Fatal("-upload-addr requires -watch")
+                }
+                if uploadToken == "" {
+                        log.Fatal("-upload-addr requires the UPLOAD_TOKEN environment variable")
+                }
+        }
+
+        apiToken := os.Getenv("API_TOKEN")
+        for _, server := range []struct{ Flag, Addr string }{{"-api-addr", apiAddr}, {"-grpc-addr", grpcAddr}} {
+                if server.Addr == "" {
+                        continue
+                }
+                if singleFile != "" || reprocess != "" {
+                        log.Fatalf("%s requires -watch", server.Flag)
+                }
+                if dbPath == "" {
+                        log.Fatalf("%s requires -db", server.Flag)
+                }
+                if apiToken == "" {
+                        log.Fatalf("%s requires the API_TOKEN environment variable", server.Flag)
+                }
+        }
+
+        if tuiMode {
+                if singleFile != "" || reprocess != "" {
+                        log.Fatal("-tui requires -watch")
+                }
+                if _, _, err := terminalSize(int(os.Stdout.Fd())); err != nil {
+                        log.Fatalf("-tui needs a terminal: %v", err)
+                }
+        }
+
+        dashboardPassword := os.Getenv("DASHBOARD_PASSWORD")
+        if dashboardAddr != "" {
+                if singleFile != "" || reprocess != "" {
+                        log.Fatal("-dashboard-addr requires -watch")
+                }
+                if dbPath == "" {
+                        log.Fatal("-dashboard-addr requires -db")
+                }
+                if storageName != "local" || paperlessOnly {
+                        log.Fatal("-dashboard-addr only edits receipts saved under -dest")
+                }
+                if dashboardPassword == "" {
+                        log.Fatal("-dashboard-addr requires the DASHBOARD_PASSWORD environment variable")
+                }
+        }
+
+        if promptCorrections > 0 && dbPath == "" {
+                log.Fatal("-prompt-corrections requires -db")
+        }
+
+        if pricesPath != "" {
+                if err := loadModelPrices(pricesPath); err != nil {
+                        log.Fatal(err)
+                }
+        }
+
+        ignorePatterns = append(ignorePatterns, defaultIgnorePatterns...)
+        for _, pattern := range strings.Split(ignoreGlobs, ",") {
+                if pattern = strings.TrimSpace(pattern); pattern == "" {
+                        continue
+                }
+                if _, err := filepath.Match(pattern, ""); err != nil {
+                        log.Fatalf("Invalid -ignore pattern %q: %v", pattern, err)
+                }
+                ignorePatterns = append(ignorePatterns, pattern)
+        }
+
+        if stableFor >= maxWait {
+                log.Fatalf("-stable-for (%s) must be shorter than -max-wait (%s)", stableFor, maxWait)
+        }
+        if pollInterval <= 0 {
+                log.Fatalf("-poll-interval must be positive, got %s", pollInterval)
+        }
+        if len(pollDirs) > 0 && pollWatchInterval <= 0 {
+                log.Fatalf("-poll-watch-interval must be positive, got %s", pollWatchInterval)
+        }
+        if maxFailures < 1 {
+                log.Fatalf("-max-failures must be at least 1, got %d", maxFailures)
+        }
+        if maxAttempts < 1 {
+                log.Fatalf("-max-attempts must be at least 1, got %d", maxAttempts)
+        }
+        if workers < 1 {
+                log.Fatalf("-workers must be at least 1, got %d", workers)
+        }
+        if requestsPerMinute < 0 || tokensPerDay < 0 {
+                log.Fatalf("-requests-per-minute and -tokens-per-day must not be negative")
+        }
+        var window *quotaWindow
+        if quotaWindowFlag != "" {
+                if tokensPerDay == 0 {
+                        log.Fatalf("-quota-window requires -tokens-per-day")
+                }
+                w, err := parseQuotaWindow(quotaWindowFlag)
+                if err != nil {
+                        log.Fatalf("Invalid -quota-window %q: %v", quotaWindowFlag, err)
+                }
+                window = w
+        }
+        if requestsPerMinute > 0 || tokensPerDay > 0 {
+                apiQuota.limits = newUsageLimits(requestsPerMinute, tokensPerDay, window)
+        }
+
+        // SIGINT/SIGTERM stop new work; files already being processed get to finish.
+        // Those run on their own context, cancelled only if -shutdown-timeout runs out.
+        sigCtx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+        defer stopSignals()
+        ctx, cancelWork := context.WithCancel(context.Background())
+        defer cancelWork()
+
+        // 1. Setup the model provider
+        analyzer, err := newAnalyzer(ctx)
+        if err != nil {
+                log.Fatal(err)
+        }
+        defer analyzer.Close()
+
+        if dbPath != "" && !dryRun {
+                receiptDB, err = openReceiptDB(dbPath)
+                if err != nil {
+                        log.Fatal(err)
+                }
+                defer receiptDB.Close()
+        }
+
+        // The state, queue, and mail files live in -dest, or in the first watch root's
+        // destination without it. Nothing else creates it when receipts are filed elsewhere
+        // (-storage, -paperless-only), or until the first category folder is made.
+        stateDir := destDir
+        if stateDir == "" {
+                stateDir = watchRoots[0].Dest
+        }
+        if !dryRun {
+                if err := os.MkdirAll(stateDir, 0755); err != nil {
+                        log.Fatalf("Failed to create state directory: %v", err)
+                }
+        }
+        processedState, err = loadProcessedState(filepath.Join(stateDir, stateFileName))
+        if err != nil {
+                log.Fatal(err)
+        }
+
+        if dryRun {
+                slog.Info("Dry-run mode: no files will be copied, moved, or created, and nothing is recorded or sent")
+        }
+
+        if reprocess != "" {
+                go func() {
+                        <-sigCtx.Done()
+                        cancelWork()
+                }()
+                if err := reprocessFile(ctx, analyzer, reprocess); err != nil {
+                        slog.Error("Failed to reprocess receipt", "event", "reprocess", "path", reprocess, "error", err)
+                        return 1
+                }
+                return 0
+        }
+
+        if singleFile != "" {
+                // There is nothing to drain in single-file mode, so a signal cancels right away
+                go func() {
+                        <-sigCtx.Done()
+                        cancelWork()
+                }()
+                // A directory is processed as it is now, with a summary, instead of being watched
+                exitCode := 0
+                if info, err := os.Stat(singleFile); err == nil && info.IsDir() {
+                        result, err := processBatch(ctx, analyzer, singleFile)
+                        if err != nil {
+                                slog.Error("Failed to read directory", "path", singleFile, "error", err)
+                                exitCode = 1
+                        } else if len(result.Failed) > 0 {
+                                exitCode = 1
+                        }
+                } else if err := processFile(ctx, analyzer, singleFile); err != nil {
+                        slog.Error("Failed to process file", "path", singleFile, "error", err)
+                        exitCode = 1
+                }
+                pendingNotifications.Wait()
+                return exitCode
+        }
+
+        // Files in progress are persisted so a crash or restart resumes them
+        if !dryRun {
+                workQueue, err = loadWorkQueue(filepath.Join(stateDir, queueFileName))
+                if err != nil {
+                        log.Fatal(err)
+                }
+        }
+
+        var mailState *MailState
+        if len(mailSources) > 0 && !dryRun {
+                if mailState, err = loadMailState(filepath.Join(stateDir, mailFileName)); err != nil {
+                        log.Fatal(err)
+                }
+        }
+
+        if digestSchedule != "" && receiptDB != nil {
+                go runDigests(sigCtx, receiptDB, digestSchedule, digestAt)
+        }
+
+        // 2. Setup File Watcher
+        watcher, err := fsnotify.NewWatcher()
+        if err != nil {
+                log.Fatal(err)
+        }
+        defer watcher.Close()
+
+        if closeWrite {
+                if closeWrites, err = newCloseWriteWatcher(sigCtx); err != nil {
+                        slog.Info("Using size polling to detect finished files", "error", err)
+                }
+        }
+
+        events := newDebouncer(debounce)
+
+        // Stable files queue up here; only -workers of them talk to Gemini at once.
+        // A file that will be retried goes back through schedule.
+        var schedule func(path string)
+        pool := startWorkers(workers, func(path string) {
+                defer activeFiles.Delete(path)
+                // Failures are logged and quarantined inside processFile
+                err := processFile(ctx, analyzer, path)
+                if !errors.Is(err, errUnsupportedFile) {
+                        health.RecordResult(err)
+                }
+                if errors.Is(err, errRetryLater) {
+                        delay := retryDelay
+                        var deferred *quotaDeferredError
+                        if errors.As(err, &deferred) {
+                                delay = time.Until(deferred.resume)
+                        }
+                        time.AfterFunc(delay, func() {
+                                if sigCtx.Err() == nil {
+                                        schedule(path)
+                                }
+                        })
+                        return
+                }
+                // A file cancelled by shutdown stays queued for the next run
+                if ctx.Err() == nil {
+                        updateQueue(path, workQueue.Done(path))
+                }
+        })
+
+        // Scanners emit bursts of Write/Chmod/Rename; act once the burst is over
+        schedule = func(path string) {
+                // Only possible receipts start a stability wait; other files are not worth watching
+                if !isReceiptCandidate(path) {
+                        return
+                }
+                events.Trigger(path, func() {
+                        // DEDUPLICATION: Check if we are already handling this file
+                        if _, loaded := activeFiles.LoadOrStore(path, true); loaded {
+                                return
+                        }
+                        updateQueue(path, workQueue.Detected(path))
+                        // Wait for the write to finish in a new thread, then hand off to the pool
+                        go processEvent(sigCtx, pool, path)
+                })
+        }
+
+        go func() {
+                for {
+                        select {
+                        case event, ok := <-watcher.Events:
+                                if !ok {
+                                        return
+                                }
+
+                                // Trigger on any modification that might indicate a file is ready
+                                // We include Rename/Chmod because some scanners write to a temp file then rename,
+                                // or change permissions as a final step.
+                                if event.Has(fsnotify.Write) || event.Has(fsnotify.Create) || event.Has(fsnotify.Rename) || event.Has(fsnotify.Chmod) {
+                                        if isIgnoredFile(event.Name) {
+                                                continue
+                                        }
+                                        // New subdirectories are watched too, and anything already in them is picked up
+                                        if recursive && event.Has(fsnotify.Create) {
+                                                if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+                                                        if err := addWatchTree(watcher, event.Name, schedule); err != nil {
+                                                                slog.Error("Failed to watch new directory", "path", event.Name, "error", err)
+                                                        }
+                                                        continue
+                                                }
+                                        }
+                                        schedule(event.Name)
+                                } else {
+                    slog.Debug("Ignored event", "event", "ignored", "path", event.Name, "op", event.Op.String())
+                }
+
+                        case err, ok := <-watcher.Errors:
+                                if !ok {
+                                        return
+                                }
+                                slog.Error("Watcher error", "error", err)
+                                health.RecordWatcherError(err)
+                        }
+                }
+        }()
+
+        // Files that arrived while the bot was down get no events, so queue them up front.
+        // Already-processed ones are skipped by processFile's state check.
+        var existing func(path string)
+        if scanExisting {
+                existing = func(path string) {
+                        if isArchivedCopy(path) {
+                                slog.Info("Skipping file: an identical copy is already in originals", "event", "duplicate", "path", path)
+                                pipelineEvents.publish(pipelineEvent{Kind: eventDuplicate, Source: path})
+                                return
+                        }
+                        schedule(path)
+                }
+        }
+
+        // Resume files from the last run first, so the scan below finds them already active
+        resumeQueue(pool, schedule)
+
+        for _, root := range watchRoots {
+                if root.Poll {
+                        go pollDir(sigCtx, root.Dir, pollWatchInterval, existing, schedule)
+                        continue
+                }
+                if err := addWatchTree(watcher, root.Dir, existing); err != nil {
+                        log.Fatalf("Failed to watch directory %s: %v", root.Dir, err)
+                }
+        }
+
+        health.SetWatching(true, pool)
+        if metricsAddr != "" {
+                srv := startMetricsServer(metricsAddr)
+                defer stopMetricsServer(srv)
+        }
+        for _, root := range watchRoots {
+                if root.Poll {
+                        slog.Info("Scanning for receipts", "path", root.Dir, "dest", root.Dest, "interval", pollWatchInterval.String())
+                        continue
+                }
+                slog.Info("Listening for receipts", "path", root.Dir, "dest", root.Dest)
+        }
+
+        // Attachments land in the first watch directory and are processed like scans
+        if mailState != nil {
+                go pollMail(sigCtx, mailState, watchRoots[0].Dir)
+        } else if len(mailSources) > 0 {
+                slog.Info("Dry-run mode: email is not checked")
+        }
+        if uploadAddr != "" && !dryRun {
+                srv := startUploadServer(uploadAddr, uploadToken, watchRoots[0].Dir)
+                defer stopUploadServer(srv)
+        } else if uploadAddr != "" {
+                slog.Info("Dry-run mode: uploads are not accepted")
+        }
+        if dashboardAddr != "" && !dryRun {
+                srv := startDashboard(dashboardAddr, dashboardPassword)
+                defer stopDashboard(srv)
+        } else if dashboardAddr != "" {
+                slog.Info("Dry-run mode: the dashboard is not served")
+        }
+        if apiAddr != "" && !dryRun {
+                srv := startAPIServer(apiAddr, apiToken)
+                defer stopAPIServer(srv)
+        } else if apiAddr != "" {
+                slog.Info("Dry-run mode: the API is not served")
+        }
+        if grpcAddr != "" && !dryRun {
+                srv := startGRPCServer(grpcAddr, apiToken)
+                defer stopGRPCServer(srv)
+        } else if grpcAddr != "" {
+                slog.Info("Dry-run mode: the gRPC service is not served")
+        }
+        // q in the live view shuts down like Ctrl-C
+        var view *tuiView
+        if tuiMode {
+                if view, err = startTUI(stopSignals); err != nil {
+                        log.Fatal(err)
+                }
+        }
+        <-sigCtx.Done()
+        if view != nil {
+                view.Close()
+        }
+        // Restore default handling so a second Ctrl-C exits immediately
+        stopSignals()
+        health.SetWatching(false, pool)
+
+        slog.Info("Shutting down: no new files will be picked up, waiting for files in progress", "timeout", shutdownTimeout.String())
+        watcher.Close()
+        events.Stop()
+
+        drained := make(chan struct{})
+        go func() {
+                pool.Close()
+                close(drained)
+        }()
+        select {
+        case <-drained:
+        case <-time.After(shutdownTimeout):
+                slog.Warn("Shutdown timeout reached, cancelling files still in progress; they stay in the watch directory")
+                cancelWork()
+                <-drained
+        }
+        pendingNotifications.Wait()
+        slog.Info("Shutdown complete")
+        return 0
+}
+
+// runExpenseReport handles the -expense-report mode, which needs neither the watcher nor Gemini
+func runExpenseReport() {
+        if destDir == "" {
+                flag.Usage()
+                log.Fatal("-dest is required to build an expense report")
+        }
+
+        report := ExpenseReport{
+                Name: expenseReport,
+                From: parseReportDateFlag("-report-from", reportFrom),
+                To:   parseReportDateFlag("-report-to", reportTo),
+        }
+
+        for _, tag := range strings.Split(reportTags, ",") {
+                if tag = strings.TrimSpace(tag); tag != "" {
+                        report.Tags = append(report.Tags, tag)
+                }
+        }
+
+        if err := buildExpenseReport(report); err != nil {
+                log.Fatalf("Expense report failed: %v", err)
+        }
+}
+
+// runAccountingExport handles the -accounting-export mode, which reuses the expense report's
+// date and tag filters
+func runAccountingExport() {
+        if destDir == "" {
+                flag.Usage()
+                log.Fatal("-dest is required for -accounting-export")
+        }
+        if !slices.Contains(accountingFormats, accountingExport) {
+                log.Fatalf("Invalid -accounting-export %q (expected freee, moneyforward, or yayoi)", accountingExport)
+        }
+
+        report := ExpenseReport{
+                From: parseReportDateFlag("-report-from", reportFrom),
+                To:   parseReportDateFlag("-report-to", reportTo),
+        }
+        for _, tag := range strings.Split(reportTags, ",") {
+                if tag = strings.TrimSpace(tag); tag != "" {
+                        report.Tags = append(report.Tags, tag)
+                }
+        }
+
+        if err := exportAccounting(accountingExport, accountingOut, accountMapPath, report); err != nil {
+                log.Fatalf("Accounting export failed: %v", err)
+        }
+}
+
+// runSpendingReport handles the -spending-report mode, reading -db or the files under -dest
+func runSpendingReport() {
+        if dbPath == "" && destDir == "" {
+                flag.Usage()
+                log.Fatal("-db or -dest is required for -spending-report")
+        }
+        if !slices.Contains(spendingFormats, spendingFormat) {
+                log.Fatalf("Invalid -spending-format %q (expected text, csv, or html)", spendingFormat)
+        }
+        period, ok := parseSpendingPeriod(spendingReport, time.Now())
+        if !ok {
+                log.Fatalf("Invalid -spending-report %q (expected YYYY-MM, YYYY, month, or year)", spendingReport)
+        }
+
+        receipts, err := loadSpendingReceipts(period)
+        if err != nil {
+                log.Fatalf("Spending report failed: %v", err)
+        }
+        if err := writeSpendingReport(buildSpendingReport(receipts, period), spendingFormat, spendingOut); err != nil {
+                log.Fatalf("Spending report failed: %v", err)
+        }
+}
+
+// runRetryFailed handles the -retry-failed mode. The files are re-queued by moving them
+// back into the watch directory, so a running bot (or the next startup scan) analyzes them.
+func runRetryFailed() {
+        roots, err := parseWatchRoots(watchDirs, pollDirs, destDir)
+        if err != nil {
+                flag.Usage()
+                log.Fatal(err)
+        }
+
+        dests := []string{}
+        if destDir != "" {
+                dests = append(dests, destDir)
+        }
+        fallbackDir := ""
+        for _, root := range roots {
+                if !slices.Contains(dests, root.Dest) {
+                        dests = append(dests, root.Dest)
+                }
+                if fallbackDir == "" {
+                        fallbackDir = root.Dir
+                }
+        }
+        if len(dests) == 0 {
+                flag.Usage()
+                log.Fatal("-dest is required for -retry-failed")
+        }
+
+        moved, err := retryFailed(dests, fallbackDir)
+        if err != nil {
+                log.Fatalf("Retry failed: %v", err)
+        }
+        slog.Info("Re-queued quarantined files", "event", "requeue", "files", moved)
+}
+
+func parseReportDateFlag(name, value string) time.Time {
+        if value == "" {
+                return time.Time{}
+        }
+        t, err := time.Parse("2006-01-02", value)
+        if err != nil {
+                log.Fatalf("Invalid %s date %q: %v", name, value, err)
+        }
+        return t
+}
+
+// setupLogging applies -log-level and switches the default logger to JSON when
+// -log-format json is set. Plain log.Printf calls are routed through the same handler.
+func setupLogging() {
+        var level slog.Level
+        if err := level.UnmarshalText([]byte(logLevel)); err != nil {
+                log.Fatalf("Invalid -log-level %q (expected debug, info, warn, or error)", logLevel)
+        }
+
+        switch logFormat {
+        case "text":
+                slog.SetLogLoggerLevel(level)
+        case "json":
+                slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+        default:
+                log.Fatalf("Invalid -log-format %q (expected text or json)", logFormat)
+        }
+}
+
+// isIgnoredFile reports whether the file's base name matches an ignore pattern
+func isIgnoredFile(path string) bool {
+        name := filepath.Base(path)
+        for _, pattern := range ignorePatterns {
+                if matched, _ := filepath.Match(pattern, name); matched {
+                        return true
+                }
+        }
+        return false
+}
+
+// resumeQueue picks up the files the last run did not finish: those still waiting to
+// finish writing are watched again, and stable or analyzed ones go straight to a worker.
+// Files that have since been removed are dropped from the queue.
+func resumeQueue(pool *workerPool, schedule func(path string)) {
+        for path, entry := range workQueue.Pending() {
+                if _, err := os.Stat(path); err != nil {
+                        updateQueue(path, workQueue.Done(path))
+                        continue
+                }
+                slog.Info("Resuming file from the last run", "event", "resume", "path", path, "stage", entry.Stage)
+                pipelineEvents.publish(pipelineEvent{Kind: eventResume, Source: path})
+                if entry.Stage == queueDetected || entry.Stage == queueRetry {
+                        schedule(path)
+                        continue
+                }
+                if _, loaded := activeFiles.LoadOrStore(path, true); loaded {
+                        continue
+                }
+                go func() {
+                        if !pool.Submit(path) {
+                                activeFiles.Delete(path)
+                        }
+                }()
+        }
+}
+
+// updateQueue logs a failure to persist the work queue; the file itself is still processed
+func updateQueue(path string, err error) {
+        if err != nil {
+                slog.Warn("Failed to update work queue", "path", path, "error", err)
+        }
+}
+
+// processEvent waits for a detected file to finish writing, then queues it for a worker.
+// The worker clears the file from activeFiles once it is done.
+func processEvent(ctx context.Context, pool *workerPool, path string) {
+        slog.Info("Detected file, waiting for write to complete", "event", "detected", "path", path)
+        pipelineEvents.publish(pipelineEvent{Kind: eventDetected, Source: path})
 
-        if watchDir == "" || destDir == "" {
-                flag.Usage()
-                log.Fatal("Both -watch and -dest flags are required")
+        waitStart := time.Now()
+        if err := waitForStableFile(ctx, path); err != nil {
+                slog.Warn("Processing aborted", "event", "stability_failed", "path", path, "duration_ms", time.Since(waitStart).Milliseconds(), "error", err)
+                pipelineEvents.publish(pipelineEvent{Kind: eventStabilityFailed, Source: path, Err: err, Duration: time.Since(waitStart)})
+                if ctx.Err() == nil {
+                        updateQueue(path, workQueue.Done(path))
+                }
+                activeFiles.Delete(path)
+                return
         }
+        slog.Info("File is stable", "event", "stable", "path", path, "duration_ms", time.Since(waitStart).Milliseconds())
+        pipelineEvents.publish(pipelineEvent{Kind: eventStable, Source: path, Duration: time.Since(waitStart)})
+        updateQueue(path, workQueue.Stable(path))
 
-        // 1. Setup Gemini Client
-        ctx := context.Background()
-        apiKey := os.Getenv("GEMINI_API_KEY")
-        if apiKey == "" {
-                log.Fatal("GEMINI_API_KEY environment variable not set")
+        if !pool.Submit(path) {
+                slog.Info("Shutting down, leaving file for the next run", "path", path)
+                activeFiles.Delete(path)
         }
+}
 
-        client, err := genai.NewClient(ctx, option.WithAPIKey(apiKey))
+// processFile runs the analyze/save/archive pipeline on a file that is already complete.
+// Files skipped as duplicates return nil.
+func processFile(ctx context.Context, analyzer ReceiptAnalyzer, path string) error {
+        metricActiveFiles.Inc()
+        defer metricActiveFiles.Dec()
+
+        // Filter by name first, then by content
+        if !isReceiptCandidate(path) {
+                return errUnsupportedFile
+        }
+        // Scanners and sync tools leave empty or stub files behind
+        if info, err := os.Stat(path); err == nil && info.Size() < minFileSize {
+                slog.Info("Skipping file: smaller than -min-size", "path", path, "size", info.Size())
+                return fmt.Errorf("%w: %d bytes is below -min-size", errUnsupportedFile, info.Size())
+        }
+        detected, err := sniffType(path)
         if err != nil {
-                log.Fatal(err)
+                slog.Error("Failed to read file", "path", path, "error", err)
+                return err
+        }
+        _, analyzable := receiptTypes[detected]
+        _, convertible := convertTargets[detected]
+        if !analyzable && !convertible {
+                // A file without an extension was only ever a guess
+                if filepath.Ext(path) == "" {
+                        return errUnsupportedFile
+                }
+                // One named as a receipt is likely a failed download, such as an HTML error page saved as .pdf
+                metricDetected.Inc()
+                metricFailed.Inc()
+                err = fmt.Errorf("content is %s, not a JPEG, PNG, PDF, HEIC, WebP, or TIFF", detected)
+                slog.Error("File is not a receipt", "path", path, "error", err)
+                quarantineFile(path, err)
+                return err
         }
-        defer client.Close()
+        metricDetected.Inc()
 
-        // 2. Setup File Watcher
-        watcher, err := fsnotify.NewWatcher()
+        hash, err := fileSHA256(path)
         if err != nil {
-                log.Fatal(err)
+                slog.Error("Failed to hash file", "path", path, "error", err)
+                return err
+        }
+        if processedState.IsProcessed(path, hash) {
+                metricDuplicates.Inc()
+                slog.Info("Skipping file: already processed", "event", "duplicate", "path", path, "state", stateFileName)
+                pipelineEvents.publish(pipelineEvent{Kind: eventDuplicate, Source: path})
+                return nil
+        }
+        if receiptDB != nil {
+                done, err := receiptDB.HashProcessed(hash)
+                if err != nil {
+                        slog.Warn("Failed to check journal", "path", path, "error", err)
+                } else if done {
+                        metricDuplicates.Inc()
+                        slog.Info("Skipping file: identical content already processed", "event", "duplicate", "path", path, "db", dbPath)
+                        pipelineEvents.publish(pipelineEvent{Kind: eventDuplicate, Source: path})
+                        return nil
+                }
         }
-        defer watcher.Close()
 
-        done := make(chan bool)
+        if checkMarker {
+                marked, err := hasProcessedMarker(path)
+                if err != nil {
+                        slog.Warn("Failed to check marker", "path", path, "error", err)
+                } else if marked {
+                        metricDuplicates.Inc()
+                        slog.Info("Skipping file: already processed by scanner-bot", "event", "duplicate", "path", path)
+                        pipelineEvents.publish(pipelineEvent{Kind: eventDuplicate, Source: path})
+                        return nil
+                }
+        }
 
-        go func() {
-                for {
-                        select {
-                        case event, ok := <-watcher.Events:
-                                if !ok {
-                                        return
-                                }
+        // Formats the providers can't all read are analyzed and filed as JPEG or PDF;
+        // the original is still what gets archived
+        content := path
+        if convertible {
+                converted, tmpDir, err := convertForAnalysis(ctx, path, detected)
+                if err != nil {
+                        metricFailed.Inc()
+                        slog.Error("Conversion failed", "path", path, "error", err)
+                        quarantineFile(path, err)
+                        return err
+                }
+                defer os.RemoveAll(tmpDir)
+                content = converted
+        }
 
-                                // Trigger on any modification that might indicate a file is ready
-                                // We include Rename/Chmod because some scanners write to a temp file then rename,
-                                // or change permissions as a final step.
-                                if event.Has(fsnotify.Write) || event.Has(fsnotify.Create) || event.Has(fsnotify.Rename) || event.Has(fsnotify.Chmod) {
-                                        // DEDUPLICATION: Check if we are already handling this file
-                                        if _, loaded := activeFiles.LoadOrStore(event.Name, true); loaded {
-                                                continue
-                                        }
-                                        // Start processing in a new thread
-                                        go processEvent(ctx, client, event.Name)
-                                } else {
-                    log.Printf("Ignored event: %v", event)
+        // -preprocess is best effort: the photo as taken is still worth analyzing
+        if preprocess && (mediaType(content) == "image/jpeg" || mediaType(content) == "image/png") {
+                cleaned, tmpDir, err := preprocessImage(ctx, content)
+                if err != nil {
+                        slog.Warn("Preprocessing failed, analyzing the image as is", "path", path, "error", err)
+                } else {
+                        defer os.RemoveAll(tmpDir)
+                        content = cleaned
                 }
+        }
 
-                        case err, ok := <-watcher.Errors:
-                                if !ok {
-                                        return
-                                }
-                                log.Println("Watcher error:", err)
+        // -split-pdf analyzes and files each page of a batch scan on its own
+        var pages []string
+        if splitPages && mediaType(content) == "application/pdf" {
+                if n, _ := countPDFPages(content); n > 1 {
+                        var splitDir string
+                        pages, splitDir, err = splitPDF(ctx, content)
+                        if err != nil {
+                                metricFailed.Inc()
+                                slog.Error("Splitting failed", "path", path, "error", err)
+                                quarantineFile(path, err)
+                                return err
                         }
+                        defer os.RemoveAll(splitDir)
+                        slog.Info("Split PDF into pages", "path", path, "pages", len(pages))
                 }
-        }()
+        }
 
-        if err := watcher.Add(watchDir); err != nil {
-                log.Fatalf("Failed to watch directory %s: %v", watchDir, err)
+        // Re-scans of the same paper have a different SHA-256 but nearly the same picture
+        phash := ""
+        if receiptDB != nil && nearDuplicateDistance > 0 {
+                phash, err = perceptualHash(content)
+                if err != nil {
+                        slog.Warn("Failed to compute perceptual hash", "path", path, "error", err)
+                }
         }
-        log.Printf("Listening for receipts in %s...", watchDir)
-        log.Printf("Saving processed files to %s...", destDir)
-        <-done
-}
 
-func processEvent(ctx context.Context, client *genai.Client, path string) {
-        defer activeFiles.Delete(path)
+        // -max-dimension only shrinks what is uploaded; the full-size image is still filed
+        upload := content
+        if maxDimension > 0 {
+                small, tmpDir, err := downscaleForUpload(content)
+                if err != nil {
+                        slog.Warn("Downscaling failed, uploading the full-size image", "path", path, "error", err)
+                } else {
+                        if tmpDir != "" {
+                                defer os.RemoveAll(tmpDir)
+                        }
+                        upload = small
+                }
+        }
 
-        log.Printf("Detected: %s. Waiting for write to complete...", path)
+        // Every model call for this file adds its tokens here, for the journal and -cost-report
+        usage := &tokenUsage{}
+        ctx = withUsage(ctx, usage)
 
-        if err := waitForStableFile(path); err != nil {
-                log.Printf("Processing aborted for %s: %v", path, err)
-                return
+        // With the daily budget used up, hand the file back before anything is uploaded
+        if _, resumed := workQueue.Analysis(path, hash); !resumed {
+                if err := apiQuota.limits.Deferred(); err != nil {
+                        slog.Info("Deferring file until the daily token budget resets", "event", "retry", "path", path, "error", err)
+                        pipelineEvents.publish(pipelineEvent{Kind: eventRetry, Source: path, Err: err})
+                        return err
+                }
         }
 
-        // Filter valid extensions
-        ext := strings.ToLower(filepath.Ext(path))
-        if ext != ".jpg" && ext != ".jpeg" && ext != ".png" && ext != ".pdf" {
-                return
+        // Journal the attempt; every return below records its outcome
+        var journalID int64
+        finishJournal := func(status string, dataList []ReceiptData, destPaths []string, procErr error) {
+                if journalID == 0 {
+                        return
+                }
+                if err := receiptDB.FinishJournal(journalID, status, dataList, destPaths, usage, procErr); err != nil {
+                        slog.Warn("Failed to update journal", "path", path, "error", err)
+                }
+        }
+        if receiptDB != nil {
+                journalID, err = receiptDB.StartJournal(path, hash, phash)
+                if err != nil {
+                        slog.Warn("Failed to journal file", "path", path, "error", err)
+                }
         }
 
-        log.Printf("Processing: %s", path)
+        if problem := nearDuplicateProblem(path, hash, phash); problem != "" {
+                metricReview.Inc()
+                err = fmt.Errorf("%w: %s", errNeedsReview, problem)
+                if moveErr := holdForReview(path, nil, []string{problem}); moveErr != nil {
+                        slog.Error("Failed to hold file for review", "event", "review", "path", path, "error", moveErr)
+                        pipelineEvents.publish(pipelineEvent{Kind: eventReview, Source: path, Err: moveErr})
+                }
+                finishJournal(journalReview, nil, nil, err)
+                return err
+        }
 
-        dataList, err := analyzeReceipt(ctx, client, path)
+        analysisStart := time.Now()
+        dataList, resumed := workQueue.Analysis(path, hash)
+        if resumed {
+                // Analyzed before a restart: file it from the saved results without calling the model again
+                slog.Info("Resuming with the saved analysis", "event", "analysis_start", "path", path)
+                pipelineEvents.publish(pipelineEvent{Kind: eventAnalysisStart, Source: path})
+                err = nil
+        } else {
+                slog.Info("Analyzing receipt", "event", "analysis_start", "path", path)
+                pipelineEvents.publish(pipelineEvent{Kind: eventAnalysisStart, Source: path})
+                dataList, err = analyzePages(withSourceHash(ctx, hash), analyzer, upload, pages)
+                metricAnalysisSeconds.Observe(time.Since(analysisStart).Seconds())
+        }
+        if err != nil && ctx.Err() != nil {
+                // Cancelled during shutdown: not the file's fault, so leave it for the next run
+                slog.Info("Analysis cancelled, leaving file in place", "event", "analysis_end", "path", path)
+                pipelineEvents.publish(pipelineEvent{Kind: eventAnalysisEnd, Source: path, Err: err})
+                finishJournal(journalFailed, nil, nil, err)
+                return err
+        }
+        if errors.Is(err, errRetryLater) {
+                // The daily budget ran out during analysis: also not the file's fault
+                slog.Info("Deferring file until the daily token budget resets", "event", "retry", "path", path, "error", err)
+                pipelineEvents.publish(pipelineEvent{Kind: eventRetry, Source: path, Err: err})
+                finishJournal(journalFailed, nil, nil, err)
+                return err
+        }
         if err != nil {
-                log.Printf("Analysis failed for %s: %v", path, err)
-                return
+                metricFailed.Inc()
+                slog.Error("Analysis failed", "event", "analysis_end", "path", path, "duration_ms", time.Since(analysisStart).Milliseconds(), "error", err)
+                pipelineEvents.publish(pipelineEvent{Kind: eventAnalysisEnd, Source: path, Err: err, Duration: time.Since(analysisStart)})
+                err = retryOrQuarantine(path, hash, fmt.Errorf("analysis failed: %w", err))
+                finishJournal(journalFailed, nil, nil, err)
+                return err
         }
 
+        promptTokens, outputTokens, cost := usage.Totals()
+        slog.Info("Analysis complete", "event", "analysis_end", "path", path, "duration_ms", time.Since(analysisStart).Milliseconds(), "receipts", len(dataList),
+                "prompt_tokens", promptTokens, "output_tokens", outputTokens, "cost_usd", fmt.Sprintf("%.4f", cost))
+        pipelineEvents.publish(pipelineEvent{Kind: eventAnalysisEnd, Source: path, Receipts: len(dataList), Duration: time.Since(analysisStart)})
+
         if len(dataList) == 0 {
-                log.Printf("No receipt data found in %s", path)
-                return
+                metricFailed.Inc()
+                slog.Warn("No receipt data found", "event", "analysis_end", "path", path)
+                err = retryOrQuarantine(path, hash, fmt.Errorf("no receipt data found"))
+                finishJournal(journalFailed, dataList, nil, err)
+                return err
+        }
+
+        if validate || minConfidence > 0 || verifyWith != "" {
+                if problems := validateReceipts(dataList); len(problems) > 0 {
+                        metricReview.Inc()
+                        err = fmt.Errorf("%w: %s", errNeedsReview, strings.Join(problems, "; "))
+                        if moveErr := holdForReview(path, dataList, problems); moveErr != nil {
+                                slog.Error("Failed to hold file for review", "event", "review", "path", path, "error", moveErr)
+                                pipelineEvents.publish(pipelineEvent{Kind: eventReview, Source: path, Err: moveErr})
+                        }
+                        finishJournal(journalReview, dataList, nil, err)
+                        return err
+                }
+        }
+
+        contents, cropDir := receiptContents(path, content, pages, dataList)
+        if cropDir != "" {
+                defer os.RemoveAll(cropDir)
+        }
+
+        updateQueue(path, workQueue.Analyzed(path, hash, dataList))
+
+        destPaths, err := saveAndArchive(path, contents, dataList)
+        if err != nil {
+                metricFailed.Inc()
+                slog.Error("Processing incomplete", "path", path, "error", err)
+                finishJournal(journalIncomplete, dataList, destPaths, err)
+                return err
+        }
+
+        metricProcessed.Inc()
+        finishJournal(journalProcessed, dataList, destPaths, nil)
+
+        if !dryRun {
+                if err := processedState.MarkProcessed(path, hash); err != nil {
+                        slog.Error("Failed to record file as processed", "path", path, "error", err)
+                }
+        }
+        return nil
+}
+
+// receiptContents picks the file each receipt is filed from: its own page of a split PDF
+// or its crop with -crop-receipts where there is one, otherwise the whole scan. Crops
+// are written to the returned temp directory, which the caller removes.
+func receiptContents(path, content string, pages []string, dataList []ReceiptData) ([]string, string) {
+        contents := make([]string, len(dataList))
+        for i, data := range dataList {
+                contents[i] = content
+                if data.Page > 0 && data.Page <= len(pages) {
+                        contents[i] = pages[data.Page-1]
+                }
+        }
+        if !cropReceipts || len(dataList) < 2 || len(pages) > 0 {
+                return contents, ""
         }
 
-        saveAndArchive(path, dataList)
+        crops, cropDir, err := cropReceiptImages(content, dataList)
+        if err != nil {
+                slog.Warn("Cropping failed, filing the whole image for each receipt", "path", path, "error", err)
+                return contents, ""
+        }
+        for i, crop := range crops {
+                if crop != "" {
+                        contents[i] = crop
+                }
+        }
+        return contents, cropDir
 }
 
 // waitForStableFile monitors the file until size is constant for a duration
-func waitForStableFile(path string) error {
-        const stabilityThreshold = 10 * time.Second
-        const maxWaitTime = 5 * time.Minute
-
+func waitForStableFile(ctx context.Context, path string) error {
         startTime := time.Now()
         lastSize := int64(-1)
         stableSince := time.Now()
 
         for {
-                if time.Since(startTime) > maxWaitTime {
+                if time.Since(startTime) > maxWait {
                         return fmt.Errorf("timeout waiting for file to stabilize")
                 }
 
                 info, err := os.Stat(path)
                 if os.IsNotExist(err) {
-                        return fmt.Errorf("file disappeared")
+                        return errFileDisappeared
                 }
                 if err != nil {
                         return fmt.Errorf("error stating file: %w", err)
@@ -168,43 +1662,157 @@ func waitForStableFile(path string) error {
 
                 currentSize := info.Size()
 
+                // Linux fast path: the writer closed the file after its last change
+                if currentSize > 0 && closeWrites.ClosedSince(path, info.ModTime()) {
+                        return nil
+                }
+
                 if currentSize != lastSize {
                         lastSize = currentSize
                         stableSince = time.Now()
                 } else {
-                        if time.Since(stableSince) >= stabilityThreshold {
+                        if time.Since(stableSince) >= stableFor {
                                 if currentSize > 0 {
                                         return nil // Stable
                                 }
                         }
                 }
 
-                time.Sleep(1 * time.Second)
+                select {
+                case <-time.After(pollInterval):
+                case <-ctx.Done():
+                        return ctx.Err()
+                }
         }
 }
 
-// analyzeReceipt uploads the file to Gemini and extracts receipt data
-func analyzeReceipt(ctx context.Context, client *genai.Client, path string) ([]ReceiptData, error) {
+// analyzeReceipt sends the file to Gemini and extracts receipt data
+func analyzeReceipt(ctx context.Context, client *genai.Client, path, modelID string) ([]ReceiptData, error) {
         f, err := os.Open(path)
         if err != nil {
                 return nil, fmt.Errorf("error opening file: %w", err)
         }
         defer f.Close()
 
-        // Upload
-        model := client.GenerativeModel(ModelName)
+        // Count pages before uploading so oversized batches never leave the machine
+        pages, err := pdfPageCount(path)
+        if err != nil {
+                return nil, err
+        }
+
+        slog.Debug("Selected model", "path", path, "model", modelID, "pages", pages)
+        model := client.GenerativeModel(modelID)
         model.ResponseMIMEType = "application/json"
+        if temperature >= 0 {
+                model.SetTemperature(float32(temperature))
+        }
+        if maxOutputTokens > 0 {
+                model.SetMaxOutputTokens(int32(maxOutputTokens))
+        }
+
+        // Small files go inline with the request, skipping the upload, status checks, and delete
+        var filePart genai.Part
+        info, err := f.Stat()
+        if err != nil {
+                return nil, fmt.Errorf("error reading file: %w", err)
+        }
+        if info.Size() <= inlineMaxSize {
+                data, err := io.ReadAll(f)
+                if err != nil {
+                        return nil, fmt.Errorf("error reading file: %w", err)
+                }
+                filePart = genai.Blob{MIMEType: mediaType(path), Data: data}
+        } else {
+                upFile, err := uploadToGemini(ctx, client, f, path)
+                if err != nil {
+                        return nil, err
+                }
+                defer client.DeleteFile(ctx, upFile.Name)
+                filePart = genai.FileData{URI: upFile.URI}
+        }
 
-        upFile, err := client.UploadFile(ctx, "", f, nil)
+        // Generate
+        prompt, err := receiptPrompt(ctx, path, pages)
+        if err != nil {
+                return nil, err
+        }
+
+        var resp *genai.GenerateContentResponse
+        budget := int32(maxOutputTokens)
+        for attempt := 0; ; attempt++ {
+                err = withRetry(ctx, "generate", func() error {
+                        var genErr error
+                        resp, genErr = model.GenerateContent(ctx, filePart, genai.Text(prompt))
+                        if genErr == nil {
+                                recordGeminiUsage(ctx, modelID, resp)
+                        }
+                        return genErr
+                })
+                err = checkGenerateResult(resp, err)
+
+                // A truncated answer is unparseable JSON; ask again with room to finish
+                if errors.Is(err, errTruncated) && attempt < maxTruncationRetries && budget < maxOutputTokenCeiling {
+                        budget = nextOutputBudget(budget)
+                        model.SetMaxOutputTokens(budget)
+                        slog.Warn("Response truncated at the token limit, retrying", "path", path, "max_output_tokens", budget)
+                        continue
+                }
+                if err != nil {
+                        return nil, err
+                }
+                break
+        }
+
+        // Corrections continue the conversation: the file and prompt, then each answer
+        history := []*genai.Content{genai.NewUserContent(filePart, genai.Text(prompt))}
+        return parseWithCorrection(path, candidateText(resp), func(invalid, correction string) (string, error) {
+                history = append(history, &genai.Content{Role: "model", Parts: []genai.Part{genai.Text(invalid)}})
+
+                chat := model.StartChat()
+                err := withRetry(ctx, "generate", func() error {
+                        // SendMessage adds the turn to History even when it fails, so start clean each time
+                        chat.History = append([]*genai.Content(nil), history...)
+                        var genErr error
+                        resp, genErr = chat.SendMessage(ctx, genai.Text(correction))
+                        if genErr == nil {
+                                recordGeminiUsage(ctx, modelID, resp)
+                        }
+                        return genErr
+                })
+                if err := checkGenerateResult(resp, err); err != nil {
+                        return "", err
+                }
+                history = append(history, genai.NewUserContent(genai.Text(correction)))
+                return candidateText(resp), nil
+        })
+}
+
+// uploadToGemini sends the file through the Files API and waits until Gemini has
+// processed it. The caller deletes the uploaded file when done.
+func uploadToGemini(ctx context.Context, client *genai.Client, f *os.File, path string) (*genai.File, error) {
+        var upFile *genai.File
+        err := withRetry(ctx, "upload", func() error {
+                // Rewind in case a rate-limited attempt already consumed the reader
+                if _, err := f.Seek(0, io.SeekStart); err != nil {
+                        return err
+                }
+                var uploadErr error
+                // The type comes from the content, since the name may have no extension
+                upFile, uploadErr = client.UploadFile(ctx, "", f, &genai.UploadFileOptions{MIMEType: mediaType(path)})
+                return uploadErr
+        })
         if err != nil {
                 return nil, fmt.Errorf("upload failed: %w", err)
         }
-        defer client.DeleteFile(ctx, upFile.Name)
 
         // Wait for processing
         for upFile.State == genai.FileStateProcessing {
                 time.Sleep(1 * time.Second)
-                upFile, err = client.GetFile(ctx, upFile.Name)
+                err = withRetry(ctx, "status check", func() error {
+                        var getErr error
+                        upFile, getErr = client.GetFile(ctx, upFile.Name)
+                        return getErr
+                })
                 if err != nil {
                         return nil, fmt.Errorf("check failed state: %w", err)
                 }
@@ -213,133 +1821,368 @@ func analyzeReceipt(ctx context.Context, client *genai.Client, path string) ([]R
         if upFile.State != genai.FileStateActive {
                 return nil, fmt.Errorf("file processing failed state: %s", upFile.State)
         }
+        return upFile, nil
+}
 
-        // Generate
-        prompt := `Analyze this Japanese receipt or certificate. Extract JSON with these keys:
-    "date" (YYYY-MM-DD),
-    "vendor" (Japanese name, if medical use clinic name),
-    "category" (Medical, Grocery, Tax, Utilities, Septic, Other),
-    "total_amount" (integer).`
-
-        resp, err := model.GenerateContent(ctx, genai.FileData{URI: upFile.URI}, genai.Text(prompt))
-        if err != nil {
-                return nil, fmt.Errorf("gemini generate error: %w", err)
-        }
-
-        if len(resp.Candidates) == 0 || len(resp.Candidates[0].Content.Parts) == 0 {
-                return nil, fmt.Errorf("empty response from model")
-        }
-
-        var jsonText string
-        if txt, ok := resp.Candidates[0].Content.Parts[0].(genai.Text); ok {
-                jsonText = string(txt)
+// parseReceiptResponse finds the receipt JSON in the model's answer, tolerating code
+// fences, commentary around it, and small syntax slips (see repairJSON)
+func parseReceiptResponse(text string) ([]ReceiptData, error) {
+        for _, candidate := range jsonCandidates(text) {
+                if dataList, ok := decodeReceipts(candidate); ok {
+                        return dataList, nil
+                }
+                if dataList, ok := decodeReceipts(repairJSON(candidate)); ok {
+                        slog.Debug("Repaired malformed JSON from the model", "json", candidate)
+                        return dataList, nil
+                }
         }
 
-        return parseGeminiResponse(jsonText)
+        return nil, fmt.Errorf("failed to parse JSON as object or array")
 }
 
-func parseGeminiResponse(jsonText string) ([]ReceiptData, error) {
+func decodeReceipts(jsonText string) ([]ReceiptData, bool) {
         var dataList []ReceiptData
         var single ReceiptData
 
         // Attempt 1: Single Object
         if err := json.Unmarshal([]byte(jsonText), &single); err == nil {
                 dataList = append(dataList, single)
-                return dataList, nil
+                return dataList, true
         }
 
         // Attempt 2: Array of Objects
         var list []ReceiptData
         if err := json.Unmarshal([]byte(jsonText), &list); err == nil {
-                return list, nil
+                return list, true
         }
 
-        return nil, fmt.Errorf("failed to parse JSON as object or array")
+        return nil, false
+}
+
+// normalizeReceipt cleans up the model's answers before a receipt is filed
+func normalizeReceipt(data ReceiptData) ReceiptData {
+        data.Date = normalizeDate(data.Date)
+        data.Vendor = normalizeVendor(data.Vendor)
+        data.Category = normalizeCategory(data.Category)
+        data.Currency = normalizeCurrency(data.Currency)
+        data.Amount = data.Amount.Round(currencyScale(data.Currency))
+        data.RegistrationNumber = normalizeRegistrationNumber(data.RegistrationNumber)
+        data.PaymentMethod = normalizePaymentMethod(data.PaymentMethod)
+        data.MedicalType = normalizeMedicalType(data.MedicalType)
+        return data
 }
 
-func saveAndArchive(srcPath string, dataList []ReceiptData) {
+// saveAndArchive files every receipt from the matching entry of contents and archives the
+// original, returning the processed paths
+func saveAndArchive(srcPath string, contents []string, dataList []ReceiptData) ([]string, error) {
+        var processedPaths []string
         successCount := 0
-        for _, data := range dataList {
-                if err := saveProcessedFile(srcPath, data); err != nil {
-                        log.Printf("Failed to save processed file: %v", err)
-                } else {
-                        successCount++
+        failCount := 0
+        for i, data := range dataList {
+                data = normalizeReceipt(data)
+
+                processedPath, err := fileReceipt(srcPath, contents[i], data, processedPaths)
+                pipelineEvents.publish(pipelineEvent{Kind: eventSave, Source: srcPath, Path: processedPath, Err: err, DryRun: dryRun, Receipt: &data})
+                if err != nil {
+                        slog.Error("Failed to save processed file", "event", "save", "source", srcPath, "vendor", data.Vendor, "amount", data.Amount, "currency", data.Currency, "error", err)
+                        failCount++
+                        continue
+                }
+                successCount++
+                processedPaths = append(processedPaths, processedPath)
+
+                if receiptDB != nil {
+                        if err := receiptDB.InsertReceipt(data, srcPath, processedPath); err != nil {
+                                slog.Error("Failed to record receipt in database", "path", processedPath, "error", err)
+                        }
+                }
+
+                if ledgerPath != "" && !dryRun {
+                        if err := appendLedger(ledgerPath, data, srcPath, processedPath); err != nil {
+                                slog.Error("Failed to add receipt to ledger", "path", processedPath, "error", err)
+                        }
+                }
+
+                if sheets != nil && !dryRun {
+                        appendSheetRow(data, srcPath, processedPath)
+                }
+
+                if webhookURL != "" && !dryRun {
+                        notifyWebhook(data, processedPath)
+                }
+                if !dryRun {
+                        notifyChatReceipt(data, srcPath, processedPath)
                 }
         }
 
-        if successCount > 0 {
-                archiveOriginalFile(srcPath)
-        } else {
-                log.Printf("No receipts saved, skipping archive for %s", srcPath)
+        if successCount == 0 {
+                slog.Error("No receipts saved, skipping archive", "event", "archive", "path", srcPath)
+                err := fmt.Errorf("no receipts saved")
+                pipelineEvents.publish(pipelineEvent{Kind: eventArchive, Source: srcPath, Err: err})
+                return nil, err
+        }
+
+        // Only give up the original once every processed copy is known to be good
+        if failCount > 0 {
+                slog.Error("Some receipts failed to save, keeping original in place", "event", "archive", "path", srcPath, "failed", failCount, "receipts", len(dataList))
+                err := fmt.Errorf("%d receipts failed to save", failCount)
+                pipelineEvents.publish(pipelineEvent{Kind: eventArchive, Source: srcPath, Err: err})
+                return processedPaths, err
         }
+
+        archived, err := archiveOriginalFile(srcPath)
+        pipelineEvents.publish(pipelineEvent{Kind: eventArchive, Source: srcPath, Path: archived, Err: err, DryRun: dryRun})
+        return processedPaths, err
 }
 
-func saveProcessedFile(srcPath string, data ReceiptData) error {
-        vendor := strings.ReplaceAll(data.Vendor, " ", "")
-        vendor = strings.ReplaceAll(vendor, "/", "-")
+// fileReceipt saves the processed copy under -dest or in the -storage backend and sends
+// it to Paperless with -paperless-url, or only sends it with -paperless-only, in which
+// case the document URL stands in for the processed path. A receipt Paperless did not
+// take counts as not saved.
+func fileReceipt(srcPath, content string, data ReceiptData, taken []string) (string, error) {
+        if paperlessOnly {
+                return sendToPaperless(srcPath, content, data)
+        }
+        var processedPath string
+        var err error
+        if storage != nil {
+                processedPath, err = storeReceipt(srcPath, content, data)
+        } else {
+                processedPath, err = saveProcessedFile(srcPath, content, data, taken)
+        }
+        if err != nil || paperless == nil {
+                return processedPath, err
+        }
+        if _, err := sendToPaperless(srcPath, content, data); err != nil {
+                return "", err
+        }
+        return processedPath, nil
+}
 
-        if data.Date == "" {
-                data.Date = time.Now().Format("2006-01-02")
+// saveProcessedFile copies the scan to its processed name. content is the file that was
+// analyzed: srcPath itself, its JPEG or PDF conversion, or one page or crop of it. taken lists the paths already
+// used by other receipts from the same scan.
+func saveProcessedFile(srcPath, content string, data ReceiptData, taken []string) (string, error) {
+        rel, err := processedRelPath(content, data)
+        if err != nil {
+                return "", err
         }
-        if data.Category == "" {
-                data.Category = "Unsorted"
+        processedPath, err := availablePath(filepath.Join(destFor(srcPath), rel), content, taken)
+        if err != nil {
+                return "", err
         }
+        processedDir := filepath.Dir(processedPath)
 
-        processedFileName := fmt.Sprintf("%s_%s_%d円%s", data.Date, vendor, data.Amount, filepath.Ext(srcPath))
-        processedDir := filepath.Join(destDir, data.Category)
-        processedPath := filepath.Join(processedDir, processedFileName)
+        if dryRun {
+                slog.Info("[dry-run] Would save processed file", "event", "save", "dry_run", true, "path", processedPath, "source", srcPath, "date", data.Date, "vendor", data.Vendor, "category", data.Category, "amount", data.Amount, "currency", data.Currency)
+                return processedPath, nil
+        }
 
         if err := os.MkdirAll(processedDir, 0755); err != nil {
-                return fmt.Errorf("failed to create directory %s: %w", processedDir, err)
+                return "", fmt.Errorf("failed to create directory %s: %w", processedDir, err)
         }
 
-        if err := robustCopy(srcPath, processedPath); err != nil {
-                return fmt.Errorf("failed to copy to processed folder: %w", err)
+        if err := robustCopy(content, processedPath); err != nil {
+                return "", fmt.Errorf("failed to copy to processed folder: %w", err)
         }
+        finishProcessedFile(processedPath, srcPath, data)
 
-        log.Printf("Saved processed file: %s", processedPath)
-        return nil
+        slog.Info("Saved processed file", "event", "save", "path", processedPath, "source", srcPath, "date", data.Date, "vendor", data.Vendor, "category", data.Category, "amount", data.Amount, "currency", data.Currency)
+        return processedPath, nil
+}
+
+// finishProcessedFile embeds metadata and the marker into a processed copy and writes its
+// sidecar, as configured. Failures are only logged; the copy itself is good.
+func finishProcessedFile(processedPath, srcPath string, data ReceiptData) {
+        // Before the marker, so the marker stays near the end of PNG and PDF files where it is looked for
+        if embedMeta {
+                if err := embedMetadata(processedPath, data); err != nil {
+                        slog.Warn("Failed to embed metadata", "path", processedPath, "error", err)
+                }
+        }
+
+        if embedMarker {
+                if err := embedProcessedMarker(processedPath); err != nil {
+                        slog.Warn("Failed to embed marker", "path", processedPath, "error", err)
+                }
+        }
+
+        if writeSidecars {
+                if err := writeSidecar(processedPath, srcPath, data); err != nil {
+                        slog.Warn("Failed to write sidecar", "path", processedPath, "error", err)
+                }
+        }
 }
 
-func archiveOriginalFile(srcPath string) {
-        originalsDir := filepath.Join(destDir, "originals")
+// archiveOriginalFile moves the original out of the watch directory into originals/, the
+// -storage backend, or the -archive-s3 bucket, returning where it went
+func archiveOriginalFile(srcPath string) (string, error) {
+        if originalsArchive != nil {
+                return archiveToS3(srcPath)
+        }
+        if storage != nil {
+                return storeOriginal(srcPath)
+        }
+
+        originalsDir := filepath.Join(destFor(srcPath), "originals")
         originalName := filepath.Base(srcPath)
-        originalsPath := filepath.Join(originalsDir, originalName)
+        // Scanners restart their numbering, so a different scan0001.jpg may already be archived
+        originalsPath, err := availablePath(filepath.Join(originalsDir, originalName), srcPath, nil)
+        if err != nil {
+                slog.Error("Failed to archive original", "event", "archive", "source", srcPath, "error", err)
+                return "", err
+        }
+
+        if dryRun {
+                slog.Info("[dry-run] Would archive original", "event", "archive", "dry_run", true, "path", originalsPath, "source", srcPath)
+                return originalsPath, nil
+        }
 
         if err := os.MkdirAll(originalsDir, 0755); err != nil {
-                log.Printf("Failed to create originals directory: %v", err)
-                return
+                slog.Error("Failed to create originals directory", "event", "archive", "path", originalsDir, "error", err)
+                return "", err
         }
 
         if err := robustMove(srcPath, originalsPath); err != nil {
-                log.Printf("Failed to move to originals: %v", err)
-        } else {
-                log.Printf("Archived original to: %s", originalsPath)
+                slog.Error("Failed to move to originals", "event", "archive", "path", originalsPath, "source", srcPath, "error", err)
+                return "", err
+        }
+
+        slog.Info("Archived original", "event", "archive", "path", originalsPath, "source", srcPath)
+        return originalsPath, nil
+}
+
+// quarantineFile moves a file that could not be analyzed into dest/failed
+// and writes a .error.txt sidecar explaining why
+func quarantineFile(srcPath string, reason error) {
+        if noQuarantine {
+                return
+        }
+
+        failedDir := filepath.Join(destFor(srcPath), "failed")
+        failedPath, err := availablePath(filepath.Join(failedDir, filepath.Base(srcPath)), srcPath, nil)
+        if err != nil {
+                slog.Error("Failed to quarantine file", "event", "quarantine", "source", srcPath, "error", err)
+                pipelineEvents.publish(pipelineEvent{Kind: eventQuarantine, Source: srcPath, Err: err})
+                return
+        }
+        errorPath := failedPath + errorReportSuffix
+
+        if dryRun {
+                slog.Info("[dry-run] Would quarantine file", "event", "quarantine", "dry_run", true, "path", failedPath, "source", srcPath, "error", reason)
+                pipelineEvents.publish(pipelineEvent{Kind: eventQuarantine, Source: srcPath, Path: failedPath, Err: reason, DryRun: true})
+                return
+        }
+
+        if err := os.MkdirAll(failedDir, 0755); err != nil {
+                slog.Error("Failed to create failed directory", "event", "quarantine", "path", failedDir, "error", err)
+                pipelineEvents.publish(pipelineEvent{Kind: eventQuarantine, Source: srcPath, Err: err})
+                return
+        }
+
+        if err := robustMove(srcPath, failedPath); err != nil {
+                slog.Error("Failed to move file to quarantine", "event", "quarantine", "source", srcPath, "error", err)
+                pipelineEvents.publish(pipelineEvent{Kind: eventQuarantine, Source: srcPath, Err: err})
+                return
         }
+
+        report := fmt.Sprintf("file: %s\ntime: %s\nerror: %v\n", srcPath, time.Now().Format(time.RFC3339), reason)
+        if err := os.WriteFile(errorPath, []byte(report), 0644); err != nil {
+                slog.Error("Failed to write error report", "event", "quarantine", "path", errorPath, "error", err)
+        }
+
+        slog.Warn("Quarantined file", "event", "quarantine", "path", failedPath, "source", srcPath, "error", reason)
+        pipelineEvents.publish(pipelineEvent{Kind: eventQuarantine, Source: srcPath, Path: failedPath, Err: reason})
+        notifyChatError(srcPath, failedPath, reason)
+        notifyPush(pushAlert{
+                Title:   "Receipt failed: " + filepath.Base(srcPath),
+                Message: reason.Error(),
+                Link:    fileLink(srcPath, failedPath),
+                Urgent:  true,
+        }, failedPath)
 }
 
-// robustCopy performs a simple copy of the file content
+// robustCopy copies the file content to a hidden temp file next to dst, syncs and verifies
+// it against the source, then renames it into place. A crash or a mismatched copy leaves
+// at most a .tmp file, never a truncated file under the final name.
 func robustCopy(src, dst string) error {
         sourceFile, err := os.Open(src)
         if err != nil { return err }
         defer sourceFile.Close()
 
-        destFile, err := os.Create(dst)
+        destFile, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".*.tmp")
+        if err != nil { return err }
+        tmpPath := destFile.Name()
+        defer os.Remove(tmpPath)
+
+        err = destFile.Chmod(0644)
+        if err == nil {
+                _, err = io.Copy(destFile, sourceFile)
+        }
+        if err == nil {
+                err = destFile.Sync()
+        }
+        if closeErr := destFile.Close(); err == nil {
+                err = closeErr
+        }
+        if err == nil {
+                err = verifyCopy(src, tmpPath)
+        }
+        if err != nil {
+                return err
+        }
+
+        if err := os.Rename(tmpPath, dst); err != nil {
+                return err
+        }
+        syncDir(filepath.Dir(dst))
+        return nil
+}
+
+// syncDir flushes a directory entry after a rename so the new name survives a power loss.
+// It is best effort: some platforms cannot open or sync directories.
+func syncDir(dir string) {
+        d, err := os.Open(dir)
+        if err != nil {
+                return
+        }
+        d.Sync()
+        d.Close()
+}
+
+// verifyCopy compares size and SHA-256 of the source and destination
+func verifyCopy(src, dst string) error {
+        srcInfo, err := os.Stat(src)
+        if err != nil { return err }
+        dstInfo, err := os.Stat(dst)
+        if err != nil { return err }
+
+        if srcInfo.Size() != dstInfo.Size() {
+                return fmt.Errorf("copy verification failed: %s is %d bytes, expected %d", dst, dstInfo.Size(), srcInfo.Size())
+        }
+
+        srcHash, err := fileSHA256(src)
+        if err != nil { return err }
+        dstHash, err := fileSHA256(dst)
         if err != nil { return err }
-        defer destFile.Close()
 
-        _, err = io.Copy(destFile, sourceFile)
-        return err
+        if srcHash != dstHash {
+                return fmt.Errorf("copy verification failed: checksum mismatch for %s", dst)
+        }
+        return nil
 }
 
+// renameFile is the rename robustMove tries first; tests replace it to fail across devices
+var renameFile = os.Rename
+
 // robustMove tries atomic rename first, then falls back to Copy+Delete
 func robustMove(src, dst string) error {
         // Try atomic rename
-        err := os.Rename(src, dst)
+        err := renameFile(src, dst)
         if err == nil { return nil }
 
         // If error is NOT cross-device, fail
-        if !strings.Contains(err.Error(), "cross-device link") {
+        if !isCrossDevice(err) {
                 return err
         }
 
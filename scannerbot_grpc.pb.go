@@ -0,0 +1,291 @@
+// The gRPC service served with -grpc-addr. It mirrors the JSON API of -api-addr and
+// adds a stream of pipeline events. Regenerate the Go code with `go generate` after
+// changing it.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: scannerbot.proto
+
+package main
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	ScannerBot_ListReceipts_FullMethodName  = "/scannerbot.v1.ScannerBot/ListReceipts"
+	ScannerBot_GetReceipt_FullMethodName    = "/scannerbot.v1.ScannerBot/GetReceipt"
+	ScannerBot_UpdateReceipt_FullMethodName = "/scannerbot.v1.ScannerBot/UpdateReceipt"
+	ScannerBot_GetStats_FullMethodName      = "/scannerbot.v1.ScannerBot/GetStats"
+	ScannerBot_WatchEvents_FullMethodName   = "/scannerbot.v1.ScannerBot/WatchEvents"
+)
+
+// ScannerBotClient is the client API for ScannerBot service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ScannerBotClient interface {
+	// ListReceipts lists receipts, newest first, like GET /receipts
+	ListReceipts(ctx context.Context, in *ListReceiptsRequest, opts ...grpc.CallOption) (*ListReceiptsResponse, error)
+	// GetReceipt returns one receipt with every field in its sidecar, like GET /receipts/{id}
+	GetReceipt(ctx context.Context, in *GetReceiptRequest, opts ...grpc.CallOption) (*Receipt, error)
+	// UpdateReceipt corrects a receipt and re-files it, like PATCH /receipts/{id}
+	UpdateReceipt(ctx context.Context, in *UpdateReceiptRequest, opts ...grpc.CallOption) (*Receipt, error)
+	// GetStats totals receipts per category and month, like GET /stats
+	GetStats(ctx context.Context, in *GetStatsRequest, opts ...grpc.CallOption) (*GetStatsResponse, error)
+	// WatchEvents streams pipeline events as they happen, until the client cancels
+	WatchEvents(ctx context.Context, in *WatchEventsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[PipelineEvent], error)
+}
+
+type scannerBotClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewScannerBotClient(cc grpc.ClientConnInterface) ScannerBotClient {
+	return &scannerBotClient{cc}
+}
+
+func (c *scannerBotClient) ListReceipts(ctx context.Context, in *ListReceiptsRequest, opts ...grpc.CallOption) (*ListReceiptsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListReceiptsResponse)
+	err := c.cc.Invoke(ctx, ScannerBot_ListReceipts_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *scannerBotClient) GetReceipt(ctx context.Context, in *GetReceiptRequest, opts ...grpc.CallOption) (*Receipt, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Receipt)
+	err := c.cc.Invoke(ctx, ScannerBot_GetReceipt_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *scannerBotClient) UpdateReceipt(ctx context.Context, in *UpdateReceiptRequest, opts ...grpc.CallOption) (*Receipt, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Receipt)
+	err := c.cc.Invoke(ctx, ScannerBot_UpdateReceipt_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *scannerBotClient) GetStats(ctx context.Context, in *GetStatsRequest, opts ...grpc.CallOption) (*GetStatsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetStatsResponse)
+	err := c.cc.Invoke(ctx, ScannerBot_GetStats_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *scannerBotClient) WatchEvents(ctx context.Context, in *WatchEventsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[PipelineEvent], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &ScannerBot_ServiceDesc.Streams[0], ScannerBot_WatchEvents_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WatchEventsRequest, PipelineEvent]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ScannerBot_WatchEventsClient = grpc.ServerStreamingClient[PipelineEvent]
+
+// ScannerBotServer is the server API for ScannerBot service.
+// All implementations must embed UnimplementedScannerBotServer
+// for forward compatibility.
+type ScannerBotServer interface {
+	// ListReceipts lists receipts, newest first, like GET /receipts
+	ListReceipts(context.Context, *ListReceiptsRequest) (*ListReceiptsResponse, error)
+	// GetReceipt returns one receipt with every field in its sidecar, like GET /receipts/{id}
+	GetReceipt(context.Context, *GetReceiptRequest) (*Receipt, error)
+	// UpdateReceipt corrects a receipt and re-files it, like PATCH /receipts/{id}
+	UpdateReceipt(context.Context, *UpdateReceiptRequest) (*Receipt, error)
+	// GetStats totals receipts per category and month, like GET /stats
+	GetStats(context.Context, *GetStatsRequest) (*GetStatsResponse, error)
+	// WatchEvents streams pipeline events as they happen, until the client cancels
+	WatchEvents(*WatchEventsRequest, grpc.ServerStreamingServer[PipelineEvent]) error
+	mustEmbedUnimplementedScannerBotServer()
+}
+
+// UnimplementedScannerBotServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedScannerBotServer struct{}
+
+func (UnimplementedScannerBotServer) ListReceipts(context.Context, *ListReceiptsRequest) (*ListReceiptsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListReceipts not implemented")
+}
+func (UnimplementedScannerBotServer) GetReceipt(context.Context, *GetReceiptRequest) (*Receipt, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetReceipt not implemented")
+}
+func (UnimplementedScannerBotServer) UpdateReceipt(context.Context, *UpdateReceiptRequest) (*Receipt, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateReceipt not implemented")
+}
+func (UnimplementedScannerBotServer) GetStats(context.Context, *GetStatsRequest) (*GetStatsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetStats not implemented")
+}
+func (UnimplementedScannerBotServer) WatchEvents(*WatchEventsRequest, grpc.ServerStreamingServer[PipelineEvent]) error {
+	return status.Errorf(codes.Unimplemented, "method WatchEvents not implemented")
+}
+func (UnimplementedScannerBotServer) mustEmbedUnimplementedScannerBotServer() {}
+func (UnimplementedScannerBotServer) testEmbeddedByValue()                    {}
+
+// UnsafeScannerBotServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ScannerBotServer will
+// result in compilation errors.
+type UnsafeScannerBotServer interface {
+	mustEmbedUnimplementedScannerBotServer()
+}
+
+func RegisterScannerBotServer(s grpc.ServiceRegistrar, srv ScannerBotServer) {
+	// If the following call pancis, it indicates UnimplementedScannerBotServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&ScannerBot_ServiceDesc, srv)
+}
+
+func _ScannerBot_ListReceipts_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListReceiptsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ScannerBotServer).ListReceipts(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ScannerBot_ListReceipts_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ScannerBotServer).ListReceipts(ctx, req.(*ListReceiptsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ScannerBot_GetReceipt_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetReceiptRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ScannerBotServer).GetReceipt(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ScannerBot_GetReceipt_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ScannerBotServer).GetReceipt(ctx, req.(*GetReceiptRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ScannerBot_UpdateReceipt_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateReceiptRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ScannerBotServer).UpdateReceipt(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ScannerBot_UpdateReceipt_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ScannerBotServer).UpdateReceipt(ctx, req.(*UpdateReceiptRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ScannerBot_GetStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetStatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ScannerBotServer).GetStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ScannerBot_GetStats_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ScannerBotServer).GetStats(ctx, req.(*GetStatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ScannerBot_WatchEvents_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchEventsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ScannerBotServer).WatchEvents(m, &grpc.GenericServerStream[WatchEventsRequest, PipelineEvent]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ScannerBot_WatchEventsServer = grpc.ServerStreamingServer[PipelineEvent]
+
+// ScannerBot_ServiceDesc is the grpc.ServiceDesc for ScannerBot service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ScannerBot_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "scannerbot.v1.ScannerBot",
+	HandlerType: (*ScannerBotServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListReceipts",
+			Handler:    _ScannerBot_ListReceipts_Handler,
+		},
+		{
+			MethodName: "GetReceipt",
+			Handler:    _ScannerBot_GetReceipt_Handler,
+		},
+		{
+			MethodName: "UpdateReceipt",
+			Handler:    _ScannerBot_UpdateReceipt_Handler,
+		},
+		{
+			MethodName: "GetStats",
+			Handler:    _ScannerBot_GetStats_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchEvents",
+			Handler:       _ScannerBot_WatchEvents_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "scannerbot.proto",
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+        "context"
+        "fmt"
+        "log/slog"
+        "net/url"
+        "os"
+        "strings"
+        "sync"
+)
+
+// sheetsAPI is the Google Sheets endpoint used by -sheet-id
+const sheetsAPI = "https://sheets.googleapis.com/v4/spreadsheets/"
+
+var sheetHeader = []string{"Date", "Vendor", "Category", "Amount", "Currency", "Link"}
+
+// sheetLedger appends receipts to a Google Sheet with an OAuth refresh token that has
+// the spreadsheets scope. The header row is written first when the sheet is empty.
+type sheetLedger struct {
+        auth          *oauthToken
+        spreadsheetID string
+        sheet         string
+
+        mu            sync.Mutex
+        headerChecked bool
+}
+
+// sheets is set up in main when -sheet-id is given
+var sheets *sheetLedger
+
+func newSheetLedger(spreadsheetID, sheet string) (*sheetLedger, error) {
+        clientID, secret, refresh := os.Getenv("SHEETS_CLIENT_ID"), os.Getenv("SHEETS_CLIENT_SECRET"), os.Getenv("SHEETS_REFRESH_TOKEN")
+        if clientID == "" || secret == "" || refresh == "" {
+                return nil, fmt.Errorf("-sheet-id requires the SHEETS_CLIENT_ID, SHEETS_CLIENT_SECRET, and SHEETS_REFRESH_TOKEN environment variables")
+        }
+        return &sheetLedger{
+                auth:          newOAuthToken("Google Sheets", googleTokenURL, clientID, secret, refresh),
+                spreadsheetID: spreadsheetID,
+                sheet:         sheet,
+        }, nil
+}
+
+// appendSheetRow adds the receipt to -sheet-id in the background. Failures are logged
+// and never affect processing; the CSV ledger and database are the records to rebuild from.
+func appendSheetRow(data ReceiptData, srcPath, processedPath string) {
+        link := fileLink(srcPath, processedPath)
+        if link == "" {
+                link = processedPath
+        }
+        row := []string{data.Date, sheetText(data.Vendor), sheetText(data.Category), data.Amount.String(), data.Currency, sheetText(link)}
+
+        pendingNotifications.Add(1)
+        go func() {
+                defer pendingNotifications.Done()
+                if err := sheets.Append(context.Background(), row); err != nil {
+                        slog.Warn("Failed to add receipt to Google Sheet", "event", "ledger", "path", processedPath, "error", err)
+                }
+        }()
+}
+
+// Append adds one row below the last row of the sheet. Values are entered as if typed,
+// so dates and amounts become dates and numbers the sheet can sum.
+func (s *sheetLedger) Append(ctx context.Context, row []string) error {
+        token, err := s.auth.Token(ctx)
+        if err != nil {
+                return err
+        }
+        headers := map[string]string{"Authorization": "Bearer " + token}
+        base := sheetsAPI + url.PathEscape(s.spreadsheetID) + "/values/"
+
+        rows := [][]string{row}
+        s.mu.Lock()
+        if !s.headerChecked {
+                var first struct {
+                        Values [][]string `json:"values"`
+                }
+                if err := getJSON(ctx, base+url.PathEscape(s.cells("A1:F1")), headers, &first); err != nil {
+                        s.mu.Unlock()
+                        return fmt.Errorf("failed to read sheet %s: %w", s.sheet, err)
+                }
+                if len(first.Values) == 0 {
+                        rows = [][]string{sheetHeader, row}
+                }
+                s.headerChecked = true
+        }
+        s.mu.Unlock()
+
+        query := url.Values{"valueInputOption": {"USER_ENTERED"}, "insertDataOption": {"INSERT_ROWS"}}
+        var resp struct{}
+        if err := postJSON(ctx, base+url.PathEscape(s.cells("A:F"))+":append?"+query.Encode(), headers, map[string]any{"values": rows}, &resp); err != nil {
+                return fmt.Errorf("failed to append to sheet %s: %w", s.sheet, err)
+        }
+        return nil
+}
+
+// cells is an A1 range on the sheet, quoting the tab name as names with spaces need
+func (s *sheetLedger) cells(a1 string) string {
+        return "'" + strings.ReplaceAll(s.sheet, "'", "''") + "'!" + a1
+}
+
+// sheetText keeps extracted text from being entered as a formula
+func sheetText(s string) string {
+        if s != "" && strings.ContainsRune("=+-@", rune(s[0])) {
+                return "'" + s
+        }
+        return s
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+        "encoding/json"
+        "os"
+        "path/filepath"
+        "time"
+)
+
+// Sidecar is the full extraction written next to a processed file as <file>.json
+type Sidecar struct {
+        ReceiptData
+        SourceFile       string `json:"source_file"`
+        SourceSHA256     string `json:"source_sha256,omitempty"`
+        SourceModifiedAt string `json:"source_modified_at,omitempty"`
+        ProcessedAt      string `json:"processed_at"`
+        Provider         string `json:"provider,omitempty"`
+        Model            string `json:"model"`
+        PromptVersion    string `json:"prompt_version,omitempty"`
+
+        // History keeps the values replaced by each reprocess, oldest first
+        History []SidecarRevision `json:"history,omitempty"`
+}
+
+// SidecarRevision is an earlier extraction of a receipt and where it was filed then
+type SidecarRevision struct {
+        ReceiptData
+        ProcessedPath string `json:"processed_path"`
+        ProcessedAt   string `json:"processed_at,omitempty"`
+        Provider      string `json:"provider,omitempty"`
+        Model         string `json:"model,omitempty"`
+        PromptVersion string `json:"prompt_version,omitempty"`
+        ReplacedAt    string `json:"replaced_at"`
+}
+
+func sidecarPath(processedPath string) string {
+        return processedPath + ".json"
+}
+
+// writeSidecar atomically writes the sidecar so a crash never leaves partial JSON
+func writeSidecar(processedPath, srcPath string, data ReceiptData) error {
+        return saveSidecar(processedPath, newSidecar(srcPath, data))
+}
+
+// newSidecar describes a receipt analyzed from srcPath
+func newSidecar(srcPath string, data ReceiptData) Sidecar {
+        sidecar := Sidecar{
+                ReceiptData: data,
+                SourceFile:  filepath.Base(srcPath),
+                ProcessedAt: time.Now().Format(time.RFC3339),
+                Provider:    data.Backend.Provider,
+                Model:       data.Backend.Model,
+        }
+
+        // The original is still in place; it is archived only after every copy is saved
+        if hash, err := fileSHA256(srcPath); err == nil {
+                sidecar.SourceSHA256 = hash
+        }
+        if info, err := os.Stat(srcPath); err == nil {
+                sidecar.SourceModifiedAt = info.ModTime().Format(time.RFC3339)
+        }
+        if version, err := promptVersion(); err == nil {
+                sidecar.PromptVersion = version
+        }
+        return sidecar
+}
+
+func saveSidecar(processedPath string, sidecar Sidecar) error {
+        content, err := json.MarshalIndent(sidecar, "", "  ")
+        if err != nil {
+                return err
+        }
+        return writeFileAtomic(sidecarPath(processedPath), content)
+}
+
+// readSidecar loads the sidecar for a processed file, if there is one
+func readSidecar(processedPath string) (Sidecar, bool) {
+        var sidecar Sidecar
+
+        content, err := os.ReadFile(sidecarPath(processedPath))
+        if err != nil {
+                return sidecar, false
+        }
+        if err := json.Unmarshal(content, &sidecar); err != nil {
+                return sidecar, false
+        }
+        return sidecar, true
+}
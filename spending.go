@@ -0,0 +1,335 @@
+package main
+
+import (
+        "encoding/csv"
+        "fmt"
+        "html/template"
+        "io"
+        "log/slog"
+        "os"
+        "path/filepath"
+        "sort"
+        "strconv"
+        "strings"
+        "text/tabwriter"
+        "time"
+)
+
+// spendingFormats are the output formats of -spending-report
+var spendingFormats = []string{"text", "csv", "html"}
+
+// spendingPeriod is the month or year a spending report covers, and the one it is
+// compared against
+type spendingPeriod struct {
+        Label     string
+        PrevLabel string
+        Start     time.Time
+        End       time.Time
+        PrevStart time.Time
+        Year      bool
+}
+
+// parseSpendingPeriod reads -spending-report: "2024-05" or "month" for a month (the
+// current one), "2024" or "year" for a calendar year
+func parseSpendingPeriod(value string, now time.Time) (spendingPeriod, bool) {
+        switch value {
+        case "month":
+                value = now.Format("2006-01")
+        case "year":
+                value = now.Format("2006")
+        }
+
+        if start, err := time.Parse("2006-01", value); err == nil {
+                prev := start.AddDate(0, -1, 0)
+                return spendingPeriod{Label: value, PrevLabel: prev.Format("2006-01"), Start: start, End: start.AddDate(0, 1, 0), PrevStart: prev}, true
+        }
+        if start, err := time.Parse("2006", value); err == nil {
+                prev := start.AddDate(-1, 0, 0)
+                return spendingPeriod{Label: value, PrevLabel: prev.Format("2006"), Start: start, End: start.AddDate(1, 0, 0), PrevStart: prev, Year: true}, true
+        }
+        return spendingPeriod{}, false
+}
+
+// loadSpendingReceipts reads the receipts dated in the period and the one before it from
+// -db when it is set, and otherwise recovers them from the files filed under -dest
+func loadSpendingReceipts(period spendingPeriod) ([]ReceiptData, error) {
+        if dbPath != "" {
+                db, err := openReceiptDB(dbPath)
+                if err != nil {
+                        return nil, err
+                }
+                defer db.Close()
+                return db.ReceiptsBetween(period.PrevStart, period.End)
+        }
+
+        filed, err := collectFiledReceipts(destDir)
+        if err != nil {
+                return nil, fmt.Errorf("failed to scan %s: %w", destDir, err)
+        }
+        receipts := make([]ReceiptData, len(filed))
+        for i, receipt := range filed {
+                receipts[i] = receipt.ReceiptData
+        }
+        return receipts, nil
+}
+
+// writeSpendingReport writes the report in -spending-format to -spending-out, or to
+// standard output
+func writeSpendingReport(report SpendingReport, format, outPath string) error {
+        write := writeSpendingText
+        switch format {
+        case "csv":
+                write = writeSpendingCSV
+        case "html":
+                write = writeSpendingHTML
+        }
+        if outPath == "" {
+                return write(os.Stdout, report)
+        }
+
+        if dryRun {
+                slog.Info("[dry-run] Would write spending report", "event", "report", "dry_run", true, "path", outPath, "receipts", report.Total.Count)
+                return nil
+        }
+        if dir := filepath.Dir(outPath); dir != "." {
+                if err := os.MkdirAll(dir, 0755); err != nil {
+                        return fmt.Errorf("failed to create directory %s: %w", dir, err)
+                }
+        }
+        f, err := os.Create(outPath)
+        if err != nil {
+                return fmt.Errorf("failed to create report: %w", err)
+        }
+        defer f.Close()
+        if err := write(f, report); err != nil {
+                return fmt.Errorf("failed to write report: %w", err)
+        }
+        slog.Info("Wrote spending report", "event", "report", "path", outPath, "receipts", report.Total.Count)
+        return nil
+}
+
+// SpendingLine is the spend on one category, vendor, or month, next to the same in the
+// previous period (or, for months, the previous month)
+type SpendingLine struct {
+        Name     string
+        Count    int
+        Total    Decimal
+        Previous Decimal
+}
+
+// Change is the percentage change from the previous period, "new" when nothing was spent then
+func (l SpendingLine) Change() string {
+        return changeLabel(l.Total, l.Previous)
+}
+
+// SpendingReport totals spending in -default-currency for a period. Receipts in other
+// currencies are totalled separately, since they cannot be added together.
+type SpendingReport struct {
+        Period     string
+        Previous   string
+        Currency   string
+        Total      SpendingLine
+        Categories []SpendingLine
+        Vendors    []SpendingLine
+        Months     []SpendingLine
+        Other      map[string]Decimal
+}
+
+func changeLabel(total, previous Decimal) string {
+        switch {
+        case previous.IsZero() && total.IsZero():
+                return ""
+        case previous.IsZero():
+                return "new"
+        }
+        return fmt.Sprintf("%+.1f%%", (total.Float64()-previous.Float64())/previous.Float64()*100)
+}
+
+// buildSpendingReport totals receipts dated in the period and the one before it. Vendors
+// are listed only if they were paid in the period; categories are listed if they were in
+// either, so one that dropped to nothing still shows.
+func buildSpendingReport(receipts []ReceiptData, period spendingPeriod) SpendingReport {
+        report := SpendingReport{Period: period.Label, Previous: period.PrevLabel, Currency: defaultCurrency, Other: map[string]Decimal{}}
+        report.Total.Name = "Total"
+        categories := map[string]*SpendingLine{}
+        vendors := map[string]*SpendingLine{}
+        var months, prevMonths [12]SpendingLine
+
+        for _, receipt := range receipts {
+                date, err := time.Parse("2006-01-02", receipt.Date)
+                if err != nil || date.Before(period.PrevStart) || !date.Before(period.End) {
+                        continue
+                }
+                current := !date.Before(period.Start)
+                if receipt.Currency != defaultCurrency {
+                        if current {
+                                report.Other[receipt.Currency] = report.Other[receipt.Currency].Add(receipt.Amount)
+                        }
+                        continue
+                }
+
+                category := categories[receipt.Category]
+                if category == nil {
+                        category = &SpendingLine{Name: receipt.Category}
+                        categories[receipt.Category] = category
+                }
+                vendor := vendors[receipt.Vendor]
+                if vendor == nil {
+                        vendor = &SpendingLine{Name: receipt.Vendor}
+                        vendors[receipt.Vendor] = vendor
+                }
+
+                month := &prevMonths[date.Month()-1]
+                if current {
+                        month = &months[date.Month()-1]
+                }
+                for _, line := range []*SpendingLine{&report.Total, category, vendor, month} {
+                        if current {
+                                line.Total = line.Total.Add(receipt.Amount)
+                                line.Count++
+                        } else {
+                                line.Previous = line.Previous.Add(receipt.Amount)
+                        }
+                }
+        }
+
+        for _, line := range categories {
+                report.Categories = append(report.Categories, *line)
+        }
+        for _, line := range vendors {
+                if line.Count > 0 {
+                        report.Vendors = append(report.Vendors, *line)
+                }
+        }
+        sortSpending(report.Categories)
+        sortSpending(report.Vendors)
+
+        // A year is broken down by month, each compared with the month before it, up to
+        // the current month
+        if period.Year {
+                for i := range months {
+                        start := period.Start.AddDate(0, i, 0)
+                        if start.After(time.Now()) {
+                                break
+                        }
+                        months[i].Name = start.Format("2006-01")
+                        if i == 0 {
+                                months[i].Previous = prevMonths[11].Previous
+                        } else {
+                                months[i].Previous = months[i-1].Total
+                        }
+                        report.Months = append(report.Months, months[i])
+                }
+        }
+        return report
+}
+
+// sortSpending orders lines by amount spent, largest first
+func sortSpending(lines []SpendingLine) {
+        sort.Slice(lines, func(i, j int) bool {
+                if c := lines[i].Total.Cmp(lines[j].Total); c != 0 {
+                        return c > 0
+                }
+                return lines[i].Name < lines[j].Name
+        })
+}
+
+// writeSpendingText prints the report as aligned tables
+func writeSpendingText(out io.Writer, report SpendingReport) error {
+        w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+        fmt.Fprintf(w, "Spending %s (%s), compared with %s\n", report.Period, report.Currency, report.Previous)
+        fmt.Fprintf(w, "Receipts: %d\tTotal: %s\tPrevious: %s\tChange: %s\n", report.Total.Count, report.Total.Total, report.Total.Previous, report.Total.Change())
+
+        for _, section := range report.sections() {
+                fmt.Fprintln(w)
+                fmt.Fprintf(w, "%s\tRECEIPTS\tTOTAL\tPREVIOUS\tCHANGE\n", strings.ToUpper(section.Heading))
+                for _, line := range section.Lines {
+                        fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", line.Name, line.Count, line.Total, line.Previous, line.Change())
+                }
+        }
+        if len(report.Other) > 0 {
+                fmt.Fprintf(w, "\nNot included (other currencies): %s\n", formatTotals(report.Other))
+        }
+        return w.Flush()
+}
+
+// writeSpendingCSV writes the report's tables one after another, separated by blank rows
+func writeSpendingCSV(out io.Writer, report SpendingReport) error {
+        w := csv.NewWriter(out)
+        w.Write([]string{"Spending Report", report.Period})
+        w.Write([]string{"Compared With", report.Previous})
+        w.Write([]string{"Currency", report.Currency})
+
+        sections := append([]spendingSection{{"Total", []SpendingLine{report.Total}}}, report.sections()...)
+        for _, section := range sections {
+                w.Write(nil)
+                w.Write([]string{section.Heading, "Receipts", "Total", "Previous", "Change"})
+                for _, line := range section.Lines {
+                        w.Write([]string{line.Name, strconv.Itoa(line.Count), line.Total.String(), line.Previous.String(), line.Change()})
+                }
+        }
+        if len(report.Other) > 0 {
+                w.Write(nil)
+                w.Write([]string{"Other Currencies", "Total", "Currency"})
+                for _, currency := range sortedKeys(report.Other) {
+                        w.Write([]string{"", report.Other[currency].String(), currency})
+                }
+        }
+
+        w.Flush()
+        return w.Error()
+}
+
+// spendingSection is one table of a spending report
+type spendingSection struct {
+        Heading string
+        Lines   []SpendingLine
+}
+
+func (r SpendingReport) sections() []spendingSection {
+        var sections []spendingSection
+        for _, section := range []spendingSection{{"Category", r.Categories}, {"Vendor", r.Vendors}, {"Month", r.Months}} {
+                if len(section.Lines) > 0 {
+                        sections = append(sections, section)
+                }
+        }
+        return sections
+}
+
+var spendingHTML = template.Must(template.New("spending").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Spending {{.Period}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border-bottom: 1px solid #ddd; padding: 4px 12px; text-align: left; }
+td.n { text-align: right; }
+</style>
+</head>
+<body>
+<h1>Spending {{.Period}}</h1>
+<p>{{.Total.Count}} receipts, {{.Total.Total}} {{.Currency}}{{with .Total.Change}} ({{.}} compared with {{$.Previous}}){{end}}</p>
+{{- range .Sections}}
+<table>
+<tr><th>{{.Heading}}</th><th>Receipts</th><th>Total</th><th>Previous</th><th>Change</th></tr>
+{{- range .Lines}}
+<tr><td>{{.Name}}</td><td class="n">{{.Count}}</td><td class="n">{{.Total}}</td><td class="n">{{.Previous}}</td><td class="n">{{.Change}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+{{- if .Other}}
+<p>Not included (other currencies):{{range $currency, $total := .Other}} {{$total}} {{$currency}}{{end}}</p>
+{{- end}}
+</body>
+</html>
+`))
+
+// writeSpendingHTML writes the report as a standalone page
+func writeSpendingHTML(out io.Writer, report SpendingReport) error {
+        return spendingHTML.Execute(out, struct {
+                SpendingReport
+                Sections []spendingSection
+        }{report, report.sections()})
+}
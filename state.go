@@ -0,0 +1,134 @@
+package main
+
+import (
+        "crypto/sha256"
+        "encoding/hex"
+        "encoding/json"
+        "fmt"
+        "io"
+        "os"
+        "path/filepath"
+        "sync"
+        "time"
+)
+
+// stateFileName lives in destDir and survives restarts
+const stateFileName = ".scanner-bot-state.json"
+
+// ProcessedEntry records one source file that was fully processed and archived
+type ProcessedEntry struct {
+        SHA256      string    `json:"sha256"`
+        ProcessedAt time.Time `json:"processed_at"`
+}
+
+// ProcessedState tracks which source paths have been processed, keyed by absolute path
+type ProcessedState struct {
+        mu    sync.Mutex
+        path  string
+        Files map[string]ProcessedEntry `json:"files"`
+}
+
+// loadProcessedState reads the state file. A missing one is created empty right away,
+// outside dry-run, so a state file that can't be written stops startup instead of
+// failing after every file and leaving each to be processed again on the next run.
+func loadProcessedState(path string) (*ProcessedState, error) {
+        state := &ProcessedState{path: path, Files: map[string]ProcessedEntry{}}
+
+        content, err := os.ReadFile(path)
+        if os.IsNotExist(err) {
+                if dryRun {
+                        return state, nil
+                }
+                if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+                        return nil, fmt.Errorf("error creating state file: %w", err)
+                }
+                if err := writeFileAtomic(path, []byte("{\n  \"files\": {}\n}")); err != nil {
+                        return nil, fmt.Errorf("error creating state file: %w", err)
+                }
+                return state, nil
+        }
+        if err != nil {
+                return nil, fmt.Errorf("error reading state file: %w", err)
+        }
+
+        if err := json.Unmarshal(content, state); err != nil {
+                return nil, fmt.Errorf("error parsing state file %s: %w", path, err)
+        }
+        if state.Files == nil {
+                state.Files = map[string]ProcessedEntry{}
+        }
+        return state, nil
+}
+
+// IsProcessed reports whether this exact file content was already processed from srcPath.
+// A new scan that reuses an old file name has a different hash and is processed normally.
+func (s *ProcessedState) IsProcessed(srcPath, hash string) bool {
+        s.mu.Lock()
+        defer s.mu.Unlock()
+
+        entry, ok := s.Files[stateKey(srcPath)]
+        return ok && entry.SHA256 == hash
+}
+
+// MarkProcessed records srcPath as done and atomically rewrites the state file
+func (s *ProcessedState) MarkProcessed(srcPath, hash string) error {
+        s.mu.Lock()
+        defer s.mu.Unlock()
+
+        s.Files[stateKey(srcPath)] = ProcessedEntry{SHA256: hash, ProcessedAt: time.Now()}
+
+        content, err := json.MarshalIndent(s, "", "  ")
+        if err != nil {
+                return err
+        }
+        return writeFileAtomic(s.path, content)
+}
+
+func stateKey(srcPath string) string {
+        if abs, err := filepath.Abs(srcPath); err == nil {
+                return abs
+        }
+        return srcPath
+}
+
+// fileSHA256 returns the hex-encoded SHA-256 of the file content
+func fileSHA256(path string) (string, error) {
+        f, err := os.Open(path)
+        if err != nil {
+                return "", err
+        }
+        defer f.Close()
+
+        h := sha256.New()
+        if _, err := io.Copy(h, f); err != nil {
+                return "", err
+        }
+        return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeFileAtomic writes to a temp file in the same directory, syncs it, then renames it
+// over path, so readers never observe a partially written file
+func writeFileAtomic(path string, content []byte) error {
+        tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+        if err != nil {
+                return err
+        }
+        defer os.Remove(tmp.Name())
+
+        if err := tmp.Chmod(0644); err != nil {
+                tmp.Close()
+                return err
+        }
+        if _, err := tmp.Write(content); err != nil {
+                tmp.Close()
+                return err
+        }
+        if err := tmp.Sync(); err != nil {
+                tmp.Close()
+                return err
+        }
+        if err := tmp.Close(); err != nil {
+                return err
+        }
+        return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+        "bytes"
+        "context"
+        "encoding/json"
+        "fmt"
+        "io"
+        "log/slog"
+        "mime/multipart"
+        "net/http"
+        "net/textproto"
+        "net/url"
+        "os"
+        "path"
+        "path/filepath"
+        "strings"
+        "sync"
+        "unicode/utf8"
+)
+
+// storageBackend files processed copies and originals in a cloud folder instead of the
+// local -dest tree. rel is a slash-separated path under the backend's root folder, built
+// by the same category and naming rules as local filing. Store returns where the file
+// ended up, which stands in for the processed path in -db, -ledger, and notifications.
+type storageBackend interface {
+        Name() string
+        Store(ctx context.Context, localPath, rel string) (string, error)
+}
+
+// storage is set up in main by -storage; nil files under -dest as usual
+var storage storageBackend
+
+// setupStorage builds the backend named by -storage, reading its secrets from the
+// environment like the API keys
+func setupStorage() (storageBackend, error) {
+        switch storageName {
+        case "", "local":
+                return nil, nil
+        case "drive":
+                clientID, secret, refresh := os.Getenv("DRIVE_CLIENT_ID"), os.Getenv("DRIVE_CLIENT_SECRET"), os.Getenv("DRIVE_REFRESH_TOKEN")
+                if clientID == "" || secret == "" || refresh == "" {
+                        return nil, fmt.Errorf("-storage drive requires the DRIVE_CLIENT_ID, DRIVE_CLIENT_SECRET, and DRIVE_REFRESH_TOKEN environment variables")
+                }
+                root := storageFolder
+                if root == "" {
+                        root = "root"
+                }
+                return &driveStorage{
+                        auth:    newOAuthToken("Google Drive", googleTokenURL, clientID, secret, refresh),
+                        root:    root,
+                        folders: map[string]string{},
+                }, nil
+        case "dropbox":
+                key, secret, refresh := os.Getenv("DROPBOX_APP_KEY"), os.Getenv("DROPBOX_APP_SECRET"), os.Getenv("DROPBOX_REFRESH_TOKEN")
+                if key == "" || secret == "" || refresh == "" {
+                        return nil, fmt.Errorf("-storage dropbox requires the DROPBOX_APP_KEY, DROPBOX_APP_SECRET, and DROPBOX_REFRESH_TOKEN environment variables")
+                }
+                return &dropboxStorage{
+                        auth: newOAuthToken("Dropbox", dropboxTokenURL, key, secret, refresh),
+                        root: "/" + strings.Trim(storageFolder, "/"),
+                }, nil
+        }
+        return nil, fmt.Errorf("invalid -storage %q: expected local, drive, or dropbox", storageName)
+}
+
+// storeReceipt prepares the processed copy in a temp directory, with metadata, marker,
+// and sidecar as configured, and uploads it to the storage backend
+func storeReceipt(srcPath, content string, data ReceiptData) (string, error) {
+        rel, err := processedRelPath(content, data)
+        if err != nil {
+                return "", err
+        }
+        rel = filepath.ToSlash(rel)
+
+        if dryRun {
+                slog.Info("[dry-run] Would store processed file", "event", "save", "dry_run", true, "storage", storage.Name(), "path", rel, "source", srcPath, "date", data.Date, "vendor", data.Vendor, "category", data.Category, "amount", data.Amount, "currency", data.Currency)
+                return storage.Name() + ":" + rel, nil
+        }
+
+        dir, err := os.MkdirTemp("", "scanner-bot-store-*")
+        if err != nil {
+                return "", err
+        }
+        defer os.RemoveAll(dir)
+
+        staged := filepath.Join(dir, path.Base(rel))
+        if err := robustCopy(content, staged); err != nil {
+                return "", fmt.Errorf("failed to stage processed file: %w", err)
+        }
+        finishProcessedFile(staged, srcPath, data)
+
+        location, err := storage.Store(context.Background(), staged, rel)
+        if err != nil {
+                return "", fmt.Errorf("failed to store in %s: %w", storage.Name(), err)
+        }
+        if writeSidecars {
+                sidecar := sidecarPath(staged)
+                if _, err := storage.Store(context.Background(), sidecar, path.Join(path.Dir(rel), filepath.Base(sidecar))); err != nil {
+                        slog.Warn("Failed to store sidecar", "storage", storage.Name(), "path", location, "error", err)
+                }
+        }
+
+        slog.Info("Stored processed file", "event", "save", "storage", storage.Name(), "path", location, "source", srcPath, "date", data.Date, "vendor", data.Vendor, "category", data.Category, "amount", data.Amount, "currency", data.Currency)
+        return location, nil
+}
+
+// storeOriginal uploads the original to originals/ in the storage backend and removes it
+// from the watch directory
+func storeOriginal(srcPath string) (string, error) {
+        rel := "originals/" + filepath.Base(srcPath)
+        if dryRun {
+                slog.Info("[dry-run] Would archive original", "event", "archive", "dry_run", true, "storage", storage.Name(), "path", rel, "source", srcPath)
+                return storage.Name() + ":" + rel, nil
+        }
+
+        location, err := storage.Store(context.Background(), srcPath, rel)
+        if err != nil {
+                slog.Error("Failed to archive original", "event", "archive", "storage", storage.Name(), "source", srcPath, "error", err)
+                return "", err
+        }
+        if err := os.Remove(srcPath); err != nil {
+                slog.Error("Failed to remove archived original", "event", "archive", "path", location, "source", srcPath, "error", err)
+                return location, err
+        }
+
+        slog.Info("Archived original", "event", "archive", "storage", storage.Name(), "path", location, "source", srcPath)
+        return location, nil
+}
+
+// storageContentType is the media type uploaded for a processed file or its sidecar
+func storageContentType(localPath string) string {
+        if strings.HasSuffix(localPath, ".json") {
+                return "application/json"
+        }
+        return mediaType(localPath)
+}
+
+// Google Drive endpoints used by -storage drive
+const (
+        driveAPI       = "https://www.googleapis.com/drive/v3/files"
+        driveUploadAPI = "https://www.googleapis.com/upload/drive/v3/files"
+        driveFolder    = "application/vnd.google-apps.folder"
+)
+
+// driveStorage uploads to a Google Drive folder (-storage-folder is its ID, "root" for
+// My Drive) with an OAuth refresh token that has the drive.file scope. Category folders
+// are created as needed and their IDs cached for the life of the process.
+type driveStorage struct {
+        auth *oauthToken
+        root string
+
+        mu      sync.Mutex
+        folders map[string]string
+}
+
+func (d *driveStorage) Name() string { return "drive" }
+
+func (d *driveStorage) Store(ctx context.Context, localPath, rel string) (string, error) {
+        parent, err := d.folder(ctx, path.Dir(rel))
+        if err != nil {
+                return "", err
+        }
+        token, err := d.auth.Token(ctx)
+        if err != nil {
+                return "", err
+        }
+
+        f, err := os.Open(localPath)
+        if err != nil {
+                return "", err
+        }
+        defer f.Close()
+
+        // A multipart/related upload sends the metadata and the content in one request
+        var body bytes.Buffer
+        w := multipart.NewWriter(&body)
+        meta, err := json.Marshal(map[string]any{"name": path.Base(rel), "parents": []string{parent}})
+        if err != nil {
+                return "", err
+        }
+        part, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json; charset=UTF-8"}})
+        if err != nil {
+                return "", err
+        }
+        part.Write(meta)
+        part, err = w.CreatePart(textproto.MIMEHeader{"Content-Type": {storageContentType(localPath)}})
+        if err != nil {
+                return "", err
+        }
+        if _, err := io.Copy(part, f); err != nil {
+                return "", err
+        }
+        if err := w.Close(); err != nil {
+                return "", err
+        }
+
+        req, err := http.NewRequestWithContext(ctx, http.MethodPost, driveUploadAPI+"?uploadType=multipart&supportsAllDrives=true&fields=id,webViewLink", &body)
+        if err != nil {
+                return "", err
+        }
+        req.Header.Set("Content-Type", "multipart/related; boundary="+w.Boundary())
+        var file struct {
+                ID          string `json:"id"`
+                WebViewLink string `json:"webViewLink"`
+        }
+        if err := doJSON(apiClient, req, map[string]string{"Authorization": "Bearer " + token}, &file); err != nil {
+                return "", err
+        }
+        if file.WebViewLink == "" {
+                return "https://drive.google.com/file/d/" + file.ID + "/view", nil
+        }
+        return file.WebViewLink, nil
+}
+
+// folder returns the ID of the folder at dir under the root, creating missing folders.
+// Lookups are serialized so concurrent workers never create the same folder twice.
+func (d *driveStorage) folder(ctx context.Context, dir string) (string, error) {
+        d.mu.Lock()
+        defer d.mu.Unlock()
+
+        parent, walked := d.root, ""
+        if dir == "." || dir == "" {
+                return parent, nil
+        }
+        for _, name := range strings.Split(dir, "/") {
+                walked = path.Join(walked, name)
+                if id, ok := d.folders[walked]; ok {
+                        parent = id
+                        continue
+                }
+
+                token, err := d.auth.Token(ctx)
+                if err != nil {
+                        return "", err
+                }
+                headers := map[string]string{"Authorization": "Bearer " + token}
+                escaped := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(name)
+                query := url.Values{
+                        "q":                         {fmt.Sprintf("name = '%s' and '%s' in parents and mimeType = '%s' and trashed = false", escaped, parent, driveFolder)},
+                        "fields":                    {"files(id)"},
+                        "supportsAllDrives":         {"true"},
+                        "includeItemsFromAllDrives": {"true"},
+                }
+                var found struct {
+                        Files []struct {
+                                ID string `json:"id"`
+                        } `json:"files"`
+                }
+                if err := getJSON(ctx, driveAPI+"?"+query.Encode(), headers, &found); err != nil {
+                        return "", fmt.Errorf("failed to look up Drive folder %s: %w", walked, err)
+                }
+
+                if len(found.Files) > 0 {
+                        parent = found.Files[0].ID
+                } else {
+                        var created struct {
+                                ID string `json:"id"`
+                        }
+                        folder := map[string]any{"name": name, "mimeType": driveFolder, "parents": []string{parent}}
+                        if err := postJSON(ctx, driveAPI+"?supportsAllDrives=true&fields=id", headers, folder, &created); err != nil {
+                                return "", fmt.Errorf("failed to create Drive folder %s: %w", walked, err)
+                        }
+                        parent = created.ID
+                }
+                d.folders[walked] = parent
+        }
+        return parent, nil
+}
+
+// Dropbox endpoints used by -storage dropbox
+const (
+        dropboxTokenURL  = "https://api.dropboxapi.com/oauth2/token"
+        dropboxUploadAPI = "https://content.dropboxapi.com/2/files/upload"
+)
+
+// dropboxStorage uploads under a Dropbox folder (-storage-folder, such as /Receipts).
+// Folders are created by the upload itself, and a name already taken gets a " (1)"
+// suffix from Dropbox rather than being overwritten.
+type dropboxStorage struct {
+        auth *oauthToken
+        root string
+}
+
+func (d *dropboxStorage) Name() string { return "dropbox" }
+
+func (d *dropboxStorage) Store(ctx context.Context, localPath, rel string) (string, error) {
+        token, err := d.auth.Token(ctx)
+        if err != nil {
+                return "", err
+        }
+        f, err := os.Open(localPath)
+        if err != nil {
+                return "", err
+        }
+        defer f.Close()
+
+        arg, err := json.Marshal(map[string]any{"path": path.Join(d.root, rel), "mode": "add", "autorename": true, "mute": true})
+        if err != nil {
+                return "", err
+        }
+        req, err := http.NewRequestWithContext(ctx, http.MethodPost, dropboxUploadAPI, f)
+        if err != nil {
+                return "", err
+        }
+        req.Header.Set("Content-Type", "application/octet-stream")
+        if info, err := f.Stat(); err == nil {
+                req.ContentLength = info.Size()
+        }
+        var uploaded struct {
+                PathDisplay string `json:"path_display"`
+        }
+        headers := map[string]string{"Authorization": "Bearer " + token, "Dropbox-API-Arg": asciiJSON(arg)}
+        if err := doJSON(apiClient, req, headers, &uploaded); err != nil {
+                return "", err
+        }
+        return "dropbox:" + uploaded.PathDisplay, nil
+}
+
+// asciiJSON escapes non-ASCII characters in JSON as \uXXXX, since HTTP headers such as
+// Dropbox-API-Arg must be ASCII and file names often are not
+func asciiJSON(data []byte) string {
+        var b strings.Builder
+        for _, r := range string(data) {
+                switch {
+                case r < utf8.RuneSelf:
+                        b.WriteRune(r)
+                case r > 0xFFFF:
+                        r -= 0x10000
+                        fmt.Fprintf(&b, `\u%04x\u%04x`, 0xD800+(r>>10), 0xDC00+(r&0x3FF))
+                default:
+                        fmt.Fprintf(&b, `\u%04x`, r)
+                }
+        }
+        return b.String()
+}
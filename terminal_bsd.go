@@ -0,0 +1,11 @@
+//go:build darwin || freebsd || netbsd || openbsd
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// The termios requests differ between Linux and the BSDs
+const (
+        ioctlGetTermios = unix.TIOCGETA
+        ioctlSetTermios = unix.TIOCSETA
+)
@@ -0,0 +1,11 @@
+//go:build linux
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// The termios requests differ between Linux and the BSDs
+const (
+        ioctlGetTermios = unix.TCGETS
+        ioctlSetTermios = unix.TCSETS
+)
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+
+package main
+
+import "errors"
+
+var errNoTerminal = errors.New("the terminal view is not supported on this platform")
+
+func enterCbreakMode(fd int) (func(), error) {
+        return nil, errNoTerminal
+}
+
+func terminalSize(fd int) (int, int, error) {
+        return 0, 0, errNoTerminal
+}
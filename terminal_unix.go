@@ -0,0 +1,31 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// enterCbreakMode makes the terminal deliver each key press as it is typed, without
+// echoing it. Ctrl-C still raises SIGINT. The returned function restores the terminal.
+func enterCbreakMode(fd int) (func(), error) {
+        termios, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+        if err != nil {
+                return nil, err
+        }
+        saved := *termios
+        termios.Lflag &^= unix.ICANON | unix.ECHO
+        termios.Cc[unix.VMIN] = 1
+        termios.Cc[unix.VTIME] = 0
+        if err := unix.IoctlSetTermios(fd, ioctlSetTermios, termios); err != nil {
+                return nil, err
+        }
+        return func() { unix.IoctlSetTermios(fd, ioctlSetTermios, &saved) }, nil
+}
+
+// terminalSize returns the columns and rows of the terminal on fd
+func terminalSize(fd int) (int, int, error) {
+        size, err := unix.IoctlGetWinsize(fd, unix.TIOCGWINSZ)
+        if err != nil {
+                return 0, 0, err
+        }
+        return int(size.Col), int(size.Row), nil
+}
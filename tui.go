@@ -0,0 +1,495 @@
+package main
+
+import (
+        "context"
+        "errors"
+        "fmt"
+        "io"
+        "log"
+        "log/slog"
+        "os"
+        "os/exec"
+        "path/filepath"
+        "runtime"
+        "slices"
+        "strings"
+        "sync"
+        "time"
+
+        "golang.org/x/text/width"
+)
+
+const (
+        // tuiMaxRecent and tuiMaxLogs bound what -tui keeps of finished files and log lines
+        tuiMaxRecent = 100
+        tuiMaxLogs   = 500
+
+        // tuiMessageFor is how long the answer to a key press stays on screen
+        tuiMessageFor = 5 * time.Second
+)
+
+// tuiFile is one file followed by the terminal view
+type tuiFile struct {
+        Source string
+        Stage  string
+        Since  time.Time
+        Detail string
+        Path   string
+        Err    string
+}
+
+// tuiView is the live terminal view shown with -tui. It follows each file through the
+// pipeline by its events, and keeps the log records for its log pane instead of printing
+// them.
+type tuiView struct {
+        mu        sync.Mutex
+        active    map[string]*tuiFile
+        order     []string
+        recent    []*tuiFile
+        logs      []string
+        selected  int
+        message   string
+        messageAt time.Time
+        closed    bool
+
+        // previous, logOutput, and logFlags are the logging setup Close puts back
+        previous  *slog.Logger
+        logOutput io.Writer
+        logFlags  int
+
+        events      <-chan pipelineEvent
+        unsubscribe func()
+        quit        func()
+        restore     func()
+        changed     chan struct{}
+        done        chan struct{}
+}
+
+// tuiStage maps a pipeline event to the stage it puts a file in, or ""
+func tuiStage(event pipelineEvent) string {
+        switch event.Kind {
+        case eventDetected:
+                return "writing"
+        case eventResume, eventStable:
+                return "queued"
+        case eventAnalysisStart:
+                return "analyzing"
+        case eventAnalysisEnd, eventSave:
+                return "saving"
+        case eventArchive:
+                if event.Err != nil {
+                        return "failed"
+                }
+                return "done"
+        case eventReview:
+                // A file that could not be moved to needs-review stays where it is
+                if event.Err == nil {
+                        return "review"
+                }
+        case eventRetry:
+                return "retry"
+        case eventStabilityFailed:
+                // Files moved away while being written, like our own archive moves, did not fail
+                if errors.Is(event.Err, errFileDisappeared) {
+                        return "skipped"
+                }
+                return "failed"
+        case eventQuarantine, eventDeadLetter:
+                return "failed"
+        case eventDuplicate:
+                return "skipped"
+        }
+        return ""
+}
+
+// startTUI takes over the terminal and the log output until Close. Pressing q calls quit.
+func startTUI(quit func()) (*tuiView, error) {
+        restore, err := enterCbreakMode(int(os.Stdin.Fd()))
+        if err != nil {
+                return nil, fmt.Errorf("-tui needs a terminal: %w", err)
+        }
+
+        // Log lines go back to where they went before once the view closes, for the
+        // shutdown. SetDefault points the log package at the view's handler, so its
+        // output is saved too.
+        events, unsubscribe := pipelineEvents.subscribe()
+        v := &tuiView{
+                active:      map[string]*tuiFile{},
+                previous:    slog.Default(),
+                logOutput:   log.Writer(),
+                logFlags:    log.Flags(),
+                events:      events,
+                unsubscribe: unsubscribe,
+                quit:        quit,
+                restore:     restore,
+                changed:     make(chan struct{}, 1),
+                done:        make(chan struct{}),
+        }
+        // Switch to the alternate screen and hide the cursor
+        fmt.Print("\x1b[?1049h\x1b[?25l")
+        slog.SetDefault(slog.New(&tuiHandler{view: v}))
+
+        go v.follow()
+        go v.drawLoop()
+        go v.readKeys()
+        return v, nil
+}
+
+// Close gives the terminal and the log output back
+func (v *tuiView) Close() {
+        v.mu.Lock()
+        if v.closed {
+                v.mu.Unlock()
+                return
+        }
+        v.closed = true
+        close(v.done)
+        v.mu.Unlock()
+
+        v.unsubscribe()
+        v.restore()
+        fmt.Print("\x1b[?25h\x1b[?1049l")
+        slog.SetDefault(v.previous)
+        log.SetOutput(v.logOutput)
+        log.SetFlags(v.logFlags)
+}
+
+// follow moves each file to the stage of its events until the view closes
+func (v *tuiView) follow() {
+        for event := range v.events {
+                v.mu.Lock()
+                if !v.closed {
+                        v.track(event)
+                }
+                v.mu.Unlock()
+                v.redraw()
+        }
+}
+
+// tuiHandler is the slog.Handler that feeds the view's log pane
+type tuiHandler struct {
+        view  *tuiView
+        attrs []slog.Attr
+}
+
+func (h *tuiHandler) Enabled(ctx context.Context, level slog.Level) bool {
+        return h.view.previous.Handler().Enabled(ctx, level)
+}
+
+func (h *tuiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+        return &tuiHandler{view: h.view, attrs: append(slices.Clip(h.attrs), attrs...)}
+}
+
+func (h *tuiHandler) WithGroup(name string) slog.Handler {
+        return h
+}
+
+func (h *tuiHandler) Handle(ctx context.Context, r slog.Record) error {
+        v := h.view
+        v.mu.Lock()
+        if v.closed {
+                v.mu.Unlock()
+                return v.previous.Handler().WithAttrs(h.attrs).Handle(ctx, r)
+        }
+
+        var line strings.Builder
+        fmt.Fprintf(&line, "%s %s %s", r.Time.Format("15:04:05"), r.Level, r.Message)
+        addAttr := func(a slog.Attr) bool {
+                fmt.Fprintf(&line, " %s=%s", a.Key, a.Value)
+                return true
+        }
+        for _, a := range h.attrs {
+                addAttr(a)
+        }
+        r.Attrs(addAttr)
+
+        v.logs = append(v.logs, line.String())
+        if len(v.logs) > tuiMaxLogs {
+                v.logs = v.logs[len(v.logs)-tuiMaxLogs:]
+        }
+        v.mu.Unlock()
+
+        v.redraw()
+        return nil
+}
+
+// track moves a file to the stage its event puts it in. Files are known by their source
+// path.
+func (v *tuiView) track(event pipelineEvent) {
+        stage := tuiStage(event)
+        key := event.Source
+        if stage == "" || key == "" {
+                return
+        }
+
+        final := slices.Contains([]string{"done", "review", "failed", "skipped"}, stage)
+        file := v.active[key]
+        // Giving up on a file is logged before it is quarantined, which finishes it again
+        again := file == nil && stage == "failed" && len(v.recent) > 0 && v.recent[0].Source == key && v.recent[0].Stage == "failed"
+        if again {
+                file = v.recent[0]
+        } else if file == nil {
+                file = &tuiFile{Source: key}
+                v.active[key] = file
+                v.order = append(v.order, key)
+        }
+        if file.Stage != stage {
+                file.Stage, file.Since = stage, time.Now()
+        }
+        if event.Err != nil {
+                file.Err = event.Err.Error()
+        }
+        switch event.Kind {
+        case eventSave:
+                file.Path = event.Path
+                if data := event.Receipt; data != nil {
+                        file.Detail = strings.TrimSpace(data.Vendor + " " + data.Amount.String() + " " + data.Currency)
+                }
+        case eventReview, eventQuarantine:
+                file.Path = event.Path
+        }
+
+        if final && !again {
+                delete(v.active, key)
+                v.order = slices.DeleteFunc(v.order, func(source string) bool { return source == key })
+                // Files skipped as already processed would crowd out the ones that were not
+                if stage != "skipped" {
+                        v.recent = append([]*tuiFile{file}, v.recent...)
+                        if len(v.recent) > tuiMaxRecent {
+                                v.recent = v.recent[:tuiMaxRecent]
+                        }
+                }
+        }
+}
+
+// redraw asks the draw loop for a new frame without waiting for it
+func (v *tuiView) redraw() {
+        select {
+        case v.changed <- struct{}{}:
+        default:
+        }
+}
+
+// drawLoop draws a frame on every change, and every second for the elapsed times
+func (v *tuiView) drawLoop() {
+        ticker := time.NewTicker(time.Second)
+        defer ticker.Stop()
+        for {
+                v.draw()
+                select {
+                case <-v.done:
+                        return
+                case <-v.changed:
+                case <-ticker.C:
+                }
+        }
+}
+
+// items lists the files in progress, then the finished ones; the selection indexes it
+func (v *tuiView) items() []*tuiFile {
+        items := make([]*tuiFile, 0, len(v.order)+len(v.recent))
+        for _, key := range v.order {
+                items = append(items, v.active[key])
+        }
+        return append(items, v.recent...)
+}
+
+func (v *tuiView) draw() {
+        cols, rows, err := terminalSize(int(os.Stdout.Fd()))
+        if err != nil || cols < 20 || rows < 12 {
+                cols, rows = 80, 24
+        }
+        status := health.report()
+
+        v.mu.Lock()
+        defer v.mu.Unlock()
+        if v.closed {
+                return
+        }
+
+        items := v.items()
+        v.selected = max(0, min(v.selected, len(items)-1))
+
+        var lines []string
+        lines = append(lines, fmt.Sprintf("scanner-bot  %s  watching %d  queued %d  active %d  api %s",
+                status.Provider, len(status.WatchDirs), status.QueueLength, status.ActiveFiles, status.API), "")
+
+        // The file list gets what the header, details, log, and help lines leave
+        const logLines, detailLines = 6, 4
+        listLines := rows - len(lines) - detailLines - logLines - 4
+        first := 0
+        if v.selected >= listLines {
+                first = v.selected - listLines + 1
+        }
+        lines = append(lines, fmt.Sprintf("FILES  %d in progress, %d recent", len(v.order), len(v.recent)))
+        for i := first; i < len(items) && i < first+listLines; i++ {
+                line := tuiFileLine(items[i])
+                if i == v.selected {
+                        line = "\x1b[7m" + fitWidth(line, cols) + "\x1b[0m"
+                }
+                lines = append(lines, line)
+        }
+        for len(lines) < 3+listLines {
+                lines = append(lines, "")
+        }
+
+        lines = append(lines, "")
+        if len(items) > 0 {
+                file := items[v.selected]
+                lines = append(lines, "Source: "+file.Source, "Filed:  "+file.Path, "Error:  "+file.Err)
+        } else {
+                lines = append(lines, "Waiting for files...", "", "")
+        }
+
+        lines = append(lines, "", "LOG")
+        for i := max(0, len(v.logs)-logLines); i < len(v.logs); i++ {
+                lines = append(lines, v.logs[i])
+        }
+        for len(lines) < rows-1 {
+                lines = append(lines, "")
+        }
+
+        help := "↑/↓ select  r retry  o open  q quit"
+        if v.message != "" && time.Since(v.messageAt) < tuiMessageFor {
+                help += "  | " + v.message
+        }
+
+        var b strings.Builder
+        b.WriteString("\x1b[H")
+        for _, line := range lines[:rows-1] {
+                b.WriteString(fitWidth(line, cols) + "\x1b[K\r\n")
+        }
+        b.WriteString(fitWidth(help, cols) + "\x1b[K")
+        os.Stdout.WriteString(b.String())
+}
+
+// tuiFileLine is a file's row: its stage, how long it has been in it (or when it
+// finished), its name, and what it was filed as or why it failed
+func tuiFileLine(file *tuiFile) string {
+        when := time.Since(file.Since).Round(time.Second).String()
+        switch file.Stage {
+        case "done", "review", "failed":
+                when = file.Since.Format("15:04:05")
+        }
+        detail := file.Detail
+        if file.Err != "" && file.Stage != "done" {
+                detail = file.Err
+        }
+        return fmt.Sprintf("  %-9s %8s  %-32s %s", file.Stage, when, filepath.Base(file.Source), detail)
+}
+
+// fitWidth cuts s to cols terminal columns, counting East Asian wide characters as two
+func fitWidth(s string, cols int) string {
+        used := 0
+        for i, r := range s {
+                w := 1
+                if kind := width.LookupRune(r).Kind(); kind == width.EastAsianWide || kind == width.EastAsianFullwidth {
+                        w = 2
+                }
+                if used+w > cols {
+                        return s[:i]
+                }
+                used += w
+        }
+        return s
+}
+
+// readKeys handles key presses until the view closes
+func (v *tuiView) readKeys() {
+        buf := make([]byte, 16)
+        for {
+                n, err := os.Stdin.Read(buf)
+                if err != nil {
+                        return
+                }
+                switch key := string(buf[:n]); key {
+                case "q":
+                        v.quit()
+                        return
+                case "k", "\x1b[A":
+                        v.move(-1)
+                case "j", "\x1b[B":
+                        v.move(1)
+                case "r":
+                        v.retrySelected()
+                case "o":
+                        v.openSelected()
+                }
+        }
+}
+
+func (v *tuiView) move(by int) {
+        v.mu.Lock()
+        v.selected += by
+        v.mu.Unlock()
+        v.redraw()
+}
+
+// selectedFile returns a copy of the selected file, since the pipeline keeps updating it
+func (v *tuiView) selectedFile() (tuiFile, bool) {
+        v.mu.Lock()
+        defer v.mu.Unlock()
+        items := v.items()
+        if v.selected < 0 || v.selected >= len(items) {
+                return tuiFile{}, false
+        }
+        return *items[v.selected], true
+}
+
+func (v *tuiView) setMessage(format string, args ...any) {
+        v.mu.Lock()
+        v.message, v.messageAt = fmt.Sprintf(format, args...), time.Now()
+        v.mu.Unlock()
+        v.redraw()
+}
+
+// retrySelected moves a quarantined or held file back to where it was scanned, where the
+// watcher picks it up again
+func (v *tuiView) retrySelected() {
+        file, ok := v.selectedFile()
+        folder := filepath.Base(filepath.Dir(file.Path))
+        if !ok || (folder != "failed" && folder != reviewDirName) {
+                v.setMessage("Only files moved to failed or needs-review can be retried")
+                return
+        }
+        if _, err := os.Stat(file.Source); err == nil {
+                v.setMessage("%s already exists", file.Source)
+                return
+        }
+        if err := robustMove(file.Path, file.Source); err != nil {
+                v.setMessage("Failed to move %s back: %v", filepath.Base(file.Path), err)
+                return
+        }
+        for _, report := range []string{file.Path + errorReportSuffix, file.Path + reviewReportSuffix} {
+                os.Remove(report)
+        }
+        v.setMessage("Moved %s back to %s", filepath.Base(file.Path), filepath.Dir(file.Source))
+}
+
+// openSelected opens where the selected file is now with the desktop's default application
+func (v *tuiView) openSelected() {
+        file, ok := v.selectedFile()
+        if !ok {
+                return
+        }
+        path := file.Path
+        if _, err := os.Stat(path); path == "" || err != nil {
+                path = file.Source
+        }
+
+        var cmd *exec.Cmd
+        switch runtime.GOOS {
+        case "darwin":
+                cmd = exec.Command("open", path)
+        case "windows":
+                cmd = exec.Command("cmd", "/c", "start", "", path)
+        default:
+                cmd = exec.Command("xdg-open", path)
+        }
+        if err := cmd.Start(); err != nil {
+                v.setMessage("Failed to open %s: %v", filepath.Base(path), err)
+                return
+        }
+        go cmd.Wait()
+        v.setMessage("Opened %s", filepath.Base(path))
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+        "context"
+        "crypto/subtle"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "io"
+        "log/slog"
+        "mime"
+        "net/http"
+        "path/filepath"
+        "strings"
+        "time"
+)
+
+// uploadTypes are the extensions given to uploads of the types converted before
+// analysis; JPEG, PNG, and PDF use receiptTypes
+var uploadTypes = map[string]string{
+        "image/heic": ".heic",
+        "image/heif": ".heif",
+        "image/webp": ".webp",
+        "image/tiff": ".tif",
+}
+
+// errSaveUpload marks a failure to write an upload into the watch directory. Its cause
+// names server paths, so clients only get this message.
+var errSaveUpload = errors.New("failed to save upload")
+
+// uploadedFile is reported back for each file saved by POST /upload: the name it was
+// sent with and the name it was saved under, never the server's directory
+type uploadedFile struct {
+        Name string `json:"name"`
+        File string `json:"file"`
+}
+
+// startUploadServer serves POST /upload on addr in the background. Uploaded files are
+// saved into dir, where the watcher picks them up like scans.
+func startUploadServer(addr, token, dir string) *http.Server {
+        mux := http.NewServeMux()
+        mux.Handle("/upload", uploadHandler(token, dir))
+
+        srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+        go func() {
+                if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+                        slog.Error("Upload server error", "error", err)
+                }
+        }()
+
+        slog.Info("Accepting uploads", "addr", addr, "path", dir)
+        return srv
+}
+
+// stopUploadServer gives uploads in progress a few seconds to finish
+func stopUploadServer(srv *http.Server) {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        if err := srv.Shutdown(ctx); err != nil {
+                slog.Warn("Upload server shutdown error", "error", err)
+        }
+}
+
+// uploadHandler accepts a multipart/form-data POST with one or more files in any field,
+// or a single file as the raw body (named by ?name= if given). Requests must carry
+// "Authorization: Bearer <UPLOAD_TOKEN>".
+func uploadHandler(token, dir string) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                if r.Method != http.MethodPost {
+                        w.Header().Set("Allow", http.MethodPost)
+                        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+                        return
+                }
+                given, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+                if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+                        slog.Warn("Rejected upload", "event", "upload", "remote", r.RemoteAddr, "error", "invalid token")
+                        http.Error(w, "unauthorized", http.StatusUnauthorized)
+                        return
+                }
+                r.Body = http.MaxBytesReader(w, r.Body, uploadMaxSize)
+
+                var saved []uploadedFile
+                err := readUploads(r, func(name string, data []byte) error {
+                        path, err := saveUpload(dir, name, data)
+                        if err != nil {
+                                return err
+                        }
+                        saved = append(saved, uploadedFile{Name: name, File: filepath.Base(path)})
+                        slog.Info("Received upload", "event", "upload", "path", path, "remote", r.RemoteAddr)
+                        return nil
+                })
+
+                var tooLarge *http.MaxBytesError
+                switch {
+                case errors.As(err, &tooLarge):
+                        http.Error(w, fmt.Sprintf("upload larger than %d bytes", uploadMaxSize), http.StatusRequestEntityTooLarge)
+                        return
+                case errors.Is(err, errUnsupportedFile):
+                        http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+                        return
+                case errors.Is(err, errSaveUpload):
+                        slog.Error("Failed to save upload", "event", "upload", "remote", r.RemoteAddr, "error", err)
+                        http.Error(w, errSaveUpload.Error(), http.StatusInternalServerError)
+                        return
+                case err != nil:
+                        slog.Warn("Rejected upload", "event", "upload", "remote", r.RemoteAddr, "error", err)
+                        http.Error(w, err.Error(), http.StatusBadRequest)
+                        return
+                case len(saved) == 0:
+                        http.Error(w, "no file in request", http.StatusBadRequest)
+                        return
+                }
+
+                w.Header().Set("Content-Type", "application/json")
+                w.WriteHeader(http.StatusAccepted)
+                json.NewEncoder(w).Encode(map[string][]uploadedFile{"files": saved})
+        })
+}
+
+// readUploads calls save with the name and content of each uploaded file
+func readUploads(r *http.Request, save func(name string, data []byte) error) error {
+        mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+        if mediaType != "multipart/form-data" {
+                data, err := io.ReadAll(r.Body)
+                if err != nil {
+                        return err
+                }
+                if len(data) == 0 {
+                        return nil
+                }
+                return save(r.URL.Query().Get("name"), data)
+        }
+
+        reader, err := r.MultipartReader()
+        if err != nil {
+                return err
+        }
+        for {
+                part, err := reader.NextPart()
+                if err == io.EOF {
+                        return nil
+                }
+                if err != nil {
+                        return err
+                }
+                // Plain form fields carry no file name
+                if part.FileName() == "" {
+                        continue
+                }
+                data, err := io.ReadAll(part)
+                if err != nil {
+                        return err
+                }
+                if err := save(part.FileName(), data); err != nil {
+                        return err
+                }
+        }
+}
+
+// saveUpload checks that data is an image or PDF and writes it into dir under its own
+// name, prefixed with the time so repeated names from a phone ("image.jpg") stay apart.
+// The extension is corrected to match the content.
+func saveUpload(dir, name string, data []byte) (string, error) {
+        name = filepath.Base(strings.ReplaceAll(name, `\`, "/"))
+        if name == "" || name == "." || name == "/" {
+                name = "upload"
+        }
+
+        head := data[:min(len(data), 512)]
+        detected := sniffConvertible(head)
+        if detected == "" {
+                detected, _, _ = mime.ParseMediaType(http.DetectContentType(head))
+        }
+        ext, ok := receiptTypes[detected]
+        if !ok {
+                if ext, ok = uploadTypes[detected]; !ok {
+                        return "", fmt.Errorf("%w: %s is %s, not an image or PDF", errUnsupportedFile, name, detected)
+                }
+        }
+        if extensionTypes[strings.ToLower(filepath.Ext(name))] == detected {
+                ext = filepath.Ext(name)
+        }
+        stem := strings.TrimSuffix(name, filepath.Ext(name))
+
+        path := filepath.Join(dir, fitFileName(safeComponent(time.Now().Format("20060102-150405")+"-"+sanitizeName(stem, maxFileNameBytes)+ext)))
+        path, err := writeIncoming(path, data)
+        if err != nil {
+                return "", fmt.Errorf("%w %s: %w", errSaveUpload, name, err)
+        }
+        return path, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+        "context"
+        "encoding/json"
+        "fmt"
+        "log/slog"
+        "os"
+        "strings"
+        "sync"
+
+        "github.com/google/generative-ai-go/genai"
+)
+
+// modelPrice is a model's list price in US dollars per million tokens
+type modelPrice struct {
+        Input  float64 `json:"input"`
+        Output float64 `json:"output"`
+}
+
+// modelPrices are the published prices of common models, matched by the longest
+// prefix of the model name, for estimating cost. -prices adds to or overrides them.
+var modelPrices = map[string]modelPrice{
+        "gemini-3-flash":        {Input: 0.50, Output: 3.00},
+        "gemini-3-pro":          {Input: 2.00, Output: 12.00},
+        "gemini-2.5-flash":      {Input: 0.30, Output: 2.50},
+        "gemini-2.5-flash-lite": {Input: 0.10, Output: 0.40},
+        "gemini-2.5-pro":        {Input: 1.25, Output: 10.00},
+        "gemini-2.0-flash":      {Input: 0.10, Output: 0.40},
+        "gemini-1.5-flash":      {Input: 0.075, Output: 0.30},
+        "gemini-1.5-pro":        {Input: 1.25, Output: 5.00},
+        "gpt-4o":                {Input: 2.50, Output: 10.00},
+        "gpt-4o-mini":           {Input: 0.15, Output: 0.60},
+        "gpt-4.1":               {Input: 2.00, Output: 8.00},
+        "gpt-4.1-mini":          {Input: 0.40, Output: 1.60},
+        "claude-sonnet-4":       {Input: 3.00, Output: 15.00},
+        "claude-3-5-sonnet":     {Input: 3.00, Output: 15.00},
+        "claude-3-7-sonnet":     {Input: 3.00, Output: 15.00},
+        "claude-haiku-4":        {Input: 1.00, Output: 5.00},
+        "claude-3-5-haiku":      {Input: 0.80, Output: 4.00},
+        "claude-opus-4":         {Input: 15.00, Output: 75.00},
+        "claude-opus-4-5":       {Input: 5.00, Output: 25.00},
+}
+
+// loadModelPrices merges a -prices JSON file ({"model-prefix": {"input": 0.1, "output": 0.4}})
+// into modelPrices
+func loadModelPrices(path string) error {
+        content, err := os.ReadFile(path)
+        if err != nil {
+                return fmt.Errorf("error reading prices: %w", err)
+        }
+        var prices map[string]modelPrice
+        if err := json.Unmarshal(content, &prices); err != nil {
+                return fmt.Errorf("error parsing prices %s: %w", path, err)
+        }
+        for model, price := range prices {
+                modelPrices[strings.ToLower(model)] = price
+        }
+        return nil
+}
+
+// priceFor finds the price of a model by the longest matching prefix
+func priceFor(model string) (modelPrice, bool) {
+        model = strings.ToLower(strings.TrimPrefix(model, "models/"))
+        best, found := "", false
+        for prefix := range modelPrices {
+                if strings.HasPrefix(model, prefix) && len(prefix) >= len(best) {
+                        best, found = prefix, true
+                }
+        }
+        return modelPrices[best], found
+}
+
+// tokenUsage adds up the tokens, and their estimated cost, of every model call made for
+// one file: retries, corrections, pages, -fallback and -verify backends included
+type tokenUsage struct {
+        mu           sync.Mutex
+        promptTokens int64
+        outputTokens int64
+        costUSD      float64
+}
+
+type usageContextKey struct{}
+
+// withUsage makes model calls under ctx add their tokens to usage
+func withUsage(ctx context.Context, usage *tokenUsage) context.Context {
+        return context.WithValue(ctx, usageContextKey{}, usage)
+}
+
+// recordUsage adds a response's token counts to the file being analyzed under ctx. Local
+// Ollama models cost nothing; models without a known price count tokens only.
+func recordUsage(ctx context.Context, provider, model string, promptTokens, outputTokens int64) {
+        usage, ok := ctx.Value(usageContextKey{}).(*tokenUsage)
+        if !ok {
+                return
+        }
+
+        var cost float64
+        if provider != "ollama" {
+                if price, ok := priceFor(model); ok {
+                        cost = (float64(promptTokens)*price.Input + float64(outputTokens)*price.Output) / 1e6
+                } else {
+                        slog.Debug("No price known for model, cost not estimated", "model", model)
+                }
+        }
+
+        usage.mu.Lock()
+        defer usage.mu.Unlock()
+        usage.promptTokens += promptTokens
+        usage.outputTokens += outputTokens
+        usage.costUSD += cost
+}
+
+// Totals returns the counts so far
+func (u *tokenUsage) Totals() (promptTokens, outputTokens int64, costUSD float64) {
+        u.mu.Lock()
+        defer u.mu.Unlock()
+        return u.promptTokens, u.outputTokens, u.costUSD
+}
+
+// recordGeminiUsage counts a Gemini response toward the file's usage and against the
+// daily budget of the backend that made the call. Thinking tokens are billed as output.
+func recordGeminiUsage(ctx context.Context, model string, resp *genai.GenerateContentResponse) {
+        if resp == nil || resp.UsageMetadata == nil {
+                return
+        }
+        meta := resp.UsageMetadata
+        recordUsage(ctx, "gemini", model, int64(meta.PromptTokenCount), int64(meta.TotalTokenCount-meta.PromptTokenCount))
+        if limits := quotaFrom(ctx).limits; limits != nil {
+                limits.RecordTokens(int64(meta.TotalTokenCount))
+        }
+}
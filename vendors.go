@@ -0,0 +1,165 @@
+package main
+
+import (
+        "log/slog"
+        "strings"
+        "sync"
+        "unicode"
+
+        "golang.org/x/text/unicode/norm"
+)
+
+// minFuzzyVendor is the shortest vendor key matched by similarity; shorter names differ
+// too much by a single character to be told apart from misreadings
+const minFuzzyVendor = 4
+
+// vendorAliases maps the vendorKey of each alias (and canonical name) to the canonical
+// vendor name. Empty means names are only matched against known vendors.
+var vendorAliases map[string]string
+
+// knownVendors remembers the spelling of every vendor filed so far, by vendorKey, for
+// -vendor-match. It starts from the vendors in -db.
+var knownVendors = struct {
+        sync.Mutex
+        once  sync.Once
+        names map[string]string
+}{names: map[string]string{}}
+
+// loadVendorAliases reads a JSON object or key=value lines mapping how the model writes a
+// vendor to the name to file it under, e.g. "7-Eleven=セブン-イレブン"
+func loadVendorAliases(path string) (map[string]string, error) {
+        raw, err := readMappingFile(path, "vendor aliases")
+        if err != nil {
+                return nil, err
+        }
+
+        aliases := map[string]string{}
+        for _, value := range raw {
+                aliases[vendorKey(value)] = value
+        }
+        for key, value := range raw {
+                aliases[vendorKey(key)] = value
+        }
+        return aliases, nil
+}
+
+// vendorKey is the form vendor names are compared in: NFKC-normalized, so full-width and
+// half-width characters match, lower-cased, and without spaces or punctuation such as
+// "-" and "・". The long vowel mark "ー" is kept, since it is part of the name.
+func vendorKey(name string) string {
+        return strings.Map(func(r rune) rune {
+                if unicode.IsSpace(r) || unicode.IsPunct(r) {
+                        return -1
+                }
+                return unicode.ToLower(r)
+        }, norm.NFKC.String(name))
+}
+
+// normalizeVendor files the model's vendor name under a single spelling per vendor:
+// the canonical name from -vendor-aliases, or with -vendor-match the spelling of the
+// vendor filed before that it matches or closely resembles
+func normalizeVendor(vendor string) string {
+        vendor = strings.TrimSpace(vendor)
+        key := vendorKey(vendor)
+        if key == "" {
+                return vendor
+        }
+
+        if canonical, ok := vendorAliases[key]; ok {
+                if canonical != vendor {
+                        slog.Info("Normalized vendor", "vendor", vendor, "canonical", canonical, "match", "alias")
+                }
+                rememberVendor(canonical)
+                return canonical
+        }
+        if vendorMatch <= 0 {
+                return vendor
+        }
+
+        knownVendors.once.Do(loadKnownVendors)
+        knownVendors.Lock()
+        defer knownVendors.Unlock()
+        if known, ok := knownVendors.names[key]; ok {
+                if known != vendor {
+                        slog.Info("Normalized vendor", "vendor", vendor, "canonical", known, "match", "exact")
+                }
+                return known
+        }
+
+        best, bestScore := "", 0.0
+        if len([]rune(key)) >= minFuzzyVendor {
+                for knownKey, known := range knownVendors.names {
+                        if score := similarity(key, knownKey); score > bestScore || (score == bestScore && known < best) {
+                                best, bestScore = known, score
+                        }
+                }
+        }
+        if bestScore >= vendorMatch {
+                slog.Info("Normalized vendor", "vendor", vendor, "canonical", best, "match", "fuzzy", "similarity", bestScore)
+                return best
+        }
+        knownVendors.names[key] = vendor
+        return vendor
+}
+
+// rememberVendor adds a vendor to knownVendors, unless one with the same key is there
+func rememberVendor(vendor string) {
+        if vendorMatch <= 0 {
+                return
+        }
+        knownVendors.once.Do(loadKnownVendors)
+        knownVendors.Lock()
+        defer knownVendors.Unlock()
+        if key := vendorKey(vendor); knownVendors.names[key] == "" {
+                knownVendors.names[key] = vendor
+        }
+}
+
+// loadKnownVendors fills knownVendors from -db, with the most used spelling of each
+// vendor and the canonical names of -vendor-aliases
+func loadKnownVendors() {
+        for _, canonical := range vendorAliases {
+                knownVendors.names[vendorKey(canonical)] = canonical
+        }
+        if receiptDB == nil {
+                return
+        }
+        vendors, err := receiptDB.VendorNames()
+        if err != nil {
+                slog.Warn("Failed to load known vendors", "error", err)
+                return
+        }
+        for _, vendor := range vendors {
+                if key := vendorKey(vendor); key != "" && knownVendors.names[key] == "" {
+                        knownVendors.names[key] = vendor
+                }
+        }
+}
+
+// similarity scores how alike two names are, from 0 to 1: one minus their edit distance
+// in characters divided by the length of the longer
+func similarity(a, b string) float64 {
+        ra, rb := []rune(a), []rune(b)
+        longer := max(len(ra), len(rb))
+        if longer == 0 {
+                return 1
+        }
+
+        // Levenshtein distance, one row at a time
+        row := make([]int, len(rb)+1)
+        for j := range row {
+                row[j] = j
+        }
+        for i := 1; i <= len(ra); i++ {
+                diagonal := row[0]
+                row[0] = i
+                for j := 1; j <= len(rb); j++ {
+                        cost := 1
+                        if ra[i-1] == rb[j-1] {
+                                cost = 0
+                        }
+                        diagonal, row[j] = row[j], min(row[j]+1, row[j-1]+1, diagonal+cost)
+                }
+        }
+        return 1 - float64(row[len(rb)])/float64(longer)
+}
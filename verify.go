@@ -0,0 +1,80 @@
+package main
+
+import (
+        "context"
+        "fmt"
+        "log/slog"
+        "strings"
+)
+
+// verifyQuota is the -verify backend's gate, so its rate limits never pause the primary
+var verifyQuota quotaGate
+
+// verifyingAnalyzer has a second backend re-read every file that the primary analyzed
+// and records where the two disagree on the date or total, for validateReceipts
+type verifyingAnalyzer struct {
+        primary  ReceiptAnalyzer
+        verifier ReceiptAnalyzer
+        backend  analysisBackend
+}
+
+func (a *verifyingAnalyzer) Analyze(ctx context.Context, path string) ([]ReceiptData, error) {
+        dataList, err := a.primary.Analyze(ctx, path)
+        if err != nil || len(dataList) == 0 {
+                return dataList, err
+        }
+
+        second, err := a.verifier.Analyze(withQuota(ctx, &verifyQuota), path)
+        if err != nil {
+                if ctx.Err() != nil {
+                        return nil, ctx.Err()
+                }
+                slog.Warn("Verification failed", "path", path, "provider", a.backend.Provider, "model", a.backend.Model, "error", err)
+                for i := range dataList {
+                        dataList[i].Disagreements = append(dataList[i].Disagreements, fmt.Sprintf("verification by %s failed: %v", a.backend.Model, err))
+                }
+                return dataList, nil
+        }
+
+        if len(second) != len(dataList) {
+                for i := range dataList {
+                        dataList[i].Disagreements = append(dataList[i].Disagreements, fmt.Sprintf("%s found %d receipts, not %d", a.backend.Model, len(second), len(dataList)))
+                }
+                return dataList, nil
+        }
+        for i := range dataList {
+                dataList[i].Disagreements = append(dataList[i].Disagreements, disagreements(dataList[i], second[i], a.backend.Model)...)
+        }
+        return dataList, nil
+}
+
+func (a *verifyingAnalyzer) Close() error {
+        a.primary.Close()
+        return a.verifier.Close()
+}
+
+// disagreements compares the date and total the way they will be filed, so "2024/5/2"
+// and "2024-05-02", or 1200 and 1200.0, still agree
+func disagreements(data, check ReceiptData, model string) []string {
+        var problems []string
+
+        if receiptDay(data.Date) != receiptDay(check.Date) {
+                problems = append(problems, fmt.Sprintf("%s read date %q, not %q", model, check.Date, data.Date))
+        }
+
+        currency, checkCurrency := normalizeCurrency(data.Currency), normalizeCurrency(check.Currency)
+        amount := data.Amount.Round(currencyScale(currency))
+        checkAmount := check.Amount.Round(currencyScale(checkCurrency))
+        if currency != checkCurrency || amount.Cmp(checkAmount) != 0 {
+                problems = append(problems, fmt.Sprintf("%s read total %s, not %s", model, amountLabel(checkAmount, checkCurrency), amountLabel(amount, currency)))
+        }
+        return problems
+}
+
+// receiptDay is the date as YYYY-MM-DD, or the raw text when it cannot be read
+func receiptDay(raw string) string {
+        if t, ok := parseReceiptDate(raw); ok {
+                return t.Format("2006-01-02")
+        }
+        return strings.TrimSpace(raw)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+        "fmt"
+        "io/fs"
+        "log/slog"
+        "os"
+        "path/filepath"
+        "slices"
+        "strings"
+
+        "github.com/fsnotify/fsnotify"
+)
+
+// stringList is a flag that can be repeated; each value may also be a comma-separated list
+type stringList []string
+
+func (l *stringList) String() string {
+        return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+        for _, item := range strings.Split(value, ",") {
+                if item = strings.TrimSpace(item); item != "" {
+                        *l = append(*l, item)
+                }
+        }
+        return nil
+}
+
+// watchRoot is one watched directory and the destination root its files are filed under.
+// Poll roots are scanned periodically instead of relying on fsnotify.
+type watchRoot struct {
+        Dir  string
+        Dest string
+        Poll bool
+}
+
+// watchRoots is built from -watch in main
+var watchRoots []watchRoot
+
+// closeWrites reports finished writes on Linux; nil elsewhere or with -close-write=false
+var closeWrites *closeWriteWatcher
+
+// parseWatchRoots turns -watch and -poll-watch entries of the form "dir" or "dir=dest"
+// into watch roots. Entries without their own destination use defaultDest.
+func parseWatchRoots(entries, pollEntries []string, defaultDest string) ([]watchRoot, error) {
+        var roots []watchRoot
+        seen := map[string]bool{}
+
+        all := append(append([]string{}, entries...), pollEntries...)
+        for i, entry := range all {
+                poll := i >= len(entries)
+                flagName := "-watch"
+                if poll {
+                        flagName = "-poll-watch"
+                }
+
+                dir, dest, hasDest := strings.Cut(entry, "=")
+                dir, dest = strings.TrimSpace(dir), strings.TrimSpace(dest)
+                if dir == "" {
+                        return nil, fmt.Errorf("invalid %s entry %q: missing directory", flagName, entry)
+                }
+                if !hasDest {
+                        dest = defaultDest
+                }
+                if dest == "" {
+                        return nil, fmt.Errorf("no destination for %s: set -dest or use %s %s=/path/to/dest", dir, flagName, dir)
+                }
+
+                abs, err := filepath.Abs(dir)
+                if err != nil {
+                        return nil, fmt.Errorf("invalid %s directory %s: %w", flagName, dir, err)
+                }
+                if seen[abs] {
+                        return nil, fmt.Errorf("directory %s is watched more than once", dir)
+                }
+                seen[abs] = true
+
+                roots = append(roots, watchRoot{Dir: abs, Dest: dest, Poll: poll})
+        }
+        return roots, nil
+}
+
+// destFor returns the destination root for a source file: the one mapped to the
+// closest enclosing watched directory, or -dest for files outside every watch root.
+// A file in one of a destination's own folders, such as one held for review, belongs
+// to that destination.
+func destFor(srcPath string) string {
+        abs, err := filepath.Abs(srcPath)
+        if err != nil {
+                return destDir
+        }
+        if dest := destRootOf(abs); dest != "" {
+                if rel, err := filepath.Rel(dest, abs); err == nil && slices.Contains(reservedDirs, strings.Split(rel, string(filepath.Separator))[0]) {
+                        return dest
+                }
+        }
+
+        dest, longest := destDir, -1
+        for _, root := range watchRoots {
+                rel, err := filepath.Rel(root.Dir, abs)
+                if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+                        continue
+                }
+                if len(root.Dir) > longest {
+                        dest, longest = root.Dest, len(root.Dir)
+                }
+        }
+        return dest
+}
+
+// destRoots returns -dest and each watch directory's own destination
+func destRoots() []string {
+        var dests []string
+        if destDir != "" {
+                dests = append(dests, destDir)
+        }
+        for _, root := range watchRoots {
+                if !slices.Contains(dests, root.Dest) {
+                        dests = append(dests, root.Dest)
+                }
+        }
+        return dests
+}
+
+// destRootOf returns the innermost destination a path is inside, or ""
+func destRootOf(path string) string {
+        abs, err := filepath.Abs(path)
+        if err != nil {
+                return ""
+        }
+        root, longest := "", -1
+        for _, dest := range destRoots() {
+                absDest, err := filepath.Abs(dest)
+                if err == nil && strings.HasPrefix(abs, absDest+string(filepath.Separator)) && len(absDest) > longest {
+                        root, longest = dest, len(absDest)
+                }
+        }
+        return root
+}
+
+// addWatchTree registers dir with the watcher and, with -recursive, every directory below it.
+// Ignored names and destination roots are skipped so the bot never watches its own output.
+// When found is non-nil it is called for each file already present, which covers files
+// written into a new subdirectory before its watch was in place.
+func addWatchTree(watcher *fsnotify.Watcher, dir string, found func(path string)) error {
+        return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+                if err != nil {
+                        if path == dir {
+                                return err
+                        }
+                        slog.Warn("Skipping unreadable path", "path", path, "error", err)
+                        return nil
+                }
+
+                if !d.IsDir() {
+                        if found != nil && !isIgnoredFile(path) {
+                                found(path)
+                        }
+                        return nil
+                }
+
+                if path != dir && (!recursive || isIgnoredFile(path) || isDestRoot(path)) {
+                        return filepath.SkipDir
+                }
+                if err := watcher.Add(path); err != nil {
+                        return fmt.Errorf("failed to watch directory %s: %w", path, err)
+                }
+                if err := closeWrites.Add(path); err != nil {
+                        slog.Info("Falling back to size polling", "path", path, "error", err)
+                }
+                return nil
+        })
+}
+
+// isDestRoot reports whether dir is -dest or one of the per-directory destinations
+func isDestRoot(dir string) bool {
+        abs, err := filepath.Abs(dir)
+        if err != nil {
+                return false
+        }
+        for _, root := range watchRoots {
+                if dest, err := filepath.Abs(root.Dest); err == nil && dest == abs {
+                        return true
+                }
+        }
+        if dest, err := filepath.Abs(destDir); err == nil && destDir != "" && dest == abs {
+                return true
+        }
+        return false
+}
+
+// isArchivedCopy reports whether an identical file already sits in the destination's
+// originals folder, as happens when a cross-device move copied the file but crashed
+// before removing the source
+func isArchivedCopy(srcPath string) bool {
+        archived := filepath.Join(destFor(srcPath), "originals", filepath.Base(srcPath))
+        if _, err := os.Stat(archived); err != nil {
+                return false
+        }
+        return verifyCopy(srcPath, archived) == nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import "sync"
+
+// workerPool runs a fixed number of goroutines fed from a queue, so a large batch of
+// scans is analyzed a few at a time instead of all at once
+type workerPool struct {
+        jobs chan string
+        done chan struct{}
+        wg   sync.WaitGroup
+
+        mu        sync.Mutex
+        closed    bool
+        senders   sync.WaitGroup
+        closeOnce sync.Once
+}
+
+// startWorkers starts n workers that call fn for each submitted path
+func startWorkers(n int, fn func(path string)) *workerPool {
+        p := &workerPool{jobs: make(chan string, 1024), done: make(chan struct{})}
+        for i := 0; i < n; i++ {
+                p.wg.Add(1)
+                go func() {
+                        defer p.wg.Done()
+                        for path := range p.jobs {
+                                fn(path)
+                        }
+                }()
+        }
+        return p
+}
+
+// Submit queues a path, blocking while the queue is full.
+// It reports false if the pool has been closed, including while it was waiting.
+func (p *workerPool) Submit(path string) bool {
+        p.mu.Lock()
+        if p.closed {
+                p.mu.Unlock()
+                return false
+        }
+        p.senders.Add(1)
+        p.mu.Unlock()
+        defer p.senders.Done()
+
+        select {
+        case p.jobs <- path:
+                return true
+        case <-p.done:
+                return false
+        }
+}
+
+// Queued returns the number of paths waiting for a free worker
+func (p *workerPool) Queued() int {
+        return len(p.jobs)
+}
+
+// Close stops accepting work and waits for queued paths to finish. Submit calls blocked
+// on a full queue give up instead of adding to the work drained here.
+func (p *workerPool) Close() {
+        p.closeOnce.Do(func() {
+                p.mu.Lock()
+                p.closed = true
+                close(p.done)
+                p.mu.Unlock()
+
+                // No Submit can be sending once they have all returned, so closing jobs is safe
+                p.senders.Wait()
+                close(p.jobs)
+        })
+
+        p.wg.Wait()
+}